@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var catFlags filesystemFlags
+
+func init() {
+	catCommand := &cobra.Command{
+		Use:   "cat",
+		Short: "Write the contents of a file in the filesystem in a LUKS-formatted file or device to stdout",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return catCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy cat /tmp/encrypted.img:/etc/fstab`,
+	}
+
+	flags := catCommand.Flags()
+	flags.SetInterspersed(false)
+	catFlags.add(flags)
+	rootCmd.AddCommand(catCommand)
+}
+
+func catCmd(cmd *cobra.Command, args []string) error {
+	image, name, err := splitImagePath(args[0])
+	if err != nil {
+		return err
+	}
+	// don't mix a password prompt in with the file's contents
+	passwordPrompt = os.Stderr
+	filesystem, closeImage, err := openFilesystem(image, &catFlags)
+	if err != nil {
+		return err
+	}
+	defer closeImage()
+	f, err := filesystem.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/luksy"
+	"github.com/spf13/cobra"
+)
+
+var checkWarningsAreErrors = false
+
+func init() {
+	checkCommand := &cobra.Command{
+		Use:   "check",
+		Short: "Check the headers of a LUKS-formatted file or device for problems",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return checkCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy check /dev/mapper/encrypted-lv`,
+	}
+
+	flags := checkCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.BoolVarP(&checkWarningsAreErrors, "strict", "s", false, "treat warnings as errors")
+	rootCmd.AddCommand(checkCommand)
+}
+
+func checkCmd(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	findings, err := luksy.Validate(f)
+	if err != nil {
+		return err
+	}
+	numErrors, numWarnings := 0, 0
+	for _, finding := range findings {
+		fmt.Fprintln(os.Stdout, finding.String())
+		switch finding.Severity {
+		case luksy.SeverityWarning:
+			numWarnings++
+		default:
+			numErrors++
+		}
+	}
+	if numErrors > 0 || (checkWarningsAreErrors && numWarnings > 0) {
+		return fmt.Errorf("%s: %d errors, %d warnings", args[0], numErrors, numWarnings)
+	}
+	if numWarnings == 0 {
+		fmt.Fprintf(os.Stdout, "%s: no problems found\n", args[0])
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strings"
 
@@ -16,6 +17,25 @@ var (
 	decryptPasswordFd   = -1
 	decryptPasswordFile = ""
 	decryptForce        = false
+	decryptWorkers      = 0
+	decryptBufferSize   = 0
+	decryptKeySlot      = -1
+	decryptTest         = false
+	decryptTries        = 3
+	decryptIgnoreReqs   = false
+	decryptType         = ""
+	decryptCipher       = ""
+	decryptKeyBits      = 0
+	decryptHash         = ""
+	decryptKeyFile      = ""
+	decryptOffset       = uint64(0)
+	decryptSkip         = uint64(0)
+	decryptSize         = uint64(0)
+	decryptTcryptHidden = false
+	decryptTcryptBackup = false
+	decryptVeraCryptPIM = 0
+	decryptPartition    = 0
+	decryptPartOffset   = ""
 )
 
 func init() {
@@ -34,11 +54,34 @@ func init() {
 	flags.IntVar(&decryptPasswordFd, "password-fd", -1, "read password from file descriptor")
 	flags.StringVar(&decryptPasswordFile, "password-file", "", "read password from file")
 	flags.BoolVarP(&decryptForce, "force-overwrite", "f", false, "forcibly overwrite existing output files")
+	flags.IntVar(&decryptWorkers, "workers", 0, "number of `threads` to decrypt with (default is one per CPU)")
+	flags.IntVar(&decryptBufferSize, "buffer-size", 0, "size of each buffer of data to decrypt, in `bytes` (default 1048576)")
+	flags.IntVarP(&decryptKeySlot, "key-slot", "S", -1, "only try the password against key slot `number`")
+	flags.BoolVar(&decryptTest, "test-passphrase", false, "only check the password, and report which key slot it unlocked")
+	flags.IntVarP(&decryptTries, "tries", "T", 3, "prompt for the password this many `times` when reading it from a terminal")
+	flags.BoolVar(&decryptIgnoreReqs, "ignore-requirements", false, "decrypt even if the volume has requirements that aren't supported (for forensic use; output may be garbage)")
+	flags.StringVar(&decryptType, "type", "", "`format` of the volume: luks, luks1, luks2, plain, or tcrypt (default is to detect LUKS)")
+	flags.StringVarP(&decryptCipher, "cipher", "c", "", "plain mode encryption algorithm (default aes-cbc-essiv:sha256)")
+	flags.IntVar(&decryptKeyBits, "key-size", 0, "size of the plain mode key, in `bits` (default 256)")
+	flags.StringVar(&decryptHash, "hash", "", "hash `algorithm` for deriving a plain mode key from the password (default ripemd160), or for limiting which tcrypt key derivation functions are tried")
+	flags.StringVar(&decryptKeyFile, "key-file", "", "read the plain mode key from `file`, which is not hashed")
+	flags.Uint64Var(&decryptOffset, "offset", 0, "plain mode payload starts at an offset of `sectors` 512-byte sectors")
+	flags.Uint64Var(&decryptSkip, "skip", 0, "plain mode IVs start at `sectors` 512-byte sectors")
+	flags.Uint64Var(&decryptSize, "size", 0, "plain mode payload is `sectors` 512-byte sectors long (default is to the end)")
+	flags.BoolVar(&decryptTcryptHidden, "tcrypt-hidden", false, "use the hidden volume's header in a TrueCrypt or VeraCrypt volume")
+	flags.BoolVar(&decryptTcryptBackup, "tcrypt-backup", false, "use the backup header at the end of a TrueCrypt or VeraCrypt volume")
+	flags.IntVar(&decryptVeraCryptPIM, "veracrypt-pim", 0, "VeraCrypt personal iterations multiplier `number`")
+	addPartitionFlags(flags, &decryptPartition, &decryptPartOffset)
 	rootCmd.AddCommand(decryptCommand)
 }
 
 func decryptCmd(cmd *cobra.Command, args []string) error {
-	if len(args) >= 2 {
+	if decryptTest && len(args) >= 2 {
+		return errors.New("--test-passphrase does not write output, but an output file was specified")
+	}
+	if len(args) >= 2 && args[1] == "-" {
+		passwordPrompt = os.Stderr
+	} else if len(args) >= 2 {
 		_, err := os.Stat(args[1])
 		if (err == nil || !os.IsNotExist(err)) && !decryptForce {
 			if err != nil {
@@ -47,80 +90,289 @@ func decryptCmd(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("-f not specified, and %q exists", args[1])
 		}
 	}
-	input, err := os.Open(args[0])
+	plainOptions := decryptCipher != "" || decryptKeyBits != 0 || decryptKeyFile != "" || decryptOffset != 0 || decryptSkip != 0 || decryptSize != 0
+	tcryptOptions := decryptTcryptHidden || decryptTcryptBackup || decryptVeraCryptPIM != 0
+	plain, tcrypt := false, false
+	switch decryptType {
+	case "", "luks", "luks1", "luks2":
+		if plainOptions || decryptHash != "" {
+			return errors.New("--cipher, --key-size, --hash, --key-file, --offset, --skip, and --size are only supported with --type plain")
+		}
+		if tcryptOptions {
+			return errors.New("--tcrypt-hidden, --tcrypt-backup, and --veracrypt-pim are only supported with --type tcrypt")
+		}
+	case "plain":
+		if tcryptOptions {
+			return errors.New("--tcrypt-hidden, --tcrypt-backup, and --veracrypt-pim are only supported with --type tcrypt")
+		}
+		switch {
+		case decryptTest:
+			return errors.New("--test-passphrase can not be used with --type plain, which has no way to check a password")
+		case decryptKeySlot >= 0:
+			return errors.New("--key-slot can not be used with --type plain, which has no key slots")
+		case decryptKeyFile != "" && (decryptPasswordFd != -1 || decryptPasswordFile != ""):
+			return errors.New("--key-file can not be combined with a password")
+		case decryptOffset > math.MaxInt64/luksy.V1SectorSize || decryptSize > math.MaxInt64/luksy.V1SectorSize:
+			return errors.New("--offset or --size is too large")
+		}
+		plain = true
+	case "tcrypt":
+		switch {
+		case plainOptions:
+			return errors.New("--cipher, --key-size, --key-file, --offset, --skip, and --size are only supported with --type plain")
+		case decryptKeySlot >= 0:
+			return errors.New("--key-slot can not be used with --type tcrypt, which has no key slots")
+		case decryptVeraCryptPIM < 0:
+			return fmt.Errorf("--veracrypt-pim %d is negative", decryptVeraCryptPIM)
+		}
+		tcrypt = true
+	default:
+		return fmt.Errorf("unsupported --type %q", decryptType)
+	}
+	if args[0] == "-" {
+		switch {
+		case tcrypt:
+			return errors.New("--type tcrypt can not be used when reading from stdin")
+		case decryptPartition != 0 || decryptPartOffset != "":
+			return errors.New("--partition and --partition-offset can not be used when reading from stdin")
+		case decryptPasswordFd == -1 && decryptPasswordFile == "" && decryptKeyFile == "":
+			return errors.New("--password-fd or --password-file is required when reading from stdin")
+		}
+		return decryptStdin(plain, args)
+	}
+	f, err := openInput(args[0])
 	if err != nil {
 		return err
 	}
-	defer input.Close()
-	v1header, v2header, v2header2, v2json, err := luksy.ReadHeaders(input, luksy.ReadHeaderOptions{})
+	defer f.Close()
+	input, err := selectPartition(f, decryptPartition, decryptPartOffset)
+	if err != nil {
+		return err
+	}
+	var volume *luksy.Volume
+	if plain {
+		password := ""
+		if decryptKeyFile == "" {
+			if password, _, err = decryptPassword(); err != nil {
+				return err
+			}
+		}
+		key, err := plainKey(decryptKeyFile, password, decryptHash, decryptKeyBits)
+		if err != nil {
+			return err
+		}
+		options := luksy.PlainOptions{
+			Cipher: decryptCipher,
+			Offset: int64(decryptOffset) * luksy.V1SectorSize,
+			Skip:   decryptSkip,
+			Size:   int64(decryptSize) * luksy.V1SectorSize,
+		}
+		if volume, err = luksy.UnlockPlain(key, input, options); err != nil {
+			return err
+		}
+		return decryptOutput(input, volume, args)
+	}
+	if tcrypt {
+		options := luksy.TcryptOptions{
+			Hidden: decryptTcryptHidden,
+			Backup: decryptTcryptBackup,
+			PIM:    decryptVeraCryptPIM,
+			Hash:   decryptHash,
+		}
+		for try := 1; ; try++ {
+			password, interactive, err := decryptPassword()
+			if err != nil {
+				return err
+			}
+			volume, err = luksy.UnlockTcrypt(password, input, options)
+			if err == nil {
+				break
+			}
+			if !interactive || try >= decryptTries || !errors.Is(err, luksy.ErrIncorrectPassphrase) {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "No key available with this passphrase.")
+		}
+		if decryptTest {
+			fmt.Fprintln(os.Stdout, "Volume header unlocked.")
+		}
+		return decryptOutput(input, volume, args)
+	}
+	// a qcow2 image keeps its LUKS header in a part of the file
+	var headers partitionFile = input
+	image, err := luksy.ReadQcow2(input)
+	switch {
+	case err == nil:
+		if decryptWorkers != 0 || decryptBufferSize != 0 {
+			return errors.New("--workers and --buffer-size can not be used with qcow2 images")
+		}
+		headers = image.LUKSHeader(input)
+	case !errors.Is(err, luksy.ErrNotQcow2):
+		return fmt.Errorf("%q: %w", args[0], err)
+	}
+	volume, err = unlockLUKS(args[0], headers, unlockLUKSOptions{
+		UnlockOptions: luksy.UnlockOptions{
+			Keyslot:            keySlotID(decryptKeySlot),
+			IgnoreRequirements: decryptIgnoreReqs,
+		},
+		passwordFd:   decryptPasswordFd,
+		passwordFile: decryptPasswordFile,
+		tries:        decryptTries,
+		luksType:     decryptType,
+	})
 	if err != nil {
 		return err
 	}
-	if v2header != nil && v2header2 != nil && v2header2.SequenceID() > v2header.SequenceID() {
-		v2header = v2header2
+	if decryptTest {
+		fmt.Fprintf(os.Stdout, "Key slot %s unlocked.\n", volume.Keyslot)
 	}
+	if image != nil {
+		if len(args) < 2 {
+			return nil
+		}
+		rc, err := image.DecryptReader(input, volume)
+		if err != nil {
+			return err
+		}
+		return writeDecrypted(rc, args[1])
+	}
+	return decryptOutput(input, volume, args)
+}
+
+// decryptStdin reads an encrypted image from stdin, which can be a pipe, from
+// front to back, and writes the decrypted payload to the output file, if one
+// was specified.
+func decryptStdin(plain bool, args []string) error {
+	var volume *luksy.Volume
+	input := io.Reader(os.Stdin)
+	if plain {
+		password := ""
+		if decryptKeyFile == "" {
+			var err error
+			if password, _, err = decryptPassword(); err != nil {
+				return err
+			}
+		}
+		key, err := plainKey(decryptKeyFile, password, decryptHash, decryptKeyBits)
+		if err != nil {
+			return err
+		}
+		options := luksy.PlainOptions{
+			Cipher: decryptCipher,
+			Offset: int64(decryptOffset) * luksy.V1SectorSize,
+			Skip:   decryptSkip,
+			Size:   int64(decryptSize) * luksy.V1SectorSize,
+		}
+		if volume, err = luksy.FormatPlain(key, options); err != nil {
+			return err
+		}
+	} else {
+		headers, err := luksy.ReadStreamHeaders(input, luksy.ReadHeaderOptions{Recover: true})
+		if err != nil {
+			return fmt.Errorf("reading headers from stdin: %w", err)
+		}
+		switch {
+		case decryptType == "luks1" && headers.V1Header == nil:
+			return errors.New("stdin is not a LUKSv1 volume")
+		case decryptType == "luks2" && headers.V2Header == nil:
+			return errors.New("stdin is not a LUKSv2 volume")
+		}
+		options := luksy.UnlockOptions{
+			Keyslot:            keySlotID(decryptKeySlot),
+			IgnoreRequirements: decryptIgnoreReqs,
+		}
+		password, _, err := decryptPassword()
+		if err != nil {
+			return err
+		}
+		if volume, err = headers.Unlock(password, options); err != nil {
+			return err
+		}
+		if decryptTest {
+			fmt.Fprintf(os.Stdout, "Key slot %s unlocked.\n", volume.Keyslot)
+		}
+		input = headers.Reader()
+	}
+	if len(args) < 2 {
+		return nil
+	}
+	return writeDecrypted(volume.DecryptStream(input, luksy.StreamOptions{Workers: decryptWorkers, BufferSize: decryptBufferSize}), args[1])
+}
+
+// decryptOutput writes the decrypted payload to the output file, if one was
+// specified.
+func decryptOutput(input io.ReaderAt, volume *luksy.Volume, args []string) error {
+	if len(args) < 2 {
+		return nil
+	}
+	return writeDecrypted(volume.DecryptReader(input, luksy.StreamOptions{Workers: decryptWorkers, BufferSize: decryptBufferSize}), args[1])
+}
+
+// writeDecrypted copies the decrypted payload to the output file, or to
+// stdout if the output file is "-", and closes the reader.
+func writeDecrypted(rc io.ReadCloser, outputFile string) error {
+	defer rc.Close()
+	if outputFile == "-" {
+		_, err := io.Copy(os.Stdout, rc)
+		return err
+	}
+	output, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	_, err = io.Copy(output, rc)
+	return err
+}
+
+// decryptPassword reads the password, noting whether or not we prompted for
+// it.
+func decryptPassword() (string, bool, error) {
+	return readPassword(decryptPasswordFd, decryptPasswordFile)
+}
+
+// passwordPrompt is where readPassword prompts for a password.  Commands which
+// write data to stdout change it to stderr.
+var passwordPrompt = os.Stdout
+
+// readPassword reads a password from a descriptor, if one was specified,
+// or a file, if one was specified, or stdin, noting whether or not we
+// prompted for it.
+func readPassword(passwordFd int, passwordFile string) (string, bool, error) {
 	var password string
-	if decryptPasswordFd != -1 {
-		f := os.NewFile(uintptr(decryptPasswordFd), fmt.Sprintf("FD %d", decryptPasswordFd))
+	interactive := false
+	if passwordFd != -1 {
+		f := os.NewFile(uintptr(passwordFd), fmt.Sprintf("FD %d", passwordFd))
 		passBytes, err := io.ReadAll(f)
 		if err != nil {
-			return fmt.Errorf("reading from descriptor %d: %w", decryptPasswordFd, err)
+			return "", false, fmt.Errorf("reading from descriptor %d: %w", passwordFd, err)
 		}
 		password = string(passBytes)
-	} else if decryptPasswordFile != "" {
-		passBytes, err := os.ReadFile(decryptPasswordFile)
+	} else if passwordFile != "" {
+		passBytes, err := os.ReadFile(passwordFile)
 		if err != nil {
-			return err
+			return "", false, err
 		}
 		password = string(passBytes)
 	} else {
 		if term.IsTerminal(int(os.Stdin.Fd())) {
-			fmt.Fprintf(os.Stdout, "Password: ")
-			os.Stdout.Sync()
+			fmt.Fprintf(passwordPrompt, "Password: ")
+			passwordPrompt.Sync()
 			passBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
 			if err != nil {
-				return fmt.Errorf("reading from stdin: %w", err)
+				return "", false, fmt.Errorf("reading from stdin: %w", err)
 			}
 			password = string(passBytes)
-			fmt.Fprintln(os.Stdout)
+			interactive = true
+			fmt.Fprintln(passwordPrompt)
 		} else {
 			passBytes, err := io.ReadAll(os.Stdin)
 			if err != nil {
-				return fmt.Errorf("reading from stdin: %w", err)
+				return "", false, fmt.Errorf("reading from stdin: %w", err)
 			}
 			password = string(passBytes)
 		}
 	}
 	password = strings.TrimRightFunc(password, func(r rune) bool { return r == '\r' || r == '\n' })
-	var decryptStream func([]byte) ([]byte, error)
-	var payloadOffset, payloadSize int64
-	var decryptSectorSize int
-	switch {
-	case v1header != nil:
-		decryptStream, decryptSectorSize, payloadOffset, payloadSize, err = v1header.Decrypt(password, input)
-	case v2header != nil:
-		decryptStream, decryptSectorSize, payloadOffset, payloadSize, err = v2header.Decrypt(password, input, *v2json)
-	default:
-		err = errors.New("internal error: unknown format")
-	}
-	if err == nil && len(args) >= 2 {
-		var output *os.File
-		output, err = os.Create(args[1])
-		if err != nil {
-			return err
-		}
-		defer output.Close()
-		_, err = input.Seek(payloadOffset, io.SeekStart)
-		if err != nil {
-			return err
-		}
-		rc := luksy.DecryptReader(decryptStream, input, decryptSectorSize)
-		defer rc.Close()
-		reader := io.Reader(rc)
-		if payloadSize >= 0 {
-			reader = io.LimitReader(reader, payloadSize)
-		}
-		_, err = io.Copy(output, reader)
-	}
-	return err
+	return password, interactive, nil
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/containers/luksy"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 )
@@ -18,6 +22,25 @@ var (
 	encryptCipher        = ""
 	encryptv1            = false
 	encryptForce         = false
+	encryptWorkers       = 0
+	encryptBufferSize    = 0
+	encryptFixedSize     = false
+	encryptMetadataSize  = ""
+	encryptKeyslotsSize  = ""
+	encryptAlignPayload  = uint64(0)
+	encryptOffset        = uint64(0)
+	encryptStripes       = 0
+	encryptKeyslotCipher = ""
+	encryptKeyslotBits   = 0
+	encryptHash          = ""
+	encryptType          = ""
+	encryptKeyBits       = 0
+	encryptKeyFile       = ""
+	encryptSkip          = uint64(0)
+	encryptSize          = uint64(0)
+	encryptPartition     = 0
+	encryptPartOffset    = ""
+	encryptQcow2         = false
 )
 
 func init() {
@@ -39,28 +62,161 @@ func init() {
 	flags.IntVar(&encryptSectorSize, "sector-size", 0, "sector size for LUKSv2")
 	flags.StringVarP(&encryptCipher, "cipher", "c", "", "encryption algorithm")
 	flags.BoolVarP(&encryptForce, "force-overwrite", "f", false, "forcibly overwrite existing output files")
+	flags.IntVar(&encryptWorkers, "workers", 0, "number of `threads` to encrypt with (default is one per CPU)")
+	flags.IntVar(&encryptBufferSize, "buffer-size", 0, "size of each buffer of data to encrypt, in `bytes` (default 1048576)")
+	flags.BoolVar(&encryptFixedSize, "fixed-size", false, "record the size of the payload in the LUKSv2 header, so that data appended to the output isn't treated as part of the payload")
+	flags.StringVar(&encryptMetadataSize, "luks2-metadata-size", "", "`size` of each LUKSv2 header, including its JSON metadata area (16k, 32k, 64k, ..., 4M)")
+	flags.StringVar(&encryptKeyslotsSize, "luks2-keyslots-size", "", "`size` of the LUKSv2 key slots area, a multiple of 4k, at most 128M")
+	flags.Uint64Var(&encryptAlignPayload, "align-payload", 0, "align the payload's offset to a multiple of `sectors` 512-byte sectors")
+	flags.Uint64Var(&encryptOffset, "offset", 0, "start the payload at an offset of `sectors` 512-byte sectors")
+	flags.IntVar(&encryptStripes, "af-stripes", 0, "split the master key into `number` anti-forensic stripes in each key slot (default 4000)")
+	flags.StringVar(&encryptKeyslotCipher, "keyslot-cipher", "", "encryption algorithm for LUKSv2 key slots (default is the payload's algorithm)")
+	flags.IntVar(&encryptKeyslotBits, "keyslot-key-size", 0, "size of the key which encrypts LUKSv2 key slots, in `bits`")
+	flags.StringVar(&encryptHash, "hash", "", "hash `algorithm` for the master key's digest and anti-forensic splitting (default sha256), or for deriving a plain mode key from the password (default ripemd160)")
+	flags.StringVar(&encryptType, "type", "", "`format` to create: luks1, luks2, or plain (default luks2)")
+	flags.IntVar(&encryptKeyBits, "key-size", 0, "size of the plain mode key, in `bits` (default 256)")
+	flags.StringVar(&encryptKeyFile, "key-file", "", "read the plain mode key from `file`, which is not hashed")
+	flags.Uint64Var(&encryptSkip, "skip", 0, "start plain mode IVs at `sectors` 512-byte sectors")
+	flags.Uint64Var(&encryptSize, "size", 0, "limit the plain mode payload to `sectors` 512-byte sectors")
+	addPartitionFlags(flags, &encryptPartition, &encryptPartOffset)
+	flags.BoolVar(&encryptQcow2, "qcow2", false, "create a qcow2 image with an embedded LUKSv1 header, as QEMU does")
 	rootCmd.AddCommand(encryptCommand)
 }
 
-func encryptCmd(cmd *cobra.Command, args []string) error {
-	_, err := os.Stat(args[1])
-	if (err == nil || !os.IsNotExist(err)) && !encryptForce {
-		if err != nil {
-			return fmt.Errorf("checking if %q exists: %w", args[1], err)
+// parseSize parses a size in bytes, optionally followed by a binary unit
+// suffix, as cryptsetup does (e.g., "16k", "4M", or "4MiB").
+func parseSize(value string) (int, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(value, "iB"), "ib")
+	multiplier := 1
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'k', 'K':
+			multiplier = 1024
+		case 'm', 'M':
+			multiplier = 1024 * 1024
+		case 'g', 'G':
+			multiplier = 1024 * 1024 * 1024
 		}
-		return fmt.Errorf("-f not specified, and %q exists", args[1])
+		if multiplier != 1 {
+			number = number[:len(number)-1]
+		} else if number != value {
+			return -1, fmt.Errorf("invalid size %q", value)
+		}
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 || n > math.MaxInt/multiplier {
+		return -1, fmt.Errorf("invalid size %q", value)
 	}
-	input, err := os.Open(args[0])
+	return n * multiplier, nil
+}
+
+// deviceSize returns the size of a file or a block device.  Stat() doesn't
+// report the size of a block device, but seeking to its end will tell us.  The
+// position for reading or writing is left where it was.
+func deviceSize(s io.Seeker) (int64, error) {
+	pos, err := s.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return fmt.Errorf("open %q: %w", args[0], err)
+		return -1, err
 	}
-	defer input.Close()
-	st, err := input.Stat()
+	size, err := s.Seek(0, io.SeekEnd)
 	if err != nil {
-		return err
+		return -1, err
 	}
-	if st.Size()%luksy.V1SectorSize != 0 {
-		return fmt.Errorf("%q is not of a suitable size, expected a multiple of %d bytes", input.Name(), luksy.V1SectorSize)
+	if _, err = s.Seek(pos, io.SeekStart); err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+func encryptCmd(cmd *cobra.Command, args []string) error {
+	inPartition := encryptPartition != 0 || encryptPartOffset != ""
+	fromStdin, toStdout := args[0] == "-", args[1] == "-"
+	if fromStdin || toStdout {
+		switch {
+		case inPartition:
+			return errors.New("--partition and --partition-offset can not be used when reading from stdin or writing to stdout")
+		case encryptQcow2:
+			return errors.New("--qcow2 can not be used when reading from stdin or writing to stdout")
+		case fromStdin && encryptFixedSize:
+			return errors.New("--fixed-size can not be used when reading from stdin, because the size of the input isn't known")
+		case fromStdin && len(encryptPasswordFds)+len(encryptPasswordFiles) == 0 && encryptKeyFile == "":
+			return errors.New("--password-fd or --password-file is required when reading from stdin")
+		}
+	}
+	if toStdout {
+		passwordPrompt = os.Stderr
+	} else if !inPartition {
+		_, err := os.Stat(args[1])
+		if (err == nil || !os.IsNotExist(err)) && !encryptForce {
+			if err != nil {
+				return fmt.Errorf("checking if %q exists: %w", args[1], err)
+			}
+			return fmt.Errorf("-f not specified, and %q exists", args[1])
+		}
+	}
+	// we can't find out the size of what we read from stdin ahead of time
+	input, inputSize := os.Stdin, int64(0)
+	if !fromStdin {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("open %q: %w", args[0], err)
+		}
+		defer f.Close()
+		size, err := deviceSize(f)
+		if err != nil {
+			return fmt.Errorf("determining size of %q: %w", args[0], err)
+		}
+		input, inputSize = f, size
+	}
+	switch encryptType {
+	case "":
+		encryptType = "luks2"
+		if encryptv1 || encryptQcow2 {
+			encryptType = "luks1"
+		}
+	case "luks1", "luks2", "plain":
+		if encryptv1 && encryptType != "luks1" {
+			return fmt.Errorf("--luks1 conflicts with --type %s", encryptType)
+		}
+	default:
+		return fmt.Errorf("unsupported --type %q", encryptType)
+	}
+	if encryptType == "plain" {
+		switch {
+		case encryptFixedSize, encryptMetadataSize != "", encryptKeyslotsSize != "", encryptKeyslotCipher != "", encryptKeyslotBits != 0,
+			encryptAlignPayload != 0, encryptStripes != 0, encryptSectorSize != 0:
+			return errors.New("options for LUKS volumes can not be used with --type plain")
+		case len(encryptPasswordFds)+len(encryptPasswordFiles) > 1:
+			return errors.New("only one password can be used with --type plain")
+		case encryptKeyFile != "" && len(encryptPasswordFds)+len(encryptPasswordFiles) > 0:
+			return errors.New("--key-file can not be combined with a password")
+		}
+	} else if encryptKeyBits != 0 || encryptKeyFile != "" || encryptSkip != 0 || encryptSize != 0 {
+		return errors.New("--key-size, --key-file, --skip, and --size are only supported with --type plain")
+	}
+	// the end of the payload is padded to fill its last sector, and only a
+	// LUKSv2 header has room to record how much of it isn't padding
+	sectorSize := int64(luksy.V1SectorSize)
+	if encryptType == "luks2" {
+		sectorSize = luksy.V2SectorSize
+		if encryptSectorSize != 0 {
+			sectorSize = int64(encryptSectorSize)
+		}
+	}
+	if inputSize%sectorSize != 0 && encryptType != "luks2" {
+		return fmt.Errorf("%q is not of a suitable size, expected a multiple of %d bytes (only LUKSv2 volumes can record the exact size of their contents)", args[0], sectorSize)
+	}
+	if encryptQcow2 {
+		switch {
+		case encryptType != "luks1":
+			return fmt.Errorf("--qcow2 can not be used with --type %s, QEMU only supports LUKSv1 headers in qcow2 images", encryptType)
+		case inPartition:
+			return errors.New("--qcow2 can not be combined with --partition or --partition-offset")
+		case encryptAlignPayload != 0 || encryptOffset != 0:
+			return errors.New("--align-payload and --offset can not be used with --qcow2")
+		case encryptWorkers != 0 || encryptBufferSize != 0:
+			return errors.New("--workers and --buffer-size can not be used with --qcow2")
+		}
 	}
 	var passwords []string
 	for _, encryptPasswordFd := range encryptPasswordFds {
@@ -78,16 +234,16 @@ func encryptCmd(cmd *cobra.Command, args []string) error {
 		}
 		passwords = append(passwords, string(passBytes))
 	}
-	if len(passwords) == 0 {
+	if len(passwords) == 0 && encryptKeyFile == "" {
 		if term.IsTerminal(int(os.Stdin.Fd())) {
-			fmt.Fprintf(os.Stdout, "Password: ")
-			os.Stdout.Sync()
+			fmt.Fprintf(passwordPrompt, "Password: ")
+			passwordPrompt.Sync()
 			passBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
 			if err != nil {
 				return fmt.Errorf("reading from stdin: %w", err)
 			}
 			passwords = append(passwords, string(passBytes))
-			fmt.Fprintln(os.Stdout)
+			fmt.Fprintln(passwordPrompt)
 		} else {
 			passBytes, err := io.ReadAll(os.Stdin)
 			if err != nil {
@@ -99,33 +255,207 @@ func encryptCmd(cmd *cobra.Command, args []string) error {
 	for i := range passwords {
 		passwords[i] = strings.TrimRightFunc(passwords[i], func(r rune) bool { return r == '\r' || r == '\n' })
 	}
+	if encryptAlignPayload != 0 && encryptOffset != 0 {
+		return errors.New("--align-payload and --offset can not be combined")
+	}
+	if encryptAlignPayload > math.MaxInt64/luksy.V1SectorSize || encryptOffset > math.MaxInt64/luksy.V1SectorSize || encryptSize > math.MaxInt64/luksy.V1SectorSize {
+		return errors.New("--align-payload, --offset, or --size is too large")
+	}
+	alignment := int64(encryptAlignPayload) * luksy.V1SectorSize
+	offset := int64(encryptOffset) * luksy.V1SectorSize
 	var header []byte
-	var encryptStream func([]byte) ([]byte, error)
-	if encryptv1 {
-		header, encryptStream, encryptSectorSize, err = luksy.EncryptV1(passwords, encryptCipher)
+	var volume *luksy.Volume
+	var err error
+	switch encryptType {
+	case "plain":
+		password := ""
+		if len(passwords) > 0 {
+			password = passwords[0]
+		}
+		key, err := plainKey(encryptKeyFile, password, encryptHash, encryptKeyBits)
+		if err != nil {
+			return err
+		}
+		options := luksy.PlainOptions{
+			Cipher: encryptCipher,
+			Offset: offset,
+			Skip:   encryptSkip,
+			Size:   int64(encryptSize) * luksy.V1SectorSize,
+		}
+		if volume, err = luksy.FormatPlain(key, options); err != nil {
+			return fmt.Errorf("creating plain mode volume: %w", err)
+		}
+	case "luks1":
+		switch {
+		case encryptFixedSize:
+			return errors.New("--fixed-size is only supported for LUKSv2")
+		case encryptMetadataSize != "", encryptKeyslotsSize != "":
+			return errors.New("--luks2-metadata-size and --luks2-keyslots-size are only supported for LUKSv2")
+		case encryptKeyslotCipher != "", encryptKeyslotBits != 0:
+			return errors.New("--keyslot-cipher and --keyslot-key-size are only supported for LUKSv2")
+		}
+		options := luksy.FormatV1Options{
+			Cipher:           encryptCipher,
+			Hash:             encryptHash,
+			Stripes:          encryptStripes,
+			PayloadAlignment: alignment,
+			PayloadOffset:    offset,
+		}
+		header, volume, err = luksy.FormatV1WithOptions(passwords, options)
 		if err != nil {
 			return fmt.Errorf("creating luksv1 data: %w", err)
 		}
-	} else {
-		header, encryptStream, encryptSectorSize, err = luksy.EncryptV2(passwords, encryptCipher, encryptSectorSize)
+	default:
+		if encryptKeyslotBits%8 != 0 {
+			return fmt.Errorf("--keyslot-key-size %d is not a multiple of 8 bits", encryptKeyslotBits)
+		}
+		options := luksy.FormatV2Options{
+			Cipher:           encryptCipher,
+			SectorSize:       encryptSectorSize,
+			KeyslotCipher:    encryptKeyslotCipher,
+			KeyslotKeySize:   encryptKeyslotBits / 8,
+			Hash:             encryptHash,
+			Stripes:          encryptStripes,
+			PayloadAlignment: alignment,
+			PayloadOffset:    offset,
+		}
+		if encryptMetadataSize != "" {
+			if options.MetadataSize, err = parseSize(encryptMetadataSize); err != nil {
+				return fmt.Errorf("--luks2-metadata-size: %w", err)
+			}
+		}
+		if encryptKeyslotsSize != "" {
+			if options.KeyslotsSize, err = parseSize(encryptKeyslotsSize); err != nil {
+				return fmt.Errorf("--luks2-keyslots-size: %w", err)
+			}
+		}
+		if inputSize%sectorSize != 0 {
+			options.PlaintextSize = inputSize
+		} else if encryptFixedSize {
+			if inputSize == 0 {
+				return fmt.Errorf("%q is empty, so --fixed-size can't be used", input.Name())
+			}
+			options.Segments = []luksy.FormatV2Segment{{Size: inputSize}}
+		}
+		header, volume, err = luksy.FormatV2WithOptions(passwords, options)
 		if err != nil {
 			return fmt.Errorf("creating luksv2 data: %w", err)
 		}
 	}
-	output, err := os.Create(args[1])
+	if encryptQcow2 {
+		return encryptToQcow2(input, args[1], header, volume)
+	}
+	options := luksy.StreamOptions{Workers: encryptWorkers, BufferSize: encryptBufferSize}
+	if toStdout {
+		wc := volume.EncryptStream(os.Stdout, header, options)
+		n, err := io.Copy(wc, input)
+		if err != nil {
+			wc.Close()
+			return err
+		}
+		if err = wc.Close(); err != nil {
+			return err
+		}
+		if n%sectorSize != 0 && volume.PlaintextSize == 0 {
+			logrus.Warnf("payload of %d bytes was padded to a multiple of %d bytes, because its size can't be recorded in a header that was written before it was read", n, sectorSize)
+		}
+		return nil
+	}
+	var output partitionFile
+	if inPartition {
+		// write into part of an existing disk image, leaving the rest
+		// of it alone
+		disk, err := os.OpenFile(args[1], os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("open %q: %w", args[1], err)
+		}
+		defer disk.Close()
+		if output, err = selectPartition(disk, encryptPartition, encryptPartOffset); err != nil {
+			return err
+		}
+		if err := checkPartitionSpace(input, output, volume); err != nil {
+			return fmt.Errorf("%q: %w", args[1], err)
+		}
+		if _, _, _, _, err := luksy.ReadHeaders(output, luksy.ReadHeaderOptions{Recover: true}); err == nil && !encryptForce {
+			return fmt.Errorf("-f not specified, and the selected part of %q already contains a LUKS volume", args[1])
+		}
+	} else {
+		f, err := os.Create(args[1])
+		if err != nil {
+			return fmt.Errorf("create %q: %w", args[1], err)
+		}
+		defer f.Close()
+		output = f
+	}
+	n, err := output.WriteAt(header, 0)
 	if err != nil {
-		return fmt.Errorf("create %q: %w", args[1], err)
+		return err
+	}
+	if n != len(header) {
+		return fmt.Errorf("short write while writing header to %q", args[1])
+	}
+	wc := volume.EncryptWriter(output, options)
+	copied, err := io.Copy(wc, input)
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+	if fromStdin && copied%sectorSize != 0 {
+		if encryptType != "luks2" {
+			logrus.Warnf("payload of %d bytes was padded to a multiple of %d bytes, because only LUKSv2 volumes can record its exact size", copied, sectorSize)
+			return nil
+		}
+		// now that we know how much there was, record it
+		if err = luksy.SetV2PlaintextSize(output, copied); err != nil {
+			return fmt.Errorf("recording the size of the payload in %q: %w", args[1], err)
+		}
+	}
+	return nil
+}
+
+// checkPartitionSpace checks that the encrypted form of the input will fit
+// in the part of a disk image that we're going to write it to, so that we
+// find out before we start overwriting it.
+func checkPartitionSpace(input io.Seeker, output io.Seeker, volume *luksy.Volume) error {
+	inputSize, err := deviceSize(input)
+	if err != nil {
+		return err
+	}
+	if volume.PayloadSize >= 0 && volume.PayloadSize < inputSize {
+		inputSize = volume.PayloadSize
+	}
+	space, err := deviceSize(output)
+	if err != nil {
+		return err
+	}
+	if volume.PayloadOffset > space || inputSize > space-volume.PayloadOffset {
+		return fmt.Errorf("payload of %d bytes at offset %d does not fit in %d bytes", inputSize, volume.PayloadOffset, space)
+	}
+	return nil
+}
+
+// encryptToQcow2 writes the input to a new qcow2 image, with the LUKS header
+// embedded in it.
+func encryptToQcow2(input io.ReadSeeker, outputFile string, header []byte, volume *luksy.Volume) error {
+	size, err := deviceSize(input)
+	if err != nil {
+		return err
+	}
+	output, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("create %q: %w", outputFile, err)
 	}
 	defer output.Close()
-	n, err := output.Write(header)
+	wc, err := luksy.NewQcow2Writer(output, header, volume, luksy.Qcow2Options{VirtualSize: size})
 	if err != nil {
 		return err
 	}
-	if n != len(header) {
-		return fmt.Errorf("short write while writing header to %q", output.Name())
+	if _, err = io.Copy(wc, input); err != nil {
+		wc.Close()
+		return err
 	}
-	wc := luksy.EncryptWriter(encryptStream, output, encryptSectorSize)
-	defer wc.Close()
-	_, err = io.Copy(wc, input)
-	return err
+	return wc.Close()
 }
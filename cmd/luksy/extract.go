@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/luksy"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var extractFlags filesystemFlags
+
+func init() {
+	extractCommand := &cobra.Command{
+		Use:   "extract",
+		Short: "Copy a file or directory out of the filesystem in a LUKS-formatted file or device",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return extractCmd(cmd, args)
+		},
+		Args:    cobra.RangeArgs(1, 2),
+		Example: `luksy extract /tmp/encrypted.img:/etc/fstab /tmp/fstab`,
+	}
+
+	flags := extractCommand.Flags()
+	flags.SetInterspersed(false)
+	extractFlags.add(flags)
+	rootCmd.AddCommand(extractCommand)
+}
+
+func extractCmd(cmd *cobra.Command, args []string) error {
+	image, name, err := splitImagePath(args[0])
+	if err != nil {
+		return err
+	}
+	// by default, copy to a file or directory with the same name in the
+	// current directory, or if we're copying the root directory, into
+	// the current directory
+	destination := path.Base(name)
+	if len(args) > 1 {
+		destination = args[1]
+	}
+	if st, err := os.Stat(destination); err == nil && st.IsDir() && name != "." {
+		destination = filepath.Join(destination, path.Base(name))
+	}
+	filesystem, closeImage, err := openFilesystem(image, &extractFlags)
+	if err != nil {
+		return err
+	}
+	defer closeImage()
+
+	// set directories' permissions and timestamps after we're done
+	// adding things to them
+	type dirInfo struct {
+		path string
+		info fs.FileInfo
+	}
+	var dirs []dirInfo
+	err = fs.WalkDir(filesystem, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := destination
+		if p != name {
+			rel, err := walkRelative(name, p)
+			if err != nil {
+				return err
+			}
+			target = filepath.Join(destination, filepath.FromSlash(rel))
+		}
+		info, err := d.Info()
+		if p == name {
+			// follow a symbolic link if we were pointed at one
+			info, err = filesystem.Stat(p)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(target, 0o700); err != nil {
+				if p == name && os.IsExist(err) {
+					// extracting into a directory that's already there
+					return nil
+				}
+				return err
+			}
+			dirs = append(dirs, dirInfo{target, info})
+			return nil
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := filesystem.ReadLink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return extractFile(filesystem, p, target, info)
+		}
+		logrus.Warnf("not extracting %q, which is a %s", p, info.Mode().Type())
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if chErr := os.Chmod(dirs[i].path, dirs[i].info.Mode().Perm()); chErr != nil && err == nil {
+			err = chErr
+		}
+		if chErr := os.Chtimes(dirs[i].path, time.Now(), dirs[i].info.ModTime()); chErr != nil && err == nil {
+			err = chErr
+		}
+	}
+	return err
+}
+
+// extractFile copies a regular file out of the filesystem.  It refuses to
+// overwrite anything that's already there.
+func extractFile(filesystem *luksy.Filesystem, name, target string, info fs.FileInfo) error {
+	f, err := filesystem.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	output, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, f); err != nil {
+		output.Close()
+		return fmt.Errorf("extracting %q: %w", name, err)
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, time.Now(), info.ModTime())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/luksy"
+	"github.com/spf13/pflag"
+)
+
+// filesystemFlags are the flags which the ls, cat, and extract commands share.
+type filesystemFlags struct {
+	passwordFd   int
+	passwordFile string
+	keySlot      int
+	tries        int
+	partition    int
+	partOffset   string
+}
+
+func (f *filesystemFlags) add(flags *pflag.FlagSet) {
+	flags.IntVar(&f.passwordFd, "password-fd", -1, "read password from file descriptor")
+	flags.StringVar(&f.passwordFile, "password-file", "", "read password from file")
+	flags.IntVarP(&f.keySlot, "key-slot", "S", -1, "only try the password against key slot `number`")
+	flags.IntVarP(&f.tries, "tries", "T", 3, "prompt for the password this many `times` when reading it from a terminal")
+	addPartitionFlags(flags, &f.partition, &f.partOffset)
+}
+
+// splitImagePath splits an "image:/path" argument into the name of the image
+// and the path of something in the filesystem in it, in the form that
+// luksy.Filesystem expects.  An argument which doesn't include a path refers
+// to the root directory.  Since either part could include a colon, we split
+// the argument at the first colon which follows the name of a file that
+// exists.
+func splitImagePath(arg string) (string, string, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, ".", nil
+	}
+	for i := strings.Index(arg, ":"); i != -1; {
+		if _, err := os.Stat(arg[:i]); err == nil {
+			p := path.Clean("/" + arg[i+1:])
+			if p == "/" {
+				return arg[:i], ".", nil
+			}
+			return arg[:i], p[1:], nil
+		}
+		next := strings.Index(arg[i+1:], ":")
+		if next == -1 {
+			break
+		}
+		i += 1 + next
+	}
+	image, _, _ := strings.Cut(arg, ":")
+	_, err := os.Stat(image)
+	return "", "", err
+}
+
+// walkRelative returns the path p, which fs.WalkDir() found while walking
+// root, relative to root.  It refuses paths which aren't under root, or which
+// would lead out of a directory on the host that we're copying root into.
+func walkRelative(root, p string) (string, error) {
+	rel, ok := p, true
+	if root != "." {
+		rel, ok = strings.CutPrefix(p, root+"/")
+	}
+	if !ok || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("refusing to use %q, which is not inside %q", p, root)
+	}
+	return rel, nil
+}
+
+// openFilesystem unlocks an image and opens the filesystem in it.  The
+// returned function closes the image.
+func openFilesystem(image string, flags *filesystemFlags) (*luksy.Filesystem, func() error, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (*luksy.Filesystem, func() error, error) {
+		f.Close()
+		return nil, nil, err
+	}
+	input, err := selectPartition(f, flags.partition, flags.partOffset)
+	if err != nil {
+		return fail(err)
+	}
+	volume, err := unlockLUKS(image, input, unlockLUKSOptions{
+		UnlockOptions: luksy.UnlockOptions{Keyslot: keySlotID(flags.keySlot)},
+		passwordFd:    flags.passwordFd,
+		passwordFile:  flags.passwordFile,
+		tries:         flags.tries,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	payload, err := volume.Payload(input)
+	if err != nil {
+		return fail(err)
+	}
+	filesystem, err := luksy.OpenFilesystem(payload)
+	if err != nil {
+		if errors.Is(err, luksy.ErrUnrecognizedFilesystem) {
+			err = fmt.Errorf("%q: the decrypted payload does not contain an ext2/3/4 or FAT filesystem: %w", image, err)
+		}
+		return fail(err)
+	}
+	return filesystem, f.Close, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkRelative(t *testing.T) {
+	for _, tc := range []struct {
+		root, p, rel string
+	}{
+		{".", "hello.txt", "hello.txt"},
+		{".", "sub/nested", "sub/nested"},
+		{"sub", "sub/nested", "nested"},
+		{"sub/dir", "sub/dir/a/b", "a/b"},
+	} {
+		rel, err := walkRelative(tc.root, tc.p)
+		require.NoError(t, err, "%q in %q", tc.p, tc.root)
+		assert.Equal(t, tc.rel, rel, "%q in %q", tc.p, tc.root)
+	}
+	for _, tc := range []struct {
+		root, p string
+	}{
+		{".", "../../evl"},
+		{".", "/etc/passwd"},
+		{".", "a/../../evl"},
+		{"sub", "../evl"},
+		{"sub", "evl"},
+		{"sub", "sub"},
+		{"sub/dir", "sub/evl"},
+		{"sub", "sub/../../evl"},
+	} {
+		_, err := walkRelative(tc.root, tc.p)
+		assert.Error(t, err, "%q in %q", tc.p, tc.root)
+	}
+}
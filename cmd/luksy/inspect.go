@@ -1,15 +1,25 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"text/tabwriter"
 
 	"github.com/containers/luksy"
 	"github.com/spf13/cobra"
 )
 
-var all bool
+var (
+	all                     bool
+	inspectFormat           = "text"
+	inspectDumpJSONMetadata = false
+	inspectPartition        = 0
+	inspectPartitionOffset  = ""
+)
 
 func init() {
 	inspectCommand := &cobra.Command{
@@ -25,21 +35,93 @@ func init() {
 	flags := inspectCommand.Flags()
 	flags.SetInterspersed(false)
 	flags.BoolVarP(&all, "all", "a", false, "include information about inactive key slots")
+	flags.StringVar(&inspectFormat, "format", inspectFormat, "output `format` (text, json, or luksdump)")
+	flags.BoolVar(&inspectDumpJSONMetadata, "dump-json-metadata", false, "print the LUKSv2 JSON metadata area as it is stored")
+	addPartitionFlags(flags, &inspectPartition, &inspectPartitionOffset)
 	rootCmd.AddCommand(inspectCommand)
 }
 
+// sortedKeys returns the keys of a map of key slots, segments, digests, or
+// tokens, sorted numerically if they're numbers, as they should be.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, aErr := strconv.ParseUint(keys[i], 10, 64)
+		b, bErr := strconv.ParseUint(keys[j], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil && a != b:
+			return a < b
+		case aErr == nil && bErr != nil:
+			return true
+		case aErr != nil && bErr == nil:
+			return false
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
 func inspectCmd(cmd *cobra.Command, args []string) error {
-	f, err := os.Open(args[0])
+	file, err := openInput(args[0])
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	v1header, v2header, _, v2json, err := luksy.ReadHeaders(f, luksy.ReadHeaderOptions{})
+	defer file.Close()
+	f, err := selectPartition(file, inspectPartition, inspectPartitionOffset)
 	if err != nil {
 		return err
 	}
+	// a qcow2 image keeps its LUKS header in a part of the file
+	image, err := luksy.ReadQcow2(f)
+	switch {
+	case err == nil:
+		f = image.LUKSHeader(f)
+	case !errors.Is(err, luksy.ErrNotQcow2):
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	v1header, v2header, v2header2, v2json, err := luksy.ReadHeaders(f, luksy.ReadHeaderOptions{Recover: true})
+	if err != nil {
+		if image == nil && inspectPartition == 0 && inspectPartitionOffset == "" {
+			// maybe it's a whole disk, with LUKS volumes in partitions
+			if partitions, partitionsErr := luksy.ReadPartitions(file); partitionsErr == nil {
+				return inspectPartitions(args[0], file, partitions)
+			}
+		}
+		return err
+	}
+	if inspectDumpJSONMetadata {
+		if v2header == nil {
+			return fmt.Errorf("%s is not a LUKSv2 volume, so it has no JSON metadata", args[0])
+		}
+		// dump the metadata that ReadHeaders() chose, which is the
+		// metadata that we use, exactly as it was read from a copy of
+		// the header whose checksum matched
+		jsonArea, err := v2json.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("encoding JSON metadata: %w", err)
+		}
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", jsonArea)
+		return err
+	}
+	switch inspectFormat {
+	case "text":
+	case "json":
+		return inspectJSON(os.Stdout, v1header, v2header, v2header2, v2json)
+	case "luksdump":
+		return inspectLuksDump(os.Stdout, args[0], v1header, v2header, v2json)
+	default:
+		return fmt.Errorf("unrecognized output format %q (expected text, json, or luksdump)", inspectFormat)
+	}
 	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
 	defer tw.Flush()
+	if image != nil {
+		fmt.Fprintf(tw, "Container\tqcow2 version %d\n", image.Version)
+		fmt.Fprintf(tw, "\tcluster size %d, virtual size %d\n", image.ClusterSize, image.VirtualSize)
+		fmt.Fprintf(tw, "\tLUKS header offset %d, length %d\n", image.LUKSHeaderOffset, image.LUKSHeaderLength)
+	}
 	if v1header != nil {
 		if v1header.Version() != 1 {
 			return fmt.Errorf("internal error: magic/version mismatch (%d)", v1header.Version())
@@ -87,8 +169,9 @@ func inspectCmd(cmd *cobra.Command, args []string) error {
 		fmt.Fprintf(tw, "Header offset\t%d\n", v2header.HeaderOffset())
 		fmt.Fprintf(tw, "Checksum\t%q, algorithm %q\n", v2header.Checksum(), v2header.ChecksumAlgorithm())
 		fmt.Fprintf(tw, "UUID\t%s\n", v2header.UUID())
-		fmt.Fprintf(tw, "Requirements\t%v\n", v2json.Config.Requirements)
-		for key, segment := range v2json.Segments {
+		fmt.Fprintf(tw, "Requirements\t%v\n", v2json.MandatoryRequirements())
+		for _, key := range sortedKeys(v2json.Segments) {
+			segment := v2json.Segments[key]
 			fmt.Fprintf(tw, "Segment %s\ttype %q, offset %s, size %s, flags %v\n", key, segment.Type, segment.Offset, segment.Size, segment.Flags)
 			switch segment.Type {
 			case "crypt":
@@ -98,7 +181,8 @@ func inspectCmd(cmd *cobra.Command, args []string) error {
 				}
 			}
 		}
-		for key, slot := range v2json.Keyslots {
+		for _, key := range sortedKeys(v2json.Keyslots) {
+			slot := v2json.Keyslots[key]
 			fmt.Fprintf(tw, "Slot %s \ttype %s\n", key, slot.Type)
 			switch slot.Type {
 			case "luks2":
@@ -109,8 +193,8 @@ func inspectCmd(cmd *cobra.Command, args []string) error {
 				}
 				fmt.Fprintf(tw, "\tluks2 KDF type %s, salt %q\n", slot.Kdf.Type, slot.Kdf.Salt)
 				switch slot.Kdf.Type {
-				case "argon2i":
-					fmt.Fprintf(tw, "\targon2i time %d, memory %d, cpus %d\n", slot.Kdf.Time, slot.Kdf.Memory, slot.Kdf.CPUs)
+				case "argon2i", "argon2id":
+					fmt.Fprintf(tw, "\t%s time %d, memory %d, cpus %d\n", slot.Kdf.Type, slot.Kdf.Time, slot.Kdf.Memory, slot.Kdf.CPUs)
 				case "pbkdf2":
 					fmt.Fprintf(tw, "\tpbkdf2 hash %s, iterations %d\n", slot.Kdf.Hash, slot.Kdf.Iterations)
 				}
@@ -132,7 +216,8 @@ func inspectCmd(cmd *cobra.Command, args []string) error {
 				fmt.Fprintf(tw, "\tpriority %s\n", slot.Priority.String())
 			}
 		}
-		for key, digest := range v2json.Digests {
+		for _, key := range sortedKeys(v2json.Digests) {
+			digest := v2json.Digests[key]
 			fmt.Fprintf(tw, "Digest %s\tdigest %q\n", key, digest.Digest)
 			fmt.Fprintf(tw, "\tsalt\t%q\n", digest.Salt)
 			fmt.Fprintf(tw, "\ttype\t%q\n", digest.Type)
@@ -142,13 +227,50 @@ func inspectCmd(cmd *cobra.Command, args []string) error {
 				fmt.Fprintf(tw, "\thash %s, iterations %d\n", digest.Hash, digest.Iterations)
 			}
 		}
-		for key, token := range v2json.Tokens {
+		for _, key := range sortedKeys(v2json.Tokens) {
+			token := v2json.Tokens[key]
 			fmt.Fprintf(tw, "Token %s\ttype %s, keyslots %v\n", key, token.Type, token.Keyslots)
 			switch token.Type {
 			case "luks2-keyring":
 				fmt.Fprintf(tw, "\tdescription %q\n", token.KeyDescription)
+			case luksy.V2JSONTokenTypePlaintextSize:
+				if token.V2JSONTokenPlaintextSize != nil {
+					fmt.Fprintf(tw, "\tplaintext size %s\n", token.PlaintextSize)
+				}
 			}
 		}
 	}
 	return nil
 }
+
+// inspectPartitions lists the partitions in a disk image which contain LUKS
+// volumes.
+func inspectPartitions(name string, f io.ReaderAt, partitions []luksy.Partition) error {
+	if inspectFormat != "text" || inspectDumpJSONMetadata {
+		return fmt.Errorf("%s is a disk image, and its partitions can only be listed in text format (use --partition to select one)", name)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	defer tw.Flush()
+	found := false
+	for _, partition := range partitions {
+		section := luksy.NewSection(f, partition.Offset, partition.Size)
+		v1header, v2header, _, _, err := luksy.ReadHeaders(section, luksy.ReadHeaderOptions{Recover: true})
+		if err != nil {
+			continue
+		}
+		if !found {
+			fmt.Fprintf(tw, "Partition\tOffset\tSize\tVersion\tUUID\tLabel\n")
+			found = true
+		}
+		switch {
+		case v1header != nil:
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t%s\n", partition.Number, partition.Offset, partition.Size, v1header.Version(), v1header.UUID(), "")
+		case v2header != nil:
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t%s\n", partition.Number, partition.Offset, partition.Size, v2header.Version(), v2header.UUID(), v2header.Label())
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is a disk image, but none of its %d partitions contain LUKS volumes", name, len(partitions))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containers/luksy"
+)
+
+// hexBytes is binary data from a header, which we encode as a hex string.
+// Binary data from LUKSv2 JSON metadata is left base64-encoded, as it is in
+// the metadata itself.
+type hexBytes []byte
+
+func (h hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+type inspectJSONV1Keyslot struct {
+	ID                int      `json:"id"`
+	Active            bool     `json:"active"`
+	Iterations        uint32   `json:"iterations"`
+	Salt              hexBytes `json:"salt"`
+	KeyMaterialOffset uint32   `json:"key_material_offset"` // in 512-byte sectors
+	Stripes           uint32   `json:"stripes"`
+}
+
+type inspectJSONV1 struct {
+	Version            int                    `json:"version"`
+	UUID               string                 `json:"uuid"`
+	CipherName         string                 `json:"cipher_name"`
+	CipherMode         string                 `json:"cipher_mode"`
+	HashSpec           string                 `json:"hash_spec"`
+	PayloadOffset      uint32                 `json:"payload_offset"` // in 512-byte sectors
+	KeyBytes           uint32                 `json:"key_bytes"`
+	MKDigest           hexBytes               `json:"mk_digest"`
+	MKDigestSalt       hexBytes               `json:"mk_digest_salt"`
+	MKDigestIterations uint32                 `json:"mk_digest_iterations"`
+	Keyslots           []inspectJSONV1Keyslot `json:"keyslots"`
+}
+
+type inspectJSONV2Header struct {
+	Magic             hexBytes `json:"magic"`
+	HeaderSize        uint64   `json:"header_size"`
+	HeaderOffset      uint64   `json:"header_offset"`
+	SequenceID        uint64   `json:"sequence_id"`
+	ChecksumAlgorithm string   `json:"checksum_algorithm"`
+	Checksum          hexBytes `json:"checksum"`
+	Salt              hexBytes `json:"salt"`
+}
+
+// inspectJSONWithID is a key slot, segment, digest, or token, which we
+// encode as the object itself with an "id" field added to it.  We don't just
+// embed the object in a struct alongside an ID field, because if the object's
+// type has a MarshalJSON() method, it would be used for the struct, too.
+type inspectJSONWithID struct {
+	ID    string
+	Value any
+}
+
+func (i inspectJSONWithID) MarshalJSON() ([]byte, error) {
+	id, err := json.Marshal(map[string]string{"id": i.ID})
+	if err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(i.Value)
+	if err != nil {
+		return nil, err
+	}
+	value = bytes.TrimSpace(value)
+	if len(value) < 2 || value[0] != '{' {
+		return nil, fmt.Errorf("internal error: %q is not an object", value)
+	}
+	if bytes.Equal(value, []byte("{}")) {
+		return id, nil
+	}
+	// replace the closing brace of {"id":"..."} with a comma, and follow it
+	// with the rest of the object
+	return append(append(id[:len(id)-1], ','), value[1:]...), nil
+}
+
+type inspectJSONV2 struct {
+	Version   int                   `json:"version"`
+	UUID      string                `json:"uuid"`
+	Label     string                `json:"label"`
+	Subsystem string                `json:"subsystem"`
+	Headers   []inspectJSONV2Header `json:"headers"` // primary, then secondary
+	Config    luksy.V2JSONConfig    `json:"config"`
+	Keyslots  []inspectJSONWithID   `json:"keyslots"`
+	Segments  []inspectJSONWithID   `json:"segments"`
+	Digests   []inspectJSONWithID   `json:"digests"`
+	Tokens    []inspectJSONWithID   `json:"tokens"`
+}
+
+func inspectJSONV2HeaderFrom(h *luksy.V2Header) inspectJSONV2Header {
+	return inspectJSONV2Header{
+		Magic:             hexBytes(h.Magic()),
+		HeaderSize:        h.HeaderSize(),
+		HeaderOffset:      h.HeaderOffset(),
+		SequenceID:        h.SequenceID(),
+		ChecksumAlgorithm: h.ChecksumAlgorithm(),
+		Checksum:          h.Checksum(),
+		Salt:              h.Salt(),
+	}
+}
+
+// inspectJSON writes a description of the headers as JSON.  Key slots,
+// segments, digests, and tokens are always listed in order of their IDs.
+func inspectJSON(w io.Writer, v1header *luksy.V1Header, v2header, v2header2 *luksy.V2Header, v2json *luksy.V2JSON) error {
+	var output any
+	switch {
+	case v1header != nil:
+		v1 := inspectJSONV1{
+			Version:            int(v1header.Version()),
+			UUID:               v1header.UUID(),
+			CipherName:         v1header.CipherName(),
+			CipherMode:         v1header.CipherMode(),
+			HashSpec:           v1header.HashSpec(),
+			PayloadOffset:      v1header.PayloadOffset(),
+			KeyBytes:           v1header.KeyBytes(),
+			MKDigest:           v1header.MKDigest(),
+			MKDigestSalt:       v1header.MKDigestSalt(),
+			MKDigestIterations: v1header.MKDigestIter(),
+			Keyslots:           []inspectJSONV1Keyslot{},
+		}
+		for i := 0; i < 8; i++ {
+			ks, err := v1header.KeySlot(i)
+			if err != nil {
+				return fmt.Errorf("reading key slot %d: %w", i, err)
+			}
+			active, err := ks.Active()
+			if err != nil {
+				return fmt.Errorf("reading key slot %d status: %w", i, err)
+			}
+			v1.Keyslots = append(v1.Keyslots, inspectJSONV1Keyslot{
+				ID:                i,
+				Active:            active,
+				Iterations:        ks.Iterations(),
+				Salt:              ks.KeySlotSalt(),
+				KeyMaterialOffset: ks.KeyMaterialOffset(),
+				Stripes:           ks.Stripes(),
+			})
+		}
+		output = v1
+	case v2header != nil:
+		v2 := inspectJSONV2{
+			Version:   int(v2header.Version()),
+			UUID:      v2header.UUID(),
+			Label:     v2header.Label(),
+			Subsystem: v2header.Subsystem(),
+			Headers:   []inspectJSONV2Header{inspectJSONV2HeaderFrom(v2header)},
+			Config:    v2json.Config,
+			Keyslots:  []inspectJSONWithID{},
+			Segments:  []inspectJSONWithID{},
+			Digests:   []inspectJSONWithID{},
+			Tokens:    []inspectJSONWithID{},
+		}
+		if v2header2 != nil {
+			v2.Headers = append(v2.Headers, inspectJSONV2HeaderFrom(v2header2))
+		}
+		for _, key := range sortedKeys(v2json.Keyslots) {
+			v2.Keyslots = append(v2.Keyslots, inspectJSONWithID{ID: key, Value: v2json.Keyslots[key]})
+		}
+		for _, key := range sortedKeys(v2json.Segments) {
+			v2.Segments = append(v2.Segments, inspectJSONWithID{ID: key, Value: v2json.Segments[key]})
+		}
+		for _, key := range sortedKeys(v2json.Digests) {
+			v2.Digests = append(v2.Digests, inspectJSONWithID{ID: key, Value: v2json.Digests[key]})
+		}
+		for _, key := range sortedKeys(v2json.Tokens) {
+			v2.Tokens = append(v2.Tokens, inspectJSONWithID{ID: key, Value: v2json.Tokens[key]})
+		}
+		output = v2
+	default:
+		return fmt.Errorf("internal error: unknown format")
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
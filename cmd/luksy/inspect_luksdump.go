@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containers/luksy"
+)
+
+// luksDumpHex formats binary data the way that cryptsetup luksDump does: a
+// space after each byte, and a new line, starting with wrapPrefix, after
+// every perLine bytes.
+func luksDumpHex(data []byte, perLine int, wrapPrefix string) string {
+	var b strings.Builder
+	for i, c := range data {
+		fmt.Fprintf(&b, "%02x ", c)
+		if (i+1)%perLine == 0 && i+1 < len(data) {
+			b.WriteString("\n" + wrapPrefix)
+		}
+	}
+	return b.String()
+}
+
+// inspectLuksDump writes a description of the headers which mimics the
+// output of cryptsetup luksDump.
+func inspectLuksDump(w io.Writer, name string, v1header *luksy.V1Header, v2header *luksy.V2Header, v2json *luksy.V2JSON) error {
+	switch {
+	case v1header != nil:
+		return luksDumpV1(w, name, v1header)
+	case v2header != nil:
+		return luksDumpV2(w, v2header, v2json)
+	}
+	return fmt.Errorf("internal error: unknown format")
+}
+
+func luksDumpV1(w io.Writer, name string, h *luksy.V1Header) error {
+	fmt.Fprintf(w, "LUKS header information for %s\n\n", name)
+	fmt.Fprintf(w, "Version:       \t%d\n", h.Version())
+	fmt.Fprintf(w, "Cipher name:   \t%s\n", h.CipherName())
+	fmt.Fprintf(w, "Cipher mode:   \t%s\n", h.CipherMode())
+	fmt.Fprintf(w, "Hash spec:     \t%s\n", h.HashSpec())
+	fmt.Fprintf(w, "Payload offset:\t%d\n", h.PayloadOffset())
+	fmt.Fprintf(w, "MK bits:       \t%d\n", h.KeyBytes()*8)
+	fmt.Fprintf(w, "MK digest:     \t%s\n", luksDumpHex(h.MKDigest(), len(h.MKDigest()), ""))
+	fmt.Fprintf(w, "MK salt:       \t%s\n", luksDumpHex(h.MKDigestSalt(), 16, "               \t"))
+	fmt.Fprintf(w, "MK iterations: \t%d\n", h.MKDigestIter())
+	fmt.Fprintf(w, "UUID:          \t%s\n\n", h.UUID())
+	for i := 0; i < 8; i++ {
+		ks, err := h.KeySlot(i)
+		if err != nil {
+			return fmt.Errorf("reading key slot %d: %w", i, err)
+		}
+		active, err := ks.Active()
+		if err != nil {
+			return fmt.Errorf("reading key slot %d status: %w", i, err)
+		}
+		if !active {
+			fmt.Fprintf(w, "Key Slot %d: DISABLED\n", i)
+			continue
+		}
+		fmt.Fprintf(w, "Key Slot %d: ENABLED\n", i)
+		fmt.Fprintf(w, "\tIterations:         \t%d\n", ks.Iterations())
+		fmt.Fprintf(w, "\tSalt:               \t%s\n", luksDumpHex(ks.KeySlotSalt(), 16, "\t                      \t"))
+		fmt.Fprintf(w, "\tKey material offset:\t%d\n", ks.KeyMaterialOffset())
+		fmt.Fprintf(w, "\tAF stripes:            \t%d\n", ks.Stripes())
+	}
+	return nil
+}
+
+func luksDumpV2(w io.Writer, h *luksy.V2Header, j *luksy.V2JSON) error {
+	orNone := func(s, none string) string {
+		if s == "" {
+			return none
+		}
+		return s
+	}
+	fmt.Fprintf(w, "LUKS header information\n")
+	fmt.Fprintf(w, "Version:       \t%d\n", h.Version())
+	fmt.Fprintf(w, "Epoch:         \t%d\n", h.SequenceID())
+	fmt.Fprintf(w, "Metadata area: \t%d [bytes]\n", h.HeaderSize())
+	fmt.Fprintf(w, "Keyslots area: \t%d [bytes]\n", j.Config.KeyslotsSize)
+	fmt.Fprintf(w, "UUID:          \t%s\n", orNone(h.UUID(), "(no UUID)"))
+	fmt.Fprintf(w, "Label:         \t%s\n", orNone(h.Label(), "(no label)"))
+	fmt.Fprintf(w, "Subsystem:     \t%s\n", orNone(h.Subsystem(), "(no subsystem)"))
+	fmt.Fprintf(w, "Flags:       \t%s\n", orNone(strings.Join(j.Config.Flags, " "), "(no flags)"))
+	if len(j.MandatoryRequirements()) > 0 {
+		fmt.Fprintf(w, "Requirements:\t%s\n", strings.Join(j.MandatoryRequirements(), " "))
+	}
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "Data segments:\n")
+	for _, key := range sortedKeys(j.Segments) {
+		segment := j.Segments[key]
+		fmt.Fprintf(w, "  %s: %s\n", key, segment.Type)
+		fmt.Fprintf(w, "\toffset: %s [bytes]\n", segment.Offset)
+		if segment.Size == "dynamic" {
+			fmt.Fprintf(w, "\tlength: (whole device)\n")
+		} else {
+			fmt.Fprintf(w, "\tlength: %s [bytes]\n", segment.Size)
+		}
+		if segment.Type == "crypt" && segment.V2JSONSegmentCrypt != nil {
+			fmt.Fprintf(w, "\tcipher: %s\n", segment.Encryption)
+			fmt.Fprintf(w, "\tsector: %d [bytes]\n", segment.SectorSize)
+			if segment.Integrity != nil {
+				fmt.Fprintf(w, "\tintegrity: %s\n", segment.Integrity.Type)
+			}
+		}
+		if len(segment.Flags) > 0 {
+			fmt.Fprintf(w, "\tflags : %s\n", strings.Join(segment.Flags, " "))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "Keyslots:\n")
+	for _, key := range sortedKeys(j.Keyslots) {
+		slot := j.Keyslots[key]
+		digestID := ""
+		for _, d := range sortedKeys(j.Digests) {
+			for _, k := range j.Digests[d].Keyslots {
+				if k == key && digestID == "" {
+					digestID = d
+				}
+			}
+		}
+		unbound := ""
+		if digestID == "" {
+			unbound = " (unbound)"
+		}
+		fmt.Fprintf(w, "  %s: %s%s\n", key, slot.Type, unbound)
+		fmt.Fprintf(w, "\tKey:        %d bits\n", slot.KeySize*8)
+		if slot.Priority != nil {
+			fmt.Fprintf(w, "\tPriority:   %s\n", slot.Priority.String())
+		}
+		if slot.Type == "luks2" && slot.V2JSONKeyslotLUKS2 != nil {
+			if slot.Area.V2JSONAreaRaw != nil {
+				fmt.Fprintf(w, "\tCipher:     %s\n", slot.Area.Encryption)
+				fmt.Fprintf(w, "\tCipher key: %d bits\n", slot.Area.KeySize*8)
+			}
+			fmt.Fprintf(w, "\tPBKDF:      %s\n", slot.Kdf.Type)
+			switch {
+			case slot.Kdf.V2JSONKdfPbkdf2 != nil:
+				fmt.Fprintf(w, "\tHash:       %s\n", slot.Kdf.Hash)
+				fmt.Fprintf(w, "\tIterations: %d\n", slot.Kdf.Iterations)
+			case slot.Kdf.V2JSONKdfArgon2i != nil:
+				fmt.Fprintf(w, "\tTime cost:  %d\n", slot.Kdf.Time)
+				fmt.Fprintf(w, "\tMemory:     %d\n", slot.Kdf.Memory)
+				fmt.Fprintf(w, "\tThreads:    %d\n", slot.Kdf.CPUs)
+			}
+			fmt.Fprintf(w, "\tSalt:       %s\n", luksDumpHex(slot.Kdf.Salt, 16, "\t            "))
+			if slot.AF.V2JSONAFLUKS1 != nil {
+				fmt.Fprintf(w, "\tAF stripes: %d\n", slot.AF.Stripes)
+				fmt.Fprintf(w, "\tAF hash:    %s\n", slot.AF.Hash)
+			}
+		}
+		if slot.Type == "reencrypt" && slot.V2JSONKeyslotReencrypt != nil {
+			fmt.Fprintf(w, "\tMode:       %s\n", slot.Mode)
+			fmt.Fprintf(w, "\tDirection:  %s\n", slot.Direction)
+			fmt.Fprintf(w, "\tResilience: %s\n", slot.Area.Type)
+		}
+		fmt.Fprintf(w, "\tArea offset:%d [bytes]\n", slot.Area.Offset)
+		fmt.Fprintf(w, "\tArea length:%d [bytes]\n", slot.Area.Size)
+		if digestID != "" {
+			fmt.Fprintf(w, "\tDigest ID:  %s\n", digestID)
+		}
+	}
+
+	fmt.Fprintf(w, "Tokens:\n")
+	for _, key := range sortedKeys(j.Tokens) {
+		token := j.Tokens[key]
+		fmt.Fprintf(w, "  %s: %s\n", key, token.Type)
+		if token.V2JSONTokenLUKS2Keyring != nil {
+			fmt.Fprintf(w, "\tKey description: %s\n", token.KeyDescription)
+		}
+		for _, k := range token.Keyslots {
+			fmt.Fprintf(w, "\tKeyslot:    %s\n", k)
+		}
+	}
+
+	fmt.Fprintf(w, "Digests:\n")
+	for _, key := range sortedKeys(j.Digests) {
+		digest := j.Digests[key]
+		fmt.Fprintf(w, "  %s: %s\n", key, digest.Type)
+		if digest.V2JSONDigestPbkdf2 != nil {
+			fmt.Fprintf(w, "\tHash:       %s\n", digest.Hash)
+			fmt.Fprintf(w, "\tIterations: %d\n", digest.Iterations)
+		}
+		fmt.Fprintf(w, "\tSalt:       %s\n", luksDumpHex(digest.Salt, 16, "\t            "))
+		fmt.Fprintf(w, "\tDigest:     %s\n", luksDumpHex(digest.Digest, 16, "\t            "))
+	}
+	return nil
+}
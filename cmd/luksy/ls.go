@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	lsFlags     filesystemFlags
+	lsLong      = false
+	lsRecursive = false
+)
+
+func init() {
+	lsCommand := &cobra.Command{
+		Use:   "ls",
+		Short: "List files in the filesystem in a LUKS-formatted file or device",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return lsCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy ls -l /tmp/encrypted.img:/etc`,
+	}
+
+	flags := lsCommand.Flags()
+	flags.SetInterspersed(false)
+	lsFlags.add(flags)
+	flags.BoolVarP(&lsLong, "long", "l", false, "list permissions, sizes, and modification times")
+	flags.BoolVarP(&lsRecursive, "recursive", "R", false, "list the contents of subdirectories, too")
+	rootCmd.AddCommand(lsCommand)
+}
+
+func lsCmd(cmd *cobra.Command, args []string) error {
+	image, name, err := splitImagePath(args[0])
+	if err != nil {
+		return err
+	}
+	filesystem, closeImage, err := openFilesystem(image, &lsFlags)
+	if err != nil {
+		return err
+	}
+	defer closeImage()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+	defer tw.Flush()
+	list := func(p string, info fs.FileInfo) error {
+		if !lsLong {
+			_, err := fmt.Fprintln(tw, p)
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := filesystem.ReadLink(path.Join(name, p))
+			if err != nil {
+				return err
+			}
+			p += " -> " + target
+		}
+		_, err := fmt.Fprintf(tw, "%s\t %d\t %s\t %s\n", info.Mode(), info.Size(), info.ModTime().Format("2006-01-02 15:04"), p)
+		return err
+	}
+	info, err := filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		info, err = filesystem.Lstat(name)
+		if err != nil {
+			return err
+		}
+		return list(path.Base(name), info)
+	}
+	return fs.WalkDir(filesystem, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == name {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := walkRelative(name, p)
+		if err != nil {
+			return err
+		}
+		if err := list(rel, info); err != nil {
+			return err
+		}
+		if d.IsDir() && !lsRecursive {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
@@ -3,14 +3,27 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"syscall"
 
+	"github.com/containers/luksy"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// Exit codes, matching the ones that cryptsetup uses.
+const (
+	exitGeneric      = 1 // wrong parameters, or an unspecified error
+	exitNoPermission = 2 // no permission (bad passphrase)
+	exitOutOfMemory  = 3
+	exitWrongDevice  = 4 // wrong device specified
+	exitDeviceExists = 5 // device already exists or device is busy
+)
+
+var logLevel = "warn"
+
 var rootCmd = &cobra.Command{
 	Use:  "luksy",
 	Long: "A tool for creating and decrypting LUKS-encrypted disk images",
@@ -18,6 +31,11 @@ var rootCmd = &cobra.Command{
 		return cmd.Help()
 	},
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		level, err := logrus.ParseLevel(logLevel)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(level)
 		return nil
 	},
 	PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
@@ -27,6 +45,30 @@ var rootCmd = &cobra.Command{
 	SilenceErrors: true,
 }
 
+func init() {
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", logLevel, "minimum `level` of messages to log (trace, debug, info, warn, error, fatal, panic)")
+}
+
+// exitCodeFor returns the exit code which cryptsetup would use for err.
+func exitCodeFor(err error) int {
+	var ee *exec.ExitError
+	switch {
+	case errors.As(err, &ee):
+		if w, ok := ee.Sys().(syscall.WaitStatus); ok {
+			return w.ExitStatus()
+		}
+	case errors.Is(err, luksy.ErrIncorrectPassphrase), errors.Is(err, syscall.EPERM):
+		return exitNoPermission
+	case errors.Is(err, syscall.ENOMEM):
+		return exitOutOfMemory
+	case errors.Is(err, fs.ErrNotExist):
+		return exitWrongDevice
+	case errors.Is(err, fs.ErrExist), errors.Is(err, syscall.EBUSY):
+		return exitDeviceExists
+	}
+	return exitGeneric
+}
+
 func main() {
 	var exitCode int
 	if err := rootCmd.Execute(); err != nil {
@@ -35,13 +77,7 @@ func main() {
 		} else {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		}
-		exitCode = 1
-		var ee *exec.ExitError
-		if errors.As(err, &ee) {
-			if w, ok := ee.Sys().(syscall.WaitStatus); ok {
-				exitCode = w.ExitStatus()
-			}
-		}
+		exitCode = exitCodeFor(err)
 	}
 	os.Exit(exitCode)
 }
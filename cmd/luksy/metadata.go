@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/luksy"
+	"github.com/spf13/cobra"
+)
+
+var metadataJSONFile = ""
+
+func init() {
+	metadataCommand := &cobra.Command{
+		Use:   "metadata",
+		Short: "Manage the JSON metadata of a LUKSv2-formatted file or device",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	metadataExportCommand := &cobra.Command{
+		Use:   "export",
+		Short: "Write the JSON metadata of a LUKSv2-formatted file or device as a JSON document",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return metadataExportCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy metadata export --json-file metadata.json /dev/mapper/encrypted-lv`,
+	}
+	flags := metadataExportCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.StringVar(&metadataJSONFile, "json-file", "", "write the metadata to `file` instead of stdout")
+	metadataCommand.AddCommand(metadataExportCommand)
+
+	metadataImportCommand := &cobra.Command{
+		Use:   "import",
+		Short: "Replace the JSON metadata of a LUKSv2-formatted file or device with a JSON document",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return metadataImportCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy metadata import --json-file metadata.json /dev/mapper/encrypted-lv`,
+	}
+	flags = metadataImportCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.StringVar(&metadataJSONFile, "json-file", "", "read the metadata from `file` instead of stdin")
+	metadataCommand.AddCommand(metadataImportCommand)
+
+	rootCmd.AddCommand(metadataCommand)
+}
+
+func metadataExportCmd(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v2json, err := readV2JSON(f, args[0])
+	if err != nil {
+		return err
+	}
+	return writeJSONDocument(metadataJSONFile, v2json)
+}
+
+func metadataImportCmd(cmd *cobra.Command, args []string) error {
+	f, err := os.OpenFile(args[0], os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = readV2JSON(f, args[0]); err != nil {
+		return err
+	}
+	var v2json luksy.V2JSON
+	if err = readJSONDocument(metadataJSONFile, &v2json); err != nil {
+		return fmt.Errorf("reading metadata: %w", err)
+	}
+	if err = luksy.UpdateV2JSON(f, &v2json); err != nil {
+		return err
+	}
+	return f.Sync()
+}
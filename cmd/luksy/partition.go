@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containers/luksy"
+	"github.com/spf13/pflag"
+)
+
+// partitionFile is either an entire file, or a part of it.
+type partitionFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+}
+
+// addPartitionFlags adds the --partition and --partition-offset flags to a
+// command's flags.
+func addPartitionFlags(flags *pflag.FlagSet, number *int, offset *string) {
+	flags.IntVar(number, "partition", 0, "use partition `number` in a disk image's GPT or MBR partition table")
+	flags.StringVar(offset, "partition-offset", "", "use the part of a disk image which starts at `offset` bytes, a multiple of 512")
+}
+
+// selectPartition returns the part of f which a --partition or
+// --partition-offset flag selected, or f itself if neither was used.
+func selectPartition(f inputFile, number int, offset string) (partitionFile, error) {
+	switch {
+	case number != 0 && offset != "":
+		return nil, errors.New("--partition and --partition-offset can not be combined")
+	case number < 0:
+		return nil, fmt.Errorf("invalid --partition %d", number)
+	case number != 0:
+		partition, err := luksy.FindPartition(f, number)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", f.Name(), err)
+		}
+		return luksy.NewSection(f, partition.Offset, partition.Size), nil
+	case offset != "":
+		start, err := parseSize(offset)
+		if err != nil {
+			return nil, fmt.Errorf("--partition-offset: %w", err)
+		}
+		if start%luksy.V1SectorSize != 0 {
+			return nil, fmt.Errorf("--partition-offset %d is not a multiple of %d", start, luksy.V1SectorSize)
+		}
+		size, err := deviceSize(f)
+		if err != nil {
+			return nil, fmt.Errorf("determining size of %q: %w", f.Name(), err)
+		}
+		if int64(start) >= size {
+			return nil, fmt.Errorf("--partition-offset %d is past the end of %q, which is %d bytes long", start, f.Name(), size)
+		}
+		return luksy.NewSection(f, int64(start), size-int64(start)), nil
+	}
+	return f, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/luksy"
+)
+
+// plainKey returns the key for a plain mode volume.  As with cryptsetup, the
+// contents of a key file are used as the key without being hashed, while a
+// password is hashed.
+func plainKey(keyFile, password, hash string, keyBits int) ([]byte, error) {
+	if keyBits < 0 || keyBits%8 != 0 {
+		return nil, fmt.Errorf("--key-size %d is not a multiple of 8 bits", keyBits)
+	}
+	if keyFile == "" {
+		return luksy.PlainKey([]byte(password), hash, keyBits/8)
+	}
+	keyBytes := keyBits / 8
+	if keyBytes == 0 {
+		keyBytes = 32
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < keyBytes {
+		return nil, fmt.Errorf("key file %q is too short to hold a %d-bit key", keyFile, keyBytes*8)
+	}
+	return key[:keyBytes], nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containers/luksy"
+	"github.com/spf13/cobra"
+)
+
+var repairYes = false
+
+func init() {
+	repairCommand := &cobra.Command{
+		Use:   "repair",
+		Short: "Rebuild a damaged LUKSv2 primary header from the secondary header",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return repairCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy repair /dev/mapper/encrypted-lv`,
+	}
+
+	flags := repairCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.BoolVarP(&repairYes, "yes", "y", false, "don't ask for confirmation before writing")
+	rootCmd.AddCommand(repairCommand)
+}
+
+func repairCmd(cmd *cobra.Command, args []string) error {
+	f, err := os.OpenFile(args[0], os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, _, _, err = luksy.ReadHeaders(f, luksy.ReadHeaderOptions{}); err == nil {
+		fmt.Fprintf(os.Stdout, "%s: primary header is intact, nothing to do\n", args[0])
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "%s: primary header is unusable: %v\n", args[0], err)
+	rebuilt, offset, err := luksy.RecoverV2PrimaryHeader(f)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Found an intact secondary header at offset %d.\n", offset)
+	if !repairYes {
+		fmt.Fprintf(os.Stdout, "Overwrite the first %d bytes of %s with a primary header rebuilt from it? [y/N] ", len(rebuilt), args[0])
+		os.Stdout.Sync()
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && answer == "" {
+			return fmt.Errorf("reading answer: %w", err)
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return errors.New("not confirmed, nothing written")
+		}
+	}
+	if _, err = f.WriteAt(rebuilt, 0); err != nil {
+		return fmt.Errorf("writing rebuilt primary header: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", args[0], err)
+	}
+	if _, _, _, _, err = luksy.ReadHeaders(f, luksy.ReadHeaderOptions{}); err != nil {
+		return fmt.Errorf("rereading repaired headers: %w", err)
+	}
+	fmt.Fprintf(os.Stdout, "%s: primary header rebuilt\n", args[0])
+	return nil
+}
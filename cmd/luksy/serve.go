@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containers/luksy"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	servePasswordFd   = -1
+	servePasswordFile = ""
+	serveKeySlot      = -1
+	serveTries        = 3
+	serveNBD          = ""
+	serveName         = ""
+	serveReadOnly     = false
+	servePartition    = 0
+	servePartOffset   = ""
+)
+
+func init() {
+	serveCommand := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the decrypted contents of a LUKS-formatted file or device over NBD",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return serveCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy serve --nbd unix:/run/user/1000/encrypted.sock /tmp/encrypted.img`,
+	}
+
+	flags := serveCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.IntVar(&servePasswordFd, "password-fd", -1, "read password from file descriptor")
+	flags.StringVar(&servePasswordFile, "password-file", "", "read password from file")
+	flags.IntVarP(&serveKeySlot, "key-slot", "S", -1, "only try the password against key slot `number`")
+	flags.IntVarP(&serveTries, "tries", "T", 3, "prompt for the password this many `times` when reading it from a terminal")
+	flags.StringVar(&serveNBD, "nbd", "", "serve using the NBD protocol on a socket at `unix:path`")
+	flags.StringVar(&serveName, "name", "", "NBD export `name` (clients which ask for the default export also get this one)")
+	flags.BoolVar(&serveReadOnly, "read-only", false, "refuse writes, and open the file or device read-only")
+	addPartitionFlags(flags, &servePartition, &servePartOffset)
+	rootCmd.AddCommand(serveCommand)
+}
+
+func serveCmd(cmd *cobra.Command, args []string) error {
+	socketPath, ok := strings.CutPrefix(serveNBD, "unix:")
+	if !ok || socketPath == "" {
+		return fmt.Errorf("--nbd %q is not of the form unix:path", serveNBD)
+	}
+	flag := os.O_RDWR
+	if serveReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(args[0], flag, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	input, err := selectPartition(f, servePartition, servePartOffset)
+	if err != nil {
+		return err
+	}
+	volume, err := unlockLUKS(args[0], input, unlockLUKSOptions{
+		UnlockOptions: luksy.UnlockOptions{Keyslot: keySlotID(serveKeySlot)},
+		passwordFd:    servePasswordFd,
+		passwordFile:  servePasswordFile,
+		tries:         serveTries,
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := volume.Payload(input)
+	if err != nil {
+		return err
+	}
+	if volume.ReadOnly && !serveReadOnly {
+		logrus.Warnf("volume is being reencrypted or has requirements that were ignored, serving it read-only")
+		serveReadOnly = true
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			listener.Close()
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	conns := make(map[net.Conn]struct{})
+	nbdOptions := luksy.NBDOptions{Name: serveName, ReadOnly: serveReadOnly}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := luksy.ServeNBD(conn, payload, nbdOptions); err != nil {
+				logrus.Errorf("serving NBD client: %v", err)
+			}
+			conn.Close()
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+	// we were interrupted, so hang up on any clients that are still
+	// connected, and make sure everything they wrote is written
+	mu.Lock()
+	for conn := range conns {
+		conn.Close()
+	}
+	mu.Unlock()
+	wg.Wait()
+	return payload.Sync()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/containers/luksy"
+	"github.com/spf13/cobra"
+)
+
+// maxTokens is the number of tokens that cryptsetup allows a LUKSv2 volume
+// to have.
+const maxTokens = 32
+
+var (
+	tokenID       = -1
+	tokenReplace  = false
+	tokenJSONFile = ""
+)
+
+func init() {
+	tokenCommand := &cobra.Command{
+		Use:   "token",
+		Short: "Manage tokens in a LUKSv2-formatted file or device",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	tokenImportCommand := &cobra.Command{
+		Use:   "import",
+		Short: "Add a token, read as a JSON document, to a LUKSv2-formatted file or device",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return tokenImportCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy token import --json-file token.json /dev/mapper/encrypted-lv`,
+	}
+	flags := tokenImportCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.IntVar(&tokenID, "token-id", -1, "token `number` to use (default is the first unused one)")
+	flags.BoolVar(&tokenReplace, "token-replace", false, "replace the token if it already exists")
+	flags.StringVar(&tokenJSONFile, "json-file", "", "read the token from `file` instead of stdin")
+	tokenCommand.AddCommand(tokenImportCommand)
+
+	tokenExportCommand := &cobra.Command{
+		Use:   "export",
+		Short: "Write a token from a LUKSv2-formatted file or device as a JSON document",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return tokenExportCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy token export --token-id 0 /dev/mapper/encrypted-lv`,
+	}
+	flags = tokenExportCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.IntVar(&tokenID, "token-id", -1, "token `number` to export")
+	flags.StringVar(&tokenJSONFile, "json-file", "", "write the token to `file` instead of stdout")
+	tokenCommand.AddCommand(tokenExportCommand)
+
+	tokenRemoveCommand := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove a token from a LUKSv2-formatted file or device",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return tokenRemoveCmd(cmd, args)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `luksy token remove --token-id 0 /dev/mapper/encrypted-lv`,
+	}
+	flags = tokenRemoveCommand.Flags()
+	flags.SetInterspersed(false)
+	flags.IntVar(&tokenID, "token-id", -1, "token `number` to remove")
+	tokenCommand.AddCommand(tokenRemoveCommand)
+
+	rootCmd.AddCommand(tokenCommand)
+}
+
+// readV2JSON reads the LUKSv2 JSON metadata from the file.
+func readV2JSON(f io.ReaderAt, name string) (*luksy.V2JSON, error) {
+	v1header, _, _, v2json, err := luksy.ReadHeaders(f, luksy.ReadHeaderOptions{Recover: true})
+	if err != nil {
+		return nil, err
+	}
+	if v1header != nil || v2json == nil {
+		return nil, fmt.Errorf("%s is not a LUKSv2 volume", name)
+	}
+	return v2json, nil
+}
+
+// readJSONDocument reads a JSON document from the named file, or from stdin
+// if no file was named.
+func readJSONDocument(jsonFile string, v any) error {
+	var data []byte
+	var err error
+	if jsonFile != "" && jsonFile != "-" {
+		data, err = os.ReadFile(jsonFile)
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONDocument writes a JSON document to the named file, or to stdout
+// if no file was named.  Values which encode themselves are written exactly
+// as they encode themselves, so that tokens which we don't know about are
+// written the way they were read.
+func writeJSONDocument(jsonFile string, v any) error {
+	var data []byte
+	var err error
+	if m, ok := v.(json.Marshaler); ok {
+		if data, err = m.MarshalJSON(); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	} else {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err = encoder.Encode(v); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	if jsonFile != "" && jsonFile != "-" {
+		return os.WriteFile(jsonFile, data, 0o600)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func tokenImportCmd(cmd *cobra.Command, args []string) error {
+	if tokenID >= maxTokens {
+		return fmt.Errorf("token ID %d is out of range (must be less than %d)", tokenID, maxTokens)
+	}
+	f, err := os.OpenFile(args[0], os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v2json, err := readV2JSON(f, args[0])
+	if err != nil {
+		return err
+	}
+	var token luksy.V2JSONToken
+	if err = readJSONDocument(tokenJSONFile, &token); err != nil {
+		return fmt.Errorf("reading token: %w", err)
+	}
+	if token.Type == "" {
+		return errors.New("token has no type")
+	}
+	if v2json.Tokens == nil {
+		v2json.Tokens = make(map[string]luksy.V2JSONToken)
+	}
+	id := tokenID
+	if id < 0 {
+		for id = 0; id < maxTokens; id++ {
+			if _, ok := v2json.Tokens[strconv.Itoa(id)]; !ok {
+				break
+			}
+		}
+		if id >= maxTokens {
+			return fmt.Errorf("all %d token IDs are already in use", maxTokens)
+		}
+	} else if _, ok := v2json.Tokens[strconv.Itoa(id)]; ok && !tokenReplace {
+		return fmt.Errorf("token %d already exists, and --token-replace was not specified", id)
+	}
+	v2json.Tokens[strconv.Itoa(id)] = token
+	if err = luksy.UpdateV2JSON(f, v2json); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Token %d created.\n", id)
+	return nil
+}
+
+func tokenExportCmd(cmd *cobra.Command, args []string) error {
+	if tokenID < 0 {
+		return errors.New("--token-id is required")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v2json, err := readV2JSON(f, args[0])
+	if err != nil {
+		return err
+	}
+	token, ok := v2json.Tokens[strconv.Itoa(tokenID)]
+	if !ok {
+		return fmt.Errorf("token %d not found", tokenID)
+	}
+	return writeJSONDocument(tokenJSONFile, token)
+}
+
+func tokenRemoveCmd(cmd *cobra.Command, args []string) error {
+	if tokenID < 0 {
+		return errors.New("--token-id is required")
+	}
+	f, err := os.OpenFile(args[0], os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v2json, err := readV2JSON(f, args[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := v2json.Tokens[strconv.Itoa(tokenID)]; !ok {
+		return fmt.Errorf("token %d not found", tokenID)
+	}
+	delete(v2json.Tokens, strconv.Itoa(tokenID))
+	if err = luksy.UpdateV2JSON(f, v2json); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/containers/luksy"
+)
+
+// unlockLUKSOptions controls how unlockLUKS reads a password and unlocks a
+// volume.
+type unlockLUKSOptions struct {
+	luksy.UnlockOptions
+	passwordFd   int
+	passwordFile string
+	// tries is the number of times to prompt for the password if it's
+	// read from a terminal.
+	tries int
+	// luksType is "luks1" or "luks2" if the volume has to be that version
+	// of LUKS.
+	luksType string
+}
+
+// keySlotID converts a --key-slot flag's value to the form that
+// luksy.UnlockOptions expects.
+func keySlotID(keySlot int) string {
+	if keySlot < 0 {
+		return ""
+	}
+	return strconv.Itoa(keySlot)
+}
+
+// unlockLUKS reads the LUKS headers from input, which is named name, and
+// unlocks the volume, prompting for the password up to options.tries times if
+// it's read from a terminal.
+func unlockLUKS(name string, input luksy.ReaderAtSeekCloser, options unlockLUKSOptions) (*luksy.Volume, error) {
+	v1header, v2header, _, v2json, err := luksy.ReadHeaders(input, luksy.ReadHeaderOptions{Recover: true})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case options.luksType == "luks1" && v1header == nil:
+		return nil, fmt.Errorf("%q is not a LUKSv1 volume", name)
+	case options.luksType == "luks2" && v2header == nil:
+		return nil, fmt.Errorf("%q is not a LUKSv2 volume", name)
+	}
+	var volume *luksy.Volume
+	for try := 1; ; try++ {
+		var password string
+		var interactive bool
+		password, interactive, err = readPassword(options.passwordFd, options.passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case v1header != nil:
+			volume, err = v1header.Unlock(password, input, options.UnlockOptions)
+		case v2header != nil:
+			volume, err = v2header.Unlock(password, input, *v2json, options.UnlockOptions)
+		default:
+			err = errors.New("internal error: unknown format")
+		}
+		if err == nil || !interactive || try >= options.tries || !errors.Is(err, luksy.ErrIncorrectPassphrase) {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "No key available with this passphrase.")
+	}
+	return volume, err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/containers/luksy"
+)
+
+// inputFile is a file or device that we read from, or an image that we read
+// from a web server.
+type inputFile interface {
+	partitionFile
+	Name() string
+}
+
+// isURL returns true if name looks like an http or https URL rather than
+// the name of a file.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// openInput opens a file or device for reading, or if it's given an http or
+// https URL, prepares to read from it using range requests.
+func openInput(name string) (inputFile, error) {
+	if !isURL(name) {
+		return os.Open(name)
+	}
+	r, err := luksy.NewHTTPReader(name, luksy.HTTPReaderOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &urlFile{HTTPReader: r, name: name}, nil
+}
+
+// urlFile is an image on a web server, which we can only read from.
+type urlFile struct {
+	*luksy.HTTPReader
+	name string
+}
+
+func (u *urlFile) Name() string {
+	return u.name
+}
+
+func (u *urlFile) WriteAt([]byte, int64) (int, error) {
+	return 0, errors.New("images read from URLs can not be written to")
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"math"
 	"strconv"
 
 	"golang.org/x/crypto/argon2"
@@ -20,6 +20,189 @@ type ReaderAtSeekCloser interface {
 	io.Closer
 }
 
+// Volume describes the payload of an unlocked volume.
+type Volume struct {
+	// Cipher encrypts and decrypts the payload.  It is nil if Segments is
+	// set.
+	Cipher *SectorCipher
+	// FirstSector is the number of the payload's first sector, for
+	// purposes of IV generation.
+	FirstSector uint64
+	// PayloadOffset is the offset in the file where the payload begins.
+	PayloadOffset int64
+	// PayloadSize is the size of the payload, which may run to the end of
+	// the file.  It is -1 if the payload runs to the end of a stream whose
+	// length isn't known.
+	PayloadSize int64
+	// Keyslot is the ID of the key slot which was unlocked.
+	Keyslot string
+	// PlaintextSize, if set, is the exact length of the plaintext, which
+	// was recorded because it isn't a multiple of the sector size.  The
+	// payload is padded to a whole number of sectors, but DecryptReader()
+	// stops after PlaintextSize bytes.
+	PlaintextSize int64
+	// Segments is set if the payload isn't a single encrypted extent of
+	// the file, which happens when a volume was part-way through being
+	// reencrypted.  It lists the parts of the payload, in order.
+	Segments []VolumeSegment
+	// ReadOnly is set if the payload mustn't be modified, because the
+	// volume was part-way through being reencrypted, or because its
+	// requirements were ignored.  Part of a reencrypting volume's payload
+	// may be read from the area where its journal is kept.
+	ReadOnly bool
+}
+
+// VolumeSegment describes one part of the payload of an unlocked volume.
+type VolumeSegment struct {
+	// Cipher decrypts the segment.  It is nil if the segment is not
+	// encrypted.
+	Cipher *SectorCipher
+	// FirstSector is the number of the segment's first sector, for
+	// purposes of IV generation.
+	FirstSector uint64
+	// Offset is the offset in the file where the segment begins.
+	Offset int64
+	// Size is the size of the segment.  In a Volume returned by
+	// FormatV2WithOptions(), or one unlocked using StreamHeaders, a
+	// segment which runs to the end of the file has a size of -1.
+	Size int64
+}
+
+// newVolumeSegment builds a VolumeSegment from a segment in the JSON
+// metadata, using the key that goes with it.  fileSize is only used if the
+// segment's size is "dynamic", and if it is negative, the segment's size is
+// left as -1.
+func newVolumeSegment(id string, segment V2JSONSegment, key []byte, fileSize int64) (VolumeSegment, error) {
+	offset, err := strconv.ParseInt(segment.Offset, 10, 64)
+	if err != nil || offset < 0 {
+		return VolumeSegment{}, fmt.Errorf("segment %q has invalid offset %q", id, segment.Offset)
+	}
+	var size int64
+	switch {
+	case segment.Size != "dynamic":
+		if size, err = strconv.ParseInt(segment.Size, 10, 64); err != nil || size < 0 {
+			return VolumeSegment{}, fmt.Errorf("segment %q has invalid size %q", id, segment.Size)
+		}
+	case fileSize < 0:
+		size = -1
+	default:
+		if size = fileSize - offset; size < 0 {
+			return VolumeSegment{}, fmt.Errorf("segment %q at offset %d is beyond the end of the file", id, offset)
+		}
+	}
+	v := VolumeSegment{Offset: offset, Size: size}
+	switch segment.Type {
+	case "linear":
+		return v, nil
+	case "crypt":
+		if segment.V2JSONSegmentCrypt == nil {
+			return VolumeSegment{}, fmt.Errorf("segment %q is corrupt: no crypt parameters", id)
+		}
+		// the IV tweak is always counted in 512-byte units, even if the
+		// segment's sectors are larger
+		if (int64(segment.IVTweak)*V1SectorSize)%int64(segment.SectorSize) != 0 {
+			return VolumeSegment{}, fmt.Errorf("segment %q has IV tweak %d, which is not a multiple of its sector size %d", id, segment.IVTweak, segment.SectorSize)
+		}
+		v.FirstSector = uint64(segment.IVTweak) * V1SectorSize / uint64(segment.SectorSize)
+		if v.Cipher, err = NewSectorCipher(segment.Encryption, key, segment.SectorSize); err != nil {
+			return VolumeSegment{}, fmt.Errorf("initializing decryption for segment %q: %w", id, err)
+		}
+		return v, nil
+	}
+	return VolumeSegment{}, fmt.Errorf("segment %q has unsupported type %q", id, segment.Type)
+}
+
+// slice returns a VolumeSegment which describes the part of this one which
+// starts at start and is size bytes long.  start should be a multiple of the
+// sector size.
+func (s VolumeSegment) slice(start, size int64) VolumeSegment {
+	slice := s
+	slice.Offset += start
+	slice.Size = size
+	if s.Cipher != nil {
+		slice.FirstSector += uint64(start / int64(s.Cipher.SectorSize()))
+	}
+	return slice
+}
+
+// DecryptReader returns an io.ReadCloser which decrypts the payload, which
+// it reads from f.  If the payload's size isn't known, it is read until f
+// runs out.
+func (v *Volume) DecryptReader(f io.ReaderAt, options StreamOptions) io.ReadCloser {
+	var rc io.ReadCloser
+	if v.Segments != nil {
+		rc = &segmentsReader{f: f, segments: v.Segments, options: options}
+	} else {
+		rc = v.Cipher.DecryptReader(newSection(f, v.PayloadOffset, v.PayloadSize), v.FirstSector, options)
+	}
+	if v.PlaintextSize > 0 {
+		// leave off the padding at the end of the last sector
+		rc = &limitedReadCloser{Reader: io.LimitReader(rc, v.PlaintextSize), Closer: rc}
+	}
+	return rc
+}
+
+// limitedReadCloser reads from a limited part of a reader, but closes all of
+// it.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newSection returns an io.SectionReader for size bytes of r, starting at
+// offset, or for everything from offset onward if size is negative.
+func newSection(r io.ReaderAt, offset, size int64) *io.SectionReader {
+	if size < 0 {
+		size = math.MaxInt64 - offset
+	}
+	return io.NewSectionReader(r, offset, size)
+}
+
+// segmentsReader reads each of a list of segments in turn, decrypting them
+// if they're encrypted.
+type segmentsReader struct {
+	f        io.ReaderAt
+	segments []VolumeSegment
+	options  StreamOptions
+	current  io.ReadCloser
+}
+
+func (r *segmentsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.segments) == 0 {
+				return 0, io.EOF
+			}
+			segment := r.segments[0]
+			r.segments = r.segments[1:]
+			section := newSection(r.f, segment.Offset, segment.Size)
+			if segment.Cipher != nil {
+				r.current = segment.Cipher.DecryptReader(section, segment.FirstSector, r.options)
+			} else {
+				r.current = io.NopCloser(section)
+			}
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			err = r.current.Close()
+			r.current = nil
+			if err == nil && n == 0 {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func (r *segmentsReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
 // Decrypt attempts to verify the specified password using information from the
 // header and read from the specified file.
 //
@@ -28,65 +211,116 @@ type ReaderAtSeekCloser interface {
 // the payload begins, and the size of the payload, assuming the payload runs
 // to the end of the file.
 func (h V1Header) Decrypt(password string, f ReaderAtSeekCloser) (func([]byte) ([]byte, error), int, int64, int64, error) {
-	size, err := f.Seek(0, io.SeekEnd)
+	v, err := h.Unlock(password, f, UnlockOptions{})
 	if err != nil {
 		return nil, -1, -1, -1, err
 	}
+	return v.Cipher.streamFunc(true, v.FirstSector), v.Cipher.SectorSize(), v.PayloadOffset, v.PayloadSize, nil
+}
+
+// Unlock attempts to verify the specified password using information from the
+// header and read from the specified file.  Key slots are tried in order, as
+// specified by options.
+//
+// Returns a description of the payload, assuming the payload runs to the end
+// of the file.
+func (h V1Header) Unlock(password string, f ReaderAtSeekCloser, options UnlockOptions) (*Volume, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return h.unlock(password, f, size, options)
+}
+
+// unlock does the work of Unlock.  If size is negative, the size of the file
+// isn't known, and the returned payload size will be -1.
+func (h V1Header) unlock(password string, f io.ReaderAt, size int64, options UnlockOptions) (*Volume, error) {
 	hasher, err := hasherByName(h.HashSpec())
 	if err != nil {
-		return nil, -1, -1, -1, fmt.Errorf("unsupported digest algorithm %q: %w", h.HashSpec(), err)
+		return nil, fmt.Errorf("unsupported digest algorithm %q: %w", h.HashSpec(), err)
 	}
 
-	activeKeys := 0
+	var attempts []keyslotAttempt
 	for k := 0; k < v1NumKeys; k++ {
 		keyslot, err := h.KeySlot(k)
 		if err != nil {
-			return nil, -1, -1, -1, fmt.Errorf("reading key slot %d: %w", k, err)
+			return nil, fmt.Errorf("reading key slot %d: %w", k, err)
 		}
 		active, err := keyslot.Active()
 		if err != nil {
-			return nil, -1, -1, -1, fmt.Errorf("checking if key slot %d is active: %w", k, err)
-		}
-		if !active {
-			continue
-		}
-		activeKeys++
-
-		passwordDerived := pbkdf2.Key([]byte(password), keyslot.KeySlotSalt(), int(keyslot.Iterations()), int(h.KeyBytes()), hasher)
-		striped := make([]byte, h.KeyBytes()*keyslot.Stripes())
-		n, err := f.ReadAt(striped, int64(keyslot.KeyMaterialOffset())*V1SectorSize)
-		if err != nil {
-			return nil, -1, -1, -1, fmt.Errorf("reading diffuse material for keyslot %d: %w", k, err)
-		}
-		if n != len(striped) {
-			return nil, -1, -1, -1, fmt.Errorf("short read while reading diffuse material for keyslot %d: expected %d, got %d", k, len(striped), n)
+			return nil, fmt.Errorf("checking if key slot %d is active: %w", k, err)
 		}
-		splitKey, err := v1decrypt(h.CipherName(), h.CipherMode(), 0, passwordDerived, striped, V1SectorSize, false)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error attempting to decrypt main key: %v\n", err)
+		if options.Keyslot != "" && options.Keyslot != strconv.Itoa(k) {
 			continue
 		}
-		mkCandidate, err := afMerge(splitKey, hasher(), int(h.KeyBytes()), int(keyslot.Stripes()))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error attempting to compute main key: %v\n", err)
+		if !active {
+			if options.Keyslot != "" {
+				return nil, fmt.Errorf("key slot %d is not active", k)
+			}
 			continue
 		}
-		mkcandidateDerived := pbkdf2.Key(mkCandidate, h.MKDigestSalt(), int(h.MKDigestIter()), v1DigestSize, hasher)
-		ivTweak := 0
-		decryptStream := func(ciphertext []byte) ([]byte, error) {
-			plaintext, err := v1decrypt(h.CipherName(), h.CipherMode(), ivTweak, mkCandidate, ciphertext, V1SectorSize, false)
-			ivTweak += len(ciphertext) / V1SectorSize
-			return plaintext, err
-		}
-		if bytes.Equal(mkcandidateDerived, h.MKDigest()) {
-			payloadOffset := int64(h.PayloadOffset() * V1SectorSize)
-			return decryptStream, V1SectorSize, payloadOffset, size - payloadOffset, nil
+		k := k
+		attempts = append(attempts, keyslotAttempt{
+			id: strconv.Itoa(k),
+			try: func(cancel <-chan struct{}) ([]byte, error) {
+				passwordDerived := pbkdf2KeyCancelable([]byte(password), keyslot.KeySlotSalt(), int(keyslot.Iterations()), int(h.KeyBytes()), hasher, cancel)
+				if passwordDerived == nil {
+					return nil, nil
+				}
+				striped := make([]byte, h.KeyBytes()*keyslot.Stripes())
+				n, err := f.ReadAt(striped, int64(keyslot.KeyMaterialOffset())*V1SectorSize)
+				if err != nil {
+					return nil, fmt.Errorf("reading diffuse material for keyslot %d: %w", k, err)
+				}
+				if n != len(striped) {
+					return nil, fmt.Errorf("short read while reading diffuse material for keyslot %d: expected %d, got %d", k, len(striped), n)
+				}
+				splitKey, err := v1decrypt(h.CipherName(), h.CipherMode(), 0, passwordDerived, striped, V1SectorSize, false)
+				if err != nil {
+					log().WithField("keyslot", k).Warnf("error attempting to decrypt main key: %v", err)
+					return nil, nil
+				}
+				mkCandidate, err := afMerge(splitKey, hasher(), int(h.KeyBytes()), int(keyslot.Stripes()))
+				if err != nil {
+					log().WithField("keyslot", k).Warnf("error attempting to compute main key: %v", err)
+					return nil, nil
+				}
+				mkcandidateDerived := pbkdf2.Key(mkCandidate, h.MKDigestSalt(), int(h.MKDigestIter()), v1DigestSize, hasher)
+				if !bytes.Equal(mkcandidateDerived, h.MKDigest()) {
+					return nil, nil
+				}
+				return mkCandidate, nil
+			},
+		})
+	}
+	if len(attempts) == 0 {
+		if options.Keyslot != "" {
+			return nil, fmt.Errorf("key slot %q not found on LUKS1 volume", options.Keyslot)
 		}
+		return nil, fmt.Errorf("%w on LUKS1 volume", ErrNoKeyslots)
+	}
+	i, mkey, err := tryKeyslots(attempts, options)
+	if err != nil {
+		return nil, err
+	}
+	if mkey == nil {
+		return nil, ErrIncorrectPassphrase
 	}
-	if activeKeys == 0 {
-		return nil, -1, -1, -1, errors.New("no passwords set on LUKS1 volume")
+	payloadCipher, err := newSectorCipher(h.CipherName(), h.CipherMode(), mkey, V1SectorSize, true)
+	if err != nil {
+		return nil, fmt.Errorf("initializing decryption: %w", err)
+	}
+	payloadOffset := int64(h.PayloadOffset() * V1SectorSize)
+	payloadSize := int64(-1)
+	if size >= 0 {
+		payloadSize = size - payloadOffset
 	}
-	return nil, -1, -1, -1, errors.New("decryption error: incorrect password")
+	return &Volume{
+		Cipher:        payloadCipher,
+		PayloadOffset: payloadOffset,
+		PayloadSize:   payloadSize,
+		Keyslot:       attempts[i].id,
+	}, nil
 }
 
 // Decrypt attempts to verify the specified password using information from the
@@ -95,161 +329,309 @@ func (h V1Header) Decrypt(password string, f ReaderAtSeekCloser) (func([]byte) (
 // Returns a function which will decrypt payload blocks in succession, the size
 // of chunks of data that the function expects, the offset in the file where
 // the payload begins, and the size of the payload, assuming the payload runs
-// to the end of the file.
+// to the end of the file.  Volumes whose payloads are split into segments,
+// which can happen if they were part-way through being reencrypted, can only
+// be decrypted using Unlock().
 func (h V2Header) Decrypt(password string, f ReaderAtSeekCloser, j V2JSON) (func([]byte) ([]byte, error), int, int64, int64, error) {
+	v, err := h.Unlock(password, f, j, UnlockOptions{})
+	if err != nil {
+		return nil, -1, -1, -1, err
+	}
+	if v.Segments != nil {
+		return nil, -1, -1, -1, errors.New("payload is split into multiple segments, which Decrypt() can't describe; use Unlock() instead")
+	}
+	return v.Cipher.streamFunc(true, v.FirstSector), v.Cipher.SectorSize(), v.PayloadOffset, v.PayloadSize, nil
+}
+
+// Unlock attempts to verify the specified password using information from the
+// header, JSON block, and read from the specified file.  Key slots are tried in
+// order of priority, as specified by options.  If the volume was part-way
+// through being reencrypted, the password needs to unlock the keys for both
+// the parts of the payload that were reencrypted and the parts that weren't.
+//
+// Returns a description of the payload.
+func (h V2Header) Unlock(password string, f ReaderAtSeekCloser, j V2JSON, options UnlockOptions) (*Volume, error) {
+	return h.unlock(password, f, func() (int64, error) { return f.Seek(0, io.SeekEnd) }, j, options)
+}
+
+// unlock does the work of Unlock, calling fileSize if it needs to know how
+// large the file is.  If fileSize returns a negative size, segments which run
+// to the end of the file, and the payload, will have a size of -1.
+func (h V2Header) unlock(password string, f io.ReaderAt, fileSize func() (int64, error), j V2JSON, options UnlockOptions) (*Volume, error) {
+	if err := j.CheckRequirements(); err != nil {
+		if !options.IgnoreRequirements {
+			return nil, err
+		}
+		log().Warnf("ignoring requirements: %v", err)
+	}
+	dataSegments, err := j.dataSegments()
+	if err != nil {
+		return nil, err
+	}
+	if len(dataSegments) == 0 {
+		return nil, fmt.Errorf("no data segments on LUKS2 volume")
+	}
+	// figure out which digests we need keys for: one for each encrypted
+	// data segment, and possibly more for reconstructing a reencryption
+	// hot zone
+	segmentDigests := make(map[string]string)
+	for _, d := range sortedIDs(j.Digests) {
+		for _, s := range j.Digests[d].Segments {
+			if _, ok := segmentDigests[s]; !ok {
+				segmentDigests[s] = d
+			}
+		}
+	}
+	neededDigests := make(map[string]bool)
+	for _, s := range append(append([]string{}, dataSegments...), j.hotZoneSourceSegments()...) {
+		if j.Segments[s].Type != "crypt" {
+			continue
+		}
+		d, ok := segmentDigests[s]
+		if !ok {
+			return nil, fmt.Errorf("encrypted segment %q is not referenced by any digest", s)
+		}
+		neededDigests[d] = true
+	}
+	if len(neededDigests) == 0 {
+		return nil, fmt.Errorf("no encrypted data segments on LUKS2 volume")
+	}
+
 	foundDigests := 0
-	for d, digest := range j.Digests {
+	triedKeyslot := false
+	keys := make(map[string][]byte)
+	keyslots := make(map[string]string)
+	for _, d := range sortedIDs(j.Digests) {
+		digest := j.Digests[d]
 		if digest.Type != "pbkdf2" {
 			continue
 		}
 		if digest.V2JSONDigestPbkdf2 == nil {
-			return nil, -1, -1, -1, fmt.Errorf("digest %q is corrupt: no pbkdf2 parameters", d)
+			return nil, fmt.Errorf("digest %q is corrupt: no pbkdf2 parameters", d)
 		}
 		foundDigests++
-		if len(digest.Segments) == 0 || len(digest.Digest) == 0 {
+		if !neededDigests[d] || len(digest.Digest) == 0 {
 			continue
 		}
-		payloadOffset := int64(-1)
-		payloadSectorSize := V1SectorSize
-		payloadEncryption := ""
-		payloadSize := int64(0)
-		ivTweak := 0
-		for _, segmentID := range digest.Segments {
-			segment, ok := j.Segments[segmentID]
-			if !ok {
-				continue // well, that was misleading
-			}
-			if segment.Type != "crypt" {
+		attempts, err := j.keyslotAttempts(password, f, d, options)
+		if err != nil {
+			return nil, err
+		}
+		if len(attempts) == 0 {
+			if options.Keyslot != "" {
 				continue
 			}
-			tmp, err := strconv.ParseInt(segment.Offset, 10, 64)
+			return nil, fmt.Errorf("%w on LUKS2 volume for digest %q", ErrNoKeyslots, d)
+		}
+		triedKeyslot = true
+		i, mkey, err := tryKeyslots(attempts, options)
+		if err != nil {
+			return nil, err
+		}
+		if mkey != nil {
+			keys[d] = mkey
+			keyslots[d] = attempts[i].id
+		}
+	}
+	if foundDigests == 0 {
+		return nil, fmt.Errorf("%w on LUKS2 volume: no usable password-verification digests", ErrNoKeyslots)
+	}
+	if options.Keyslot != "" && !triedKeyslot {
+		return nil, fmt.Errorf("key slot %q not found or not usable on LUKS2 volume", options.Keyslot)
+	}
+	if len(keys) == 0 {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, d := range sortedIDs(neededDigests) {
+		if _, ok := keys[d]; !ok {
+			return nil, fmt.Errorf("%w for digest %q, which is needed to decrypt part of the payload", ErrIncorrectPassphrase, d)
+		}
+	}
+
+	size, sized := int64(-1), false
+	newSegment := func(id string) (VolumeSegment, error) {
+		segment := j.Segments[id]
+		if segment.Size == "dynamic" && !sized {
+			s, err := fileSize()
 			if err != nil {
-				continue
+				return VolumeSegment{}, err
 			}
-			payloadOffset = tmp
-			if segment.Size == "dynamic" {
-				size, err := f.Seek(0, io.SeekEnd)
-				if err != nil {
-					continue
-				}
-				payloadSize = size - payloadOffset
-			} else {
-				payloadSize, err = strconv.ParseInt(segment.Size, 10, 64)
-				if err != nil {
-					continue
-				}
+			size, sized = s, true
+		}
+		return newVolumeSegment(id, segment, keys[segmentDigests[id]], size)
+	}
+	var segments []VolumeSegment
+	var keyslot string
+	logicalOffset := int64(0)
+	for _, s := range dataSegments {
+		segment, err := newSegment(s)
+		if err != nil {
+			return nil, err
+		}
+		if keyslot == "" && segment.Cipher != nil {
+			keyslot = keyslots[segmentDigests[s]]
+		}
+		if j.Segments[s].hasFlag("in-reencryption") {
+			hotZone, err := j.hotZoneSegments(f, segment, logicalOffset, newSegment)
+			if err != nil {
+				return nil, fmt.Errorf("reading reencryption hot zone in segment %q: %w", s, err)
 			}
-			payloadSectorSize = segment.SectorSize
-			payloadEncryption = segment.Encryption
-			ivTweak = segment.IVTweak
-			break
+			segments = append(segments, hotZone...)
+		} else {
+			segments = append(segments, segment)
 		}
-		if payloadEncryption == "" {
+		if segment.Size < 0 || logicalOffset < 0 {
+			logicalOffset = -1
+		} else {
+			logicalOffset += segment.Size
+		}
+	}
+	plaintextSize, err := j.plaintextSize(logicalOffset)
+	if err != nil {
+		return nil, err
+	}
+	readOnly := j.checkModifiable() != nil
+	if len(segments) == 1 && segments[0].Cipher != nil {
+		return &Volume{
+			Cipher:        segments[0].Cipher,
+			FirstSector:   segments[0].FirstSector,
+			PayloadOffset: segments[0].Offset,
+			PayloadSize:   segments[0].Size,
+			Keyslot:       keyslot,
+			PlaintextSize: plaintextSize,
+			ReadOnly:      readOnly,
+		}, nil
+	}
+	return &Volume{
+		PayloadOffset: segments[0].Offset,
+		PayloadSize:   logicalOffset,
+		Keyslot:       keyslot,
+		PlaintextSize: plaintextSize,
+		Segments:      segments,
+		ReadOnly:      readOnly,
+	}, nil
+}
+
+// keyslotAttempts returns a list of attempts to unlock the key for the
+// digest using the password, for the key slots which options allow us to try.
+func (j V2JSON) keyslotAttempts(password string, f io.ReaderAt, d string, options UnlockOptions) ([]keyslotAttempt, error) {
+	digest := j.Digests[d]
+	digester, err := hasherByName(digest.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported digest algorithm %q: %w", digest.Hash, err)
+	}
+	var attempts []keyslotAttempt
+	for _, k := range j.keyslotsByPriority() {
+		if options.Keyslot != "" && options.Keyslot != k {
 			continue
 		}
-		activeKeys := 0
-		for k, keyslot := range j.Keyslots {
-			if keyslot.Priority != nil && *keyslot.Priority == V2JSONKeyslotPriorityIgnore {
-				continue
-			}
-			applicable := true
-			if len(digest.Keyslots) > 0 {
-				applicable = false
-				for i := 0; i < len(digest.Keyslots); i++ {
-					if k == digest.Keyslots[i] {
-						applicable = true
-						break
-					}
+		keyslot := j.Keyslots[k]
+		if options.Keyslot == "" && keyslot.Priority != nil && *keyslot.Priority == V2JSONKeyslotPriorityIgnore {
+			continue
+		}
+		applicable := true
+		if len(digest.Keyslots) > 0 {
+			applicable = false
+			for i := 0; i < len(digest.Keyslots); i++ {
+				if k == digest.Keyslots[i] {
+					applicable = true
+					break
 				}
 			}
-			if !applicable {
-				continue
+		}
+		if !applicable {
+			continue
+		}
+		if keyslot.Type != "luks2" {
+			continue
+		}
+		if keyslot.V2JSONKeyslotLUKS2 == nil {
+			return nil, &ErrCorruptKeyslot{ID: k}
+		}
+		if keyslot.V2JSONKeyslotLUKS2.AF.Type != "luks1" {
+			continue
+		}
+		if keyslot.V2JSONKeyslotLUKS2.AF.V2JSONAFLUKS1 == nil {
+			return nil, &ErrCorruptKeyslot{ID: k, Reason: "no AF parameters"}
+		}
+		if keyslot.Area.Type != "raw" {
+			return nil, &ErrCorruptKeyslot{ID: k, Reason: "key data area is not raw"}
+		}
+		if keyslot.Area.Size < int64(keyslot.KeySize)*int64(keyslot.AF.Stripes) {
+			return nil, &ErrCorruptKeyslot{ID: k, Reason: fmt.Sprintf("key data area is too small (%d < %d)", keyslot.Area.Size, keyslot.KeySize*keyslot.AF.Stripes)}
+		}
+		afhasher, err := hasherByName(keyslot.AF.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported digest algorithm %q: %w", keyslot.AF.Hash, err)
+		}
+		var derive func(cancel <-chan struct{}) []byte
+		var memory int64
+		switch keyslot.V2JSONKeyslotLUKS2.Kdf.Type {
+		default:
+			continue
+		case "pbkdf2":
+			if keyslot.V2JSONKeyslotLUKS2.Kdf.V2JSONKdfPbkdf2 == nil {
+				return nil, &ErrCorruptKeyslot{ID: k, Reason: "no pbkdf2 parameters"}
 			}
-			if keyslot.Type != "luks2" {
-				continue
+			hasher, err := hasherByName(keyslot.Kdf.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported digest algorithm %q: %w", keyslot.Kdf.Hash, err)
 			}
-			if keyslot.V2JSONKeyslotLUKS2 == nil {
-				return nil, -1, -1, -1, fmt.Errorf("key slot %q is corrupt", k)
+			derive = func(cancel <-chan struct{}) []byte {
+				return pbkdf2KeyCancelable([]byte(password), keyslot.Kdf.Salt, keyslot.Kdf.Iterations, keyslot.Area.KeySize, hasher, cancel)
 			}
-			if keyslot.V2JSONKeyslotLUKS2.AF.Type != "luks1" {
-				continue
+		case "argon2i":
+			if keyslot.V2JSONKeyslotLUKS2.Kdf.V2JSONKdfArgon2i == nil {
+				return nil, &ErrCorruptKeyslot{ID: k, Reason: "no argon2i parameters"}
 			}
-			if keyslot.V2JSONKeyslotLUKS2.AF.V2JSONAFLUKS1 == nil {
-				return nil, -1, -1, -1, fmt.Errorf("key slot %q is corrupt: no AF parameters", k)
+			// Argon2 can't be interrupted, so these ignore cancellation.
+			derive = func(<-chan struct{}) []byte {
+				return argon2.Key([]byte(password), keyslot.Kdf.Salt, uint32(keyslot.Kdf.Time), uint32(keyslot.Kdf.Memory), uint8(keyslot.Kdf.CPUs), uint32(keyslot.Area.KeySize))
 			}
-			if keyslot.Area.Type != "raw" {
-				return nil, -1, -1, -1, fmt.Errorf("key slot %q is corrupt: key data area is not raw", k)
+			memory = int64(keyslot.Kdf.Memory) * 1024
+		case "argon2id":
+			if keyslot.V2JSONKeyslotLUKS2.Kdf.V2JSONKdfArgon2i == nil {
+				return nil, &ErrCorruptKeyslot{ID: k, Reason: "no argon2id parameters"}
 			}
-			if keyslot.Area.KeySize*V2SectorSize < keyslot.KeySize*keyslot.AF.Stripes {
-				return nil, -1, -1, -1, fmt.Errorf("key slot %q is corrupt: key data area is too small (%d < %d)", k, keyslot.Area.KeySize*V2SectorSize, keyslot.KeySize*keyslot.AF.Stripes)
+			derive = func(<-chan struct{}) []byte {
+				return argon2.IDKey([]byte(password), keyslot.Kdf.Salt, uint32(keyslot.Kdf.Time), uint32(keyslot.Kdf.Memory), uint8(keyslot.Kdf.CPUs), uint32(keyslot.Area.KeySize))
 			}
-			var passwordDerived []byte
-			switch keyslot.V2JSONKeyslotLUKS2.Kdf.Type {
-			default:
-				continue
-			case "pbkdf2":
-				if keyslot.V2JSONKeyslotLUKS2.Kdf.V2JSONKdfPbkdf2 == nil {
-					return nil, -1, -1, -1, fmt.Errorf("key slot %q is corrupt: no pbkdf2 parameters", k)
+			memory = int64(keyslot.Kdf.Memory) * 1024
+		}
+		k := k
+		attempts = append(attempts, keyslotAttempt{
+			id:     k,
+			memory: memory,
+			try: func(cancel <-chan struct{}) ([]byte, error) {
+				passwordDerived := derive(cancel)
+				if passwordDerived == nil {
+					return nil, nil
+				}
+				striped := make([]byte, keyslot.KeySize*keyslot.AF.Stripes)
+				n, err := f.ReadAt(striped, int64(keyslot.Area.Offset))
+				if err != nil {
+					return nil, fmt.Errorf("reading diffuse material for keyslot %q: %w", k, err)
+				}
+				if n != len(striped) {
+					return nil, fmt.Errorf("short read while reading diffuse material for keyslot %q: expected %d, got %d", k, len(striped), n)
 				}
-				hasher, err := hasherByName(keyslot.Kdf.Hash)
+				splitKey, err := v2decrypt(keyslot.Area.Encryption, 0, passwordDerived, striped, V1SectorSize, false)
 				if err != nil {
-					return nil, -1, -1, -1, fmt.Errorf("unsupported digest algorithm %q: %w", keyslot.Kdf.Hash, err)
+					log().WithField("keyslot", k).Warnf("error attempting to decrypt main key: %v", err)
+					return nil, nil
 				}
-				passwordDerived = pbkdf2.Key([]byte(password), keyslot.Kdf.Salt, keyslot.Kdf.Iterations, keyslot.KeySize, hasher)
-			case "argon2i":
-				if keyslot.V2JSONKeyslotLUKS2.Kdf.V2JSONKdfArgon2i == nil {
-					return nil, -1, -1, -1, fmt.Errorf("key slot %q is corrupt: no argon2i parameters", k)
+				mkCandidate, err := afMerge(splitKey, afhasher(), int(keyslot.KeySize), int(keyslot.AF.Stripes))
+				if err != nil {
+					log().WithField("keyslot", k).Warnf("error attempting to compute main key: %v", err)
+					return nil, nil
 				}
-				passwordDerived = argon2.Key([]byte(password), keyslot.Kdf.Salt, uint32(keyslot.Kdf.Time), uint32(keyslot.Kdf.Memory), uint8(keyslot.Kdf.CPUs), uint32(keyslot.KeySize))
-			case "argon2id":
-				if keyslot.V2JSONKeyslotLUKS2.Kdf.V2JSONKdfArgon2i == nil {
-					return nil, -1, -1, -1, fmt.Errorf("key slot %q is corrupt: no argon2id parameters", k)
+				mkcandidateDerived := pbkdf2.Key(mkCandidate, digest.Salt, digest.Iterations, len(digest.Digest), digester)
+				if !bytes.Equal(mkcandidateDerived, digest.Digest) {
+					return nil, nil
 				}
-				passwordDerived = argon2.IDKey([]byte(password), keyslot.Kdf.Salt, uint32(keyslot.Kdf.Time), uint32(keyslot.Kdf.Memory), uint8(keyslot.Kdf.CPUs), uint32(keyslot.KeySize))
-			}
-			striped := make([]byte, keyslot.KeySize*keyslot.AF.Stripes)
-			n, err := f.ReadAt(striped, int64(keyslot.Area.Offset))
-			if err != nil {
-				return nil, -1, -1, -1, fmt.Errorf("reading diffuse material for keyslot %q: %w", k, err)
-			}
-			if n != len(striped) {
-				return nil, -1, -1, -1, fmt.Errorf("short read while reading diffuse material for keyslot %q: expected %d, got %d", k, len(striped), n)
-			}
-			splitKey, err := v2decrypt(keyslot.Area.Encryption, 0, passwordDerived, striped, V1SectorSize, false)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error attempting to decrypt main key: %v\n", err)
-				continue
-			}
-			afhasher, err := hasherByName(keyslot.AF.Hash)
-			if err != nil {
-				return nil, -1, -1, -1, fmt.Errorf("unsupported digest algorithm %q: %w", keyslot.AF.Hash, err)
-			}
-			mkCandidate, err := afMerge(splitKey, afhasher(), int(keyslot.KeySize), int(keyslot.AF.Stripes))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error attempting to compute main key: %v\n", err)
-				continue
-			}
-			digester, err := hasherByName(digest.Hash)
-			if err != nil {
-				return nil, -1, -1, -1, fmt.Errorf("unsupported digest algorithm %q: %w", digest.Hash, err)
-			}
-			mkcandidateDerived := pbkdf2.Key(mkCandidate, digest.Salt, digest.Iterations, len(digest.Digest), digester)
-			decryptStream := func(ciphertext []byte) ([]byte, error) {
-				plaintext, err := v2decrypt(payloadEncryption, ivTweak, mkCandidate, ciphertext, payloadSectorSize, true)
-				ivTweak += len(ciphertext) / payloadSectorSize
-				return plaintext, err
-			}
-			if bytes.Equal(mkcandidateDerived, digest.Digest) {
-				return decryptStream, payloadSectorSize, payloadOffset, payloadSize, nil
-			}
-			activeKeys++
-		}
-		if activeKeys == 0 {
-			return nil, -1, -1, -1, fmt.Errorf("no passwords set on LUKS2 volume for digest %q", d)
-		}
-	}
-	if foundDigests == 0 {
-		return nil, -1, -1, -1, errors.New("no usable password-verification digests set on LUKS2 volume")
+				return mkCandidate, nil
+			},
+		})
 	}
-	return nil, -1, -1, -1, errors.New("decryption error: incorrect password")
+	return attempts, nil
 }
@@ -2,9 +2,10 @@ package luksy
 
 import (
 	"crypto/rand"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
 
@@ -20,60 +21,154 @@ import (
 // which will encrypt blocks of data in succession, and the size of chunks of
 // data that it expects.
 func EncryptV1(password []string, cipher string) ([]byte, func([]byte) ([]byte, error), int, error) {
+	head, payloadCipher, err := FormatV1(password, cipher)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	return head, payloadCipher.streamFunc(false, 0), payloadCipher.SectorSize(), nil
+}
+
+// FormatV1 prepares to encrypt data using one or more passwords and the
+// specified cipher (or a default, if the specified cipher is "").
+//
+// Returns a fixed LUKSv1 header which contains keying information, and a
+// SectorCipher which will encrypt the payload, starting with sector 0.
+func FormatV1(password []string, cipher string) ([]byte, *SectorCipher, error) {
+	head, volume, err := FormatV1WithOptions(password, FormatV1Options{Cipher: cipher})
+	if err != nil {
+		return nil, nil, err
+	}
+	return head, volume.Cipher, nil
+}
+
+// FormatV1Options controls how FormatV1WithOptions() lays out a LUKSv1
+// volume.
+type FormatV1Options struct {
+	// Cipher is the cipher to encrypt the payload with.  If "",
+	// "aes-xts-plain64" is used.
+	Cipher string
+	// Hash is the hash algorithm used when deriving keys from passwords,
+	// computing the master key's digest, and splitting the master key into
+	// stripes.  If "", "sha256" is used.
+	Hash string
+	// Stripes is the number of anti-forensic stripes that the master key
+	// is split into in each key slot.  If 0, V1Stripes is used.  Other
+	// implementations may not accept other values.
+	Stripes int
+	// PayloadAlignment, if set, is a value, in bytes, which the
+	// payload's offset is rounded up to a multiple of.  It must be a
+	// multiple of V1SectorSize.
+	PayloadAlignment int64
+	// PayloadOffset, if set, is the offset of the payload, in bytes.  It
+	// must be a multiple of V1SectorSize, large enough to leave room for
+	// the header and key slots before it, and it can not be combined with
+	// PayloadAlignment.
+	PayloadOffset int64
+}
+
+// checkPayloadPlacement checks that a payload alignment and offset are usable
+// together, and with the specified sector size.
+func checkPayloadPlacement(alignment, offset int64, sectorSize int) error {
+	switch {
+	case alignment != 0 && offset != 0:
+		return errors.New("a payload alignment and a payload offset can not both be specified")
+	case alignment < 0 || alignment%int64(sectorSize) != 0:
+		return fmt.Errorf("payload alignment %d is not a multiple of %d", alignment, sectorSize)
+	case offset < 0 || offset%int64(sectorSize) != 0:
+		return fmt.Errorf("payload offset %d is not a multiple of %d", offset, sectorSize)
+	}
+	return nil
+}
+
+// placePayload returns the offset where a payload should start, given the
+// size of everything that precedes it.
+func placePayload(headerLength, alignment, offset int64) (int64, error) {
+	switch {
+	case offset != 0:
+		if offset < headerLength {
+			return -1, fmt.Errorf("payload offset %d is too small, the header and key slots need %d bytes", offset, headerLength)
+		}
+		return offset, nil
+	case alignment != 0:
+		return (headerLength + alignment - 1) / alignment * alignment, nil
+	}
+	return headerLength, nil
+}
+
+// FormatV1WithOptions prepares to encrypt data using one or more passwords,
+// laying out the volume as specified by options.
+//
+// Returns a fixed LUKSv1 header which contains keying information, and a
+// Volume which describes the payload, which immediately follows the header.
+func FormatV1WithOptions(password []string, options FormatV1Options) ([]byte, *Volume, error) {
 	if len(password) == 0 {
-		return nil, nil, -1, errors.New("at least one password is required")
+		return nil, nil, errors.New("at least one password is required")
 	}
 	if len(password) > v1NumKeys {
-		return nil, nil, -1, fmt.Errorf("attempted to use %d passwords, only %d possible", len(password), v1NumKeys)
+		return nil, nil, fmt.Errorf("attempted to use %d passwords, only %d possible", len(password), v1NumKeys)
 	}
+	cipher := options.Cipher
 	if cipher == "" {
 		cipher = "aes-xts-plain64"
 	}
+	hashSpec := options.Hash
+	if hashSpec == "" {
+		hashSpec = "sha256"
+	}
+	hasher, err := hasherByName(hashSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	stripes := options.Stripes
+	if stripes == 0 {
+		stripes = V1Stripes
+	}
+	if stripes < 0 {
+		return nil, nil, fmt.Errorf("invalid number of stripes %d", stripes)
+	}
+	if err := checkPayloadPlacement(options.PayloadAlignment, options.PayloadOffset, V1SectorSize); err != nil {
+		return nil, nil, err
+	}
 
 	salt := make([]byte, v1SaltSize)
 	n, err := rand.Read(salt)
 	if err != nil {
-		return nil, nil, -1, fmt.Errorf("reading random data: %w", err)
+		return nil, nil, fmt.Errorf("reading random data: %w", err)
 	}
 	if n != len(salt) {
-		return nil, nil, -1, errors.New("short read")
+		return nil, nil, errors.New("short read")
 	}
 
 	cipherSpec := strings.SplitN(cipher, "-", 3)
 	if len(cipherSpec) != 3 || len(cipherSpec[0]) == 0 || len(cipherSpec[1]) == 0 || len(cipherSpec[2]) == 0 {
-		return nil, nil, -1, fmt.Errorf("invalid cipher %q", cipher)
+		return nil, nil, fmt.Errorf("invalid cipher %q", cipher)
 	}
 
 	var h V1Header
 	if err := h.SetMagic(V1Magic); err != nil {
-		return nil, nil, -1, fmt.Errorf("setting magic to v1: %w", err)
+		return nil, nil, fmt.Errorf("setting magic to v1: %w", err)
 	}
 	if err := h.SetVersion(1); err != nil {
-		return nil, nil, -1, fmt.Errorf("setting version to 1: %w", err)
+		return nil, nil, fmt.Errorf("setting version to 1: %w", err)
 	}
 	h.SetCipherName(cipherSpec[0])
 	h.SetCipherMode(cipherSpec[1] + "-" + cipherSpec[2])
-	h.SetHashSpec("sha256")
+	h.SetHashSpec(hashSpec)
 	h.SetKeyBytes(32)
 	if cipherSpec[1] == "xts" {
 		h.SetKeyBytes(64)
 	}
 	h.SetMKDigestSalt(salt)
-	h.SetMKDigestIter(V1Stripes)
+	h.SetMKDigestIter(uint32(digestIterationsPBKDF2(salt, v1DigestSize, hasher)))
 	h.SetUUID(uuid.NewString())
 
 	mkey := make([]byte, h.KeyBytes())
 	n, err = rand.Read(mkey)
 	if err != nil {
-		return nil, nil, -1, fmt.Errorf("reading random data: %w", err)
+		return nil, nil, fmt.Errorf("reading random data: %w", err)
 	}
 	if n != len(mkey) {
-		return nil, nil, -1, errors.New("short read")
-	}
-
-	hasher, err := hasherByName(h.HashSpec())
-	if err != nil {
-		return nil, nil, -1, errors.New("internal error")
+		return nil, nil, errors.New("short read")
 	}
 
 	mkdigest := pbkdf2.Key(mkey, h.MKDigestSalt(), int(h.MKDigestIter()), v1DigestSize, hasher)
@@ -81,60 +176,65 @@ func EncryptV1(password []string, cipher string) ([]byte, func([]byte) ([]byte,
 
 	headerLength := roundUpToMultiple(v1HeaderStructSize, V1AlignKeyslots)
 	iterations := IterationsPBKDF2(salt, int(h.KeyBytes()), hasher)
-	var stripes [][]byte
+	var keyMaterial [][]byte
 	ksSalt := make([]byte, v1KeySlotSaltLength)
 	for i := 0; i < v1NumKeys; i++ {
 		n, err = rand.Read(ksSalt)
 		if err != nil {
-			return nil, nil, -1, fmt.Errorf("reading random data: %w", err)
+			return nil, nil, fmt.Errorf("reading random data: %w", err)
 		}
 		if n != len(ksSalt) {
-			return nil, nil, -1, errors.New("short read")
+			return nil, nil, errors.New("short read")
 		}
 		var keyslot V1KeySlot
 		keyslot.SetActive(i < len(password))
 		keyslot.SetIterations(uint32(iterations))
-		keyslot.SetStripes(V1Stripes)
+		keyslot.SetStripes(uint32(stripes))
 		keyslot.SetKeySlotSalt(ksSalt)
 		if i < len(password) {
-			splitKey, err := afSplit(mkey, hasher(), int(h.MKDigestIter()))
+			splitKey, err := afSplit(mkey, hasher(), int(keyslot.Stripes()))
 			if err != nil {
-				return nil, nil, -1, fmt.Errorf("splitting key: %w", err)
+				return nil, nil, fmt.Errorf("splitting key: %w", err)
 			}
 			passwordDerived := pbkdf2.Key([]byte(password[i]), keyslot.KeySlotSalt(), int(keyslot.Iterations()), int(h.KeyBytes()), hasher)
 			striped, err := v1encrypt(h.CipherName(), h.CipherMode(), 0, passwordDerived, splitKey, V1SectorSize, false)
 			if err != nil {
-				return nil, nil, -1, fmt.Errorf("encrypting split key with password: %w", err)
+				return nil, nil, fmt.Errorf("encrypting split key with password: %w", err)
 			}
 			if len(striped) != len(mkey)*int(keyslot.Stripes()) {
-				return nil, nil, -1, fmt.Errorf("internal error: got %d stripe bytes, expected %d", len(striped), len(mkey)*int(keyslot.Stripes()))
+				return nil, nil, fmt.Errorf("internal error: got %d stripe bytes, expected %d", len(striped), len(mkey)*int(keyslot.Stripes()))
 			}
-			stripes = append(stripes, striped)
+			keyMaterial = append(keyMaterial, striped)
 		}
 		keyslot.SetKeyMaterialOffset(uint32(headerLength / V1SectorSize))
 		if err := h.SetKeySlot(i, keyslot); err != nil {
-			return nil, nil, -1, fmt.Errorf("internal error: setting value for key slot %d: %w", i, err)
+			return nil, nil, fmt.Errorf("internal error: setting value for key slot %d: %w", i, err)
 		}
 		headerLength += len(mkey) * int(keyslot.Stripes())
 		headerLength = roundUpToMultiple(headerLength, V1AlignKeyslots)
 	}
 	headerLength = roundUpToMultiple(headerLength, V1SectorSize)
+	payloadOffset, err := placePayload(int64(headerLength), options.PayloadAlignment, options.PayloadOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payloadOffset/V1SectorSize > math.MaxUint32 {
+		return nil, nil, fmt.Errorf("payload offset %d is too large", payloadOffset)
+	}
 
-	h.SetPayloadOffset(uint32(headerLength / V1SectorSize))
-	head := make([]byte, headerLength)
+	h.SetPayloadOffset(uint32(payloadOffset / V1SectorSize))
+	head := make([]byte, payloadOffset)
 	offset := copy(head, h[:])
 	offset = roundUpToMultiple(offset, V1AlignKeyslots)
-	for _, stripe := range stripes {
-		copy(head[offset:], stripe)
-		offset = roundUpToMultiple(offset+len(stripe), V1AlignKeyslots)
+	for _, material := range keyMaterial {
+		copy(head[offset:], material)
+		offset = roundUpToMultiple(offset+len(material), V1AlignKeyslots)
 	}
-	ivTweak := 0
-	encryptStream := func(plaintext []byte) ([]byte, error) {
-		ciphertext, err := v1encrypt(h.CipherName(), h.CipherMode(), ivTweak, mkey, plaintext, V1SectorSize, true)
-		ivTweak += len(plaintext) / V1SectorSize
-		return ciphertext, err
+	payloadCipher, err := newSectorCipher(h.CipherName(), h.CipherMode(), mkey, V1SectorSize, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing encryption: %w", err)
 	}
-	return head, encryptStream, V1SectorSize, nil
+	return head, &Volume{Cipher: payloadCipher, PayloadOffset: payloadOffset, PayloadSize: -1}, nil
 }
 
 // EncryptV2 prepares to encrypt data using one or more passwords and the
@@ -144,76 +244,326 @@ func EncryptV1(password []string, cipher string) ([]byte, func([]byte) ([]byte,
 // function which will encrypt blocks of data in succession, and the size of
 // chunks of data that it expects.
 func EncryptV2(password []string, cipher string, payloadSectorSize int) ([]byte, func([]byte) ([]byte, error), int, error) {
+	head, payloadCipher, err := FormatV2(password, cipher, payloadSectorSize)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	return head, payloadCipher.streamFunc(false, 0), payloadCipher.SectorSize(), nil
+}
+
+// FormatV2 prepares to encrypt data using one or more passwords and the
+// specified cipher (or a default, if the specified cipher is "").
+//
+// Returns a fixed LUKSv2 header which contains keying information, and a
+// SectorCipher which will encrypt the payload, starting with sector 0.
+func FormatV2(password []string, cipher string, payloadSectorSize int) ([]byte, *SectorCipher, error) {
+	head, volume, err := FormatV2WithOptions(password, FormatV2Options{Cipher: cipher, SectorSize: payloadSectorSize})
+	if err != nil {
+		return nil, nil, err
+	}
+	return head, volume.Cipher, nil
+}
+
+// EncryptWriter returns an io.WriteCloser which encrypts the payload, which
+// is written to it, and writes it to w.  Close() returns an error if the
+// payload didn't fill all of the segments that have a fixed size.
+func (v *Volume) EncryptWriter(w io.WriterAt, options StreamOptions) io.WriteCloser {
+	segments := v.Segments
+	if segments == nil {
+		segments = []VolumeSegment{{Cipher: v.Cipher, FirstSector: v.FirstSector, Offset: v.PayloadOffset, Size: v.PayloadSize}}
+	}
+	return &segmentsWriter{w: w, segments: segments, options: options, plaintextSize: v.PlaintextSize}
+}
+
+// segmentsWriter writes to each of a list of segments in turn, encrypting
+// data written to them if they're encrypted.  A segment with a negative size
+// accepts everything that's written to it.  If plaintextSize is set, exactly
+// that much has to be written, and the rest of the last sector is padded.
+type segmentsWriter struct {
+	w             io.WriterAt
+	segments      []VolumeSegment
+	options       StreamOptions
+	current       io.WriteCloser
+	remaining     int64
+	written       int64
+	plaintextSize int64
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (s *segmentsWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.current == nil {
+			if len(s.segments) == 0 {
+				return written, errors.New("payload is larger than the volume's segments")
+			}
+			segment := s.segments[0]
+			s.segments = s.segments[1:]
+			writer := io.NewOffsetWriter(s.w, segment.Offset)
+			if segment.Cipher != nil {
+				s.current = segment.Cipher.EncryptWriter(writer, segment.FirstSector, s.options)
+			} else {
+				s.current = nopWriteCloser{writer}
+			}
+			s.remaining = segment.Size
+		}
+		chunk := p
+		if s.remaining >= 0 && int64(len(chunk)) > s.remaining {
+			chunk = chunk[:s.remaining]
+		}
+		n, err := s.current.Write(chunk)
+		written += n
+		s.written += int64(n)
+		p = p[n:]
+		if s.remaining >= 0 {
+			s.remaining -= int64(n)
+		}
+		if err != nil {
+			return written, err
+		}
+		if s.remaining == 0 {
+			err := s.current.Close()
+			s.current = nil
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *segmentsWriter) Close() error {
+	var err error
+	if s.current != nil {
+		err = s.current.Close()
+		s.current = nil
+		if err == nil && s.remaining > 0 && s.plaintextSize == 0 {
+			err = fmt.Errorf("payload is %d bytes too short to fill the volume's segments", s.remaining)
+		}
+	}
+	if err == nil && s.plaintextSize > 0 && s.written != s.plaintextSize {
+		err = fmt.Errorf("payload is %d bytes long, but the volume records its length as %d bytes", s.written, s.plaintextSize)
+	}
+	for _, segment := range s.segments {
+		if err == nil && segment.Size > 0 {
+			err = errors.New("payload is too short to fill all of the volume's segments")
+		}
+	}
+	s.segments = nil
+	return err
+}
+
+// FormatV2Options controls how FormatV2WithOptions() lays out a LUKSv2
+// volume.
+type FormatV2Options struct {
+	// Cipher is the cipher to encrypt the payload with.  If "",
+	// "aes-xts-plain64" is used.
+	Cipher string
+	// SectorSize is the payload's sector size.  If 0, V2SectorSize is used.
+	SectorSize int
+	// Segments are the parts that the payload is made up of, in order.  If
+	// none are specified, the payload is a single encrypted segment which
+	// runs to the end of the file.
+	Segments []FormatV2Segment
+	// KeyslotCipher is the cipher which protects the master key in each
+	// key slot.  If "", the payload's cipher is used.
+	KeyslotCipher string
+	// KeyslotKeySize is the size, in bytes, of the key which is derived
+	// from a password to decrypt a key slot.  If 0, and KeyslotCipher is
+	// not set, the size of the master key is used.  If 0, and
+	// KeyslotCipher is set, 64 is used for XTS mode, and 32 otherwise.
+	KeyslotKeySize int
+	// Hash is the hash algorithm used when computing the master key's
+	// digest and splitting the master key into stripes.  If "", "sha256"
+	// is used.  The headers' checksums always use "sha256".
+	Hash string
+	// MetadataSize is the size of each copy of the header, including its
+	// JSON area.  If 0, the smallest size which can hold the JSON metadata
+	// is used.
+	MetadataSize int
+	// KeyslotsSize is the size of the key slots area, which must be a
+	// multiple of V2AlignKeyslots.  If 0, and PayloadOffset is set, the
+	// key slots area fills the space between the headers and the payload,
+	// up to a maximum of 128 MiB.  Otherwise, it leaves room for 64 key
+	// slots.
+	KeyslotsSize int
+	// Stripes is the number of anti-forensic stripes that the master key
+	// is split into in each key slot.  If 0, V2Stripes is used.  Other
+	// implementations may not accept other values.
+	Stripes int
+	// PayloadAlignment, if set, is a value, in bytes, which the
+	// payload's offset is rounded up to a multiple of.  It must be a
+	// multiple of the sector size.
+	PayloadAlignment int64
+	// PayloadOffset, if set, is the offset of the payload, in bytes.  It
+	// must be a multiple of the sector size, large enough to leave room
+	// for the headers and key slots before it, and it can not be combined
+	// with PayloadAlignment.
+	PayloadOffset int64
+	// PlaintextSize, if set, is the exact length of the plaintext, which
+	// doesn't need to be a multiple of the sector size.  The payload is
+	// a single segment, just large enough to hold it, and a token which
+	// records it is added, so that it can be decrypted to exactly the
+	// same length.  It can not be combined with Segments.
+	PlaintextSize int64
+}
+
+// v2MaxKeyslotsSize is the largest key slots area that cryptsetup accepts.
+const v2MaxKeyslotsSize = 128 * 1024 * 1024
+
+// FormatV2Segment describes one of the parts that a payload is made up of.
+type FormatV2Segment struct {
+	// Size is the size of the segment, which must be a multiple of the
+	// sector size.  If 0, the segment runs to the end of the file, and it
+	// must be the last segment.
+	Size int64
+	// Linear indicates that the segment is stored without being
+	// encrypted.
+	Linear bool
+}
+
+// FormatV2WithOptions prepares to encrypt data using one or more passwords,
+// laying out the volume as specified by options.  Each segment of the
+// payload immediately follows the one before it.
+//
+// Returns a fixed LUKSv2 header which contains keying information, and a
+// Volume which describes the payload, which immediately follows the header.
+// The size of a segment which runs to the end of the file is given as -1.
+func FormatV2WithOptions(password []string, options FormatV2Options) ([]byte, *Volume, error) {
 	if len(password) == 0 {
-		return nil, nil, -1, errors.New("at least one password is required")
+		return nil, nil, errors.New("at least one password is required")
 	}
+	cipher := options.Cipher
 	if cipher == "" {
 		cipher = "aes-xts-plain64"
 	}
 	cipherSpec := strings.SplitN(cipher, "-", 3)
 	if len(cipherSpec) != 3 || len(cipherSpec[0]) == 0 || len(cipherSpec[1]) == 0 || len(cipherSpec[2]) == 0 {
-		return nil, nil, -1, fmt.Errorf("invalid cipher %q", cipher)
+		return nil, nil, fmt.Errorf("invalid cipher %q", cipher)
 	}
+	payloadSectorSize := options.SectorSize
 	if payloadSectorSize == 0 {
 		payloadSectorSize = V2SectorSize
 	}
 	switch payloadSectorSize {
 	default:
-		return nil, nil, -1, fmt.Errorf("invalid sector size %d", payloadSectorSize)
+		return nil, nil, fmt.Errorf("invalid sector size %d", payloadSectorSize)
 	case 512, 1024, 2048, 4096:
 	}
+	segmentSpecs := options.Segments
+	switch {
+	case options.PlaintextSize < 0:
+		return nil, nil, fmt.Errorf("invalid plaintext size %d", options.PlaintextSize)
+	case options.PlaintextSize > 0 && len(segmentSpecs) != 0:
+		return nil, nil, errors.New("a plaintext size can not be combined with a list of segments")
+	case options.PlaintextSize > 0:
+		segmentSpecs = []FormatV2Segment{{Size: roundUpToMultiple64(options.PlaintextSize, int64(payloadSectorSize))}}
+	case len(segmentSpecs) == 0:
+		segmentSpecs = []FormatV2Segment{{}}
+	}
+	encryptedSegments := 0
+	for i, spec := range segmentSpecs {
+		switch {
+		case spec.Size < 0 || spec.Size%int64(payloadSectorSize) != 0:
+			return nil, nil, fmt.Errorf("segment %d: size %d is not a multiple of the sector size %d", i, spec.Size, payloadSectorSize)
+		case spec.Size == 0 && i != len(segmentSpecs)-1:
+			return nil, nil, fmt.Errorf("segment %d: only the last segment can run to the end of the file", i)
+		}
+		if !spec.Linear {
+			encryptedSegments++
+		}
+	}
+	if encryptedSegments == 0 {
+		return nil, nil, errors.New("at least one segment must be encrypted")
+	}
+	headerSizes := v2HeaderSizes
+	if options.MetadataSize != 0 {
+		if options.MetadataSize < 0 || !validV2HeaderSize(uint64(options.MetadataSize)) {
+			return nil, nil, fmt.Errorf("invalid metadata size %d", options.MetadataSize)
+		}
+		headerSizes = []uint64{uint64(options.MetadataSize)}
+	}
+	if options.KeyslotsSize < 0 || options.KeyslotsSize%V2AlignKeyslots != 0 || options.KeyslotsSize > v2MaxKeyslotsSize {
+		return nil, nil, fmt.Errorf("invalid key slots area size %d", options.KeyslotsSize)
+	}
+	afStripes := options.Stripes
+	if afStripes == 0 {
+		afStripes = V2Stripes
+	}
+	if afStripes < 0 {
+		return nil, nil, fmt.Errorf("invalid number of stripes %d", afStripes)
+	}
+	if err := checkPayloadPlacement(options.PayloadAlignment, options.PayloadOffset, payloadSectorSize); err != nil {
+		return nil, nil, err
+	}
+	hashSpec := options.Hash
+	if hashSpec == "" {
+		hashSpec = "sha256"
+	}
+	hasher, err := hasherByName(hashSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mkey := make([]byte, 32)
+	if cipherSpec[1] == "xts" {
+		mkey = make([]byte, 64)
+	}
+	keyslotCipher := options.KeyslotCipher
+	keyslotKeySize := options.KeyslotKeySize
+	if keyslotCipher == "" {
+		keyslotCipher = cipher
+		if keyslotKeySize == 0 {
+			keyslotKeySize = len(mkey)
+		}
+	}
+	if keyslotKeySize == 0 {
+		keyslotKeySize = 32
+		if keyslotCipherSpec := strings.SplitN(keyslotCipher, "-", 3); len(keyslotCipherSpec) > 1 && keyslotCipherSpec[1] == "xts" {
+			keyslotKeySize = 64
+		}
+	}
+	if keyslotKeySize < 0 {
+		return nil, nil, fmt.Errorf("invalid key slot key size %d", keyslotKeySize)
+	}
+	if _, err := NewSectorCipher(keyslotCipher, make([]byte, keyslotKeySize), V1SectorSize); err != nil {
+		return nil, nil, fmt.Errorf("key slot cipher %q with a %d-byte key: %w", keyslotCipher, keyslotKeySize, err)
+	}
 
 	headerSalts := make([]byte, v1SaltSize*3)
 	n, err := rand.Read(headerSalts)
 	if err != nil {
-		return nil, nil, -1, err
+		return nil, nil, err
 	}
 	if n != len(headerSalts) {
-		return nil, nil, -1, errors.New("short read")
+		return nil, nil, errors.New("short read")
 	}
 	hSalt1 := headerSalts[:v1SaltSize]
 	hSalt2 := headerSalts[v1SaltSize : v1SaltSize*2]
 	mkeySalt := headerSalts[v1SaltSize*2:]
 
-	roundHeaderSize := func(size int) (int, error) {
-		switch {
-		case size < 0x4000:
-			return 0x4000, nil
-		case size < 0x8000:
-			return 0x8000, nil
-		case size < 0x10000:
-			return 0x10000, nil
-		case size < 0x20000:
-			return 0x20000, nil
-		case size < 0x40000:
-			return 0x40000, nil
-		case size < 0x80000:
-			return 0x80000, nil
-		case size < 0x100000:
-			return 0x100000, nil
-		case size < 0x200000:
-			return 0x200000, nil
-		case size < 0x400000:
-			return 0x400000, nil
-		}
-		return 0, fmt.Errorf("internal error: unsupported header size %d", size)
-	}
-
 	var h1, h2 V2Header
 	if err := h1.SetMagic(V2Magic1); err != nil {
-		return nil, nil, -1, fmt.Errorf("setting magic to v2: %w", err)
+		return nil, nil, fmt.Errorf("setting magic to v2: %w", err)
 	}
 	if err := h2.SetMagic(V2Magic2); err != nil {
-		return nil, nil, -1, fmt.Errorf("setting magic to v2: %w", err)
+		return nil, nil, fmt.Errorf("setting magic to v2: %w", err)
 	}
 	if err := h1.SetVersion(2); err != nil {
-		return nil, nil, -1, fmt.Errorf("setting version to 2: %w", err)
+		return nil, nil, fmt.Errorf("setting version to 2: %w", err)
 	}
 	if err := h2.SetVersion(2); err != nil {
-		return nil, nil, -1, fmt.Errorf("setting version to 2: %w", err)
+		return nil, nil, fmt.Errorf("setting version to 2: %w", err)
 	}
-	h1.SetSequenceID(1)
-	h2.SetSequenceID(1)
+	h1.SetSequenceID(0) // incremented when the headers are written
+	h2.SetSequenceID(0)
 	h1.SetLabel("")
 	h2.SetLabel("")
 	h1.SetChecksumAlgorithm("sha256")
@@ -228,39 +578,30 @@ func EncryptV2(password []string, cipher string, payloadSectorSize int) ([]byte,
 	h1.SetChecksum(nil)
 	h2.SetChecksum(nil)
 
-	mkey := make([]byte, 32)
-	if cipherSpec[1] == "xts" {
-		mkey = make([]byte, 64)
-	}
 	n, err = rand.Read(mkey)
 	if err != nil {
-		return nil, nil, -1, fmt.Errorf("reading random data: %w", err)
+		return nil, nil, fmt.Errorf("reading random data: %w", err)
 	}
 	if n != len(mkey) {
-		return nil, nil, -1, errors.New("short read")
+		return nil, nil, errors.New("short read")
 	}
 
 	tuningSalt := make([]byte, v1SaltSize)
-	hasher, err := hasherByName(h1.ChecksumAlgorithm())
-	if err != nil {
-		return nil, nil, -1, errors.New("internal error")
-	}
-	iterations := IterationsPBKDF2(tuningSalt, len(mkey), hasher)
+	iterations := digestIterationsPBKDF2(tuningSalt, len(mkey), hasher)
 	timeCost := 16
 	threadsCost := 16
-	memoryCost := MemoryCostArgon2(tuningSalt, len(mkey), timeCost, threadsCost)
+	memoryCost := MemoryCostArgon2(tuningSalt, keyslotKeySize, timeCost, threadsCost)
 	priority := V2JSONKeyslotPriorityNormal
 	var stripes [][]byte
 	var keyslots []V2JSONKeyslot
 
 	mdigest := pbkdf2.Key(mkey, mkeySalt, iterations, len(hasher().Sum([]byte{})), hasher)
 	digest0 := V2JSONDigest{
-		Type:     "pbkdf2",
-		Salt:     mkeySalt,
-		Digest:   mdigest,
-		Segments: []string{"0"},
+		Type:   "pbkdf2",
+		Salt:   mkeySalt,
+		Digest: mdigest,
 		V2JSONDigestPbkdf2: &V2JSONDigestPbkdf2{
-			Hash:       h1.ChecksumAlgorithm(),
+			Hash:       hashSpec,
 			Iterations: iterations,
 		},
 	}
@@ -269,19 +610,19 @@ func EncryptV2(password []string, cipher string, payloadSectorSize int) ([]byte,
 		keyslotSalt := make([]byte, v1SaltSize)
 		n, err := rand.Read(keyslotSalt)
 		if err != nil {
-			return nil, nil, -1, err
+			return nil, nil, err
 		}
 		if n != len(keyslotSalt) {
-			return nil, nil, -1, errors.New("short read")
+			return nil, nil, errors.New("short read")
 		}
-		key := argon2.Key([]byte(password[i]), keyslotSalt, uint32(timeCost), uint32(memoryCost), uint8(threadsCost), uint32(len(mkey)))
-		split, err := afSplit(mkey, hasher(), V2Stripes)
+		key := argon2.Key([]byte(password[i]), keyslotSalt, uint32(timeCost), uint32(memoryCost), uint8(threadsCost), uint32(keyslotKeySize))
+		split, err := afSplit(mkey, hasher(), afStripes)
 		if err != nil {
-			return nil, nil, -1, fmt.Errorf("splitting: %w", err)
+			return nil, nil, fmt.Errorf("splitting: %w", err)
 		}
-		striped, err := v2encrypt(cipher, 0, key, split, V1SectorSize, false)
+		striped, err := v2encrypt(keyslotCipher, 0, key, split, V1SectorSize, false)
 		if err != nil {
-			return nil, nil, -1, fmt.Errorf("encrypting: %w", err)
+			return nil, nil, fmt.Errorf("encrypting: %w", err)
 		}
 		stripes = append(stripes, striped)
 		keyslot := V2JSONKeyslot{
@@ -292,7 +633,7 @@ func EncryptV2(password []string, cipher string, payloadSectorSize int) ([]byte,
 				Offset: 10000000, // gets updated later
 				Size:   int64(roundUpToMultiple(len(striped), V2AlignKeyslots)),
 				V2JSONAreaRaw: &V2JSONAreaRaw{
-					Encryption: cipher,
+					Encryption: keyslotCipher,
 					KeySize:    len(key),
 				},
 			},
@@ -301,8 +642,8 @@ func EncryptV2(password []string, cipher string, payloadSectorSize int) ([]byte,
 				AF: V2JSONAF{
 					Type: "luks1",
 					V2JSONAFLUKS1: &V2JSONAFLUKS1{
-						Stripes: V2Stripes,
-						Hash:    h1.ChecksumAlgorithm(),
+						Stripes: afStripes,
+						Hash:    hashSpec,
 					},
 				},
 				Kdf: V2JSONKdf{
@@ -320,102 +661,131 @@ func EncryptV2(password []string, cipher string, payloadSectorSize int) ([]byte,
 		digest0.Keyslots = append(digest0.Keyslots, strconv.Itoa(i))
 	}
 
-	segment0 := V2JSONSegment{
-		Type:   "crypt",
-		Offset: "10000000", // gets updated later
-		Size:   "dynamic",
-		V2JSONSegmentCrypt: &V2JSONSegmentCrypt{
-			IVTweak:    0,
-			Encryption: cipher,
-			SectorSize: payloadSectorSize,
-		},
+	// the segments' offsets get updated later, when we know how large
+	// the headers are
+	segments := make([]V2JSONSegment, len(segmentSpecs))
+	logicalOffset := int64(0)
+	for i, spec := range segmentSpecs {
+		size := "dynamic"
+		if spec.Size != 0 {
+			size = strconv.FormatInt(spec.Size, 10)
+		}
+		segments[i] = V2JSONSegment{
+			Type: "linear",
+			Size: size,
+		}
+		if !spec.Linear {
+			segments[i].Type = "crypt"
+			segments[i].V2JSONSegmentCrypt = &V2JSONSegmentCrypt{
+				IVTweak:    int(logicalOffset / V1SectorSize),
+				Encryption: cipher,
+				SectorSize: payloadSectorSize,
+			}
+			digest0.Segments = append(digest0.Segments, strconv.Itoa(i))
+		}
+		logicalOffset += spec.Size
 	}
 
 	j := V2JSON{
 		Config:   V2JSONConfig{},
 		Keyslots: map[string]V2JSONKeyslot{},
-		Digests:  map[string]V2JSONDigest{},
+		Digests:  map[string]V2JSONDigest{"0": digest0},
 		Segments: map[string]V2JSONSegment{},
 		Tokens:   map[string]V2JSONToken{},
 	}
-rebuild:
-	j.Digests["0"] = digest0
-	j.Segments["0"] = segment0
-	encodedJSON, err := json.Marshal(j)
-	if err != nil {
-		return nil, nil, -1, err
-	}
-	headerPlusPaddedJsonSize, err := roundHeaderSize(int(V2SectorSize) /* binary header */ + len(encodedJSON) + 1)
-	if err != nil {
-		return nil, nil, -1, err
-	}
-	if j.Config.JsonSize != headerPlusPaddedJsonSize-V2SectorSize {
-		j.Config.JsonSize = headerPlusPaddedJsonSize - V2SectorSize
-		goto rebuild
+	if options.PlaintextSize > 0 {
+		j.Tokens["0"] = newPlaintextSizeToken(options.PlaintextSize)
 	}
+	keyslotSize := roundUpToMultiple(len(mkey)*afStripes, V2AlignKeyslots)
+	neededKeyslotsSize := keyslotSize * len(password)
 
-	if h1.HeaderSize() != uint64(headerPlusPaddedJsonSize) {
-		h1.SetHeaderSize(uint64(headerPlusPaddedJsonSize))
-		h2.SetHeaderSize(uint64(headerPlusPaddedJsonSize))
-		h1.SetHeaderOffset(0)
-		h2.SetHeaderOffset(uint64(headerPlusPaddedJsonSize))
-		goto rebuild
+	// the key slots area follows the secondary header, so its location
+	// depends on how large the headers need to be to hold the JSON
+	// metadata which describes it, and the payload follows the key slots
+	var head []byte
+	for _, headerSize := range headerSizes {
+		h1.SetHeaderSize(headerSize)
+		h2.SetHeaderSize(headerSize)
+		keyslotsOffset := int64(headerSize) * 2
+		j.Config.KeyslotsSize = options.KeyslotsSize
+		if j.Config.KeyslotsSize == 0 {
+			if options.PayloadOffset != 0 {
+				available := options.PayloadOffset - keyslotsOffset
+				if available > v2MaxKeyslotsSize {
+					available = v2MaxKeyslotsSize
+				}
+				if available > 0 {
+					j.Config.KeyslotsSize = int(available) / V2AlignKeyslots * V2AlignKeyslots
+				}
+			} else {
+				j.Config.KeyslotsSize = keyslotSize * 64
+				if j.Config.KeyslotsSize < neededKeyslotsSize {
+					j.Config.KeyslotsSize = neededKeyslotsSize
+				}
+			}
+		}
+		if j.Config.KeyslotsSize < neededKeyslotsSize {
+			err = fmt.Errorf("key slots area size %d is too small for %d key slots of %d bytes", j.Config.KeyslotsSize, len(password), keyslotSize)
+			continue
+		}
+		for i := range keyslots {
+			keyslots[i].Area.Offset = keyslotsOffset + int64(keyslotSize)*int64(i)
+			j.Keyslots[strconv.Itoa(i)] = keyslots[i]
+		}
+		var segmentOffset int64
+		segmentOffset, err = placePayload(keyslotsOffset+int64(j.Config.KeyslotsSize), options.PayloadAlignment, options.PayloadOffset)
+		if err != nil {
+			return nil, nil, err
+		}
+		offset := segmentOffset
+		for i := range segments {
+			segments[i].Offset = strconv.FormatInt(offset, 10)
+			j.Segments[strconv.Itoa(i)] = segments[i]
+			offset += segmentSpecs[i].Size
+		}
+		head = make([]byte, segmentOffset)
+		err = WriteHeaders(byteWriterAt(head), &h1, &h2, &j)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrMetadataTooLarge) {
+			return nil, nil, err
+		}
 	}
-
-	keyslotsOffset := h2.HeaderOffset() * 2
-	maxKeys := len(password)
-	if maxKeys < 64 {
-		maxKeys = 64
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range keyslots {
+		copy(head[keyslots[i].Area.Offset:], stripes[i])
 	}
-	for i := 0; i < len(password); i++ {
-		oldOffset := keyslots[i].Area.Offset
-		keyslots[i].Area.Offset = int64(keyslotsOffset) + int64(roundUpToMultiple(len(mkey)*V2Stripes, V2AlignKeyslots))*int64(i)
-		j.Keyslots[strconv.Itoa(i)] = keyslots[i]
-		if keyslots[i].Area.Offset != oldOffset {
-			goto rebuild
+	payloadCipher, err := NewSectorCipher(cipher, mkey, payloadSectorSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing encryption: %w", err)
+	}
+	volume := &Volume{Keyslot: "0", PayloadOffset: int64(len(head)), PlaintextSize: options.PlaintextSize}
+	offset := int64(len(head))
+	for _, spec := range segmentSpecs {
+		segment := VolumeSegment{
+			Offset: offset,
+			Size:   spec.Size,
+		}
+		if spec.Size == 0 {
+			segment.Size = -1
+		}
+		if !spec.Linear {
+			segment.Cipher = payloadCipher
+			segment.FirstSector = uint64((offset - volume.PayloadOffset) / int64(payloadSectorSize))
 		}
+		volume.Segments = append(volume.Segments, segment)
+		offset += spec.Size
 	}
-	keyslotsSize := roundUpToMultiple(len(mkey)*V2Stripes, V2AlignKeyslots) * maxKeys
-	if j.Config.KeyslotsSize != keyslotsSize {
-		j.Config.KeyslotsSize = keyslotsSize
-		goto rebuild
+	volume.PayloadSize = offset - volume.PayloadOffset
+	if volume.Segments[len(volume.Segments)-1].Size < 0 {
+		volume.PayloadSize = -1
 	}
-
-	segmentOffsetInt := roundUpToMultiple(int(keyslotsOffset)+j.Config.KeyslotsSize, V2SectorSize)
-	segmentOffset := strconv.Itoa(segmentOffsetInt)
-	if segment0.Offset != segmentOffset {
-		segment0.Offset = segmentOffset
-		goto rebuild
+	if len(volume.Segments) == 1 {
+		volume.Cipher = payloadCipher
+		volume.Segments = nil
 	}
-
-	d1 := hasher()
-	h1.SetChecksum(nil)
-	d1.Write(h1[:])
-	d1.Write(encodedJSON)
-	zeropad := make([]byte, headerPlusPaddedJsonSize-len(h1)-len(encodedJSON))
-	d1.Write(zeropad)
-	h1.SetChecksum(d1.Sum(nil))
-	d2 := hasher()
-	h2.SetChecksum(nil)
-	d2.Write(h2[:])
-	d2.Write(encodedJSON)
-	d1.Write(zeropad)
-	h2.SetChecksum(d2.Sum(nil))
-
-	head := make([]byte, segmentOffsetInt)
-	copy(head, h1[:])
-	copy(head[V2SectorSize:], encodedJSON)
-	copy(head[h2.HeaderOffset():], h2[:])
-	copy(head[h2.HeaderOffset()+V2SectorSize:], encodedJSON)
-	for i := 0; i < len(password); i++ {
-		iAsString := strconv.Itoa(i)
-		copy(head[j.Keyslots[iAsString].Area.Offset:], stripes[i])
-	}
-	ivTweak := 0
-	encryptStream := func(plaintext []byte) ([]byte, error) {
-		ciphertext, err := v2encrypt(cipher, ivTweak, mkey, plaintext, payloadSectorSize, true)
-		ivTweak += len(plaintext) / payloadSectorSize
-		return ciphertext, err
-	}
-	return head, encryptStream, segment0.SectorSize, nil
+	return head, volume, nil
 }
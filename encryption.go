@@ -1,8 +1,6 @@
 package luksy
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -12,314 +10,32 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"runtime"
 	"strings"
+	"sync"
 
-	"github.com/aead/serpent"
-	"golang.org/x/crypto/cast5"
 	"golang.org/x/crypto/ripemd160"
-	"golang.org/x/crypto/twofish"
-	"golang.org/x/crypto/xts"
 )
 
 func v1encrypt(cipherName, cipherMode string, ivTweak int, key []byte, plaintext []byte, sectorSize int, bulk bool) ([]byte, error) {
-	var err error
-	var newBlockCipher func([]byte) (cipher.Block, error)
-	ciphertext := make([]byte, len(plaintext))
-
-	switch cipherName {
-	case "aes":
-		newBlockCipher = aes.NewCipher
-	case "twofish":
-		newBlockCipher = func(key []byte) (cipher.Block, error) { return twofish.NewCipher(key) }
-	case "cast5":
-		newBlockCipher = func(key []byte) (cipher.Block, error) { return cast5.NewCipher(key) }
-	case "serpent":
-		newBlockCipher = serpent.NewCipher
-	default:
-		return nil, fmt.Errorf("unsupported cipher %s", cipherName)
-	}
-	if sectorSize == 0 {
-		sectorSize = V1SectorSize
-	}
-	switch sectorSize {
-	default:
-		return nil, fmt.Errorf("invalid sector size %d", sectorSize)
-	case 512, 1024, 2048, 4096:
-	}
-
-	switch cipherMode {
-	case "ecb":
-		cipher, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += cipher.BlockSize() {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			cipher.Encrypt(ciphertext[processed:processed+blockLeft], plaintext[processed:processed+blockLeft])
-		}
-	case "cbc-plain":
-		block, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			ivValue := processed/sectorSize + ivTweak
-			if bulk { // iv_large_sectors is not being used
-				ivValue *= sectorSize / V1SectorSize
-			}
-			iv0 := make([]byte, block.BlockSize())
-			binary.LittleEndian.PutUint32(iv0, uint32(ivValue))
-			cipher := cipher.NewCBCEncrypter(block, iv0)
-			cipher.CryptBlocks(ciphertext[processed:processed+blockLeft], plaintext[processed:processed+blockLeft])
-		}
-	case "cbc-plain64":
-		block, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			ivValue := processed/sectorSize + ivTweak
-			if bulk { // iv_large_sectors is not being used
-				ivValue *= sectorSize / V1SectorSize
-			}
-			iv0 := make([]byte, block.BlockSize())
-			binary.LittleEndian.PutUint64(iv0, uint64(ivValue))
-			cipher := cipher.NewCBCEncrypter(block, iv0)
-			cipher.CryptBlocks(ciphertext[processed:processed+blockLeft], plaintext[processed:processed+blockLeft])
-		}
-	case "cbc-essiv:sha256":
-		hasherName := strings.TrimPrefix(cipherMode, "cbc-essiv:")
-		hasher, err := hasherByName(hasherName)
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption using hash %s: %w", hasherName, err)
-		}
-		h := hasher()
-		h.Write(key)
-		makeiv, err := newBlockCipher(h.Sum(nil))
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption: %w", err)
-		}
-		block, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			ivValue := (processed/sectorSize + ivTweak)
-			if bulk { // iv_large_sectors is not being used
-				ivValue *= sectorSize / V1SectorSize
-			}
-			plain0 := make([]byte, makeiv.BlockSize())
-			binary.LittleEndian.PutUint64(plain0, uint64(ivValue))
-			iv0 := make([]byte, makeiv.BlockSize())
-			makeiv.Encrypt(iv0, plain0)
-			cipher := cipher.NewCBCEncrypter(block, iv0)
-			cipher.CryptBlocks(ciphertext[processed:processed+blockLeft], plaintext[processed:processed+blockLeft])
-		}
-	case "xts-plain":
-		cipher, err := xts.NewCipher(newBlockCipher, key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			sector := uint64(processed/sectorSize + ivTweak)
-			if bulk { // iv_large_sectors is not being used
-				sector *= uint64(sectorSize / V1SectorSize)
-			}
-			sector = sector % 0x100000000
-			cipher.Encrypt(ciphertext[processed:processed+blockLeft], plaintext[processed:processed+blockLeft], sector)
-		}
-	case "xts-plain64":
-		cipher, err := xts.NewCipher(newBlockCipher, key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing encryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			sector := uint64(processed/sectorSize + ivTweak)
-			if bulk { // iv_large_sectors is not being used
-				sector *= uint64(sectorSize / V1SectorSize)
-			}
-			cipher.Encrypt(ciphertext[processed:processed+blockLeft], plaintext[processed:processed+blockLeft], sector)
-		}
-	default:
-		return nil, fmt.Errorf("unsupported cipher mode %s", cipherMode)
-	}
-
+	c, err := newSectorCipher(cipherName, cipherMode, key, sectorSize, bulk)
 	if err != nil {
+		return nil, fmt.Errorf("initializing encryption: %w", err)
+	}
+	ciphertext := make([]byte, len(plaintext))
+	if err := c.EncryptSectors(ciphertext, plaintext, uint64(ivTweak)); err != nil {
 		return nil, fmt.Errorf("cipher error: %w", err)
 	}
 	return ciphertext, nil
 }
 
 func v1decrypt(cipherName, cipherMode string, ivTweak int, key []byte, ciphertext []byte, sectorSize int, bulk bool) ([]byte, error) {
-	var err error
-	var newBlockCipher func([]byte) (cipher.Block, error)
-	plaintext := make([]byte, len(ciphertext))
-
-	switch cipherName {
-	case "aes":
-		newBlockCipher = aes.NewCipher
-	case "twofish":
-		newBlockCipher = func(key []byte) (cipher.Block, error) { return twofish.NewCipher(key) }
-	case "cast5":
-		newBlockCipher = func(key []byte) (cipher.Block, error) { return cast5.NewCipher(key) }
-	case "serpent":
-		newBlockCipher = serpent.NewCipher
-	default:
-		return nil, fmt.Errorf("unsupported cipher %s", cipherName)
-	}
-	if sectorSize == 0 {
-		sectorSize = V1SectorSize
-	}
-	switch sectorSize {
-	default:
-		return nil, fmt.Errorf("invalid sector size %d", sectorSize)
-	case 512, 1024, 2048, 4096:
-	}
-
-	switch cipherMode {
-	case "ecb":
-		cipher, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption: %w", err)
-		}
-		for processed := 0; processed < len(ciphertext); processed += cipher.BlockSize() {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(ciphertext) {
-				blockLeft = len(ciphertext) - processed
-			}
-			cipher.Decrypt(plaintext[processed:processed+blockLeft], ciphertext[processed:processed+blockLeft])
-		}
-	case "cbc-plain":
-		block, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			ivValue := processed/sectorSize + ivTweak
-			if bulk { // iv_large_sectors is not being used
-				ivValue *= sectorSize / V1SectorSize
-			}
-			iv0 := make([]byte, block.BlockSize())
-			binary.LittleEndian.PutUint32(iv0, uint32(ivValue))
-			cipher := cipher.NewCBCDecrypter(block, iv0)
-			cipher.CryptBlocks(plaintext[processed:processed+blockLeft], ciphertext[processed:processed+blockLeft])
-		}
-	case "cbc-plain64":
-		block, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			ivValue := processed/sectorSize + ivTweak
-			if bulk { // iv_large_sectors is not being used
-				ivValue *= sectorSize / V1SectorSize
-			}
-			iv0 := make([]byte, block.BlockSize())
-			binary.LittleEndian.PutUint64(iv0, uint64(ivValue))
-			cipher := cipher.NewCBCDecrypter(block, iv0)
-			cipher.CryptBlocks(plaintext[processed:processed+blockLeft], ciphertext[processed:processed+blockLeft])
-		}
-	case "cbc-essiv:sha256":
-		hasherName := strings.TrimPrefix(cipherMode, "cbc-essiv:")
-		hasher, err := hasherByName(hasherName)
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption using hash %s: %w", hasherName, err)
-		}
-		h := hasher()
-		h.Write(key)
-		makeiv, err := newBlockCipher(h.Sum(nil))
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption: %w", err)
-		}
-		block, err := newBlockCipher(key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption: %w", err)
-		}
-		for processed := 0; processed < len(plaintext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(plaintext) {
-				blockLeft = len(plaintext) - processed
-			}
-			ivValue := (processed/sectorSize + ivTweak)
-			if bulk { // iv_large_sectors is not being used
-				ivValue *= sectorSize / V1SectorSize
-			}
-			plain0 := make([]byte, makeiv.BlockSize())
-			binary.LittleEndian.PutUint64(plain0, uint64(ivValue))
-			iv0 := make([]byte, makeiv.BlockSize())
-			makeiv.Encrypt(iv0, plain0)
-			cipher := cipher.NewCBCDecrypter(block, iv0)
-			cipher.CryptBlocks(plaintext[processed:processed+blockLeft], ciphertext[processed:processed+blockLeft])
-		}
-	case "xts-plain":
-		cipher, err := xts.NewCipher(newBlockCipher, key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption: %w", err)
-		}
-		for processed := 0; processed < len(ciphertext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(ciphertext) {
-				blockLeft = len(ciphertext) - processed
-			}
-			sector := uint64(processed/sectorSize + ivTweak)
-			if bulk { // iv_large_sectors is not being used
-				sector *= uint64(sectorSize / V1SectorSize)
-			}
-			sector = sector % 0x100000000
-			cipher.Decrypt(plaintext[processed:processed+blockLeft], ciphertext[processed:processed+blockLeft], sector)
-		}
-	case "xts-plain64":
-		cipher, err := xts.NewCipher(newBlockCipher, key)
-		if err != nil {
-			return nil, fmt.Errorf("initializing decryption: %w", err)
-		}
-		for processed := 0; processed < len(ciphertext); processed += sectorSize {
-			blockLeft := sectorSize
-			if processed+blockLeft > len(ciphertext) {
-				blockLeft = len(ciphertext) - processed
-			}
-			sector := uint64(processed/sectorSize + ivTweak)
-			if bulk { // iv_large_sectors is not being used
-				sector *= uint64(sectorSize / V1SectorSize)
-			}
-			cipher.Decrypt(plaintext[processed:processed+blockLeft], ciphertext[processed:processed+blockLeft], sector)
-		}
-	default:
-		return nil, fmt.Errorf("unsupported cipher mode %s", cipherMode)
-	}
-
+	c, err := newSectorCipher(cipherName, cipherMode, key, sectorSize, bulk)
 	if err != nil {
+		return nil, fmt.Errorf("initializing decryption: %w", err)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	if err := c.DecryptSectors(plaintext, ciphertext, uint64(ivTweak)); err != nil {
 		return nil, fmt.Errorf("cipher error: %w", err)
 	}
 	return plaintext, nil
@@ -331,7 +47,7 @@ func v2encrypt(cipherSuite string, ivTweak int, key []byte, ciphertext []byte, s
 	default:
 		cipherSpec := strings.SplitN(cipherSuite, "-", 2)
 		if len(cipherSpec) < 2 {
-			return nil, fmt.Errorf("unrecognized cipher suite %q", cipherSuite)
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, cipherSuite)
 		}
 		cipherName = cipherSpec[0]
 		cipherMode = cipherSpec[1]
@@ -345,7 +61,7 @@ func v2decrypt(cipherSuite string, ivTweak int, key []byte, ciphertext []byte, s
 	default:
 		cipherSpec := strings.SplitN(cipherSuite, "-", 2)
 		if len(cipherSpec) < 2 {
-			return nil, fmt.Errorf("unrecognized cipher suite %q", cipherSuite)
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, cipherSuite)
 		}
 		cipherName = cipherSpec[0]
 		cipherMode = cipherSpec[1]
@@ -448,105 +164,401 @@ func hasherByName(name string) (func() hash.Hash, error) {
 	}
 }
 
+// StreamOptions controls how the readers and writers returned by
+// EncryptWriterWithOptions, DecryptReaderWithOptions, and the SectorCipher
+// EncryptWriter and DecryptReader methods process data.
+type StreamOptions struct {
+	// BufferSize is the size of each buffer that data is read into,
+	// transformed in, and written from.  It is rounded up to a multiple of
+	// the block size.  If 0, 1 MiB is used.
+	BufferSize int
+	// Workers is the number of goroutines that transform buffers
+	// concurrently.  If 0, one per CPU is used, up to 8.  Streams built
+	// around a function which processes blocks in succession always use 1.
+	// Each stream allocates Workers+2 buffers, so by default, a stream
+	// can use up to 10 MiB of memory.
+	Workers int
+	// detachReads causes Close() to return without waiting for a read
+	// from the underlying reader which is already in progress, which
+	// might not finish for a long time if it's reading from a pipe.
+	detachReads bool
+}
+
+// defaultMaxWorkers is the most goroutines that a stream uses to transform
+// buffers if it isn't told how many to use.  Beyond this, there isn't much
+// to be gained, and the buffers add up.
+const defaultMaxWorkers = 8
+
+// wrapperBuffer is a buffer's worth of data which is making its way through
+// a wrapper's pipeline.  They're allocated once, and then recycled.
+type wrapperBuffer struct {
+	buf        []byte // the entire buffer
+	data       []byte // the part of buf which holds data
+	firstBlock uint64
+	err        error
+	done       chan struct{} // signaled when the data has been transformed
+}
+
+// wrapper reads or writes data in a pipeline: one goroutine reads (or
+// writes), up to "workers" goroutines transform buffers in place, and buffers
+// are handed back in the order in which they were read (or written).
 type wrapper struct {
-	fn        func(plaintext []byte) ([]byte, error)
-	blockSize int
-	buf       []byte
-	buffered  int
-	processed int
-	reader    io.Reader
-	eof       bool
-	writer    io.Writer
-}
-
-func (w *wrapper) partialWrite() error {
-	if w.buffered-w.processed >= w.blockSize {
-		toProcess := roundDownToMultiple(w.buffered-w.processed, w.blockSize)
-		processed, err := w.fn(w.buf[w.processed : w.processed+toProcess])
+	transform  func(buf []byte, firstBlock uint64) error
+	blockSize  int
+	bufferSize int
+	workers    int
+	reader     io.Reader
+	writer     io.Writer
+	detach     bool
+
+	started   bool
+	closed    bool
+	free      chan *wrapperBuffer
+	jobs      chan *wrapperBuffer
+	ordered   chan *wrapperBuffer
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	current   *wrapperBuffer
+	consumed  int
+	nextBlock uint64
+	err       error
+	writeLock sync.Mutex
+	writeErr  error
+	readLock  sync.Mutex
+	reading   bool // fill is reading from reader
+	stopped   bool // fill should not start another read
+}
+
+func newWrapper(transform func([]byte, uint64) error, blockSize int, options StreamOptions) *wrapper {
+	bufferSize := options.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 1024 * 1024
+	}
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+		if workers > defaultMaxWorkers {
+			workers = defaultMaxWorkers
+		}
+	}
+	return &wrapper{
+		transform:  transform,
+		blockSize:  blockSize,
+		bufferSize: roundUpToMultiple(bufferSize, blockSize),
+		workers:    workers,
+		detach:     options.detachReads,
+	}
+}
+
+// sequentialTransform adapts a function which processes blocks in
+// succession, and which therefore can only be called from one goroutine at a
+// time, into something that a wrapper can use.
+func sequentialTransform(fn func([]byte) ([]byte, error)) func([]byte, uint64) error {
+	return func(buf []byte, _ uint64) error {
+		processed, err := fn(buf)
 		if err != nil {
 			return err
 		}
-		nProcessed := copy(w.buf[w.processed:], processed)
-		w.processed += nProcessed
+		if len(processed) != len(buf) {
+			return fmt.Errorf("internal error: transformed %d bytes into %d bytes", len(buf), len(processed))
+		}
+		copy(buf, processed)
+		return nil
 	}
-	if w.processed >= w.blockSize {
-		nWritten, err := w.writer.Write(w.buf[:w.processed])
+}
+
+func (w *wrapper) start() {
+	w.started = true
+	buffers := w.workers + 2
+	w.free = make(chan *wrapperBuffer, buffers)
+	for i := 0; i < buffers; i++ {
+		w.free <- &wrapperBuffer{
+			buf:  make([]byte, w.bufferSize),
+			done: make(chan struct{}, 1),
+		}
+	}
+	w.jobs = make(chan *wrapperBuffer, buffers)
+	w.ordered = make(chan *wrapperBuffer, buffers+1) // leave room for an error
+	w.stop = make(chan struct{})
+	for i := 0; i < w.workers; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	w.wg.Add(1)
+	if w.reader != nil {
+		go w.fill()
+	} else {
+		go w.drain()
+	}
+}
+
+// work transforms buffers until there are no more of them.
+func (w *wrapper) work() {
+	defer w.wg.Done()
+	for job := range w.jobs {
+		job.err = w.transform(job.data, job.firstBlock)
+		job.done <- struct{}{}
+	}
+}
+
+// submit queues a buffer for transformation, and for handing off in order
+// once it's been transformed.
+func (w *wrapper) submit(job *wrapperBuffer, n int) {
+	job.data = job.buf[:n]
+	job.firstBlock = w.nextBlock
+	job.err = nil
+	w.nextBlock += uint64(n / w.blockSize)
+	w.jobs <- job
+	w.ordered <- job
+}
+
+// fill reads data into buffers and queues them for transformation until it
+// runs out of data or is told to stop.
+func (w *wrapper) fill() {
+	defer w.wg.Done()
+	defer close(w.ordered)
+	defer close(w.jobs)
+	for {
+		var job *wrapperBuffer
+		select {
+		case job = <-w.free:
+		case <-w.stop:
+			return
+		}
+		w.readLock.Lock()
+		stopped := w.stopped
+		w.reading = !stopped
+		w.readLock.Unlock()
+		if stopped {
+			return
+		}
+		n, err := io.ReadFull(w.reader, job.buf)
+		w.readLock.Lock()
+		w.reading = false
+		w.readLock.Unlock()
+		n = roundDownToMultiple(n, w.blockSize)
+		if n > 0 {
+			w.submit(job, n)
+		}
 		if err != nil {
-			return err
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				failed := &wrapperBuffer{err: err, done: make(chan struct{}, 1)}
+				failed.done <- struct{}{}
+				w.ordered <- failed
+			}
+			return
 		}
-		copy(w.buf, w.buf[nWritten:w.buffered])
-		w.buffered -= nWritten
-		w.processed -= nWritten
-		if w.processed != 0 {
-			return fmt.Errorf("short write: %d != %d", nWritten, nWritten+w.processed)
+	}
+}
+
+// drain writes transformed buffers in order, and returns them to the free
+// list.
+func (w *wrapper) drain() {
+	defer w.wg.Done()
+	for job := range w.ordered {
+		<-job.done
+		if err := w.writeError(); err == nil {
+			err = job.err
+			if err == nil {
+				var nWritten int
+				nWritten, err = w.writer.Write(job.data)
+				if err == nil && nWritten != len(job.data) {
+					err = fmt.Errorf("short write: %d != %d", nWritten, len(job.data))
+				}
+			}
+			if err != nil {
+				w.writeLock.Lock()
+				w.writeErr = err
+				w.writeLock.Unlock()
+			}
 		}
+		w.free <- job
+	}
+}
+
+func (w *wrapper) writeError() error {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+	return w.writeErr
+}
+
+// nextWriteBuffer returns the buffer that we're filling, getting a new one
+// from the free list if we need one.
+func (w *wrapper) nextWriteBuffer() (*wrapperBuffer, error) {
+	if w.closed || w.writer == nil {
+		return nil, errors.New("write to closed or read-only stream")
+	}
+	if !w.started {
+		w.start()
+	}
+	if err := w.writeError(); err != nil {
+		return nil, err
+	}
+	if w.current == nil {
+		w.current = <-w.free
+		w.consumed = 0
+	}
+	return w.current, nil
+}
+
+// filledWriteBuffer submits the buffer we're filling if it's full.
+func (w *wrapper) filledWriteBuffer() {
+	if w.consumed == len(w.current.buf) {
+		w.submit(w.current, w.consumed)
+		w.current = nil
 	}
-	return nil
 }
 
 func (w *wrapper) Write(buf []byte) (int, error) {
 	n := 0
 	for n < len(buf) {
-		nBuffered := copy(w.buf[w.buffered:], buf[n:])
-		w.buffered += nBuffered
-		n += nBuffered
-		if err := w.partialWrite(); err != nil {
+		current, err := w.nextWriteBuffer()
+		if err != nil {
 			return n, err
 		}
+		nBuffered := copy(current.buf[w.consumed:], buf[n:])
+		w.consumed += nBuffered
+		n += nBuffered
+		w.filledWriteBuffer()
 	}
 	return n, nil
 }
 
+// ReadFrom reads data directly into our buffers, saving io.Copy() from
+// having to copy it through a buffer of its own.
+func (w *wrapper) ReadFrom(reader io.Reader) (int64, error) {
+	var n int64
+	for {
+		current, err := w.nextWriteBuffer()
+		if err != nil {
+			return n, err
+		}
+		nRead, err := io.ReadFull(reader, current.buf[w.consumed:])
+		w.consumed += nRead
+		n += int64(nRead)
+		w.filledWriteBuffer()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+}
+
+// nextReadBuffer returns the buffer that we're returning data from, waiting
+// for the next one in line if we need to.
+func (w *wrapper) nextReadBuffer() (*wrapperBuffer, error) {
+	if w.closed || w.reader == nil {
+		return nil, errors.New("read from closed or write-only stream")
+	}
+	if !w.started {
+		w.start()
+	}
+	if w.current == nil && w.err == nil {
+		job, ok := <-w.ordered
+		if !ok {
+			w.err = io.EOF
+			return nil, w.err
+		}
+		<-job.done
+		if job.err != nil {
+			w.err = job.err
+			return nil, w.err
+		}
+		w.current = job
+		w.consumed = 0
+	}
+	return w.current, w.err
+}
+
+// consumedReadBuffer returns the buffer that we're returning data from to
+// the free list if we're done with it.
+func (w *wrapper) consumedReadBuffer() {
+	if w.consumed == len(w.current.data) {
+		w.free <- w.current
+		w.current = nil
+	}
+}
+
 func (w *wrapper) Read(buf []byte) (int, error) {
 	n := 0
 	for n < len(buf) {
-		if !w.eof {
-			nRead, err := w.reader.Read(w.buf[w.buffered:])
-			if err != nil {
-				if !errors.Is(err, io.EOF) {
-					w.buffered += nRead
-					return n, err
-				}
-				w.eof = true
+		current, err := w.nextReadBuffer()
+		if err != nil {
+			if n > 0 {
+				break
 			}
-			w.buffered += nRead
+			return 0, err
 		}
-		if w.buffered == 0 && w.eof {
-			return n, io.EOF
-		}
-		if w.buffered-w.processed >= w.blockSize {
-			toProcess := roundDownToMultiple(w.buffered-w.processed, w.blockSize)
-			processed, err := w.fn(w.buf[w.processed : w.processed+toProcess])
-			if err != nil {
-				return n, err
+		nRead := copy(buf[n:], current.data[w.consumed:])
+		n += nRead
+		w.consumed += nRead
+		w.consumedReadBuffer()
+	}
+	return n, nil
+}
+
+// WriteTo writes data directly from our buffers, saving io.Copy() from
+// having to copy it through a buffer of its own.
+func (w *wrapper) WriteTo(writer io.Writer) (int64, error) {
+	var n int64
+	for {
+		current, err := w.nextReadBuffer()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
 			}
-			nProcessed := copy(w.buf[w.processed:], processed)
-			w.processed += nProcessed
+			return n, err
 		}
-		nRead := copy(buf[n:], w.buf[:w.processed])
-		n += nRead
-		copy(w.buf, w.buf[nRead:w.buffered])
-		w.processed -= nRead
-		w.buffered -= nRead
-		if w.buffered-w.processed < w.blockSize {
-			break
+		nWritten, err := writer.Write(current.data[w.consumed:])
+		n += int64(nWritten)
+		w.consumed += nWritten
+		w.consumedReadBuffer()
+		if err != nil {
+			return n, err
 		}
 	}
-	return n, nil
 }
 
 func (w *wrapper) Close() error {
-	if w.writer != nil {
-		if w.buffered%w.blockSize != 0 {
-			nPadding := w.blockSize - w.buffered%w.blockSize
-			nWritten, err := w.Write(make([]byte, nPadding))
-			if err != nil {
-				return fmt.Errorf("flushing write: %v", err)
-			}
-			if nWritten < nPadding {
-				return fmt.Errorf("flushing write: %d != %d", nPadding, nWritten)
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if !w.started {
+		return nil
+	}
+	if w.reader != nil {
+		w.readLock.Lock()
+		w.stopped = true
+		reading := w.reading
+		w.readLock.Unlock()
+		close(w.stop)
+		if reading && w.detach {
+			// fill will stop once its read returns, and the
+			// workers will stop after it does
+			return nil
+		}
+		w.wg.Wait()
+		return nil
+	}
+	if w.current != nil && w.consumed > 0 {
+		if w.consumed%w.blockSize != 0 {
+			nPadding := w.blockSize - w.consumed%w.blockSize
+			for i := 0; i < nPadding; i++ {
+				w.current.buf[w.consumed+i] = 0
 			}
+			w.consumed += nPadding
 		}
+		w.submit(w.current, w.consumed)
+		w.current = nil
+	}
+	close(w.jobs)
+	close(w.ordered)
+	w.wg.Wait()
+	if err := w.writeError(); err != nil {
+		return fmt.Errorf("flushing write: %w", err)
 	}
 	return nil
 }
@@ -557,16 +569,42 @@ func (w *wrapper) Close() error {
 // If only a partial block has been written when Close() is called, a final
 // block with its length padded with zero bytes will be transformed and
 // written.
+// Because fn returns newly-allocated slices, the EncryptWriter method of a
+// SectorCipher, which encrypts in place, is more efficient.
 func EncryptWriter(fn func(plaintext []byte) ([]byte, error), writer io.Writer, blockSize int) io.WriteCloser {
-	bufferSize := roundUpToMultiple(1024*1024, blockSize)
-	return &wrapper{fn: fn, blockSize: blockSize, buf: make([]byte, bufferSize), writer: writer}
+	return EncryptWriterWithOptions(fn, writer, blockSize, StreamOptions{})
+}
+
+// EncryptWriterWithOptions is a version of EncryptWriter which accepts
+// options.  Reads, encryption, and writes are pipelined, but since the
+// encryption function processes blocks in succession, it is only ever called
+// from one goroutine at a time.
+func EncryptWriterWithOptions(fn func(plaintext []byte) ([]byte, error), writer io.Writer, blockSize int, options StreamOptions) io.WriteCloser {
+	options.Workers = 1
+	w := newWrapper(sequentialTransform(fn), blockSize, options)
+	w.writer = writer
+	return w
 }
 
 // DecryptReader creates an io.ReadCloser which buffers reads through a
 // decryption function, decrypting and returning multiples of the blockSize
 // until it reaches the end of the file.  When data will no longer be read, the
 // returned reader should be closed.
+// Because fn returns newly-allocated slices, the DecryptReader method of a
+// SectorCipher, which decrypts in place, is more efficient.
 func DecryptReader(fn func(ciphertext []byte) ([]byte, error), reader io.Reader, blockSize int) io.ReadCloser {
-	bufferSize := roundUpToMultiple(1024*1024, blockSize)
-	return &wrapper{fn: fn, blockSize: blockSize, buf: make([]byte, bufferSize), reader: reader}
+	return DecryptReaderWithOptions(fn, reader, blockSize, StreamOptions{})
+}
+
+// DecryptReaderWithOptions is a version of DecryptReader which accepts
+// options.  Reads, decryption, and writes are pipelined, but since the
+// decryption function processes blocks in succession, it is only ever called
+// from one goroutine at a time.  The returned reader reads ahead, so the
+// reader should not be used by anything else until the returned reader has
+// been closed.
+func DecryptReaderWithOptions(fn func(ciphertext []byte) ([]byte, error), reader io.Reader, blockSize int, options StreamOptions) io.ReadCloser {
+	options.Workers = 1
+	w := newWrapper(sequentialTransform(fn), blockSize, options)
+	w.reader = reader
+	return w
 }
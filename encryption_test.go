@@ -1,16 +1,19 @@
 package luksy
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -307,3 +310,394 @@ func TestWrappers(t *testing.T) {
 		}
 	}
 }
+
+func TestSectorCipher(t *testing.T) {
+	// Digests of the ciphertext that v1encrypt produced for a fixed key and
+	// plaintext, starting at sector 3, before it was built on SectorCipher.
+	knownAnswers := []struct {
+		cipherSpec string
+		sectorSize int
+		sha256     string
+	}{
+		{"aes-cbc-plain", 512, "c1af7a60bb0ea3bc1e3be7dfe9e28efdf0c0306e9ef2228fdc7f27868d2d0054"},
+		{"aes-cbc-plain", 4096, "224279de368c45d7f57b3956fe0cd3b208bc822c28702a7d96b4c363feb00e9a"},
+		{"aes-cbc-plain64", 512, "c1af7a60bb0ea3bc1e3be7dfe9e28efdf0c0306e9ef2228fdc7f27868d2d0054"},
+		{"aes-cbc-plain64", 4096, "224279de368c45d7f57b3956fe0cd3b208bc822c28702a7d96b4c363feb00e9a"},
+		{"aes-cbc-essiv:sha256", 512, "34a4310d38c8c25b52ee332ed52a8962a00e73dcd8a555abe25fa620b125d3ef"},
+		{"aes-cbc-essiv:sha256", 4096, "a843fab6d9aa5e15da23b1400c730d66d2f4580b36a35548158414303a88d155"},
+		{"aes-xts-plain", 512, "81cbc4df9843e113ce326a6f9a2fd379ac9c4029477fb4f2739ce0c26a3c969b"},
+		{"aes-xts-plain", 4096, "cc94d42698297d8c5c1a896f798675b9c6408652c65ff96d1af2e132bd39e9a4"},
+		{"aes-xts-plain64", 512, "81cbc4df9843e113ce326a6f9a2fd379ac9c4029477fb4f2739ce0c26a3c969b"},
+		{"aes-xts-plain64", 4096, "cc94d42698297d8c5c1a896f798675b9c6408652c65ff96d1af2e132bd39e9a4"},
+		{"serpent-xts-plain64", 512, "702ac9a020276d3e4bbd68d7a4e67b70007f1e82aec552e5725ef41da4222e8f"},
+		{"serpent-xts-plain64", 4096, "ca1b4e46f52282cddeb3283810859b996367d2005a8a300abf8647a6878f6811"},
+		{"twofish-xts-plain64", 512, "248c153bd3c35adf6c84bb6e8265579dce57011c0fcbf4c1d784d7be05ba7ba6"},
+		{"twofish-xts-plain64", 4096, "0bba9b75034ccfe6b4f9752973038f577a82b4cef94cbc5d2c74c6803c57de41"},
+	}
+	for _, knownAnswer := range knownAnswers {
+		cipherSpec, sectorSize := knownAnswer.cipherSpec, knownAnswer.sectorSize
+		t.Run(fmt.Sprintf("%s:%d", cipherSpec, sectorSize), func(t *testing.T) {
+			key := make([]byte, 32)
+			if strings.Contains(cipherSpec, "-xts-") {
+				key = make([]byte, 64)
+			}
+			for i := range key {
+				key[i] = byte(i)
+			}
+			data := make([]byte, sectorSize*8)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+
+			c, err := NewSectorCipher(cipherSpec, key, sectorSize)
+			require.NoError(t, err)
+			assert.Equal(t, sectorSize, c.SectorSize())
+			assert.Equal(t, cipherSpec, c.CipherSpec())
+
+			encrypted := make([]byte, len(data))
+			err = c.EncryptSectors(encrypted, data, 3)
+			require.NoError(t, err)
+			sum := sha256.Sum256(encrypted)
+			assert.Equal(t, knownAnswer.sha256, hex.EncodeToString(sum[:]), "ciphertext doesn't match the known answer")
+
+			inPlace := dupInt8(encrypted[sectorSize:])
+			err = c.DecryptSectors(inPlace, inPlace, 4)
+			require.NoError(t, err)
+			assert.Equal(t, data[sectorSize:], inPlace, "decrypting starting with a later sector failed")
+		})
+	}
+	_, err := NewSectorCipher("aes", make([]byte, 32), 512)
+	assert.Error(t, err, "expected an error for an incomplete cipher spec")
+	_, err = NewSectorCipher("aes-xts-plain64", make([]byte, 64), 3)
+	assert.Error(t, err, "expected an error for an invalid sector size")
+}
+
+func TestSectorCipherStreams(t *testing.T) {
+	key := make([]byte, 64)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	c, err := NewSectorCipher("aes-xts-plain64", key, 4096)
+	require.NoError(t, err)
+	data := make([]byte, 4096*100)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	expected := make([]byte, len(data))
+	require.NoError(t, c.EncryptSectors(expected, data, 7))
+
+	for _, options := range []StreamOptions{{}, {Workers: 1}, {Workers: 4, BufferSize: 4096}, {Workers: 3, BufferSize: 10000}} {
+		t.Run(fmt.Sprintf("workers=%d,buffer=%d", options.Workers, options.BufferSize), func(t *testing.T) {
+			var encrypted bytes.Buffer
+			wc := c.EncryptWriter(&encrypted, 7, options)
+			for offset := 0; offset < len(data); offset += 0x1234 {
+				end := offset + 0x1234
+				if end > len(data) {
+					end = len(data)
+				}
+				_, err := wc.Write(data[offset:end])
+				require.NoError(t, err)
+			}
+			require.NoError(t, wc.Close())
+			assert.Equal(t, expected, encrypted.Bytes(), "parallel encryption produced different output")
+
+			rc := c.DecryptReader(bytes.NewReader(append(encrypted.Bytes(), "trailing"...)), 7, options)
+			decrypted, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			assert.Equal(t, data, decrypted, "parallel decryption produced different output")
+		})
+	}
+}
+
+func TestFormatV2Segments(t *testing.T) {
+	const sectorSize = 4096
+	for _, tc := range []struct {
+		name     string
+		segments []FormatV2Segment
+		payload  int
+		trailing int
+	}{
+		{name: "dynamic", payload: 64 * sectorSize},
+		{name: "fixed", segments: []FormatV2Segment{{Size: 64 * sectorSize}}, payload: 64 * sectorSize, trailing: 5000},
+		{name: "several", segments: []FormatV2Segment{{Size: 8 * sectorSize}, {Size: 16 * sectorSize, Linear: true}, {Size: 8 * sectorSize}, {}}, payload: 64 * sectorSize},
+		{name: "several-fixed", segments: []FormatV2Segment{{Size: 8 * sectorSize, Linear: true}, {Size: 24 * sectorSize}}, payload: 32 * sectorSize, trailing: sectorSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{SectorSize: sectorSize, Segments: tc.segments})
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(header)), volume.PayloadOffset)
+			plaintext := make([]byte, tc.payload)
+			_, err = rand.Read(plaintext)
+			require.NoError(t, err)
+
+			f, err := os.Create(filepath.Join(t.TempDir(), "encrypted"))
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = f.Write(header)
+			require.NoError(t, err)
+			wc := volume.EncryptWriter(f, StreamOptions{BufferSize: 3 * sectorSize})
+			_, err = wc.Write(plaintext)
+			require.NoError(t, err)
+			require.NoError(t, wc.Close())
+			trailing := make([]byte, tc.trailing)
+			_, err = rand.Read(trailing)
+			require.NoError(t, err)
+			_, err = f.WriteAt(trailing, volume.PayloadOffset+int64(len(plaintext)))
+			require.NoError(t, err)
+
+			_, h1, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+			require.NoError(t, err)
+			unlocked, err := h1.Unlock("password", f, *j, UnlockOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(plaintext)), unlocked.PayloadSize, "trailing data should not be part of the payload")
+			rc := unlocked.DecryptReader(f, StreamOptions{})
+			decrypted, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			assert.Equal(t, plaintext, decrypted)
+
+			for i, segment := range tc.segments {
+				if !segment.Linear {
+					continue
+				}
+				v := unlocked.Segments[i]
+				assert.Nil(t, v.Cipher)
+				stored := make([]byte, v.Size)
+				_, err = f.ReadAt(stored, v.Offset)
+				require.NoError(t, err)
+				assert.Equal(t, plaintext[v.Offset-volume.PayloadOffset:v.Offset-volume.PayloadOffset+v.Size], stored, "linear segment should not be encrypted")
+			}
+		})
+	}
+
+	t.Run("too-short", func(t *testing.T) {
+		_, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{Segments: []FormatV2Segment{{Size: 4096}}})
+		require.NoError(t, err)
+		wc := volume.EncryptWriter(byteWriterAt(make([]byte, volume.PayloadOffset+4096)), StreamOptions{})
+		_, err = wc.Write(make([]byte, 512))
+		require.NoError(t, err)
+		assert.Error(t, wc.Close())
+	})
+
+	t.Run("too-long", func(t *testing.T) {
+		_, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{Segments: []FormatV2Segment{{Size: 4096}}})
+		require.NoError(t, err)
+		wc := volume.EncryptWriter(byteWriterAt(make([]byte, volume.PayloadOffset+8192)), StreamOptions{})
+		_, err = wc.Write(make([]byte, 8192))
+		assert.Error(t, err)
+		wc.Close()
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{Segments: []FormatV2Segment{{}, {Size: 4096}}})
+		assert.Error(t, err, "only the last segment can be dynamic")
+		_, _, err = FormatV2WithOptions([]string{"password"}, FormatV2Options{SectorSize: 4096, Segments: []FormatV2Segment{{Size: 512}}})
+		assert.Error(t, err, "segment sizes have to be multiples of the sector size")
+		_, _, err = FormatV2WithOptions([]string{"password"}, FormatV2Options{Segments: []FormatV2Segment{{Linear: true}}})
+		assert.Error(t, err, "at least one segment has to be encrypted")
+	})
+}
+
+// roundTripVolume writes header and an encrypted payload to a file, then
+// unlocks it and checks that the payload decrypts correctly.
+func roundTripVolume(t *testing.T, header []byte, volume *Volume, password string) {
+	plaintext := make([]byte, 64*V1SectorSize)
+	_, err := rand.Read(plaintext)
+	require.NoError(t, err)
+	f, err := os.Create(filepath.Join(t.TempDir(), "encrypted"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(header)
+	require.NoError(t, err)
+	wc := volume.EncryptWriter(f, StreamOptions{})
+	_, err = wc.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+
+	var unlocked *Volume
+	v1, h1, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+	require.NoError(t, err)
+	if v1 != nil {
+		unlocked, err = v1.Unlock(password, f, UnlockOptions{})
+	} else {
+		unlocked, err = h1.Unlock(password, f, *j, UnlockOptions{})
+	}
+	require.NoError(t, err)
+	assert.Equal(t, volume.PayloadOffset, unlocked.PayloadOffset)
+	rc := unlocked.DecryptReader(f, StreamOptions{})
+	decrypted, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestFormatLayout(t *testing.T) {
+	const mib = 1024 * 1024
+
+	t.Run("v1", func(t *testing.T) {
+		header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{PayloadOffset: 16 * mib})
+		require.NoError(t, err)
+		assert.Equal(t, int64(16*mib), volume.PayloadOffset)
+		assert.Len(t, header, 16*mib)
+		roundTripVolume(t, header, volume, "password")
+
+		header, volume, err = FormatV1WithOptions([]string{"password"}, FormatV1Options{PayloadAlignment: mib, Stripes: 2000})
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), volume.PayloadOffset%mib)
+		var h V1Header
+		copy(h[:], header)
+		ks, err := h.KeySlot(0)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(2000), ks.Stripes())
+		roundTripVolume(t, header, volume, "password")
+		findings, err := Validate(bytes.NewReader(header))
+		require.NoError(t, err)
+		assert.NotEmpty(t, findingsMatching(findings, SeverityWarning, "unusual number of stripes 2000"), "%v", findings)
+
+		_, _, err = FormatV1WithOptions([]string{"password"}, FormatV1Options{PayloadOffset: 4096})
+		assert.Error(t, err, "payload offset is too small for the key slots")
+	})
+
+	t.Run("v2-sizes", func(t *testing.T) {
+		header, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{MetadataSize: 0x40000, KeyslotsSize: mib})
+		require.NoError(t, err)
+		_, h1, h2, j, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(0x40000), h1.HeaderSize())
+		assert.Equal(t, uint64(0x40000), h2.HeaderOffset())
+		assert.Equal(t, mib, j.Config.KeyslotsSize)
+		assert.Equal(t, int64(2*0x40000+mib), volume.PayloadOffset)
+		findings, err := Validate(bytes.NewReader(header))
+		require.NoError(t, err)
+		assert.Empty(t, findings)
+		roundTripVolume(t, header, volume, "password")
+	})
+
+	t.Run("v2-offset", func(t *testing.T) {
+		header, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{SectorSize: 4096, PayloadOffset: 16 * mib})
+		require.NoError(t, err)
+		assert.Equal(t, int64(16*mib), volume.PayloadOffset)
+		_, h1, _, j, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 16*mib-2*int(h1.HeaderSize()), j.Config.KeyslotsSize, "key slots area should fill the space before the payload")
+		roundTripVolume(t, header, volume, "password")
+	})
+
+	t.Run("v2-alignment", func(t *testing.T) {
+		header, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{PayloadAlignment: 3 * mib, Stripes: 1000})
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), volume.PayloadOffset%(3*mib))
+		_, _, _, j, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 1000, j.Keyslots["0"].AF.Stripes)
+		roundTripVolume(t, header, volume, "password")
+	})
+
+	t.Run("v2-invalid", func(t *testing.T) {
+		for _, options := range []FormatV2Options{
+			{MetadataSize: 12345},
+			{KeyslotsSize: 4096},
+			{KeyslotsSize: 4097},
+			{KeyslotsSize: 256 * mib},
+			{PayloadOffset: 4096},
+			{PayloadOffset: 1000},
+			{PayloadOffset: mib, PayloadAlignment: mib},
+			{SectorSize: 4096, PayloadAlignment: 512},
+			{Stripes: -1},
+		} {
+			_, _, err := FormatV2WithOptions([]string{"password"}, options)
+			assert.Error(t, err, "%+v", options)
+		}
+	})
+}
+
+func TestFormatAlgorithms(t *testing.T) {
+	t.Run("v1", func(t *testing.T) {
+		header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{Hash: "sha512"})
+		require.NoError(t, err)
+		var h V1Header
+		copy(h[:], header)
+		assert.Equal(t, "sha512", h.HashSpec())
+		assert.GreaterOrEqual(t, h.MKDigestIter(), uint32(minDigestIterations))
+		roundTripVolume(t, header, volume, "password")
+
+		_, _, err = FormatV1WithOptions([]string{"password"}, FormatV1Options{Hash: "md5"})
+		assert.Error(t, err)
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		options := FormatV2Options{
+			Cipher:         "aes-xts-plain64",
+			KeyslotCipher:  "aes-cbc-essiv:sha256",
+			KeyslotKeySize: 16,
+			Hash:           "sha512",
+		}
+		header, volume, err := FormatV2WithOptions([]string{"password"}, options)
+		require.NoError(t, err)
+		_, _, _, j, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+		require.NoError(t, err)
+		keyslot := j.Keyslots["0"]
+		assert.Equal(t, 64, keyslot.KeySize)
+		assert.Equal(t, "aes-cbc-essiv:sha256", keyslot.Area.Encryption)
+		assert.Equal(t, 16, keyslot.Area.KeySize)
+		assert.Equal(t, "sha512", keyslot.AF.Hash)
+		assert.Equal(t, "sha512", j.Digests["0"].Hash)
+		assert.GreaterOrEqual(t, j.Digests["0"].Iterations, minDigestIterations)
+		assert.Equal(t, "aes-xts-plain64", j.Segments["0"].Encryption)
+		findings, err := Validate(bytes.NewReader(header))
+		require.NoError(t, err)
+		assert.Empty(t, findings)
+		roundTripVolume(t, header, volume, "password")
+
+		for _, options := range []FormatV2Options{
+			{Hash: "md5"},
+			{KeyslotCipher: "aes-xts-plain64", KeyslotKeySize: 20},
+			{KeyslotCipher: "nonexistent-cbc-plain"},
+		} {
+			_, _, err := FormatV2WithOptions([]string{"password"}, options)
+			assert.Error(t, err, "%+v", options)
+		}
+	})
+}
+
+func BenchmarkSectorCipher(b *testing.B) {
+	for _, cipherSpec := range []string{"aes-cbc-plain64", "aes-cbc-essiv:sha256", "aes-xts-plain64"} {
+		b.Run(cipherSpec, func(b *testing.B) {
+			key := make([]byte, 32)
+			if strings.Contains(cipherSpec, "-xts-") {
+				key = make([]byte, 64)
+			}
+			_, err := rand.Read(key)
+			require.NoError(b, err)
+			c, err := NewSectorCipher(cipherSpec, key, 512)
+			require.NoError(b, err)
+			buf := make([]byte, 1024*1024)
+			b.SetBytes(int64(len(buf)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.DecryptSectors(buf, buf, uint64(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecryptReader(b *testing.B) {
+	key := make([]byte, 64)
+	_, err := rand.Read(key)
+	require.NoError(b, err)
+	c, err := NewSectorCipher("aes-xts-plain64", key, 4096)
+	require.NoError(b, err)
+	ciphertext := make([]byte, 16*1024*1024)
+	b.SetBytes(int64(len(ciphertext)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc := c.DecryptReader(bytes.NewReader(ciphertext), 0, StreamOptions{})
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			b.Fatal(err)
+		}
+		rc.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package luksy
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrIncorrectPassphrase is returned when a password doesn't unlock
+	// any of the key slots that it was tried against.
+	ErrIncorrectPassphrase = errors.New("decryption error: incorrect password")
+	// ErrNoKeyslots is returned when a volume has no key slots which a
+	// password could be checked against.
+	ErrNoKeyslots = errors.New("no passwords set")
+	// ErrUnsupportedCipher is returned when a header calls for a cipher
+	// or cipher mode which we don't implement.
+	ErrUnsupportedCipher = errors.New("unsupported cipher")
+	// ErrHeaderChecksum is returned when a LUKSv2 header's checksum
+	// doesn't match its contents.
+	ErrHeaderChecksum = errors.New("header checksum mismatch")
+	// ErrMetadataTooLarge is returned when encoded LUKSv2 JSON metadata
+	// won't fit in the JSON area of a header of the requested size.
+	ErrMetadataTooLarge = errors.New("JSON metadata is too large for the LUKS header")
+)
+
+// ErrCorruptKeyslot is returned when a key slot's parameters don't make
+// sense, or its key material can't be used.
+type ErrCorruptKeyslot struct {
+	// ID is the ID of the key slot.
+	ID string
+	// Reason describes what's wrong with it, if we know.
+	Reason string
+}
+
+func (e *ErrCorruptKeyslot) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("key slot %q is corrupt", e.ID)
+	}
+	return fmt.Sprintf("key slot %q is corrupt: %s", e.ID, e.Reason)
+}
+
+// ErrUnmetRequirement is returned when a LUKSv2 volume's metadata lists a
+// mandatory requirement, or flags one of its segments in a way, that we
+// don't know how to honor, usually because the volume is part-way through
+// being reencrypted, or uses a feature that we don't implement.
+type ErrUnmetRequirement struct {
+	// Requirement is the requirement, or the segment flag.
+	Requirement string
+	// Segment is the ID of the segment, if Requirement is a segment flag.
+	Segment string
+}
+
+func (e *ErrUnmetRequirement) Error() string {
+	if e.Segment != "" {
+		return fmt.Sprintf("segment %q is flagged %q, which is not supported", e.Segment, e.Requirement)
+	}
+	return fmt.Sprintf("volume has unsupported requirement %q", e.Requirement)
+}
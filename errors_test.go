@@ -0,0 +1,64 @@
+package luksy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	header, _, err := FormatV2([]string{"password"}, "", 0)
+	require.NoError(t, err)
+
+	t.Run("checksum", func(t *testing.T) {
+		_, v2a, v2b, _, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+		require.NoError(t, err)
+		jsonSize := v2a.HeaderSize() - V2SectorSize
+		assert.NoError(t, v2a.verifyChecksum(header[V2SectorSize:V2SectorSize+jsonSize]))
+		assert.NoError(t, v2b.verifyChecksum(header[v2b.HeaderOffset()+V2SectorSize:v2b.HeaderOffset()+V2SectorSize+jsonSize]))
+
+		corrupted := bytes.Clone(header)
+		corrupted[V2SectorSize+jsonSize-1] = 'x'
+		_, _, _, _, err = ReadHeaders(bytes.NewReader(corrupted), ReadHeaderOptions{})
+		assert.ErrorIs(t, err, ErrHeaderChecksum)
+	})
+
+	t.Run("cipher", func(t *testing.T) {
+		_, err := NewSectorCipher("rot13-ecb", make([]byte, 16), 0)
+		assert.ErrorIs(t, err, ErrUnsupportedCipher)
+		_, err = NewSectorCipher("aes-ctr-plain64", make([]byte, 16), 0)
+		assert.ErrorIs(t, err, ErrUnsupportedCipher)
+		_, err = NewSectorCipher("aes", make([]byte, 16), 0)
+		assert.ErrorIs(t, err, ErrUnsupportedCipher)
+	})
+
+	t.Run("keyslots", func(t *testing.T) {
+		encryptedFile := filepath.Join(t.TempDir(), "encrypted")
+		require.NoError(t, os.WriteFile(encryptedFile, header, 0o600))
+		f, err := os.Open(encryptedFile)
+		require.NoError(t, err)
+		defer f.Close()
+		_, v2header, _, v2json, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+
+		_, err = v2header.Unlock("wrong", f, *v2json, UnlockOptions{})
+		assert.ErrorIs(t, err, ErrIncorrectPassphrase)
+
+		keyslot := v2json.Keyslots["0"]
+		keyslot.Area.Type = "unknown"
+		v2json.Keyslots = map[string]V2JSONKeyslot{"0": keyslot}
+		_, err = v2header.Unlock("password", f, *v2json, UnlockOptions{})
+		var corrupt *ErrCorruptKeyslot
+		require.True(t, errors.As(err, &corrupt), "expected an ErrCorruptKeyslot, got %v", err)
+		assert.Equal(t, "0", corrupt.ID)
+
+		v2json.Keyslots = nil
+		_, err = v2header.Unlock("password", f, *v2json, UnlockOptions{})
+		assert.ErrorIs(t, err, ErrNoKeyslots)
+	})
+}
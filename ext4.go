@@ -0,0 +1,569 @@
+package luksy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+const (
+	ext4SuperblockOffset = 1024
+	ext4SuperblockSize   = 1024
+	ext4Magic            = 0xef53
+	ext4RootInode        = 2
+
+	ext4CompatHasJournal = 0x4
+
+	ext4IncompatFiletype   = 0x2
+	ext4IncompatRecover    = 0x4
+	ext4IncompatExtents    = 0x40
+	ext4Incompat64Bit      = 0x80
+	ext4IncompatMMP        = 0x100
+	ext4IncompatFlexBG     = 0x200
+	ext4IncompatEAInode    = 0x400
+	ext4IncompatMetaBG     = 0x10
+	ext4IncompatCsumSeed   = 0x2000
+	ext4IncompatLargeDir   = 0x4000
+	ext4IncompatInlineData = 0x8000
+	ext4IncompatEncrypt    = 0x10000
+	ext4IncompatCasefold   = 0x20000
+	ext4IncompatSupported  = ext4IncompatFiletype | ext4IncompatRecover | ext4IncompatExtents | ext4Incompat64Bit | ext4IncompatMMP | ext4IncompatFlexBG | ext4IncompatEAInode | ext4IncompatMetaBG | ext4IncompatCsumSeed | ext4IncompatLargeDir | ext4IncompatInlineData | ext4IncompatEncrypt | ext4IncompatCasefold
+
+	ext4RoCompatSparseSuper = 0x1
+	ext4RoCompatHugeFile    = 0x8
+
+	ext4InodeFlagEncrypt    = 0x800
+	ext4InodeFlagHugeFile   = 0x40000
+	ext4InodeFlagExtents    = 0x80000
+	ext4InodeFlagInlineData = 0x10000000
+
+	ext4ExtentMagic    = 0xf30a
+	ext4MaxExtentDepth = 5
+	ext4InlineSize     = 60 // the size of i_block
+	ext4XattrMagic     = 0xea020000
+	ext4XattrSystem    = 7 // the "system." namespace
+)
+
+// ext4 reads an ext2, ext3, or ext4 filesystem.
+type ext4 struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup uint32
+	blocksPerGroup uint32
+	firstDataBlock uint32
+	firstMetaBG    uint32
+	descSize       int64
+	compat         uint32
+	incompat       uint32
+	roCompat       uint32
+	mu             sync.Mutex
+	inodeTables    map[uint32]int64 // block group -> offset of its inode table
+}
+
+// openExt4 reads an ext2/3/4 superblock.
+func openExt4(r io.ReaderAt) (*ext4, error) {
+	sb := make([]byte, ext4SuperblockSize)
+	if n, err := r.ReadAt(sb, ext4SuperblockOffset); n != len(sb) {
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil, ErrUnrecognizedFilesystem
+		}
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(sb[56:]) != ext4Magic {
+		return nil, ErrUnrecognizedFilesystem
+	}
+	e := &ext4{
+		r:              r,
+		inodesPerGroup: binary.LittleEndian.Uint32(sb[40:]),
+		blocksPerGroup: binary.LittleEndian.Uint32(sb[32:]),
+		firstDataBlock: binary.LittleEndian.Uint32(sb[20:]),
+		firstMetaBG:    binary.LittleEndian.Uint32(sb[260:]),
+		inodeSize:      128,
+		descSize:       32,
+		inodeTables:    make(map[uint32]int64),
+	}
+	logBlockSize := binary.LittleEndian.Uint32(sb[24:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("ext4 block size 2^%d is not supported", 10+logBlockSize)
+	}
+	e.blockSize = 1024 << logBlockSize
+	if binary.LittleEndian.Uint32(sb[76:]) > 0 {
+		// dynamic revision, so features and the inode size mean something
+		e.compat = binary.LittleEndian.Uint32(sb[92:])
+		e.incompat = binary.LittleEndian.Uint32(sb[96:])
+		e.roCompat = binary.LittleEndian.Uint32(sb[100:])
+		e.inodeSize = int64(binary.LittleEndian.Uint16(sb[88:]))
+	}
+	if unsupported := e.incompat &^ ext4IncompatSupported; unsupported != 0 {
+		return nil, fmt.Errorf("ext4 filesystem uses unsupported features %#x", unsupported)
+	}
+	if e.incompat&ext4Incompat64Bit != 0 {
+		e.descSize = int64(binary.LittleEndian.Uint16(sb[254:]))
+	}
+	switch {
+	case e.inodeSize < 128 || e.inodeSize > e.blockSize || e.inodeSize&(e.inodeSize-1) != 0:
+		return nil, fmt.Errorf("ext4 inode size %d is not valid", e.inodeSize)
+	case e.descSize < 32 || e.descSize > e.blockSize || e.descSize&(e.descSize-1) != 0:
+		return nil, fmt.Errorf("ext4 group descriptor size %d is not valid", e.descSize)
+	case e.inodesPerGroup == 0 || e.blocksPerGroup == 0:
+		return nil, errors.New("ext4 block groups have no blocks or no inodes")
+	}
+	if e.incompat&ext4IncompatRecover != 0 {
+		log().Warnf("ext4 filesystem's journal needs to be recovered, some files may be out of date")
+	}
+	return e, nil
+}
+
+func (e *ext4) typ() string {
+	switch {
+	case e.incompat&(ext4IncompatExtents|ext4Incompat64Bit|ext4IncompatFlexBG) != 0:
+		return "ext4"
+	case e.compat&ext4CompatHasJournal != 0:
+		return "ext3"
+	}
+	return "ext2"
+}
+
+// groupHasSuperblock returns true if the block group has a backup copy of the
+// superblock and group descriptors at its start.
+func (e *ext4) groupHasSuperblock(group uint32) bool {
+	if group <= 1 || e.roCompat&ext4RoCompatSparseSuper == 0 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// inodeTable returns the location of a block group's inode table.
+func (e *ext4) inodeTable(group uint32) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if offset, ok := e.inodeTables[group]; ok {
+		return offset, nil
+	}
+	descsPerBlock := uint32(e.blockSize / e.descSize)
+	descBlock := group / descsPerBlock
+	var block int64
+	if e.incompat&ext4IncompatMetaBG == 0 || descBlock < e.firstMetaBG {
+		block = int64(e.firstDataBlock) + 1 + int64(descBlock)
+	} else {
+		// the descriptors for each "meta" block group are in the
+		// first block group in it
+		first := descBlock * descsPerBlock
+		block = int64(first)*int64(e.blocksPerGroup) + int64(e.firstDataBlock)
+		if e.groupHasSuperblock(first) {
+			block++
+		}
+	}
+	desc := make([]byte, e.descSize)
+	if _, err := e.r.ReadAt(desc, block*e.blockSize+int64(group%descsPerBlock)*e.descSize); err != nil {
+		return -1, fmt.Errorf("reading ext4 group descriptor %d: %w", group, err)
+	}
+	table := int64(binary.LittleEndian.Uint32(desc[8:]))
+	if e.descSize >= 64 {
+		table |= int64(binary.LittleEndian.Uint32(desc[40:])) << 32
+	}
+	e.inodeTables[group] = table * e.blockSize
+	return table * e.blockSize, nil
+}
+
+// ext4Node is an inode, which is read the first time that we need to know
+// anything about it.
+type ext4Node struct {
+	fs     *ext4
+	number uint32
+	once   sync.Once
+	err    error
+	mode   uint16
+	flags  uint32
+	size   int64
+	blocks int64 // in 512-byte units, excluding any extended attribute block
+	mtime  time.Time
+	block  [ext4InlineSize]byte
+	inline []byte // the rest of inline data, after what's in block
+}
+
+// ext4Node returns a node for an inode, reading it first.
+func (e *ext4) node(number uint32) (*ext4Node, error) {
+	n := &ext4Node{fs: e, number: number}
+	if err := n.read(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *ext4Node) read() error {
+	n.once.Do(func() {
+		e := n.fs
+		if n.number == 0 {
+			n.err = errors.New("ext4 inode number 0 is not valid")
+			return
+		}
+		group := (n.number - 1) / e.inodesPerGroup
+		table, err := e.inodeTable(group)
+		if err != nil {
+			n.err = err
+			return
+		}
+		inode := make([]byte, e.inodeSize)
+		if _, err := e.r.ReadAt(inode, table+int64((n.number-1)%e.inodesPerGroup)*e.inodeSize); err != nil {
+			n.err = fmt.Errorf("reading ext4 inode %d: %w", n.number, err)
+			return
+		}
+		n.mode = binary.LittleEndian.Uint16(inode[0:])
+		n.size = int64(binary.LittleEndian.Uint32(inode[4:])) | int64(binary.LittleEndian.Uint32(inode[108:]))<<32
+		n.flags = binary.LittleEndian.Uint32(inode[32:])
+		copy(n.block[:], inode[40:])
+		n.blocks = int64(binary.LittleEndian.Uint32(inode[28:])) | int64(binary.LittleEndian.Uint16(inode[116:]))<<32
+		if e.roCompat&ext4RoCompatHugeFile != 0 && n.flags&ext4InodeFlagHugeFile != 0 {
+			n.blocks *= e.blockSize / 512
+		}
+		if binary.LittleEndian.Uint32(inode[104:]) != 0 || binary.LittleEndian.Uint16(inode[118:]) != 0 {
+			n.blocks -= e.blockSize / 512
+		}
+		seconds := int64(int32(binary.LittleEndian.Uint32(inode[16:])))
+		var nanoseconds int64
+		if e.inodeSize > 128 && binary.LittleEndian.Uint16(inode[128:]) >= 0x8c-0x80 {
+			extra := binary.LittleEndian.Uint32(inode[0x88:])
+			seconds += int64(extra&3) << 32
+			nanoseconds = int64(extra >> 2)
+		}
+		n.mtime = time.Unix(seconds, nanoseconds)
+		if n.flags&ext4InodeFlagInlineData != 0 && e.inodeSize > 128 {
+			extraSize := int64(binary.LittleEndian.Uint16(inode[128:]))
+			if 128+extraSize > e.inodeSize {
+				n.err = fmt.Errorf("ext4 inode %d is corrupted: extra inode size %d is too large", n.number, extraSize)
+				return
+			}
+			n.inline = ext4InlineXattr(inode[128+extraSize:])
+		}
+	})
+	return n.err
+}
+
+func (n *ext4Node) info(name string) *fsFileInfo {
+	if err := n.read(); err != nil {
+		return &fsFileInfo{name: name}
+	}
+	mode := fs.FileMode(n.mode & 0o777)
+	if n.mode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if n.mode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if n.mode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return &fsFileInfo{name: name, size: n.size, mode: mode | ext4FileType(n.mode), modTime: n.mtime}
+}
+
+// ext4InlineXattr finds the "system.data" extended attribute, which holds
+// whatever inline data doesn't fit in i_block, in the extended attributes
+// which follow the fixed part of an inode.
+func ext4InlineXattr(xattrs []byte) []byte {
+	if len(xattrs) < 4 || binary.LittleEndian.Uint32(xattrs) != ext4XattrMagic {
+		return nil
+	}
+	entries := xattrs[4:]
+	for pos := 0; pos+16 <= len(entries) && binary.LittleEndian.Uint32(entries[pos:]) != 0; {
+		nameLen := int(entries[pos])
+		nameIndex := entries[pos+1]
+		valueOffset := int(binary.LittleEndian.Uint16(entries[pos+2:]))
+		valueInode := binary.LittleEndian.Uint32(entries[pos+4:])
+		valueSize := int(binary.LittleEndian.Uint32(entries[pos+8:]))
+		if pos+16+nameLen > len(entries) {
+			return nil
+		}
+		name := string(entries[pos+16 : pos+16+nameLen])
+		if nameIndex == ext4XattrSystem && name == "data" && valueInode == 0 && valueOffset+valueSize <= len(entries) {
+			return entries[valueOffset : valueOffset+valueSize]
+		}
+		pos += (16 + nameLen + 3) &^ 3
+	}
+	return nil
+}
+
+// ext4FileType converts the type bits of an inode's mode to an fs.FileMode.
+func ext4FileType(mode uint16) fs.FileMode {
+	switch mode & 0xf000 {
+	case 0x1000:
+		return fs.ModeNamedPipe
+	case 0x2000:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case 0x4000:
+		return fs.ModeDir
+	case 0x6000:
+		return fs.ModeDevice
+	case 0xa000:
+		return fs.ModeSymlink
+	case 0xc000:
+		return fs.ModeSocket
+	}
+	return 0
+}
+
+// ext4DirentType converts the file type stored in a directory entry to an
+// fs.FileMode, returning false if the entry doesn't say.
+func ext4DirentType(t uint8) (fs.FileMode, bool) {
+	switch t {
+	case 1:
+		return 0, true
+	case 2:
+		return fs.ModeDir, true
+	case 3:
+		return fs.ModeDevice | fs.ModeCharDevice, true
+	case 4:
+		return fs.ModeDevice, true
+	case 5:
+		return fs.ModeNamedPipe, true
+	case 6:
+		return fs.ModeSocket, true
+	case 7:
+		return fs.ModeSymlink, true
+	}
+	return 0, false
+}
+
+func (n *ext4Node) contents() (io.ReaderAt, error) {
+	if err := n.read(); err != nil {
+		return nil, err
+	}
+	if n.flags&ext4InodeFlagEncrypt != 0 {
+		return nil, fmt.Errorf("ext4 inode %d is encrypted", n.number)
+	}
+	isSymlink := n.mode&0xf000 == 0xa000
+	switch {
+	case n.flags&ext4InodeFlagInlineData != 0:
+		data := append(append([]byte{}, n.block[:]...), n.inline...)
+		if n.size > int64(len(data)) {
+			return nil, fmt.Errorf("ext4 inode %d is missing some of its inline data", n.number)
+		}
+		return &inlineReader{data[:n.size]}, nil
+	case isSymlink && n.size < ext4InlineSize && n.blocks == 0:
+		// a "fast" symlink, with the target stored in the inode
+		return &inlineReader{n.block[:n.size]}, nil
+	}
+	extents, err := n.extents()
+	if err != nil {
+		return nil, err
+	}
+	return &extentReader{r: n.fs.r, extents: extents, size: n.size}, nil
+}
+
+// inlineReader reads contents which are stored in an inode.
+type inlineReader struct {
+	data []byte
+}
+
+func (i *inlineReader) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(i.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, i.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// extents maps the inode's blocks, either by reading its extent tree, or by
+// reading its direct and indirect block maps.
+func (n *ext4Node) extents() ([]fsExtent, error) {
+	e := n.fs
+	var extents []fsExtent
+	add := func(logical, physical, length int64) {
+		if len(extents) > 0 {
+			last := &extents[len(extents)-1]
+			if last.logical+last.length == logical && last.physical >= 0 && physical >= 0 && last.physical+last.length == physical {
+				last.length += length
+				return
+			}
+		}
+		extents = append(extents, fsExtent{logical: logical, physical: physical, length: length})
+	}
+	if n.flags&ext4InodeFlagExtents != 0 {
+		var walk func(node []byte, depth int) error
+		walk = func(node []byte, depth int) error {
+			if len(node) < 12 || binary.LittleEndian.Uint16(node[0:]) != ext4ExtentMagic {
+				return fmt.Errorf("ext4 inode %d has a corrupted extent tree", n.number)
+			}
+			entries := int(binary.LittleEndian.Uint16(node[2:]))
+			nodeDepth := int(binary.LittleEndian.Uint16(node[6:]))
+			if nodeDepth != depth || 12+12*entries > len(node) {
+				return fmt.Errorf("ext4 inode %d has a corrupted extent tree", n.number)
+			}
+			for i := 0; i < entries; i++ {
+				entry := node[12+12*i:]
+				logical := int64(binary.LittleEndian.Uint32(entry[0:])) * e.blockSize
+				if depth == 0 {
+					length := int64(binary.LittleEndian.Uint16(entry[4:]))
+					physical := (int64(binary.LittleEndian.Uint16(entry[6:]))<<32 | int64(binary.LittleEndian.Uint32(entry[8:]))) * e.blockSize
+					if length > 32768 {
+						// preallocated, but never written to
+						length -= 32768
+						physical = -1
+					}
+					add(logical, physical, length*e.blockSize)
+					continue
+				}
+				child := make([]byte, e.blockSize)
+				block := int64(binary.LittleEndian.Uint16(entry[8:]))<<32 | int64(binary.LittleEndian.Uint32(entry[4:]))
+				if _, err := e.r.ReadAt(child, block*e.blockSize); err != nil {
+					return fmt.Errorf("reading extent tree of ext4 inode %d: %w", n.number, err)
+				}
+				if err := walk(child, depth-1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		depth := int(binary.LittleEndian.Uint16(n.block[6:]))
+		if depth > ext4MaxExtentDepth {
+			return nil, fmt.Errorf("ext4 inode %d has a corrupted extent tree", n.number)
+		}
+		if err := walk(n.block[:], depth); err != nil {
+			return nil, err
+		}
+		return extents, nil
+	}
+	// block maps: 12 direct blocks, then single, double, and triple
+	// indirect blocks
+	blocks := (n.size + e.blockSize - 1) / e.blockSize
+	perBlock := e.blockSize / 4
+	var walk func(block uint32, level int, logical int64) error
+	walk = func(block uint32, level int, logical int64) error {
+		if block == 0 || logical >= blocks {
+			return nil
+		}
+		if level == 0 {
+			add(logical*e.blockSize, int64(block)*e.blockSize, e.blockSize)
+			return nil
+		}
+		pointers := make([]byte, e.blockSize)
+		if _, err := e.r.ReadAt(pointers, int64(block)*e.blockSize); err != nil {
+			return fmt.Errorf("reading block map of ext4 inode %d: %w", n.number, err)
+		}
+		span := int64(1)
+		for i := 1; i < level; i++ {
+			span *= perBlock
+		}
+		for i := int64(0); i < perBlock; i++ {
+			if err := walk(binary.LittleEndian.Uint32(pointers[4*i:]), level-1, logical+i*span); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	logical := int64(0)
+	for i := 0; i < 15; i++ {
+		level := 0
+		if i >= 12 {
+			level = i - 11
+		}
+		if err := walk(binary.LittleEndian.Uint32(n.block[4*i:]), level, logical); err != nil {
+			return nil, err
+		}
+		span := int64(1)
+		for j := 0; j < level; j++ {
+			span *= perBlock
+		}
+		logical += span
+	}
+	return extents, nil
+}
+
+func (n *ext4Node) entries() ([]fsDirent, error) {
+	if err := n.read(); err != nil {
+		return nil, err
+	}
+	e := n.fs
+	// entries never cross from one block into the next
+	var blocks [][]byte
+	if n.flags&ext4InodeFlagInlineData != 0 {
+		// the parent's inode number, and then entries, which can
+		// continue in an extended attribute
+		blocks = append(blocks, n.block[4:])
+		if len(n.inline) > 0 {
+			blocks = append(blocks, n.inline)
+		}
+	} else {
+		r, err := n.contents()
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, n.size)
+		if _, err := r.ReadAt(data, 0); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("reading ext4 directory inode %d: %w", n.number, err)
+		}
+		for len(data) > 0 {
+			block := data
+			if int64(len(block)) > e.blockSize {
+				block = block[:e.blockSize]
+			}
+			blocks = append(blocks, block)
+			data = data[len(block):]
+		}
+	}
+	var dirents []fsDirent
+	for _, block := range blocks {
+		blockSize := int64(len(block))
+		for pos := int64(0); pos+8 <= blockSize; {
+			entry := block[pos:]
+			number := binary.LittleEndian.Uint32(entry[0:])
+			recLen := int64(binary.LittleEndian.Uint16(entry[4:]))
+			if recLen == 0 || recLen == 65535 {
+				recLen = blockSize
+			} else {
+				recLen = recLen&65532 | (recLen&3)<<16
+			}
+			nameLen := int(entry[6])
+			fileType := entry[7]
+			if e.incompat&ext4IncompatFiletype == 0 {
+				nameLen = int(binary.LittleEndian.Uint16(entry[6:]))
+				fileType = 0
+			}
+			if recLen < 8 || recLen > int64(len(entry)) || 8+nameLen > int(recLen) {
+				return nil, fmt.Errorf("ext4 directory inode %d is corrupted", n.number)
+			}
+			pos += recLen
+			name := string(entry[8 : 8+nameLen])
+			if number == 0 || name == "." || name == ".." {
+				continue
+			}
+			if !validDirentName(name) {
+				return nil, fmt.Errorf("ext4 directory inode %d has an entry with invalid name %q", n.number, name)
+			}
+			child := &ext4Node{fs: e, number: number}
+			typ, ok := ext4DirentType(fileType)
+			dirent := fsDirent{name: name, typ: typ, node: func() (fsNode, error) {
+				if err := child.read(); err != nil {
+					return nil, err
+				}
+				return child, nil
+			}}
+			if !ok {
+				// no type in the entry, so we have to check
+				if err := child.read(); err != nil {
+					return nil, err
+				}
+				dirent.typ = ext4FileType(child.mode)
+			}
+			dirents = append(dirents, dirent)
+		}
+	}
+	return dirents, nil
+}
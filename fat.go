@@ -0,0 +1,368 @@
+package luksy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	fatDirentSize     = 32
+	fatAttrReadOnly   = 0x01
+	fatAttrVolumeID   = 0x08
+	fatAttrDirectory  = 0x10
+	fatAttrLongName   = 0x0f
+	fatLowercaseBase  = 0x08
+	fatLowercaseExt   = 0x10
+	fatLastLongName   = 0x40
+	fatCacheChunkSize = 64 * 1024
+)
+
+// fat reads a FAT12, FAT16, or FAT32 filesystem.
+type fat struct {
+	r           io.ReaderAt
+	bits        int
+	clusterSize int64
+	fatOffset   int64
+	dataOffset  int64
+	rootOffset  int64 // FAT12 and FAT16 only
+	rootSize    int64 // FAT12 and FAT16 only
+	rootCluster uint32
+	clusters    uint32 // the number of data clusters
+	mu          sync.Mutex
+	cacheOffset int64
+	cache       []byte // part of the allocation table
+}
+
+// openFAT reads a FAT boot sector.
+func openFAT(r io.ReaderAt) (*fat, error) {
+	bs := make([]byte, 512)
+	if n, err := r.ReadAt(bs, 0); n != len(bs) {
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil, ErrUnrecognizedFilesystem
+		}
+		return nil, err
+	}
+	bytesPerSector := int64(binary.LittleEndian.Uint16(bs[11:]))
+	sectorsPerCluster := int64(bs[13])
+	reservedSectors := int64(binary.LittleEndian.Uint16(bs[14:]))
+	fats := int64(bs[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[17:]))
+	totalSectors := int64(binary.LittleEndian.Uint16(bs[19:]))
+	if totalSectors == 0 {
+		totalSectors = int64(binary.LittleEndian.Uint32(bs[32:]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(bs[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(bs[36:]))
+	}
+	switch {
+	case bs[510] != 0x55 || bs[511] != 0xaa, bs[0] != 0xeb && bs[0] != 0xe9,
+		bytesPerSector < 512 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0,
+		sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0,
+		reservedSectors == 0, fats == 0, fatSectors == 0:
+		return nil, ErrUnrecognizedFilesystem
+	}
+	rootSectors := (rootEntries*fatDirentSize + bytesPerSector - 1) / bytesPerSector
+	dataSector := reservedSectors + fats*fatSectors + rootSectors
+	if totalSectors <= dataSector {
+		return nil, ErrUnrecognizedFilesystem
+	}
+	f := &fat{
+		r:           r,
+		clusterSize: sectorsPerCluster * bytesPerSector,
+		fatOffset:   reservedSectors * bytesPerSector,
+		dataOffset:  dataSector * bytesPerSector,
+		rootOffset:  (reservedSectors + fats*fatSectors) * bytesPerSector,
+		rootSize:    rootSectors * bytesPerSector,
+		clusters:    uint32((totalSectors - dataSector) / sectorsPerCluster),
+	}
+	// the number of clusters is the only thing that determines the type
+	switch {
+	case f.clusters < 4085:
+		f.bits = 12
+	case f.clusters < 65525:
+		f.bits = 16
+	default:
+		f.bits = 32
+		f.rootCluster = binary.LittleEndian.Uint32(bs[44:])
+		if rootEntries != 0 || f.rootCluster < 2 {
+			return nil, errors.New("FAT32 filesystem has no root directory")
+		}
+	}
+	if fatSectors*bytesPerSector*8 < int64(f.clusters+2)*int64(f.bits) {
+		return nil, fmt.Errorf("FAT%d allocation table is too small for %d clusters", f.bits, f.clusters)
+	}
+	return f, nil
+}
+
+func (f *fat) rootNode() fsNode {
+	return &fatNode{fs: f, root: true, cluster: f.rootCluster, attr: fatAttrDirectory}
+}
+
+// readFAT reads part of the allocation table, with some caching, since we
+// tend to look at the entries for clusters in order.
+func (f *fat) readFAT(b []byte, offset int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if offset < f.cacheOffset || offset+int64(len(b)) > f.cacheOffset+int64(len(f.cache)) {
+		chunk := offset / fatCacheChunkSize * fatCacheChunkSize
+		cache := make([]byte, 2*fatCacheChunkSize)
+		n, err := f.r.ReadAt(cache, f.fatOffset+chunk)
+		if n < int(offset-chunk)+len(b) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("reading FAT: %w", err)
+		}
+		f.cacheOffset, f.cache = chunk, cache[:n]
+	}
+	copy(b, f.cache[offset-f.cacheOffset:])
+	return nil
+}
+
+// next returns the cluster which follows a cluster in a chain, or 0 if the
+// cluster is the last one in its chain.
+func (f *fat) next(cluster uint32) (uint32, error) {
+	var next, last uint32
+	switch f.bits {
+	case 12:
+		var b [2]byte
+		if err := f.readFAT(b[:], int64(cluster)+int64(cluster/2)); err != nil {
+			return 0, err
+		}
+		next = uint32(binary.LittleEndian.Uint16(b[:]))
+		if cluster&1 != 0 {
+			next >>= 4
+		}
+		next &= 0xfff
+		last = 0xff8
+	case 16:
+		var b [2]byte
+		if err := f.readFAT(b[:], 2*int64(cluster)); err != nil {
+			return 0, err
+		}
+		next = uint32(binary.LittleEndian.Uint16(b[:]))
+		last = 0xfff8
+	default:
+		var b [4]byte
+		if err := f.readFAT(b[:], 4*int64(cluster)); err != nil {
+			return 0, err
+		}
+		next = binary.LittleEndian.Uint32(b[:]) & 0x0fffffff
+		last = 0x0ffffff8
+	}
+	switch {
+	case next >= last:
+		return 0, nil
+	case next < 2 || next >= f.clusters+2:
+		return 0, fmt.Errorf("FAT cluster chain is broken at cluster %d", cluster)
+	}
+	return next, nil
+}
+
+// chain maps the clusters in a chain which starts at the given cluster.  If
+// size is not negative, only as much of the chain as is needed to hold that
+// many bytes is read.
+func (f *fat) chain(first uint32, size int64) ([]fsExtent, error) {
+	var extents []fsExtent
+	logical := int64(0)
+	for cluster, count := first, uint32(0); cluster != 0 && (size < 0 || logical < size); count++ {
+		if cluster < 2 || cluster >= f.clusters+2 || count >= f.clusters {
+			return nil, fmt.Errorf("FAT cluster chain starting at cluster %d is broken", first)
+		}
+		physical := f.dataOffset + int64(cluster-2)*f.clusterSize
+		if len(extents) > 0 && extents[len(extents)-1].physical+extents[len(extents)-1].length == physical {
+			extents[len(extents)-1].length += f.clusterSize
+		} else {
+			extents = append(extents, fsExtent{logical: logical, physical: physical, length: f.clusterSize})
+		}
+		logical += f.clusterSize
+		next, err := f.next(cluster)
+		if err != nil {
+			return nil, err
+		}
+		cluster = next
+	}
+	if size >= 0 && logical < size {
+		return nil, fmt.Errorf("FAT cluster chain starting at cluster %d is too short", first)
+	}
+	return extents, nil
+}
+
+// fatNode is a file or directory, as described by its directory entry.
+type fatNode struct {
+	fs      *fat
+	root    bool
+	attr    uint8
+	cluster uint32
+	size    int64
+	mtime   time.Time
+}
+
+func (n *fatNode) info(name string) *fsFileInfo {
+	mode := fs.FileMode(0o755)
+	if n.attr&fatAttrDirectory != 0 {
+		mode |= fs.ModeDir
+	} else {
+		mode &^= 0o111
+	}
+	if n.attr&fatAttrReadOnly != 0 {
+		mode &^= 0o222
+	}
+	return &fsFileInfo{name: name, size: n.size, mode: mode, modTime: n.mtime}
+}
+
+func (n *fatNode) contents() (io.ReaderAt, error) {
+	extents, err := n.fs.chain(n.cluster, n.size)
+	if err != nil {
+		return nil, err
+	}
+	return &extentReader{r: n.fs.r, extents: extents, size: n.size}, nil
+}
+
+func (n *fatNode) entries() ([]fsDirent, error) {
+	var data []byte
+	if n.root && n.fs.bits != 32 {
+		data = make([]byte, n.fs.rootSize)
+		if _, err := n.fs.r.ReadAt(data, n.fs.rootOffset); err != nil {
+			return nil, fmt.Errorf("reading FAT root directory: %w", err)
+		}
+	} else {
+		extents, err := n.fs.chain(n.cluster, -1)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(0)
+		for _, extent := range extents {
+			size += extent.length
+		}
+		data = make([]byte, size)
+		if _, err := (&extentReader{r: n.fs.r, extents: extents, size: size}).ReadAt(data, 0); err != nil {
+			return nil, fmt.Errorf("reading FAT directory: %w", err)
+		}
+	}
+	var dirents []fsDirent
+	var longName []uint16
+	var longNameChecksum uint8
+	longNameNext := 0
+	for pos := 0; pos+fatDirentSize <= len(data); pos += fatDirentSize {
+		entry := data[pos : pos+fatDirentSize]
+		if entry[0] == 0 {
+			break
+		}
+		attr := entry[11]
+		if entry[0] == 0xe5 {
+			longName, longNameNext = nil, 0
+			continue
+		}
+		if attr&0x3f == fatAttrLongName {
+			// long names are stored backwards, 13 characters per entry,
+			// before the regular entry
+			sequence := int(entry[0] & 0x1f)
+			if entry[0]&fatLastLongName != 0 {
+				longName = make([]uint16, 13*sequence)
+				longNameChecksum = entry[13]
+				longNameNext = sequence
+			}
+			if sequence == 0 || sequence != longNameNext || entry[13] != longNameChecksum {
+				longNameNext = 0
+				continue
+			}
+			chars := longName[13*(sequence-1):]
+			for i, offset := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars[i] = binary.LittleEndian.Uint16(entry[offset:])
+			}
+			longNameNext--
+			continue
+		}
+		haveLongName := longNameNext == 0 && longName != nil && fatShortNameChecksum(entry[:11]) == longNameChecksum
+		name := fatShortName(entry)
+		if haveLongName {
+			for i, c := range longName {
+				if c == 0 {
+					longName = longName[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(longName))
+		}
+		longName, longNameNext = nil, 0
+		if attr&fatAttrVolumeID != 0 || name == "." || name == ".." {
+			continue
+		}
+		if !validDirentName(name) {
+			return nil, fmt.Errorf("FAT directory has an entry with invalid name %q", name)
+		}
+		node := &fatNode{
+			fs:      n.fs,
+			attr:    attr,
+			cluster: uint32(binary.LittleEndian.Uint16(entry[26:])),
+			size:    int64(binary.LittleEndian.Uint32(entry[28:])),
+			mtime:   fatTime(binary.LittleEndian.Uint16(entry[24:]), binary.LittleEndian.Uint16(entry[22:])),
+		}
+		if n.fs.bits == 32 {
+			node.cluster |= uint32(binary.LittleEndian.Uint16(entry[20:])) << 16
+		}
+		if attr&fatAttrDirectory != 0 {
+			node.size = 0
+		}
+		dirents = append(dirents, fsDirent{name: name, typ: node.info("").Mode().Type(), node: func() (fsNode, error) { return node, nil }})
+	}
+	return dirents, nil
+}
+
+// fatShortName decodes an 8.3 name from a directory entry.
+func fatShortName(entry []byte) string {
+	base := make([]byte, 8)
+	copy(base, entry[:8])
+	if base[0] == 0x05 {
+		// a name which really starts with 0xe5
+		base[0] = 0xe5
+	}
+	name := latin1(strings.TrimRight(string(base), " "))
+	ext := latin1(strings.TrimRight(string(entry[8:11]), " "))
+	if entry[12]&fatLowercaseBase != 0 {
+		name = strings.ToLower(name)
+	}
+	if entry[12]&fatLowercaseExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext != "" {
+		name += "." + ext
+	}
+	return name
+}
+
+// latin1 converts a string of bytes in ISO-8859-1 to UTF-8.
+func latin1(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+// fatShortNameChecksum computes the checksum of an 8.3 name which the long
+// name entries that precede it carry.
+func fatShortNameChecksum(name []byte) uint8 {
+	var sum uint8
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// fatTime decodes a timestamp, which is in local time.
+func fatTime(date, t uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0xf), int(date&0x1f), int(t>>11), int(t>>5&0x3f), 2*int(t&0x1f), 0, time.Local)
+}
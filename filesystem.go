@@ -0,0 +1,396 @@
+package luksy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrUnrecognizedFilesystem is returned by OpenFilesystem when it doesn't
+// recognize the filesystem that it's asked to read.
+var ErrUnrecognizedFilesystem = errors.New("unrecognized filesystem")
+
+// maxSymlinks is the number of symbolic links which we'll follow while
+// looking up a single path before deciding that we're in a loop, matching the
+// limit that Linux enforces.
+const maxSymlinks = 40
+
+// Filesystem is a read-only view of an ext2, ext3, ext4, or FAT filesystem.
+// Paths are resolved relative to the root of the filesystem, with symbolic
+// links followed everywhere except at the end of a path passed to Lstat or
+// ReadLink, or when listing a directory.
+type Filesystem struct {
+	typ             string
+	root            fsNode
+	caseInsensitive bool
+}
+
+// fsNode is a file, directory, or symbolic link in a filesystem that we know
+// how to read.
+type fsNode interface {
+	// info returns information about the node, which will be reported
+	// using the passed-in name.
+	info(name string) *fsFileInfo
+	// entries lists the contents of a directory, omitting "." and "..".
+	entries() ([]fsDirent, error)
+	// contents returns a reader for the contents of a regular file, or for
+	// the target of a symbolic link.
+	contents() (io.ReaderAt, error)
+}
+
+// fsDirent is an entry in a directory, which can be used to find the node that
+// it refers to.
+type fsDirent struct {
+	name string
+	typ  fs.FileMode
+	node func() (fsNode, error)
+}
+
+// validDirentName checks that a name read from a directory entry can be used
+// as one component of a path, which rules out names that are empty or which
+// contain a "/" or a NUL.
+func validDirentName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\x00")
+}
+
+// OpenFilesystem reads the filesystem which starts at the beginning of r,
+// which would typically be the Payload of an unlocked Volume.  Only the parts
+// of r which are needed to find and read the files that are asked for are
+// read.
+func OpenFilesystem(r io.ReaderAt) (*Filesystem, error) {
+	ext, err := openExt4(r)
+	if err == nil {
+		root, err := ext.node(ext4RootInode)
+		if err != nil {
+			return nil, err
+		}
+		return &Filesystem{typ: ext.typ(), root: root}, nil
+	} else if !errors.Is(err, ErrUnrecognizedFilesystem) {
+		return nil, err
+	}
+	fat, err := openFAT(r)
+	if err == nil {
+		return &Filesystem{typ: fmt.Sprintf("vfat (FAT%d)", fat.bits), root: fat.rootNode(), caseInsensitive: true}, nil
+	} else if !errors.Is(err, ErrUnrecognizedFilesystem) {
+		return nil, err
+	}
+	return nil, ErrUnrecognizedFilesystem
+}
+
+// Type returns a description of the filesystem's type, e.g. "ext4".
+func (f *Filesystem) Type() string {
+	return f.typ
+}
+
+// walk looks up a path, following symbolic links along the way, and also at
+// the end of the path if followLast is set.
+func (f *Filesystem) walk(op, name string, followLast bool) (fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	parents := []fsNode{f.root}
+	var components []string
+	if name != "." {
+		components = strings.Split(name, "/")
+	}
+	links := 0
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(parents) > 1 {
+				parents = parents[:len(parents)-1]
+			}
+			continue
+		}
+		dir := parents[len(parents)-1]
+		if !dir.info("").IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+		}
+		node, err := f.lookup(dir, component)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if node.info("").Mode()&fs.ModeSymlink != 0 && (len(components) > 0 || followLast) {
+			if links++; links > maxSymlinks {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			target, err := readLink(node)
+			if err != nil {
+				return nil, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			if strings.HasPrefix(target, "/") {
+				parents = parents[:1]
+			}
+			components = append(strings.Split(target, "/"), components...)
+			continue
+		}
+		parents = append(parents, node)
+	}
+	return parents[len(parents)-1], nil
+}
+
+// lookup finds an entry in a directory.
+func (f *Filesystem) lookup(dir fsNode, name string) (fsNode, error) {
+	entries, err := dir.entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.name == name || (f.caseInsensitive && strings.EqualFold(entry.name, name)) {
+			return entry.node()
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// readLink reads the target of a symbolic link.
+func readLink(node fsNode) (string, error) {
+	r, err := node.contents()
+	if err != nil {
+		return "", err
+	}
+	target := make([]byte, node.info("").Size())
+	if _, err := r.ReadAt(target, 0); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// Open opens a file or directory.  The returned file implements io.ReaderAt
+// and io.Seeker as well as fs.File, and fs.ReadDirFile if it is a directory.
+func (f *Filesystem) Open(name string) (fs.File, error) {
+	node, err := f.walk("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	file := &fsFile{node: node, fileInfo: node.info(path.Base(name))}
+	if !file.fileInfo.IsDir() {
+		r, err := node.contents()
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		file.SectionReader = io.NewSectionReader(r, 0, file.fileInfo.Size())
+	}
+	return file, nil
+}
+
+// Stat returns information about a file or directory, following symbolic
+// links.
+func (f *Filesystem) Stat(name string) (fs.FileInfo, error) {
+	node, err := f.walk("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(name)), nil
+}
+
+// Lstat returns information about a file, directory, or symbolic link, without
+// following a symbolic link at the end of the path.
+func (f *Filesystem) Lstat(name string) (fs.FileInfo, error) {
+	node, err := f.walk("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(name)), nil
+}
+
+// ReadLink returns the target of a symbolic link.
+func (f *Filesystem) ReadLink(name string) (string, error) {
+	node, err := f.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.info("").Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := readLink(node)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// ReadDir lists the contents of a directory, sorted by name.
+func (f *Filesystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := f.walk("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readDir(node)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// readDir lists the contents of a directory node, sorted by name.
+func readDir(node fsNode) ([]fs.DirEntry, error) {
+	if !node.info("").IsDir() {
+		return nil, errors.New("not a directory")
+	}
+	dirents, err := node.entries()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, 0, len(dirents))
+	for _, dirent := range dirents {
+		entries = append(entries, &fsDirEntry{fsDirent: dirent})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fsFileInfo describes a file, directory, or symbolic link.
+type fsFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *fsFileInfo) Name() string       { return i.name }
+func (i *fsFileInfo) Size() int64        { return i.size }
+func (i *fsFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *fsFileInfo) ModTime() time.Time { return i.modTime }
+func (i *fsFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fsFileInfo) Sys() any           { return nil }
+
+// fsDirEntry is an fs.DirEntry, which only reads information about the entry
+// from the filesystem when it's asked for it.
+type fsDirEntry struct {
+	fsDirent
+}
+
+func (e *fsDirEntry) Name() string      { return e.name }
+func (e *fsDirEntry) IsDir() bool       { return e.typ.IsDir() }
+func (e *fsDirEntry) Type() fs.FileMode { return e.typ }
+
+func (e *fsDirEntry) Info() (fs.FileInfo, error) {
+	node, err := e.node()
+	if err != nil {
+		return nil, err
+	}
+	return node.info(e.name), nil
+}
+
+// fsFile is an open file or directory.
+type fsFile struct {
+	*io.SectionReader
+	node     fsNode
+	fileInfo *fsFileInfo
+	dir      []fs.DirEntry
+	dirRead  bool
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.fileInfo, nil
+}
+
+func (f *fsFile) Read(b []byte) (int, error) {
+	if f.SectionReader == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.fileInfo.name, Err: errors.New("is a directory")}
+	}
+	return f.SectionReader.Read(b)
+}
+
+func (f *fsFile) Close() error {
+	return nil
+}
+
+// ReadDir reads the contents of a directory, following the conventions of
+// fs.ReadDirFile.
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.dirRead {
+		entries, err := readDir(f.node)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.fileInfo.name, Err: err}
+		}
+		f.dir, f.dirRead = entries, true
+	}
+	if n <= 0 {
+		entries := f.dir
+		f.dir = nil
+		return entries, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dir) {
+		n = len(f.dir)
+	}
+	entries := f.dir[:n]
+	f.dir = f.dir[n:]
+	return entries, nil
+}
+
+// fsExtent maps part of a file to a location on disk.
+type fsExtent struct {
+	logical  int64 // offset in the file
+	physical int64 // offset on disk, or -1 for a hole
+	length   int64
+}
+
+// extentReader reads a file whose contents are scattered around the disk, as
+// described by a sorted list of extents.  Parts of the file which aren't
+// covered by any extent are holes, and read as zeroes.
+type extentReader struct {
+	r       io.ReaderAt
+	extents []fsExtent
+	size    int64
+}
+
+func (e *extentReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if off >= e.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(b)) > e.size-off {
+		b = b[:e.size-off]
+		eof = io.EOF
+	}
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		// find the first extent which ends after pos
+		i := sort.Search(len(e.extents), func(i int) bool {
+			return e.extents[i].logical+e.extents[i].length > pos
+		})
+		chunk := int64(len(b) - n)
+		if i == len(e.extents) || e.extents[i].logical > pos {
+			// a hole, which lasts until the next extent
+			if i < len(e.extents) && e.extents[i].logical-pos < chunk {
+				chunk = e.extents[i].logical - pos
+			}
+			for j := range b[n : n+int(chunk)] {
+				b[n+j] = 0
+			}
+			n += int(chunk)
+			continue
+		}
+		extent := e.extents[i]
+		if extent.logical+extent.length-pos < chunk {
+			chunk = extent.logical + extent.length - pos
+		}
+		if extent.physical < 0 {
+			for j := range b[n : n+int(chunk)] {
+				b[n+j] = 0
+			}
+		} else if _, err := e.r.ReadAt(b[n:n+int(chunk)], extent.physical+pos-extent.logical); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+	}
+	return n, eof
+}
@@ -0,0 +1,463 @@
+package luksy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ext4Image builds a small filesystem with 1024-byte blocks, with files that
+// use extent trees and block maps, holes, and symbolic links.
+type ext4Image struct {
+	data []byte
+}
+
+const ext4ImageBlocks = 72
+
+func (e *ext4Image) block(n int) []byte {
+	return e.data[n*1024 : (n+1)*1024]
+}
+
+func (e *ext4Image) inode(n uint32, mode uint16, size int64, flags uint32, block []byte) {
+	inode := e.data[3*1024+int(n-1)*128:][:128]
+	binary.LittleEndian.PutUint16(inode[0:], mode)
+	binary.LittleEndian.PutUint32(inode[4:], uint32(size))
+	binary.LittleEndian.PutUint32(inode[16:], uint32(time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC).Unix()))
+	binary.LittleEndian.PutUint32(inode[32:], flags)
+	copy(inode[40:100], make([]byte, 60))
+	copy(inode[40:100], block)
+	binary.LittleEndian.PutUint32(inode[108:], uint32(size>>32))
+	if flags&ext4InodeFlagInlineData == 0 && len(block) > 0 && mode&0xf000 != 0xa000 {
+		binary.LittleEndian.PutUint32(inode[28:], 2)
+	}
+}
+
+// ext4Extents builds an extent tree node.
+func ext4Extents(depth uint16, entries ...[3]uint32) []byte {
+	node := make([]byte, 12+12*len(entries))
+	binary.LittleEndian.PutUint16(node[0:], ext4ExtentMagic)
+	binary.LittleEndian.PutUint16(node[2:], uint16(len(entries)))
+	binary.LittleEndian.PutUint16(node[4:], uint16(len(entries)))
+	binary.LittleEndian.PutUint16(node[6:], depth)
+	for i, entry := range entries {
+		e := node[12+12*i:]
+		binary.LittleEndian.PutUint32(e[0:], entry[0])
+		if depth == 0 {
+			binary.LittleEndian.PutUint16(e[4:], uint16(entry[1]))
+			binary.LittleEndian.PutUint32(e[8:], entry[2])
+		} else {
+			binary.LittleEndian.PutUint32(e[4:], entry[2])
+		}
+	}
+	return node
+}
+
+// dir fills in a directory block.
+func (e *ext4Image) dir(block int, entries ...any) {
+	b := e.block(block)
+	pos := 0
+	for i := 0; i < len(entries); i += 3 {
+		number, fileType, name := entries[i].(int), entries[i+1].(int), entries[i+2].(string)
+		recLen := (8 + len(name) + 3) &^ 3
+		if i+3 == len(entries) {
+			recLen = len(b) - pos
+		}
+		binary.LittleEndian.PutUint32(b[pos:], uint32(number))
+		binary.LittleEndian.PutUint16(b[pos+4:], uint16(recLen))
+		b[pos+6] = uint8(len(name))
+		b[pos+7] = uint8(fileType)
+		copy(b[pos+8:], name)
+		pos += recLen
+	}
+}
+
+func blockNumbers(numbers ...uint32) []byte {
+	b := make([]byte, 4*len(numbers))
+	for i, n := range numbers {
+		binary.LittleEndian.PutUint32(b[4*i:], n)
+	}
+	return b
+}
+
+func newExt4Image(t *testing.T) (*ext4Image, map[string][]byte) {
+	e := &ext4Image{data: make([]byte, ext4ImageBlocks*1024)}
+	sb := e.block(1)
+	binary.LittleEndian.PutUint32(sb[0:], 32)
+	binary.LittleEndian.PutUint32(sb[4:], ext4ImageBlocks)
+	binary.LittleEndian.PutUint32(sb[20:], 1)
+	binary.LittleEndian.PutUint32(sb[32:], 8192)
+	binary.LittleEndian.PutUint32(sb[40:], 32)
+	binary.LittleEndian.PutUint16(sb[56:], ext4Magic)
+	binary.LittleEndian.PutUint32(sb[76:], 1)
+	binary.LittleEndian.PutUint16(sb[88:], 128)
+	binary.LittleEndian.PutUint32(sb[96:], ext4IncompatFiletype|ext4IncompatExtents|ext4IncompatInlineData)
+	binary.LittleEndian.PutUint32(e.block(2)[8:], 3)
+
+	expected := make(map[string][]byte)
+	e.inode(2, 0x4000|0o755, 1024, ext4InodeFlagExtents, ext4Extents(0, [3]uint32{0, 1, 10}))
+	e.dir(10, 2, 2, ".", 2, 2, "..", 12, 1, "hello.txt", 13, 2, "sub", 15, 7, "link", 11, 1, "indirect", 16, 2, "inline")
+
+	expected["hello.txt"] = []byte("hello, world\n")
+	e.inode(12, 0x8000|0o644, 13, ext4InodeFlagExtents, ext4Extents(0, [3]uint32{0, 1, 11}))
+	copy(e.block(11), expected["hello.txt"])
+
+	// a directory which uses a block map
+	e.inode(13, 0x4000|0o700, 1024, 0, blockNumbers(12))
+	e.dir(12, 13, 2, ".", 2, 2, "..", 14, 1, "nested")
+
+	// a file with an extent tree with an index node, a hole, and an
+	// extent which was allocated but never written to
+	nested := randomBytes(t, 4*1024+5)
+	copy(nested[1024:], make([]byte, 3*1024))
+	expected["sub/nested"] = nested
+	e.inode(14, 0x8000|0o4755, int64(len(nested)), ext4InodeFlagExtents, ext4Extents(1, [3]uint32{0, 0, 13}))
+	copy(e.block(13), ext4Extents(0, [3]uint32{0, 1, 14}, [3]uint32{3, 32768 + 1, 15}, [3]uint32{4, 1, 16}))
+	copy(e.block(14), nested[:1024])
+	copy(e.block(15), randomBytes(t, 1024))
+	copy(e.block(16), nested[4*1024:])
+
+	// a "fast" symbolic link
+	e.inode(15, 0xa000|0o777, 10, 0, []byte("sub/nested"))
+	expected["link"] = nested
+
+	// 12 direct blocks, then an indirect block which points to one block
+	// followed by a hole
+	indirect := randomBytes(t, 14*1024)
+	copy(indirect[13*1024:], make([]byte, 1024))
+	expected["indirect"] = indirect
+	e.inode(11, 0x8000|0o600, int64(len(indirect)), 0, blockNumbers(20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32))
+	for i := 0; i < 12; i++ {
+		copy(e.block(20+i), indirect[i*1024:])
+	}
+	copy(e.block(32), blockNumbers(33, 0))
+	copy(e.block(33), indirect[12*1024:])
+
+	// a directory and file with inline data
+	inline := append(blockNumbers(2), make([]byte, 56)...)
+	binary.LittleEndian.PutUint32(inline[4:], 17)
+	binary.LittleEndian.PutUint16(inline[8:], 56)
+	inline[10] = 4
+	inline[11] = 1
+	copy(inline[12:], "tiny")
+	e.inode(16, 0x4000|0o755, 60, ext4InodeFlagInlineData, inline)
+	expected["inline/tiny"] = []byte("small enough to fit")
+	e.inode(17, 0x8000|0o644, int64(len(expected["inline/tiny"])), ext4InodeFlagInlineData, expected["inline/tiny"])
+	return e, expected
+}
+
+func TestExt4(t *testing.T) {
+	image, expected := newExt4Image(t)
+	filesystem, err := OpenFilesystem(bytes.NewReader(image.data))
+	require.NoError(t, err)
+	assert.Equal(t, "ext4", filesystem.Type())
+	require.NoError(t, fstest.TestFS(filesystem, "hello.txt", "sub/nested", "link", "indirect", "inline/tiny"))
+
+	for name, contents := range expected {
+		data, err := fs.ReadFile(filesystem, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, contents, data, name)
+	}
+	entries, err := fs.ReadDir(filesystem, ".")
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"hello.txt", "indirect", "inline", "link", "sub"}, names)
+
+	info, err := filesystem.Stat("sub/nested")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeSetuid|0o755, info.Mode())
+	assert.Equal(t, time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC), info.ModTime().UTC())
+	info, err = filesystem.Lstat("link")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeSymlink|0o777, info.Mode())
+	target, err := filesystem.ReadLink("link")
+	require.NoError(t, err)
+	assert.Equal(t, "sub/nested", target)
+	_, err = filesystem.ReadLink("hello.txt")
+	assert.Error(t, err)
+	_, err = filesystem.Open("sub/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = filesystem.Open("hello.txt/x")
+	assert.Error(t, err)
+	data, err := fs.ReadFile(filesystem, "sub/../inline/../hello.txt")
+	assert.Error(t, err, "fs.FS paths can't include ..")
+	assert.Nil(t, data)
+
+	// symbolic links which go in circles
+	image.inode(15, 0xa000|0o777, 4, 0, []byte("link"))
+	filesystem, err = OpenFilesystem(bytes.NewReader(image.data))
+	require.NoError(t, err)
+	_, err = filesystem.Open("link")
+	assert.ErrorContains(t, err, "too many levels of symbolic links")
+
+	// directory entries whose names can't be used as path components
+	for _, name := range []string{"../../evl", "a/b", "nul\x00", ""} {
+		image, _ = newExt4Image(t)
+		image.dir(10, 2, 2, ".", 2, 2, "..", 12, 1, name)
+		filesystem, err = OpenFilesystem(bytes.NewReader(image.data))
+		require.NoError(t, err)
+		_, err = fs.ReadDir(filesystem, ".")
+		assert.ErrorContains(t, err, "invalid name", "%q", name)
+	}
+
+	// an inode with inline data, whose extra size puts its extended
+	// attributes past the end of the inode
+	image, _ = newExt4Image(t)
+	binary.LittleEndian.PutUint16(image.block(1)[88:], 256)
+	inodes := image.data[3*1024:]
+	hello := inodes[11*256 : 12*256]
+	copy(hello, inodes[11*128:12*128])
+	binary.LittleEndian.PutUint32(hello[32:], ext4InodeFlagInlineData)
+	binary.LittleEndian.PutUint16(hello[128:], 0xfff0)
+	copy(inodes[256:256+128], inodes[128:256])
+	filesystem, err = OpenFilesystem(bytes.NewReader(image.data))
+	require.NoError(t, err)
+	_, err = fs.ReadFile(filesystem, "hello.txt")
+	assert.ErrorContains(t, err, "extra inode size")
+
+	// reading the filesystem from an encrypted payload
+	image, expected = newExt4Image(t)
+	f, volume := payloadVolume(t, image.data)
+	payload, err := volume.Payload(f)
+	require.NoError(t, err)
+	filesystem, err = OpenFilesystem(payload)
+	require.NoError(t, err)
+	data, err = fs.ReadFile(filesystem, "sub/nested")
+	require.NoError(t, err)
+	assert.Equal(t, expected["sub/nested"], data)
+
+	_, err = OpenFilesystem(bytes.NewReader(make([]byte, 8192)))
+	assert.ErrorIs(t, err, ErrUnrecognizedFilesystem)
+	_, err = OpenFilesystem(bytes.NewReader(nil))
+	assert.ErrorIs(t, err, ErrUnrecognizedFilesystem)
+}
+
+// fatImage builds a FAT filesystem with 512-byte sectors and clusters.
+type fatImage struct {
+	data     []byte
+	bits     int
+	fatStart int
+	dataSect int
+	rootSect int
+}
+
+func (f *fatImage) setFAT(cluster, value uint32) {
+	fat := f.data[f.fatStart*512:]
+	switch f.bits {
+	case 12:
+		off := int(cluster + cluster/2)
+		if cluster&1 == 0 {
+			fat[off] = uint8(value)
+			fat[off+1] = fat[off+1]&0xf0 | uint8(value>>8)&0x0f
+		} else {
+			fat[off] = fat[off]&0x0f | uint8(value<<4)
+			fat[off+1] = uint8(value >> 4)
+		}
+	case 16:
+		binary.LittleEndian.PutUint16(fat[2*cluster:], uint16(value))
+	default:
+		binary.LittleEndian.PutUint32(fat[4*cluster:], value)
+	}
+}
+
+func (f *fatImage) cluster(n uint32) []byte {
+	return f.data[(f.dataSect+int(n)-2)*512:][:512]
+}
+
+// chain links clusters together, and returns the first one.
+func (f *fatImage) chain(clusters ...uint32) uint32 {
+	for i, c := range clusters {
+		next := uint32(0x0fffffff)
+		if i+1 < len(clusters) {
+			next = clusters[i+1]
+		}
+		f.setFAT(c, next&(1<<f.bits-1))
+	}
+	return clusters[0]
+}
+
+func fatDirent(name string, attr, ntres uint8, cluster uint32, size int) []byte {
+	entry := make([]byte, fatDirentSize)
+	copy(entry, name)
+	entry[11] = attr
+	entry[12] = ntres
+	binary.LittleEndian.PutUint16(entry[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(entry[22:], 10<<11|20<<5|15)             // 10:20:30
+	binary.LittleEndian.PutUint16(entry[24:], uint16(2021-1980)<<9|6<<5|7) // 2021-06-07
+	binary.LittleEndian.PutUint16(entry[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(entry[28:], uint32(size))
+	return entry
+}
+
+// fatLongName builds the entries which precede shortName's entry to give it a
+// long name.
+func fatLongName(long, shortName string) []byte {
+	chars := utf16.Encode([]rune(long))
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+		for len(chars)%13 != 0 {
+			chars = append(chars, 0xffff)
+		}
+	}
+	count := len(chars) / 13
+	var entries []byte
+	for sequence := count; sequence >= 1; sequence-- {
+		entry := make([]byte, fatDirentSize)
+		entry[0] = uint8(sequence)
+		if sequence == count {
+			entry[0] |= fatLastLongName
+		}
+		entry[11] = fatAttrLongName
+		entry[13] = fatShortNameChecksum([]byte(shortName))
+		for i, offset := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(entry[offset:], chars[13*(sequence-1)+i])
+		}
+		entries = append(entries, entry...)
+	}
+	return entries
+}
+
+func newFATImage(t *testing.T, bits int) (*fatImage, map[string][]byte) {
+	clusters := map[int]int{12: 200, 16: 5000, 32: 70000}[bits]
+	rootEntries := 64
+	if bits == 32 {
+		rootEntries = 0
+	}
+	fatSectors := ((clusters+2)*bits/8 + 511) / 512
+	f := &fatImage{bits: bits, fatStart: 4, rootSect: 4 + 2*fatSectors}
+	f.dataSect = f.rootSect + rootEntries*fatDirentSize/512
+	total := f.dataSect + clusters
+	f.data = make([]byte, total*512)
+	bs := f.data[:512]
+	bs[0] = 0xeb
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:], uint16(f.fatStart))
+	bs[16] = 2
+	binary.LittleEndian.PutUint16(bs[17:], uint16(rootEntries))
+	binary.LittleEndian.PutUint32(bs[32:], uint32(total))
+	if bits == 32 {
+		binary.LittleEndian.PutUint32(bs[36:], uint32(fatSectors))
+		binary.LittleEndian.PutUint32(bs[44:], f.chain(2))
+	} else {
+		binary.LittleEndian.PutUint16(bs[22:], uint16(fatSectors))
+	}
+	bs[510], bs[511] = 0x55, 0xaa
+
+	expected := make(map[string][]byte)
+	var root []byte
+	root = append(root, fatDirent("VOLUME     ", fatAttrVolumeID, 0, 0, 0)...)
+	deleted := fatDirent("DELETED TXT", 0, 0, 0, 0)
+	deleted[0] = 0xe5
+	root = append(root, deleted...)
+
+	// a file which isn't stored in consecutive clusters
+	expected["README.TXT"] = randomBytes(t, 3*512-100)
+	root = append(root, fatDirent("README  TXT", fatAttrReadOnly, 0, f.chain(10, 11, 5), len(expected["README.TXT"]))...)
+	copy(f.cluster(10), expected["README.TXT"])
+	copy(f.cluster(11), expected["README.TXT"][512:])
+	copy(f.cluster(5), expected["README.TXT"][1024:])
+
+	expected["Long File Name, Ünicode.txt"] = []byte("long\n")
+	root = append(root, fatLongName("Long File Name, Ünicode.txt", "LONGFI~1TXT")...)
+	root = append(root, fatDirent("LONGFI~1TXT", 0, 0, f.chain(6), 5)...)
+	copy(f.cluster(6), "long\n")
+
+	expected["lower.txt"] = []byte("lower\n")
+	root = append(root, fatDirent("LOWER   TXT", 0, fatLowercaseBase|fatLowercaseExt, f.chain(7), 6)...)
+	copy(f.cluster(7), "lower\n")
+
+	// a long name whose checksum doesn't match the entry it's attached
+	// to, so it should be ignored
+	root = append(root, fatLongName("Orphaned long name", "SOMETH~1TXT")...)
+	root = append(root, fatDirent("STALE   TXT", 0, 0, 0, 0)...)
+	expected["STALE.TXT"] = []byte{}
+
+	root = append(root, fatDirent("SUBDIR     ", fatAttrDirectory, 0, f.chain(8, 9), 0)...)
+	subdir := fatDirent(".          ", fatAttrDirectory, 0, 8, 0)
+	subdir = append(subdir, fatDirent("..         ", fatAttrDirectory, 0, 0, 0)...)
+	for i := 0; i < 16; i++ {
+		// fill the first cluster, so that the directory continues
+		// into the next one
+		subdir = append(subdir, fatDirent("EMPTY"+string(rune('A'+i))+"     ", 0, 0, 0, 0)...)
+		expected["SUBDIR/EMPTY"+string(rune('A'+i))] = []byte{}
+	}
+	expected["SUBDIR/INNER.BIN"] = []byte("inner\n")
+	subdir = append(subdir, fatDirent("INNER   BIN", 0, 0, f.chain(12), 6)...)
+	copy(f.cluster(12), "inner\n")
+	copy(f.cluster(8), subdir)
+	copy(f.cluster(9), subdir[512:])
+
+	if bits == 32 {
+		copy(f.cluster(2), root)
+	} else {
+		copy(f.data[f.rootSect*512:], root)
+	}
+	// the second copy of the allocation table
+	copy(f.data[(f.fatStart+fatSectors)*512:], f.data[f.fatStart*512:(f.fatStart+fatSectors)*512])
+	return f, expected
+}
+
+func TestFAT(t *testing.T) {
+	for _, bits := range []int{12, 16, 32} {
+		image, expected := newFATImage(t, bits)
+		filesystem, err := OpenFilesystem(bytes.NewReader(image.data))
+		require.NoError(t, err, "FAT%d", bits)
+		require.Equal(t, map[int]string{12: "vfat (FAT12)", 16: "vfat (FAT16)", 32: "vfat (FAT32)"}[bits], filesystem.Type())
+		var names []string
+		for name := range expected {
+			names = append(names, name)
+		}
+		require.NoError(t, fstest.TestFS(filesystem, names...), "FAT%d", bits)
+		for name, contents := range expected {
+			data, err := fs.ReadFile(filesystem, name)
+			require.NoError(t, err, "FAT%d %s", bits, name)
+			assert.Equal(t, contents, data, "FAT%d %s", bits, name)
+		}
+
+		// names are case-insensitive
+		data, err := fs.ReadFile(filesystem, "subdir/inner.bin")
+		require.NoError(t, err, "FAT%d", bits)
+		assert.Equal(t, expected["SUBDIR/INNER.BIN"], data)
+
+		info, err := filesystem.Stat("README.TXT")
+		require.NoError(t, err)
+		assert.Equal(t, fs.FileMode(0o444), info.Mode())
+		assert.Equal(t, time.Date(2021, 6, 7, 10, 20, 30, 0, time.Local), info.ModTime())
+		info, err = filesystem.Stat("SUBDIR")
+		require.NoError(t, err)
+		assert.Equal(t, fs.ModeDir|0o755, info.Mode())
+
+		// a broken cluster chain
+		image.setFAT(11, 0)
+		filesystem, err = OpenFilesystem(bytes.NewReader(image.data))
+		require.NoError(t, err)
+		_, err = fs.ReadFile(filesystem, "README.TXT")
+		assert.Error(t, err, "FAT%d", bits)
+		assert.False(t, errors.Is(err, io.EOF))
+
+		// a long name which can't be used as a path component, in
+		// place of the volume label and the deleted file
+		image, _ = newFATImage(t, bits)
+		root := image.data[image.rootSect*512:]
+		if bits == 32 {
+			root = image.cluster(2)
+		}
+		copy(root, append(fatLongName("../../evl", "EVL        "), fatDirent("EVL        ", 0, 0, 0, 0)...))
+		filesystem, err = OpenFilesystem(bytes.NewReader(image.data))
+		require.NoError(t, err)
+		_, err = fs.ReadDir(filesystem, ".")
+		assert.ErrorContains(t, err, "invalid name", "FAT%d", bits)
+	}
+}
@@ -0,0 +1,351 @@
+package luksy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRangeNotSupported is returned by NewHTTPReader when the server doesn't
+// answer range requests with partial content.
+var ErrRangeNotSupported = errors.New("server does not support range requests")
+
+const (
+	defaultHTTPBlockSize    = 64 * 1024
+	defaultHTTPCacheSize    = 16 * 1024 * 1024
+	defaultHTTPReadahead    = 4 * 1024 * 1024
+	defaultHTTPRetries      = 3
+	defaultHTTPRetryBackoff = time.Second
+)
+
+// HTTPReaderOptions control how an HTTPReader fetches and caches data.
+type HTTPReaderOptions struct {
+	// Client is used to make requests.  By default, http.DefaultClient
+	// is used.
+	Client *http.Client
+	// BlockSize is the unit, in bytes, in which data is fetched and
+	// cached.  The default is 64 KiB.
+	BlockSize int64
+	// CacheSize is the amount of data, in bytes, which is kept for reuse.
+	// It is rounded up to a multiple of BlockSize.  The default is 16 MiB.
+	CacheSize int64
+	// Readahead is the most data, in bytes, which will be fetched in one
+	// request when the file is being read sequentially.  The default is
+	// 4 MiB, or CacheSize if that is smaller.
+	Readahead int64
+	// Retries is the number of times a failed request will be retried.
+	// The default is 3, and a negative value disables retries.
+	Retries int
+	// RetryBackoff is how long to wait before retrying a request for the
+	// first time.  The wait doubles with each subsequent attempt.  The
+	// default is one second.
+	RetryBackoff time.Duration
+}
+
+// HTTPReader reads a file from a web server using range requests, fetching
+// only the parts of the file that are read, and caching them.  If the server
+// identifies the version of the file that it first returned, requests for
+// other parts of the file will fail if it changes.
+type HTTPReader struct {
+	url       string
+	options   HTTPReaderOptions
+	size      int64
+	etag      string
+	modified  string
+	mu        sync.Mutex
+	blocks    map[int64]*list.Element
+	lru       *list.List // of *httpBlock, most recently used first
+	next      int64      // where the last read ended
+	readahead int64
+	pos       int64 // for Read and Seek
+}
+
+type httpBlock struct {
+	index int64
+	data  []byte
+}
+
+// NewHTTPReader prepares to read the file at url, which is expected to use
+// the http or https scheme.  It fetches the first block of the file to find
+// out how large the file is, and to check that the server supports range
+// requests.
+func NewHTTPReader(url string, options HTTPReaderOptions) (*HTTPReader, error) {
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	if options.BlockSize <= 0 {
+		options.BlockSize = defaultHTTPBlockSize
+	}
+	if options.CacheSize <= 0 {
+		options.CacheSize = defaultHTTPCacheSize
+	}
+	options.CacheSize = roundUpToMultiple64(options.CacheSize, options.BlockSize)
+	if options.Readahead <= 0 {
+		options.Readahead = defaultHTTPReadahead
+	}
+	if options.Readahead > options.CacheSize {
+		options.Readahead = options.CacheSize
+	}
+	if options.Retries == 0 {
+		options.Retries = defaultHTTPRetries
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = defaultHTTPRetryBackoff
+	}
+	r := &HTTPReader{
+		url:       url,
+		options:   options,
+		size:      -1,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+		readahead: options.BlockSize,
+	}
+	data, err := r.fetch(0, options.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	r.cache(0, data)
+	return r, nil
+}
+
+// Size returns the size of the file.
+func (r *HTTPReader) Size() int64 {
+	return r.size
+}
+
+// fetch requests length bytes starting at offset, retrying if the request
+// fails in a way that might not happen again.
+func (r *HTTPReader) fetch(offset, length int64) ([]byte, error) {
+	backoff := r.options.RetryBackoff
+	for try := 0; ; try++ {
+		data, retry, err := r.fetchOnce(offset, length)
+		if err == nil || !retry || try >= r.options.Retries {
+			return data, err
+		}
+		log().Debugf("retrying request for %d bytes at offset %d of %s in %v: %v", length, offset, r.url, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// fetchOnce makes one request, and also returns whether or not it's worth
+// retrying it if it fails.
+func (r *HTTPReader) fetchOnce(offset, length int64) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	switch {
+	case r.etag != "":
+		req.Header.Set("If-Match", r.etag)
+	case r.modified != "":
+		req.Header.Set("If-Unmodified-Since", r.modified)
+	}
+	resp, err := r.options.Client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		if r.size == -1 {
+			// the first request, for an empty file
+			if total, ok := parseContentRangeTotal(resp.Header.Get("Content-Range")); ok && total == 0 {
+				r.size = 0
+				return nil, false, nil
+			}
+		}
+		return nil, false, fmt.Errorf("%s: bytes %d-%d are not available", r.url, offset, offset+length-1)
+	case http.StatusPreconditionFailed:
+		return nil, false, fmt.Errorf("%s: file changed on the server while it was being read", r.url)
+	case http.StatusOK:
+		if r.size == -1 && resp.ContentLength == 0 {
+			// some servers answer this way for empty files
+			r.size = 0
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("%s: %w", r.url, ErrRangeNotSupported)
+	default:
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+		return nil, retry, fmt.Errorf("%s: %s", r.url, resp.Status)
+	}
+	start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", r.url, err)
+	}
+	if r.size == -1 {
+		r.size = total
+		if strings.HasPrefix(resp.Header.Get("ETag"), `"`) {
+			// only a strong ETag can be used with If-Match
+			r.etag = resp.Header.Get("ETag")
+		}
+		r.modified = resp.Header.Get("Last-Modified")
+	}
+	if start != offset || total != r.size || (end != offset+length-1 && end != total-1) {
+		return nil, false, fmt.Errorf("%s: asked for bytes %d-%d of %d, got %d-%d of %d", r.url, offset, offset+length-1, r.size, start, end, total)
+	}
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, true, fmt.Errorf("%s: reading bytes %d-%d: %w", r.url, start, end, err)
+	}
+	return data, false, nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/total".
+func parseContentRange(value string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	rangeSpec, totalSpec, ok2 := strings.Cut(spec, "/")
+	startSpec, endSpec, ok3 := strings.Cut(rangeSpec, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, 0, fmt.Errorf("unexpected Content-Range %q", value)
+	}
+	if start, err = strconv.ParseInt(startSpec, 10, 64); err == nil {
+		if end, err = strconv.ParseInt(endSpec, 10, 64); err == nil {
+			total, err = strconv.ParseInt(totalSpec, 10, 64)
+		}
+	}
+	if err != nil || start < 0 || end < start || total <= end {
+		return 0, 0, 0, fmt.Errorf("unexpected Content-Range %q", value)
+	}
+	return start, end, total, nil
+}
+
+// parseContentRangeTotal parses a Content-Range header of the form
+// "bytes */total", which accompanies a response that has no content.
+func parseContentRangeTotal(value string) (int64, bool) {
+	totalSpec, ok := strings.CutPrefix(value, "bytes */")
+	if !ok {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(totalSpec, 10, 64)
+	return total, err == nil && total >= 0
+}
+
+// cache splits data, which starts at the beginning of a block, into blocks,
+// and adds them to the cache, discarding the least recently used blocks to
+// make room for them.
+func (r *HTTPReader) cache(offset int64, data []byte) {
+	for len(data) > 0 {
+		block := data
+		if int64(len(block)) > r.options.BlockSize {
+			block = block[:r.options.BlockSize]
+		}
+		index := offset / r.options.BlockSize
+		if e, ok := r.blocks[index]; ok {
+			r.lru.Remove(e)
+		}
+		r.blocks[index] = r.lru.PushFront(&httpBlock{index: index, data: block})
+		for int64(r.lru.Len())*r.options.BlockSize > r.options.CacheSize {
+			oldest := r.lru.Remove(r.lru.Back()).(*httpBlock)
+			delete(r.blocks, oldest.index)
+		}
+		offset += int64(len(block))
+		data = data[len(block):]
+	}
+}
+
+// ReadAt reads from the file, fetching any parts of it that aren't cached.
+func (r *HTTPReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(b)) > r.size-off {
+		b = b[:r.size-off]
+		eof = io.EOF
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// when we're being read from front to back, fetch more at a time
+	if off == r.next {
+		r.readahead *= 2
+		if r.readahead > r.options.Readahead {
+			r.readahead = r.options.Readahead
+		}
+	} else {
+		r.readahead = r.options.BlockSize
+	}
+	r.next = off + int64(len(b))
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		index := pos / r.options.BlockSize
+		if e, ok := r.blocks[index]; ok {
+			r.lru.MoveToFront(e)
+			block := e.Value.(*httpBlock).data
+			n += copy(b[n:], block[pos-index*r.options.BlockSize:])
+			continue
+		}
+		// fetch everything up to the next block that we already have,
+		// or the readahead limit, whichever comes first, but at least
+		// enough to finish this read
+		start := index * r.options.BlockSize
+		end := start + r.readahead
+		if wanted := roundUpToMultiple64(off+int64(len(b)), r.options.BlockSize); end < wanted {
+			end = wanted
+		}
+		for i := index + 1; i*r.options.BlockSize < end; i++ {
+			if _, ok := r.blocks[i]; ok {
+				end = i * r.options.BlockSize
+				break
+			}
+		}
+		if end > r.size {
+			end = r.size
+		}
+		data, err := r.fetch(start, end-start)
+		if err != nil {
+			return n, err
+		}
+		n += copy(b[n:], data[pos-start:])
+		r.cache(start, data)
+	}
+	return n, eof
+}
+
+// Read reads from the file, starting where the last Read ended or where Seek
+// set the position.
+func (r *HTTPReader) Read(b []byte) (int, error) {
+	n, err := r.ReadAt(b, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the position that Read will read from next.
+func (r *HTTPReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return r.pos, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	r.pos = offset
+	return r.pos, nil
+}
+
+// Close discards any cached data.
+func (r *HTTPReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blocks = make(map[int64]*list.Element)
+	r.lru.Init()
+	return nil
+}
@@ -0,0 +1,201 @@
+package luksy
+
+import (
+	"bytes"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeServer serves a file, keeping track of how much of it was asked for,
+// and failing requests when it's told to.
+type rangeServer struct {
+	mu       sync.Mutex
+	content  []byte
+	etag     string
+	requests int
+	served   int64
+	failures int // the number of upcoming requests to fail
+	status   int // what to fail them with
+	noRanges bool
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	content, etag := s.content, s.etag
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		w.WriteHeader(s.status)
+		return
+	}
+	noRanges := s.noRanges
+	s.mu.Unlock()
+	if noRanges {
+		req.Header.Del("Range")
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	counter := &countingWriter{ResponseWriter: w}
+	http.ServeContent(counter, req, "image", time.Time{}, bytes.NewReader(content))
+	s.mu.Lock()
+	s.served += counter.n
+	s.mu.Unlock()
+}
+
+func (s *rangeServer) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.served
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func startRangeServer(t *testing.T, content []byte) (*rangeServer, string) {
+	s := &rangeServer{content: content, etag: `"v1"`}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server.URL + "/image"
+}
+
+func TestHTTPReader(t *testing.T) {
+	content := randomBytes(t, 1024*1024+123)
+	s, url := startRangeServer(t, content)
+	options := HTTPReaderOptions{BlockSize: 4096, CacheSize: 256 * 1024, RetryBackoff: time.Millisecond}
+	r, err := NewHTTPReader(url, options)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), r.Size())
+
+	// random reads
+	rng := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		off := rng.Int63n(int64(len(content)))
+		buf := make([]byte, rng.Intn(20000))
+		n, err := r.ReadAt(buf, off)
+		expected := content[off:]
+		if len(expected) > len(buf) {
+			expected = expected[:len(buf)]
+			require.NoError(t, err)
+		} else {
+			require.ErrorIs(t, err, io.EOF)
+		}
+		require.Equal(t, expected, buf[:n])
+	}
+
+	// reading something again shouldn't mean asking for it again
+	buf := make([]byte, 100)
+	_, err = r.ReadAt(buf, 500000)
+	require.NoError(t, err)
+	requests, _ := s.stats()
+	_, err = r.ReadAt(buf, 500010)
+	require.NoError(t, err)
+	after, _ := s.stats()
+	assert.Equal(t, requests, after)
+
+	// reading from front to back should fetch more than one block at a
+	// time
+	r, err = NewHTTPReader(url, options)
+	require.NoError(t, err)
+	requests, _ = s.stats()
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	after, _ = s.stats()
+	assert.Less(t, after-requests, 20)
+
+	// Read and Seek
+	_, err = r.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, content[len(content)-10:], data)
+	require.NoError(t, r.Close())
+
+	// failures which go away are retried
+	s.failures, s.status = 2, http.StatusServiceUnavailable
+	_, err = r.ReadAt(buf, 0)
+	require.NoError(t, err)
+	s.failures = 10
+	_, err = r.ReadAt(buf, 200000)
+	assert.ErrorContains(t, err, "503")
+
+	// failures which won't go away aren't
+	s.failures, s.status = 10, http.StatusNotFound
+	requests, _ = s.stats()
+	_, err = NewHTTPReader(url, options)
+	assert.ErrorContains(t, err, "404")
+	after, _ = s.stats()
+	assert.Equal(t, requests+1, after)
+	s.failures = 0
+
+	// the file changing out from under us is an error
+	r, err = NewHTTPReader(url, options)
+	require.NoError(t, err)
+	s.mu.Lock()
+	s.content, s.etag = randomBytes(t, len(content)), `"v2"`
+	s.mu.Unlock()
+	_, err = r.ReadAt(buf, 300000)
+	assert.ErrorContains(t, err, "changed")
+
+	// servers which ignore ranges, and empty files
+	s.noRanges = true
+	_, err = NewHTTPReader(url, options)
+	assert.ErrorIs(t, err, ErrRangeNotSupported)
+	s.noRanges = false
+	s.content = nil
+	r, err = NewHTTPReader(url, options)
+	require.NoError(t, err)
+	assert.Zero(t, r.Size())
+	_, err = r.ReadAt(buf, 0)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHTTPReaderUnlock(t *testing.T) {
+	// a LUKS image which is mostly payload
+	header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{})
+	require.NoError(t, err)
+	plaintext := randomBytes(t, 8*1024*1024)
+	var image bytes.Buffer
+	image.Write(header)
+	wc := volume.Cipher.EncryptWriter(&image, volume.FirstSector, StreamOptions{})
+	_, err = wc.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+
+	s, url := startRangeServer(t, image.Bytes())
+	r, err := NewHTTPReader(url, HTTPReaderOptions{})
+	require.NoError(t, err)
+	v1header, _, _, _, err := ReadHeaders(r, ReadHeaderOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, v1header)
+	unlocked, err := v1header.Unlock("password", r, UnlockOptions{})
+	require.NoError(t, err)
+
+	// checking the password shouldn't need much of the image
+	_, served := s.stats()
+	assert.Less(t, served, int64(1024*1024))
+
+	rc := unlocked.DecryptReader(r, StreamOptions{})
+	decrypted, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, plaintext, decrypted)
+}
@@ -0,0 +1,31 @@
+package luksy
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger atomic.Value // holds a loggerHolder
+
+type loggerHolder struct {
+	logrus.FieldLogger
+}
+
+// SetLogger sets the logger which diagnostic messages are sent to.  By
+// default, they are sent to logrus's standard logger.  Passing nil restores
+// the default.
+func SetLogger(l logrus.FieldLogger) {
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	logger.Store(loggerHolder{l})
+}
+
+// log returns the logger which diagnostic messages should be sent to.
+func log() logrus.FieldLogger {
+	if h, ok := logger.Load().(loggerHolder); ok {
+		return h.FieldLogger
+	}
+	return logrus.StandardLogger()
+}
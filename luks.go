@@ -3,17 +3,155 @@ package luksy
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
+// ReaderAtWriterAt is a combination of io.ReaderAt and io.WriterAt, which is
+// what we need in order to update headers in place.
+type ReaderAtWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
 // ReadHeaderOptions can control some of what ReadHeaders() does.
-type ReadHeaderOptions struct{}
+type ReadHeaderOptions struct {
+	// Recover, if set, causes ReadHeaders() to look for a LUKSv2
+	// secondary header at each of the offsets where one can be found if
+	// the primary header is missing or its checksum doesn't match.  If
+	// one is found, a warning is logged, and a primary header rebuilt
+	// from it is returned along with it.
+	Recover bool
+}
 
 // ReadHeaders reads LUKS headers from the specified file, returning either a
 // LUKSv1 header, or two LUKSv2 headers and a LUKSv2 JSON block, depending on
-// which format is detected.
+// which format is detected.  The JSON block is read from whichever of the
+// LUKSv2 headers is intact and has the higher sequence ID.
 func ReadHeaders(f io.ReaderAt, options ReadHeaderOptions) (*V1Header, *V2Header, *V2Header, *V2JSON, error) {
+	v1, v2a, v2b, j, err := readHeaders(f)
+	var damaged *damagedHeaderError
+	if err != nil && options.Recover && errors.As(err, &damaged) {
+		h1, h2, _, j2, recoverErr := recoverV2Headers(f)
+		if errors.Is(recoverErr, errNoSecondaryHeader) {
+			return nil, nil, nil, nil, err
+		}
+		if recoverErr != nil {
+			return nil, nil, nil, nil, fmt.Errorf("%w (while recovering from a secondary header: %w)", err, recoverErr)
+		}
+		log().Warnf("primary LUKS header is unusable (%v), using secondary header at offset %d", err, h2.HeaderOffset())
+		return nil, h1, h2, j2, nil
+	}
+	return v1, v2a, v2b, j, err
+}
+
+// damagedHeaderError is returned by readHeaders when the primary header is
+// missing, or its checksum doesn't match, which are the cases where a
+// secondary header might be usable in its place.
+type damagedHeaderError struct {
+	err error
+}
+
+func (e *damagedHeaderError) Error() string {
+	return e.err.Error()
+}
+
+func (e *damagedHeaderError) Unwrap() error {
+	return e.err
+}
+
+// errNoSecondaryHeader is returned by recoverV2Headers when it doesn't find
+// anything that looks like a secondary header.
+var errNoSecondaryHeader = errors.New("no secondary LUKS header found")
+
+// RecoverV2PrimaryHeader looks for a LUKSv2 secondary header at each of the
+// offsets where one can be found, and if it finds one which is intact,
+// returns a primary header and JSON area rebuilt from it, which can be
+// written to the beginning of the file in place of a damaged primary header,
+// along with the offset of the secondary header.
+func RecoverV2PrimaryHeader(f io.ReaderAt) ([]byte, int64, error) {
+	h1, h2, jsonArea, _, err := recoverV2Headers(f)
+	if err != nil {
+		return nil, -1, err
+	}
+	rebuilt := make([]byte, len(h1)+len(jsonArea))
+	copy(rebuilt, h1[:])
+	copy(rebuilt[len(h1):], jsonArea)
+	return rebuilt, int64(h2.HeaderOffset()), nil
+}
+
+// recoverV2Headers scans for an intact LUKSv2 secondary header, returning a
+// primary header rebuilt from it, the secondary header, its raw JSON area,
+// and the decoded JSON data.
+func recoverV2Headers(f io.ReaderAt) (*V2Header, *V2Header, []byte, *V2JSON, error) {
+	var errs error
+	addErr := func(err error) {
+		if errs == nil {
+			errs = err
+		} else {
+			errs = fmt.Errorf("%w; %w", errs, err)
+		}
+	}
+	for _, offset := range v2HeaderSizes {
+		var h2 V2Header
+		n, err := f.ReadAt(h2[:], int64(offset))
+		if n != len(h2) {
+			break // the file isn't big enough to hold anything at larger offsets, either
+		}
+		if h2.Magic() != V2Magic2 || h2.Version() != 2 {
+			continue
+		}
+		if h2.HeaderOffset() != offset || h2.HeaderSize() != offset {
+			addErr(fmt.Errorf("secondary header at offset %d has header offset %d and size %d", offset, h2.HeaderOffset(), h2.HeaderSize()))
+			continue
+		}
+		jsonArea := make([]byte, offset-V2SectorSize)
+		if n, err = f.ReadAt(jsonArea, int64(offset)+V2SectorSize); n != len(jsonArea) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			addErr(fmt.Errorf("reading JSON data for secondary header at offset %d: %w", offset, err))
+			continue
+		}
+		if err = h2.verifyChecksum(jsonArea); err != nil {
+			addErr(fmt.Errorf("secondary header at offset %d: %w", offset, err))
+			continue
+		}
+		var jsonData V2JSON
+		if err = json.Unmarshal(bytes.TrimRightFunc(jsonArea, func(r rune) bool { return r == 0 }), &jsonData); err != nil {
+			addErr(fmt.Errorf("decoding JSON data for secondary header at offset %d: %w", offset, err))
+			continue
+		}
+		if uint64(jsonData.Config.JsonSize) != offset-V2SectorSize {
+			addErr(fmt.Errorf("JSON data size mismatch for secondary header at offset %d: (expected %d, used %d)", offset, jsonData.Config.JsonSize, offset-V2SectorSize))
+			continue
+		}
+		h1 := h2
+		if err = h1.SetMagic(V2Magic1); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		h1.SetHeaderOffset(0)
+		sum, err := h1.computeChecksum(jsonArea)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		h1.SetChecksum(sum)
+		return &h1, &h2, jsonArea, &jsonData, nil
+	}
+	if errs != nil {
+		return nil, nil, nil, nil, fmt.Errorf("no usable secondary LUKS header found: %w", errs)
+	}
+	return nil, nil, nil, nil, errNoSecondaryHeader
+}
+
+// readHeaders reads the headers at the beginning of f.  For a LUKSv2 volume,
+// both copies of the header are read, and the JSON metadata that's returned
+// comes from whichever intact copy has the higher sequence ID, so that if we
+// were interrupted while writing the headers, the more recent metadata is
+// used.
+func readHeaders(f io.ReaderAt) (*V1Header, *V2Header, *V2Header, *V2JSON, error) {
 	var v1 V1Header
 	var v2a, v2b V2Header
 	n, err := f.ReadAt(v2a[:], 0)
@@ -30,7 +168,7 @@ func ReadHeaders(f io.ReaderAt, options ReadHeaderOptions) (*V1Header, *V2Header
 		return nil, nil, nil, nil, fmt.Errorf("only able to read %d bytes - file truncated?", n)
 	}
 	if v2a.Magic() != V2Magic1 {
-		return nil, nil, nil, nil, fmt.Errorf("internal error: magic mismatch in LUKS header (%q)", v2a.Magic())
+		return nil, nil, nil, nil, &damagedHeaderError{fmt.Errorf("internal error: magic mismatch in LUKS header (%q)", v2a.Magic())}
 	}
 	switch v2a.Version() { // is it a v1 header, or the first v2 header?
 	case 1:
@@ -43,6 +181,14 @@ func ReadHeaders(f io.ReaderAt, options ReadHeaderOptions) (*V1Header, *V2Header
 		if size < 4096 {
 			return nil, nil, nil, nil, fmt.Errorf("unsupported header size while looking for JSON data")
 		}
+		primaryJSON, err := readV2JSONArea(f, v2a, 0)
+		if err != nil {
+			err = fmt.Errorf("primary LUKS header: %w", err)
+			if errors.Is(err, ErrHeaderChecksum) {
+				err = &damagedHeaderError{err}
+			}
+			return nil, nil, nil, nil, err
+		}
 		if n, err = f.ReadAt(v2b[:], int64(size)); err != nil || n != len(v2b) {
 			if err == nil && n != len(v2b) {
 				err = fmt.Errorf("short read: read only %d bytes, should have read %d", n, len(v2b))
@@ -50,26 +196,167 @@ func ReadHeaders(f io.ReaderAt, options ReadHeaderOptions) (*V1Header, *V2Header
 			return nil, nil, nil, nil, err
 		}
 		if v2b.Magic() != V2Magic2 {
-			return nil, nil, nil, nil, fmt.Errorf("internal error: magic mismatch in second LUKS header (%q)", v2b.Magic())
+			log().Warnf("secondary LUKS header at offset %d is missing (magic %q), using the primary header", size, v2b.Magic())
+			return nil, &v2a, &v2b, primaryJSON, nil
 		}
-		jsonSize := size - 4096
-		buf := make([]byte, jsonSize)
-		n, err = f.ReadAt(buf[:], 4096)
+		secondaryJSON, err := readV2JSONArea(f, v2b, size)
 		if err != nil {
-			return nil, nil, nil, nil, fmt.Errorf("internal error: while reading JSON data: %w", err)
+			log().Warnf("secondary LUKS header at offset %d is unusable (%v), using the primary header", size, err)
+			return nil, &v2a, &v2b, primaryJSON, nil
 		}
-		if n < 0 || uint64(n) != jsonSize {
-			return nil, nil, nil, nil, fmt.Errorf("internal error: short read while reading JSON data (wanted %d, got %d)", jsonSize, n)
+		if v2b.SequenceID() > v2a.SequenceID() {
+			return nil, &v2a, &v2b, secondaryJSON, nil
 		}
-		var jsonData V2JSON
-		buf = bytes.TrimRightFunc(buf, func(r rune) bool { return r == 0 })
-		if err = json.Unmarshal(buf, &jsonData); err != nil {
-			return nil, nil, nil, nil, fmt.Errorf("internal error: decoding JSON data: %w", err)
+		return nil, &v2a, &v2b, primaryJSON, nil
+	}
+	return nil, nil, nil, nil, fmt.Errorf("error reading LUKS header - magic identifier not found")
+}
+
+// readV2JSONArea reads and decodes the JSON area which follows the LUKSv2
+// header at offset, after checking the header's checksum.
+func readV2JSONArea(f io.ReaderAt, h V2Header, offset uint64) (*V2JSON, error) {
+	jsonSize := h.HeaderSize() - V2SectorSize
+	buf := make([]byte, jsonSize)
+	n, err := f.ReadAt(buf, int64(offset)+V2SectorSize)
+	if err != nil && !(err == io.EOF && uint64(n) == jsonSize) {
+		return nil, fmt.Errorf("internal error: while reading JSON data: %w", err)
+	}
+	if n < 0 || uint64(n) != jsonSize {
+		return nil, fmt.Errorf("internal error: short read while reading JSON data (wanted %d, got %d)", jsonSize, n)
+	}
+	if err = h.verifyChecksum(buf); err != nil {
+		return nil, err
+	}
+	var jsonData V2JSON
+	buf = bytes.TrimRightFunc(buf, func(r rune) bool { return r == 0 })
+	if err = json.Unmarshal(buf, &jsonData); err != nil {
+		return nil, fmt.Errorf("internal error: decoding JSON data: %w", err)
+	}
+	if uint64(jsonData.Config.JsonSize) != jsonSize {
+		return nil, fmt.Errorf("internal error: JSON data size mismatch: (expected %d, used %d)", jsonData.Config.JsonSize, jsonSize)
+	}
+	return &jsonData, nil
+}
+
+// UpdateV2JSON replaces the JSON metadata in both of the LUKSv2 headers in f
+// with j, after checking that j is consistent.  The headers' sequence IDs are
+// incremented, and their checksums are recomputed.  Volumes whose current
+// metadata has any requirements or segment flags, which usually means that
+// they're being reencrypted, are not modified.  If the primary header is
+// damaged, but the secondary header is intact, both are rewritten, which
+// repairs the primary header.
+func UpdateV2JSON(f ReaderAtWriterAt, j *V2JSON) error {
+	v1, h1, h2, current, err := ReadHeaders(f, ReadHeaderOptions{Recover: true})
+	if err != nil {
+		return err
+	}
+	if v1 != nil {
+		return errors.New("LUKSv1 volumes do not have JSON metadata")
+	}
+	if err := current.checkModifiable(); err != nil {
+		return fmt.Errorf("refusing to modify JSON metadata: %w", err)
+	}
+	check := *j
+	check.Config.JsonSize = int(h1.HeaderSize()) - V2SectorSize
+	var v validator
+	v.validateV2JSON(*h1, check)
+	var problems []string
+	for _, finding := range v.findings {
+		if finding.Severity >= SeverityError {
+			problems = append(problems, finding.Message)
 		}
-		if uint64(jsonData.Config.JsonSize) != jsonSize {
-			return nil, nil, nil, nil, fmt.Errorf("internal error: JSON data size mismatch: (expected %d, used %d)", jsonData.Config.JsonSize, jsonSize)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("refusing to write inconsistent JSON metadata: %s", strings.Join(problems, "; "))
+	}
+	return WriteHeaders(f, h1, h2, j)
+}
+
+// WriteHeaders encodes j into a JSON area which fills the space between the
+// binary header and the end of the header, zero-padding it, increments the
+// sequence IDs of h1 and h2 past the higher of the two, recomputes their
+// checksums, and writes both headers, each followed by a copy of the JSON
+// area, to w, starting with the secondary header.  If neither header has a
+// size set, the smallest size that the JSON metadata fits in is used.
+// j.Config.JsonSize is updated to match the size of the JSON area.
+//
+// The metadata is written as it is, without checking that it makes sense.
+// Returns an error wrapping ErrMetadataTooLarge if the JSON metadata doesn't
+// fit.
+func WriteHeaders(w io.WriterAt, h1, h2 *V2Header, j *V2JSON) error {
+	if h1.HeaderSize() != h2.HeaderSize() {
+		return fmt.Errorf("primary and secondary header sizes differ (%d and %d)", h1.HeaderSize(), h2.HeaderSize())
+	}
+	headerSizes := v2HeaderSizes
+	if h1.HeaderSize() != 0 {
+		if !validV2HeaderSize(h1.HeaderSize()) {
+			return fmt.Errorf("invalid header size %d", h1.HeaderSize())
 		}
-		return nil, &v2a, &v2b, &jsonData, nil
+		headerSizes = []uint64{h1.HeaderSize()}
 	}
-	return nil, nil, nil, nil, fmt.Errorf("error reading LUKS header - magic identifier not found")
+	var jsonArea []byte
+	var encodedSize int
+	for _, headerSize := range headerSizes {
+		jsonSize := int(headerSize) - V2SectorSize
+		updated := *j
+		updated.Config.JsonSize = jsonSize
+		encoded, err := encodeJSON(updated)
+		if err != nil {
+			return fmt.Errorf("encoding JSON metadata: %w", err)
+		}
+		encodedSize = len(encoded)
+		// leave room for at least one NUL terminator
+		if encodedSize < jsonSize {
+			jsonArea = make([]byte, jsonSize)
+			copy(jsonArea, encoded)
+			h1.SetHeaderSize(headerSize)
+			h2.SetHeaderSize(headerSize)
+			break
+		}
+	}
+	if jsonArea == nil {
+		return fmt.Errorf("%w: %d bytes encoded, largest JSON area is %d bytes", ErrMetadataTooLarge, encodedSize, headerSizes[len(headerSizes)-1]-V2SectorSize)
+	}
+	sequenceID := h1.SequenceID()
+	if h2.SequenceID() > sequenceID {
+		sequenceID = h2.SequenceID()
+	}
+	sequenceID++
+	// write the secondary header first, so that if we're interrupted, the
+	// primary header, which has a lower sequence ID, is still intact
+	for _, h := range []struct {
+		header *V2Header
+		offset uint64
+	}{{h2, h1.HeaderSize()}, {h1, 0}} {
+		h.header.SetHeaderOffset(h.offset)
+		h.header.SetSequenceID(sequenceID)
+		sum, err := h.header.computeChecksum(jsonArea)
+		if err != nil {
+			return err
+		}
+		h.header.SetChecksum(sum)
+		if _, err := w.WriteAt(h.header[:], int64(h.offset)); err != nil {
+			return fmt.Errorf("writing header at offset %d: %w", h.offset, err)
+		}
+		if _, err := w.WriteAt(jsonArea, int64(h.offset)+V2SectorSize); err != nil {
+			return fmt.Errorf("writing JSON metadata at offset %d: %w", int64(h.offset)+V2SectorSize, err)
+		}
+	}
+	j.Config.JsonSize = len(jsonArea)
+	return nil
+}
+
+// byteWriterAt is an io.WriterAt which writes into a byte slice, which it
+// won't grow.
+type byteWriterAt []byte
+
+func (b byteWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(b)) {
+		return 0, fmt.Errorf("write at offset %d is outside of a %d-byte buffer", off, len(b))
+	}
+	n := copy(b[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
 }
@@ -0,0 +1,272 @@
+package luksy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadHeadersRecover(t *testing.T) {
+	header, _, err := FormatV2([]string{"password"}, "", 0)
+	require.NoError(t, err)
+	_, v2a, v2b, v2json, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+	require.NoError(t, err)
+
+	damaged := bytes.Clone(header)
+	copy(damaged, make([]byte, V2SectorSize))
+	_, _, _, _, err = ReadHeaders(bytes.NewReader(damaged), ReadHeaderOptions{})
+	assert.Error(t, err)
+
+	v1, h1, h2, j, err := ReadHeaders(bytes.NewReader(damaged), ReadHeaderOptions{Recover: true})
+	require.NoError(t, err)
+	assert.Nil(t, v1)
+	require.NotNil(t, h1)
+	assert.Equal(t, V2Magic1, h1.Magic())
+	assert.Equal(t, uint64(0), h1.HeaderOffset())
+	assert.Equal(t, v2a.UUID(), h1.UUID())
+	assert.Equal(t, *v2b, *h2)
+	assert.Equal(t, v2json, j)
+
+	// a primary header whose checksum doesn't match is also replaced
+	corrupted := bytes.Clone(header)
+	corrupted[V2SectorSize+1] ^= 0xff
+	_, _, _, _, err = ReadHeaders(bytes.NewReader(corrupted), ReadHeaderOptions{})
+	assert.ErrorIs(t, err, ErrHeaderChecksum)
+	_, _, _, j, err = ReadHeaders(bytes.NewReader(corrupted), ReadHeaderOptions{Recover: true})
+	require.NoError(t, err)
+	assert.Equal(t, v2json, j)
+
+	// but not a file that we can't read all of, or one with no headers
+	_, _, _, _, err = ReadHeaders(bytes.NewReader(header[:V2SectorSize+1]), ReadHeaderOptions{Recover: true})
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "recovering")
+	_, _, _, _, err = ReadHeaders(bytes.NewReader(make([]byte, len(header))), ReadHeaderOptions{Recover: true})
+	assert.ErrorContains(t, err, "magic mismatch")
+	assert.NotContains(t, err.Error(), "recovering")
+
+	rebuilt, offset, err := RecoverV2PrimaryHeader(bytes.NewReader(damaged))
+	require.NoError(t, err)
+	assert.Equal(t, int64(v2b.HeaderOffset()), offset)
+	copy(damaged, rebuilt)
+	_, h1, _, j, err = ReadHeaders(bytes.NewReader(damaged), ReadHeaderOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, v2json, j)
+	assert.Equal(t, v2b.SequenceID(), h1.SequenceID())
+
+	// a damaged secondary header shouldn't be accepted, either
+	copy(damaged, make([]byte, V2SectorSize))
+	damaged[v2b.HeaderOffset()+V2SectorSize+1] ^= 0xff
+	_, _, _, _, err = ReadHeaders(bytes.NewReader(damaged), ReadHeaderOptions{Recover: true})
+	assert.ErrorIs(t, err, ErrHeaderChecksum)
+	_, _, err = RecoverV2PrimaryHeader(bytes.NewReader(damaged))
+	assert.Error(t, err)
+}
+
+func TestReadHeadersInterrupted(t *testing.T) {
+	header, _, err := FormatV2([]string{"password"}, "", 0)
+	require.NoError(t, err)
+	_, h1, h2, j, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+	require.NoError(t, err)
+	size := h1.HeaderSize()
+
+	// write new metadata, but only copy the secondary header, which is
+	// written first, as if we were interrupted before writing the primary
+	updated := bytes.Clone(header)
+	j.Tokens = map[string]V2JSONToken{"0": newPlaintextSizeToken(4096)}
+	require.NoError(t, WriteHeaders(byteWriterAt(updated), h1, h2, j))
+	interrupted := bytes.Clone(header)
+	copy(interrupted[size:2*size], updated[size:2*size])
+
+	_, h1b, h2b, jb, err := ReadHeaders(bytes.NewReader(interrupted), ReadHeaderOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), h1b.SequenceID())
+	assert.Equal(t, uint64(2), h2b.SequenceID())
+	assert.Len(t, jb.Tokens, 1, "metadata should have come from the more recent secondary header")
+
+	// if the secondary header is damaged, the primary header is used
+	interrupted[size+V2SectorSize+1] ^= 0xff
+	_, _, _, jb, err = ReadHeaders(bytes.NewReader(interrupted), ReadHeaderOptions{})
+	require.NoError(t, err)
+	assert.Len(t, jb.Tokens, 0, "metadata should have come from the primary header")
+}
+
+func TestUpdateV2JSON(t *testing.T) {
+	header, _, err := FormatV2([]string{"password"}, "", 0)
+	require.NoError(t, err)
+	encryptedFile := filepath.Join(t.TempDir(), "encrypted")
+	require.NoError(t, os.WriteFile(encryptedFile, header, 0o600))
+	f, err := os.OpenFile(encryptedFile, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	_, h1, h2, j, err := ReadHeaders(f, ReadHeaderOptions{})
+	require.NoError(t, err)
+
+	const custom = `{"type":"acme-tpm","keyslots":["0"],"zeta":1,"alpha":{"nested":[1,2,3]},"pcrs":"0,7"}`
+	var token V2JSONToken
+	require.NoError(t, json.Unmarshal([]byte(custom), &token))
+	j.Tokens = map[string]V2JSONToken{"0": token}
+	require.NoError(t, UpdateV2JSON(f, j))
+
+	_, h1b, h2b, jb, err := ReadHeaders(f, ReadHeaderOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, h1.SequenceID()+1, h1b.SequenceID())
+	assert.Equal(t, h2.SequenceID()+1, h2b.SequenceID())
+	jsonArea := make([]byte, h2b.HeaderSize()-V2SectorSize)
+	_, err = f.ReadAt(jsonArea, int64(h2b.HeaderOffset())+V2SectorSize)
+	require.NoError(t, err)
+	assert.NoError(t, h2b.verifyChecksum(jsonArea))
+	encoded, err := json.Marshal(jb.Tokens["0"])
+	require.NoError(t, err)
+	assert.Equal(t, custom, string(encoded))
+
+	// changing a field we know about shouldn't lose the ones we don't
+	token = jb.Tokens["0"]
+	token.Keyslots = nil
+	encoded, err = json.Marshal(token)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"acme-tpm","zeta":1,"alpha":{"nested":[1,2,3]},"pcrs":"0,7"}`, string(encoded))
+
+	// metadata which refers to things that don't exist should be refused
+	token.Keyslots = []string{"5"}
+	jb.Tokens["0"] = token
+	assert.Error(t, UpdateV2JSON(f, jb))
+
+	// the volume should still be usable
+	_, h1b, _, jb, err = ReadHeaders(f, ReadHeaderOptions{})
+	require.NoError(t, err)
+	_, err = h1b.Unlock("password", f, *jb, UnlockOptions{})
+	assert.NoError(t, err)
+}
+
+func TestUpdateV2JSONVerbatim(t *testing.T) {
+	header, _, err := FormatV2([]string{"password"}, "", 0)
+	require.NoError(t, err)
+	encryptedFile := filepath.Join(t.TempDir(), "encrypted")
+	require.NoError(t, os.WriteFile(encryptedFile, header, 0o600))
+	f, err := os.OpenFile(encryptedFile, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	_, _, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+	require.NoError(t, err)
+
+	// characters that encoding/json escapes by default, and whitespace
+	// that it strips, should both survive
+	const custom = "{ \"type\": \"acme-<tok>\",\n  \"keyslots\": [\"0\"],\n  \"url\": \"https:\\/\\/x\\/a&b\"\t}"
+	var token V2JSONToken
+	require.NoError(t, json.Unmarshal([]byte(custom), &token))
+	j.Tokens = map[string]V2JSONToken{"0": token}
+	require.NoError(t, UpdateV2JSON(f, j))
+
+	checkVerbatim := func() *V2JSON {
+		_, h1, h2, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		for _, h := range []*V2Header{h1, h2} {
+			jsonArea := make([]byte, h.HeaderSize()-V2SectorSize)
+			_, err = f.ReadAt(jsonArea, int64(h.HeaderOffset())+V2SectorSize)
+			require.NoError(t, err)
+			assert.Contains(t, string(bytes.TrimRight(jsonArea, "\x00")), `"0":`+custom)
+		}
+		encoded, err := j.Tokens["0"].MarshalJSON()
+		require.NoError(t, err)
+		assert.Equal(t, custom, string(encoded))
+		return j
+	}
+	j = checkVerbatim()
+
+	// changing something else shouldn't change the token
+	j.Config.Flags = append(j.Config.Flags, "allow-discards")
+	require.NoError(t, UpdateV2JSON(f, j))
+	j = checkVerbatim()
+	assert.Equal(t, []string{"allow-discards"}, j.Config.Flags)
+}
+
+func TestWriteHeaders(t *testing.T) {
+	header, _, err := FormatV2([]string{"password"}, "", 0)
+	require.NoError(t, err)
+	_, h1, h2, j, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), h1.SequenceID())
+	assert.Equal(t, h1.SequenceID(), h2.SequenceID())
+
+	// add fields, and types of things, that we don't know about everywhere
+	encoded, err := json.Marshal(j)
+	require.NoError(t, err)
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(encoded, &doc))
+	doc["x-top"] = "top"
+	doc["config"].(map[string]any)["x-config"] = []any{"a", "b"}
+	keyslot := doc["keyslots"].(map[string]any)["0"].(map[string]any)
+	keyslot["x-keyslot"] = map[string]any{"nested": true}
+	keyslot["af"].(map[string]any)["x-af"] = 1.0
+	keyslot["kdf"].(map[string]any)["x-kdf"] = 2.0
+	keyslot["area"].(map[string]any)["x-area"] = 3.0
+	doc["keyslots"].(map[string]any)["1"] = map[string]any{
+		"type":     "x-keyslot-type",
+		"key_size": 64.0,
+		"area":     map[string]any{"type": "x-area-type", "offset": "32768", "size": "4096", "x-area-field": "z"},
+		"x-field":  "y",
+	}
+	doc["segments"].(map[string]any)["0"].(map[string]any)["x-segment"] = "s"
+	doc["digests"].(map[string]any)["0"].(map[string]any)["x-digest"] = "d"
+	doc["tokens"].(map[string]any)["0"] = map[string]any{"type": "x-token-type", "keyslots": []any{}, "x-token": "t"}
+	encoded, err = json.Marshal(doc)
+	require.NoError(t, err)
+
+	var modified V2JSON
+	require.NoError(t, json.Unmarshal(encoded, &modified))
+	reencoded, err := json.Marshal(modified)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(encoded), string(reencoded))
+
+	head := bytes.Clone(header)
+	require.NoError(t, WriteHeaders(byteWriterAt(head), h1, h2, &modified))
+	_, h1b, h2b, jb, err := ReadHeaders(bytes.NewReader(head), ReadHeaderOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), h1b.SequenceID())
+	assert.Equal(t, uint64(2), h2b.SequenceID())
+	assert.Equal(t, h1.HeaderSize(), h1b.HeaderSize())
+	reencoded, err = json.Marshal(jb)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(encoded), string(reencoded))
+	assert.Equal(t, "x-keyslot-type", jb.Keyslots["1"].Type)
+	assert.Equal(t, "x-area-type", jb.Keyslots["1"].Area.Type)
+	assert.Equal(t, "x-token-type", jb.Tokens["0"].Type)
+
+	// changing fields we know about shouldn't lose the ones we don't
+	keyslot0 := jb.Keyslots["0"]
+	priority := V2JSONKeyslotPriorityHigh
+	keyslot0.Priority = &priority
+	keyslot0.Area.Size *= 2
+	jb.Keyslots["0"] = keyslot0
+	reencoded, err = json.Marshal(jb)
+	require.NoError(t, err)
+	keyslot["priority"] = 2.0
+	keyslot["area"].(map[string]any)["size"] = strconv.FormatInt(keyslot0.Area.Size, 10)
+	encoded, err = json.Marshal(doc)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(encoded), string(reencoded))
+
+	// metadata that won't fit should be refused
+	jb.Tokens["1"] = V2JSONToken{Type: strings.Repeat("x", int(h1b.HeaderSize()))}
+	err = WriteHeaders(byteWriterAt(bytes.Clone(head)), h1b, h2b, jb)
+	assert.ErrorIs(t, err, ErrMetadataTooLarge)
+
+	// without a header size, the smallest one that fits should be chosen
+	var h1c, h2c V2Header
+	h1c, h2c = *h1b, *h2b
+	h1c.SetHeaderSize(0)
+	h2c.SetHeaderSize(0)
+	head = make([]byte, 0x80000)
+	require.NoError(t, WriteHeaders(byteWriterAt(head), &h1c, &h2c, jb))
+	assert.Equal(t, uint64(0x8000), h1c.HeaderSize())
+	_, _, _, jc, err := ReadHeaders(bytes.NewReader(head), ReadHeaderOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int(0x8000-V2SectorSize), jc.Config.JsonSize)
+}
@@ -0,0 +1,351 @@
+package luksy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Values used in the NBD protocol's "fixed newstyle" handshake and its
+// transmission phase, as described in
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic              = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptionMagic        = 0x49484156454f5054 // "IHAVEOPT"
+	nbdReplyMagic         = 0x3e889045565a9
+	nbdRequestMagic       = 0x25609513
+	nbdSimpleReplyMagic   = 0x67446698
+	nbdFlagFixedNewstyle  = 1 << 0
+	nbdFlagNoZeroes       = 1 << 1
+	nbdOptExportName      = 1
+	nbdOptAbort           = 2
+	nbdOptList            = 3
+	nbdOptInfo            = 6
+	nbdOptGo              = 7
+	nbdRepAck             = 1
+	nbdRepServer          = 2
+	nbdRepInfo            = 3
+	nbdRepErrUnsup        = 1<<31 + 1
+	nbdRepErrInvalid      = 1<<31 + 3
+	nbdRepErrUnknown      = 1<<31 + 6
+	nbdInfoExport         = 0
+	nbdInfoBlockSize      = 3
+	nbdFlagHasFlags       = 1 << 0
+	nbdFlagReadOnly       = 1 << 1
+	nbdFlagSendFlush      = 1 << 2
+	nbdFlagSendFUA        = 1 << 3
+	nbdFlagSendWriteZeros = 1 << 6
+	nbdCmdFlagFUA         = 1 << 0
+	nbdCmdRead            = 0
+	nbdCmdWrite           = 1
+	nbdCmdDisc            = 2
+	nbdCmdFlush           = 3
+	nbdCmdWriteZeroes     = 6
+	nbdEPERM              = 1
+	nbdEIO                = 5
+	nbdEINVAL             = 22
+	nbdENOSPC             = 28
+	nbdENOTSUP            = 95
+	nbdMaxOptionLength    = 64 * 1024
+	nbdMaxRequestLength   = 32 * 1024 * 1024
+	nbdPreferredBlockSize = 4096
+)
+
+// NBDExport is what ServeNBD() serves to a client, typically a *Payload.
+type NBDExport interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+	Sync() error
+}
+
+// NBDOptions controls how ServeNBD() serves an export.
+type NBDOptions struct {
+	// Name is the name of the export.  Clients which ask for the default
+	// export, whose name is "", are also given this one.
+	Name string
+	// ReadOnly causes write requests to be refused.
+	ReadOnly bool
+}
+
+// ServeNBD handles a single client connection using the NBD protocol,
+// serving the export to it until it disconnects.  Only the "fixed newstyle"
+// handshake is supported.  Requests are handled one at a time, in the order
+// in which they are received.
+func ServeNBD(conn io.ReadWriter, export NBDExport, options NBDOptions) error {
+	s := &nbdServer{
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		export:  export,
+		options: options,
+	}
+	proceed, err := s.handshake()
+	if err != nil || !proceed {
+		return err
+	}
+	return s.transmit()
+}
+
+type nbdServer struct {
+	r        *bufio.Reader
+	w        *bufio.Writer
+	export   NBDExport
+	options  NBDOptions
+	noZeroes bool
+}
+
+func (s *nbdServer) write(values ...any) error {
+	for _, value := range values {
+		if err := binary.Write(s.w, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *nbdServer) transmissionFlags() uint16 {
+	flags := uint16(nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA | nbdFlagSendWriteZeros)
+	if s.options.ReadOnly {
+		flags |= nbdFlagReadOnly
+	}
+	return flags
+}
+
+func (s *nbdServer) knownExport(name string) bool {
+	return name == "" || name == s.options.Name
+}
+
+func (s *nbdServer) optionReply(option, reply uint32, data []byte) error {
+	if err := s.write(uint64(nbdReplyMagic), option, reply, uint32(len(data)), data); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// handshake negotiates with the client until it picks an export, returning
+// false if the client went away without picking one.
+func (s *nbdServer) handshake() (bool, error) {
+	if err := s.write(uint64(nbdMagic), uint64(nbdOptionMagic), uint16(nbdFlagFixedNewstyle|nbdFlagNoZeroes)); err != nil {
+		return false, err
+	}
+	if err := s.w.Flush(); err != nil {
+		return false, err
+	}
+	var clientFlags uint32
+	if err := binary.Read(s.r, binary.BigEndian, &clientFlags); err != nil {
+		return false, fmt.Errorf("reading client flags: %w", err)
+	}
+	if clientFlags&nbdFlagFixedNewstyle == 0 {
+		return false, errors.New("client does not support the fixed newstyle handshake")
+	}
+	s.noZeroes = clientFlags&nbdFlagNoZeroes != 0
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(s.r, binary.BigEndian, &header); err != nil {
+			return false, fmt.Errorf("reading option: %w", err)
+		}
+		if header.Magic != nbdOptionMagic {
+			return false, fmt.Errorf("bad option magic %#x", header.Magic)
+		}
+		if header.Length > nbdMaxOptionLength {
+			return false, fmt.Errorf("option %d is too long (%d bytes)", header.Option, header.Length)
+		}
+		data := make([]byte, header.Length)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return false, fmt.Errorf("reading option %d: %w", header.Option, err)
+		}
+		switch header.Option {
+		case nbdOptExportName:
+			if !s.knownExport(string(data)) {
+				return false, fmt.Errorf("client asked for unknown export %q", string(data))
+			}
+			if err := s.write(uint64(s.export.Size()), s.transmissionFlags()); err != nil {
+				return false, err
+			}
+			if !s.noZeroes {
+				if err := s.write(make([]byte, 124)); err != nil {
+					return false, err
+				}
+			}
+			return true, s.w.Flush()
+		case nbdOptAbort:
+			return false, s.optionReply(header.Option, nbdRepAck, nil)
+		case nbdOptList:
+			if len(data) != 0 {
+				if err := s.optionReply(header.Option, nbdRepErrInvalid, nil); err != nil {
+					return false, err
+				}
+				continue
+			}
+			name := make([]byte, 4+len(s.options.Name))
+			binary.BigEndian.PutUint32(name, uint32(len(s.options.Name)))
+			copy(name[4:], s.options.Name)
+			if err := s.optionReply(header.Option, nbdRepServer, name); err != nil {
+				return false, err
+			}
+			if err := s.optionReply(header.Option, nbdRepAck, nil); err != nil {
+				return false, err
+			}
+		case nbdOptInfo, nbdOptGo:
+			if len(data) < 4 || uint64(len(data)) < 4+uint64(binary.BigEndian.Uint32(data)) {
+				if err := s.optionReply(header.Option, nbdRepErrInvalid, nil); err != nil {
+					return false, err
+				}
+				continue
+			}
+			nameLength := binary.BigEndian.Uint32(data)
+			name := string(data[4 : 4+nameLength])
+			requests := data[4+nameLength:]
+			if len(requests) < 2 || len(requests) != 2+2*int(binary.BigEndian.Uint16(requests)) {
+				if err := s.optionReply(header.Option, nbdRepErrInvalid, nil); err != nil {
+					return false, err
+				}
+				continue
+			}
+			wantBlockSize := false
+			for i := 2; i < len(requests); i += 2 {
+				if binary.BigEndian.Uint16(requests[i:]) == nbdInfoBlockSize {
+					wantBlockSize = true
+				}
+			}
+			if !s.knownExport(name) {
+				if err := s.optionReply(header.Option, nbdRepErrUnknown, []byte(fmt.Sprintf("unknown export %q", name))); err != nil {
+					return false, err
+				}
+				continue
+			}
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info[0:], nbdInfoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(s.export.Size()))
+			binary.BigEndian.PutUint16(info[10:], s.transmissionFlags())
+			if err := s.optionReply(header.Option, nbdRepInfo, info); err != nil {
+				return false, err
+			}
+			if wantBlockSize {
+				info = make([]byte, 14)
+				binary.BigEndian.PutUint16(info[0:], nbdInfoBlockSize)
+				binary.BigEndian.PutUint32(info[2:], 1)
+				binary.BigEndian.PutUint32(info[6:], nbdPreferredBlockSize)
+				binary.BigEndian.PutUint32(info[10:], nbdMaxRequestLength)
+				if err := s.optionReply(header.Option, nbdRepInfo, info); err != nil {
+					return false, err
+				}
+			}
+			if err := s.optionReply(header.Option, nbdRepAck, nil); err != nil {
+				return false, err
+			}
+			if header.Option == nbdOptGo {
+				return true, nil
+			}
+		default:
+			if err := s.optionReply(header.Option, nbdRepErrUnsup, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// reply sends a simple reply to a request, with data if the request
+// succeeded and it was a read request.
+func (s *nbdServer) reply(handle uint64, errno uint32, data []byte) error {
+	if err := s.write(uint32(nbdSimpleReplyMagic), errno, handle); err != nil {
+		return err
+	}
+	if errno == 0 && data != nil {
+		if _, err := s.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+// transmit handles requests until the client disconnects.
+func (s *nbdServer) transmit() error {
+	size := uint64(s.export.Size())
+	for {
+		var request struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		if err := binary.Read(s.r, binary.BigEndian, &request); err != nil {
+			if errors.Is(err, io.EOF) {
+				// the client went away without saying goodbye
+				return nil
+			}
+			return fmt.Errorf("reading request: %w", err)
+		}
+		if request.Magic != nbdRequestMagic {
+			return fmt.Errorf("bad request magic %#x", request.Magic)
+		}
+		if request.Length > nbdMaxRequestLength {
+			return fmt.Errorf("request of type %d is too long (%d bytes)", request.Type, request.Length)
+		}
+		var data []byte
+		if request.Type == nbdCmdWrite {
+			data = make([]byte, request.Length)
+			if _, err := io.ReadFull(s.r, data); err != nil {
+				return fmt.Errorf("reading write request: %w", err)
+			}
+		}
+		inBounds := request.Offset <= size && uint64(request.Length) <= size-request.Offset
+		var errno uint32
+		var reply []byte
+		switch request.Type {
+		case nbdCmdDisc:
+			return nil
+		case nbdCmdRead:
+			if !inBounds {
+				errno = nbdEINVAL
+				break
+			}
+			reply = make([]byte, request.Length)
+			if _, err := s.export.ReadAt(reply, int64(request.Offset)); err != nil && !errors.Is(err, io.EOF) {
+				log().Errorf("reading %d bytes at offset %d: %v", request.Length, request.Offset, err)
+				errno = nbdEIO
+			}
+		case nbdCmdWrite, nbdCmdWriteZeroes:
+			if s.options.ReadOnly {
+				errno = nbdEPERM
+				break
+			}
+			if !inBounds {
+				errno = nbdENOSPC
+				break
+			}
+			if data == nil {
+				data = make([]byte, request.Length)
+			}
+			if _, err := s.export.WriteAt(data, int64(request.Offset)); err != nil {
+				log().Errorf("writing %d bytes at offset %d: %v", request.Length, request.Offset, err)
+				errno = nbdEIO
+				break
+			}
+			if request.Flags&nbdCmdFlagFUA != 0 {
+				if err := s.export.Sync(); err != nil {
+					log().Errorf("flushing: %v", err)
+					errno = nbdEIO
+				}
+			}
+		case nbdCmdFlush:
+			if err := s.export.Sync(); err != nil {
+				log().Errorf("flushing: %v", err)
+				errno = nbdEIO
+			}
+		default:
+			errno = nbdENOTSUP
+		}
+		if err := s.reply(request.Handle, errno, reply); err != nil {
+			return fmt.Errorf("sending reply: %w", err)
+		}
+	}
+}
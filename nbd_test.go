@@ -0,0 +1,188 @@
+package luksy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nbdTestClient is just enough of an NBD client to exercise ServeNBD().
+type nbdTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	handle uint64
+}
+
+func (c *nbdTestClient) write(values ...any) {
+	for _, value := range values {
+		if b, ok := value.([]byte); ok && len(b) == 0 {
+			// net.Pipe() would wait for a reader to accept nothing
+			continue
+		}
+		require.NoError(c.t, binary.Write(c.conn, binary.BigEndian, value))
+	}
+}
+
+func (c *nbdTestClient) read(values ...any) {
+	for _, value := range values {
+		require.NoError(c.t, binary.Read(c.conn, binary.BigEndian, value))
+	}
+}
+
+func (c *nbdTestClient) handshake() {
+	var magic, optionMagic uint64
+	var flags uint16
+	c.read(&magic, &optionMagic, &flags)
+	require.Equal(c.t, uint64(nbdMagic), magic)
+	require.Equal(c.t, uint64(nbdOptionMagic), optionMagic)
+	require.NotZero(c.t, flags&nbdFlagFixedNewstyle)
+	c.write(uint32(nbdFlagFixedNewstyle | nbdFlagNoZeroes))
+}
+
+// option sends an option, and returns the replies to it, ending with the
+// first one that isn't NBD_REP_INFO or NBD_REP_SERVER.
+func (c *nbdTestClient) option(option uint32, data []byte) (replies []uint32, payloads [][]byte) {
+	c.write(uint64(nbdOptionMagic), option, uint32(len(data)), data)
+	for {
+		var magic uint64
+		var replyOption, reply, length uint32
+		c.read(&magic, &replyOption, &reply, &length)
+		require.Equal(c.t, uint64(nbdReplyMagic), magic)
+		require.Equal(c.t, option, replyOption)
+		payload := make([]byte, length)
+		_, err := io.ReadFull(c.conn, payload)
+		require.NoError(c.t, err)
+		replies = append(replies, reply)
+		payloads = append(payloads, payload)
+		if reply != nbdRepInfo && reply != nbdRepServer {
+			return replies, payloads
+		}
+	}
+}
+
+// exportRequest builds the data for NBD_OPT_INFO and NBD_OPT_GO.
+func exportRequest(name string, infos ...uint16) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	data = append(data, name...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(infos)))
+	for _, info := range infos {
+		data = binary.BigEndian.AppendUint16(data, info)
+	}
+	return data
+}
+
+// request sends a request and reads the reply, returning the error number
+// and, for successful reads, the data that was read.
+func (c *nbdTestClient) request(flags, requestType uint16, offset uint64, length uint32, data []byte) (uint32, []byte) {
+	c.handle++
+	c.write(uint32(nbdRequestMagic), flags, requestType, c.handle, offset, length)
+	if data != nil {
+		c.write(data)
+	}
+	if requestType == nbdCmdDisc {
+		return 0, nil
+	}
+	var magic, errno uint32
+	var handle uint64
+	c.read(&magic, &errno, &handle)
+	require.Equal(c.t, uint32(nbdSimpleReplyMagic), magic)
+	require.Equal(c.t, c.handle, handle)
+	if requestType != nbdCmdRead || errno != 0 {
+		return errno, nil
+	}
+	buf := make([]byte, length)
+	_, err := io.ReadFull(c.conn, buf)
+	require.NoError(c.t, err)
+	return errno, buf
+}
+
+func startNBD(t *testing.T, export NBDExport, options NBDOptions) (*nbdTestClient, chan error) {
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeNBD(server, export, options)
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	c := &nbdTestClient{t: t, conn: client}
+	c.handshake()
+	return c, done
+}
+
+func TestServeNBD(t *testing.T) {
+	expected := randomBytes(t, 3*16*4096)
+	f, volume := payloadVolume(t, expected)
+	payload, err := volume.Payload(f)
+	require.NoError(t, err)
+
+	t.Run("read-write", func(t *testing.T) {
+		c, done := startNBD(t, payload, NBDOptions{Name: "luks"})
+		replies, payloads := c.option(nbdOptList, nil)
+		require.Equal(t, []uint32{nbdRepServer, nbdRepAck}, replies)
+		assert.Equal(t, "\x00\x00\x00\x04luks", string(payloads[0]))
+		replies, _ = c.option(nbdOptInfo, exportRequest("other"))
+		assert.Equal(t, []uint32{nbdRepErrUnknown}, replies)
+		replies, _ = c.option(99, nil)
+		assert.Equal(t, []uint32{nbdRepErrUnsup}, replies)
+		replies, payloads = c.option(nbdOptGo, exportRequest("luks", nbdInfoBlockSize))
+		require.Equal(t, []uint32{nbdRepInfo, nbdRepInfo, nbdRepAck}, replies)
+		assert.Equal(t, uint64(len(expected)), binary.BigEndian.Uint64(payloads[0][2:]))
+		assert.Zero(t, binary.BigEndian.Uint16(payloads[0][10:])&nbdFlagReadOnly)
+		assert.Equal(t, uint16(nbdInfoBlockSize), binary.BigEndian.Uint16(payloads[1]))
+
+		errno, data := c.request(0, nbdCmdRead, 1000, 70000, nil)
+		require.Zero(t, errno)
+		assert.Equal(t, expected[1000:71000], data)
+
+		written := randomBytes(t, 5000)
+		errno, _ = c.request(nbdCmdFlagFUA, nbdCmdWrite, 60000, uint32(len(written)), written)
+		require.Zero(t, errno)
+		copy(expected[60000:], written)
+		errno, _ = c.request(0, nbdCmdWriteZeroes, 130000, 1234, nil)
+		require.Zero(t, errno)
+		copy(expected[130000:], make([]byte, 1234))
+		errno, _ = c.request(0, nbdCmdFlush, 0, 0, nil)
+		require.Zero(t, errno)
+		errno, data = c.request(0, nbdCmdRead, 0, uint32(len(expected)), nil)
+		require.Zero(t, errno)
+		assert.Equal(t, expected, data)
+
+		errno, _ = c.request(0, nbdCmdRead, uint64(len(expected))-10, 20, nil)
+		assert.Equal(t, uint32(nbdEINVAL), errno)
+		errno, _ = c.request(0, nbdCmdWrite, uint64(len(expected))-10, 20, make([]byte, 20))
+		assert.Equal(t, uint32(nbdENOSPC), errno)
+		errno, _ = c.request(0, 4, 0, 4096, nil)
+		assert.Equal(t, uint32(nbdENOTSUP), errno)
+
+		c.request(0, nbdCmdDisc, 0, 0, nil)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("read-only-export-name", func(t *testing.T) {
+		c, done := startNBD(t, payload, NBDOptions{ReadOnly: true})
+		c.write(uint64(nbdOptionMagic), uint32(nbdOptExportName), uint32(0))
+		var size uint64
+		var flags uint16
+		c.read(&size, &flags)
+		assert.Equal(t, uint64(len(expected)), size)
+		assert.NotZero(t, flags&nbdFlagReadOnly)
+		errno, _ := c.request(0, nbdCmdWrite, 0, 10, make([]byte, 10))
+		assert.Equal(t, uint32(nbdEPERM), errno)
+		errno, data := c.request(0, nbdCmdRead, 0, 10, nil)
+		require.Zero(t, errno)
+		assert.Equal(t, expected[:10], data)
+		c.conn.Close()
+		require.NoError(t, <-done)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		c, done := startNBD(t, payload, NBDOptions{})
+		replies, _ := c.option(nbdOptAbort, nil)
+		assert.Equal(t, []uint32{nbdRepAck}, replies)
+		require.NoError(t, <-done)
+	})
+}
@@ -0,0 +1,324 @@
+package luksy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+// ErrNoPartitionTable is returned by ReadPartitions() when it doesn't find
+// either a GPT or an MBR partition table.
+var ErrNoPartitionTable = errors.New("no partition table found")
+
+// Locations of things in MBR partition tables, and in GPT headers and
+// partition entries.
+const (
+	mbrSignatureStart   = 510
+	mbrSignature        = "\x55\xaa"
+	mbrEntriesStart     = 446
+	mbrEntrySize        = 16
+	mbrEntries          = 4
+	mbrTypeEmpty        = 0x00
+	mbrTypeProtective   = 0xee
+	mbrMaxLogical       = 128
+	gptSignature        = "EFI PART"
+	gptHeaderSizeStart  = 12
+	gptHeaderCRCStart   = 16
+	gptEntriesLBAStart  = 72
+	gptEntryCountStart  = 80
+	gptEntrySizeStart   = 84
+	gptEntriesCRCStart  = 88
+	gptMinHeaderSize    = 92
+	gptMinEntrySize     = 128
+	gptMaxEntriesLength = 1024 * 1024
+)
+
+// Partition describes a partition in a disk image's partition table.
+type Partition struct {
+	// Number is the partition's number, counting from 1, as it would be
+	// numbered by the kernel.  Logical partitions in an MBR extended
+	// partition are numbered starting at 5.
+	Number int
+	// Offset and Size are the location and size of the partition, in
+	// bytes.
+	Offset int64
+	Size   int64
+	// Type is the GPT partition type GUID, or the MBR partition type in
+	// hexadecimal, e.g., "0x83".
+	Type string
+	// UUID and Name are the GPT partition's unique GUID and name.  They
+	// are empty for MBR partitions.
+	UUID string
+	Name string
+}
+
+// ReadPartitions reads the partition table from a disk image, preferring a
+// GPT partition table to an MBR partition table, and returns a list of the
+// partitions that it describes, in order.  Unused entries are not included.
+func ReadPartitions(f io.ReaderAt) ([]Partition, error) {
+	mbr := make([]byte, 512)
+	if n, err := f.ReadAt(mbr, 0); n != len(mbr) {
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil, ErrNoPartitionTable
+		}
+		return nil, fmt.Errorf("reading MBR: %w", err)
+	}
+	if string(mbr[mbrSignatureStart:mbrSignatureStart+len(mbrSignature)]) != mbrSignature {
+		return nil, ErrNoPartitionTable
+	}
+	for i := 0; i < mbrEntries; i++ {
+		if mbr[mbrEntriesStart+i*mbrEntrySize+4] == mbrTypeProtective {
+			return readGPTPartitions(f)
+		}
+	}
+	return readMBRPartitions(f, mbr)
+}
+
+// mbrExtended returns true if the MBR partition type is one which is used
+// for extended partitions.
+func mbrExtended(partitionType byte) bool {
+	return partitionType == 0x05 || partitionType == 0x0f || partitionType == 0x85
+}
+
+// readMBRPartitions parses the primary partitions in an MBR, and the logical
+// partitions in an extended partition, if there is one.
+func readMBRPartitions(f io.ReaderAt, mbr []byte) ([]Partition, error) {
+	var partitions []Partition
+	var extendedStart int64 = -1
+	for i := 0; i < mbrEntries; i++ {
+		entry := mbr[mbrEntriesStart+i*mbrEntrySize : mbrEntriesStart+(i+1)*mbrEntrySize]
+		partitionType := entry[4]
+		start := int64(binary.LittleEndian.Uint32(entry[8:])) * V1SectorSize
+		size := int64(binary.LittleEndian.Uint32(entry[12:])) * V1SectorSize
+		if partitionType == mbrTypeEmpty || size == 0 {
+			continue
+		}
+		if mbrExtended(partitionType) {
+			if extendedStart != -1 {
+				return nil, errors.New("MBR has more than one extended partition")
+			}
+			extendedStart = start
+		}
+		partitions = append(partitions, Partition{
+			Number: i + 1,
+			Offset: start,
+			Size:   size,
+			Type:   fmt.Sprintf("0x%02x", partitionType),
+		})
+	}
+	if extendedStart == -1 {
+		return partitions, nil
+	}
+	// each extended boot record describes one logical partition, relative
+	// to itself, and the location of the next extended boot record,
+	// relative to the start of the extended partition
+	ebrStart := extendedStart
+	ebr := make([]byte, 512)
+	for number := 5; number < 5+mbrMaxLogical; number++ {
+		if n, err := f.ReadAt(ebr, ebrStart); n != len(ebr) {
+			return nil, fmt.Errorf("reading extended boot record at offset %d: %w", ebrStart, err)
+		}
+		if string(ebr[mbrSignatureStart:mbrSignatureStart+len(mbrSignature)]) != mbrSignature {
+			return nil, fmt.Errorf("extended boot record at offset %d has no signature", ebrStart)
+		}
+		logical := ebr[mbrEntriesStart : mbrEntriesStart+mbrEntrySize]
+		if logical[4] != mbrTypeEmpty {
+			partitions = append(partitions, Partition{
+				Number: number,
+				Offset: ebrStart + int64(binary.LittleEndian.Uint32(logical[8:]))*V1SectorSize,
+				Size:   int64(binary.LittleEndian.Uint32(logical[12:])) * V1SectorSize,
+				Type:   fmt.Sprintf("0x%02x", logical[4]),
+			})
+		}
+		next := ebr[mbrEntriesStart+mbrEntrySize : mbrEntriesStart+2*mbrEntrySize]
+		if next[4] == mbrTypeEmpty || binary.LittleEndian.Uint32(next[8:]) == 0 {
+			return partitions, nil
+		}
+		ebrStart = extendedStart + int64(binary.LittleEndian.Uint32(next[8:]))*V1SectorSize
+	}
+	return nil, fmt.Errorf("more than %d logical partitions, is the chain of extended boot records circular?", mbrMaxLogical)
+}
+
+// gptGUID formats a GUID as it's stored in GPT structures, with its first
+// three fields in little-endian byte order.
+func gptGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// readGPTPartitions parses a GPT partition table.  The logical block size
+// isn't recorded anywhere, so we look for the header at both of the likely
+// locations.
+func readGPTPartitions(f io.ReaderAt) ([]Partition, error) {
+	header := make([]byte, 512)
+	for _, blockSize := range []int64{512, 4096} {
+		if n, err := f.ReadAt(header, blockSize); n != len(header) {
+			if err == nil || errors.Is(err, io.EOF) {
+				continue
+			}
+			return nil, fmt.Errorf("reading GPT header: %w", err)
+		}
+		if string(header[:len(gptSignature)]) != gptSignature {
+			continue
+		}
+		headerSize := binary.LittleEndian.Uint32(header[gptHeaderSizeStart:])
+		if headerSize < gptMinHeaderSize || headerSize > uint32(len(header)) {
+			return nil, fmt.Errorf("GPT header has invalid size %d", headerSize)
+		}
+		checksummed := bytes.Clone(header[:headerSize])
+		binary.LittleEndian.PutUint32(checksummed[gptHeaderCRCStart:], 0)
+		if crc32.ChecksumIEEE(checksummed) != binary.LittleEndian.Uint32(header[gptHeaderCRCStart:]) {
+			return nil, errors.New("GPT header checksum mismatch")
+		}
+		entriesLBA := binary.LittleEndian.Uint64(header[gptEntriesLBAStart:])
+		entryCount := binary.LittleEndian.Uint32(header[gptEntryCountStart:])
+		entrySize := binary.LittleEndian.Uint32(header[gptEntrySizeStart:])
+		if entrySize < gptMinEntrySize || entrySize%8 != 0 || uint64(entryCount)*uint64(entrySize) > gptMaxEntriesLength {
+			return nil, fmt.Errorf("GPT header describes %d partition entries of size %d, which is not supported", entryCount, entrySize)
+		}
+		entries := make([]byte, int(entryCount)*int(entrySize))
+		if n, err := f.ReadAt(entries, int64(entriesLBA)*blockSize); n != len(entries) {
+			return nil, fmt.Errorf("reading GPT partition entries: %w", err)
+		}
+		if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[gptEntriesCRCStart:]) {
+			return nil, errors.New("GPT partition entries checksum mismatch")
+		}
+		var partitions []Partition
+		for i := 0; i < int(entryCount); i++ {
+			entry := entries[i*int(entrySize) : (i+1)*int(entrySize)]
+			if bytes.Equal(entry[0:16], make([]byte, 16)) {
+				continue
+			}
+			first := binary.LittleEndian.Uint64(entry[32:])
+			last := binary.LittleEndian.Uint64(entry[40:])
+			if last < first {
+				return nil, fmt.Errorf("GPT partition %d ends (%d) before it starts (%d)", i+1, last, first)
+			}
+			name := make([]uint16, 36)
+			for j := range name {
+				name[j] = binary.LittleEndian.Uint16(entry[56+j*2:])
+			}
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			partitions = append(partitions, Partition{
+				Number: i + 1,
+				Offset: int64(first) * blockSize,
+				Size:   int64(last-first+1) * blockSize,
+				Type:   gptGUID(entry[0:16]),
+				UUID:   gptGUID(entry[16:32]),
+				Name:   string(utf16.Decode(name)),
+			})
+		}
+		return partitions, nil
+	}
+	return nil, errors.New("MBR describes a GPT partition table, but no GPT header was found")
+}
+
+// FindPartition reads the partition table from a disk image, and returns
+// the partition with the specified number.
+func FindPartition(f io.ReaderAt, number int) (Partition, error) {
+	partitions, err := ReadPartitions(f)
+	if err != nil {
+		return Partition{}, err
+	}
+	for _, partition := range partitions {
+		if partition.Number == number {
+			return partition, nil
+		}
+	}
+	return Partition{}, fmt.Errorf("partition %d not found", number)
+}
+
+// Section presents a part of a larger file, such as a partition in a disk
+// image, as if it were a file of its own, so that it can be passed to
+// functions which read or write LUKS volumes.  Closing a Section does not
+// close the file which contains it.
+type Section struct {
+	f      io.ReaderAt
+	offset int64
+	size   int64
+	pos    int64
+}
+
+// NewSection returns a Section which covers size bytes of f, starting at
+// offset.  If f is also an io.WriterAt, the Section can be written to.
+func NewSection(f io.ReaderAt, offset, size int64) *Section {
+	return &Section{f: f, offset: offset, size: size}
+}
+
+// Size returns the size of the section.
+func (s *Section) Size() int64 {
+	return s.size
+}
+
+// ReadAt reads from the section, stopping at its end.
+func (s *Section) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.size-off {
+		n, err := s.f.ReadAt(p[:s.size-off], s.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return s.f.ReadAt(p, s.offset+off)
+}
+
+// WriteAt writes to the section, refusing to write past its end.
+func (s *Section) WriteAt(p []byte, off int64) (int, error) {
+	w, ok := s.f.(io.WriterAt)
+	if !ok {
+		return 0, errors.New("section is not writable")
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("write at negative offset %d", off)
+	}
+	if off > s.size || int64(len(p)) > s.size-off {
+		return 0, fmt.Errorf("writing %d bytes at offset %d would run past the end of a %d-byte section", len(p), off, s.size)
+	}
+	return w.WriteAt(p, s.offset+off)
+}
+
+// Seek sets the offset for the next Read, which is only of interest to
+// callers which use it to find the size of the section.
+func (s *Section) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// Read reads from the section at the current offset.
+func (s *Section) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Close does nothing, since the Section doesn't own the file which contains
+// it.
+func (s *Section) Close() error {
+	return nil
+}
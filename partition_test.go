@@ -0,0 +1,192 @@
+package luksy
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putMBREntry fills in an MBR partition table entry.
+func putMBREntry(sector []byte, index int, partitionType byte, startSector, sectors uint32) {
+	entry := sector[mbrEntriesStart+index*mbrEntrySize:]
+	entry[4] = partitionType
+	binary.LittleEndian.PutUint32(entry[8:], startSector)
+	binary.LittleEndian.PutUint32(entry[12:], sectors)
+	copy(sector[mbrSignatureStart:], mbrSignature)
+}
+
+// putGPTGUID stores a GUID in the mixed-endian form that GPT uses.
+func putGPTGUID(b []byte, u uuid.UUID) {
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(u[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(u[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(u[6:]))
+	copy(b[8:], u[8:])
+}
+
+// writeGPT writes a protective MBR, a GPT header, and partition entries for
+// the listed partitions to f, using the specified logical block size.
+func writeGPT(t *testing.T, f io.WriterAt, blockSize int64, partitions []Partition) {
+	mbr := make([]byte, 512)
+	putMBREntry(mbr, 0, mbrTypeProtective, 1, 0xffffffff)
+	_, err := f.WriteAt(mbr, 0)
+	require.NoError(t, err)
+
+	const entryCount, entrySize = 128, 128
+	entries := make([]byte, entryCount*entrySize)
+	for _, partition := range partitions {
+		entry := entries[(partition.Number-1)*entrySize:]
+		putGPTGUID(entry[0:], uuid.MustParse(partition.Type))
+		putGPTGUID(entry[16:], uuid.MustParse(partition.UUID))
+		binary.LittleEndian.PutUint64(entry[32:], uint64(partition.Offset/blockSize))
+		binary.LittleEndian.PutUint64(entry[40:], uint64((partition.Offset+partition.Size)/blockSize-1))
+		for i, u := range utf16.Encode([]rune(partition.Name)) {
+			binary.LittleEndian.PutUint16(entry[56+i*2:], u)
+		}
+	}
+	_, err = f.WriteAt(entries, 2*blockSize)
+	require.NoError(t, err)
+
+	header := make([]byte, gptMinHeaderSize)
+	copy(header, gptSignature)
+	binary.LittleEndian.PutUint32(header[8:], 0x00010000)
+	binary.LittleEndian.PutUint32(header[gptHeaderSizeStart:], gptMinHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:], 1)
+	binary.LittleEndian.PutUint64(header[gptEntriesLBAStart:], 2)
+	binary.LittleEndian.PutUint32(header[gptEntryCountStart:], entryCount)
+	binary.LittleEndian.PutUint32(header[gptEntrySizeStart:], entrySize)
+	binary.LittleEndian.PutUint32(header[gptEntriesCRCStart:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[gptHeaderCRCStart:], crc32.ChecksumIEEE(header))
+	_, err = f.WriteAt(header, blockSize)
+	require.NoError(t, err)
+}
+
+func TestReadPartitionsGPT(t *testing.T) {
+	const linux = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+	for _, blockSize := range []int64{512, 4096} {
+		expected := []Partition{
+			{Number: 1, Offset: 256 * 4096, Size: 64 * 4096, Type: linux, UUID: uuid.NewString(), Name: "first"},
+			{Number: 3, Offset: 512 * 4096, Size: 128 * 4096, Type: linux, UUID: uuid.NewString(), Name: "third, ünïcödé"},
+		}
+		f, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+		require.NoError(t, err)
+		defer f.Close()
+		require.NoError(t, f.Truncate(1024*4096))
+		writeGPT(t, f, blockSize, expected)
+
+		partitions, err := ReadPartitions(f)
+		require.NoError(t, err, "block size %d", blockSize)
+		assert.Equal(t, expected, partitions, "block size %d", blockSize)
+
+		partition, err := FindPartition(f, 3)
+		require.NoError(t, err)
+		assert.Equal(t, expected[1], partition)
+		_, err = FindPartition(f, 2)
+		assert.Error(t, err)
+
+		// damage the partition entries
+		_, err = f.WriteAt([]byte{0xff}, 2*blockSize+100)
+		require.NoError(t, err)
+		_, err = ReadPartitions(f)
+		assert.ErrorContains(t, err, "checksum")
+	}
+}
+
+func TestReadPartitionsMBR(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(4*1024*1024))
+
+	mbr := make([]byte, 512)
+	putMBREntry(mbr, 0, 0x83, 2048, 2048)
+	putMBREntry(mbr, 1, 0x05, 4096, 4096)
+	_, err = f.WriteAt(mbr, 0)
+	require.NoError(t, err)
+	// two logical partitions, each of which is preceded by its EBR
+	ebr := make([]byte, 512)
+	putMBREntry(ebr, 0, 0x83, 1, 1023)
+	putMBREntry(ebr, 1, 0x05, 1024, 2048)
+	_, err = f.WriteAt(ebr, 4096*V1SectorSize)
+	require.NoError(t, err)
+	ebr = make([]byte, 512)
+	putMBREntry(ebr, 0, 0x8e, 8, 2040)
+	_, err = f.WriteAt(ebr, (4096+1024)*V1SectorSize)
+	require.NoError(t, err)
+
+	partitions, err := ReadPartitions(f)
+	require.NoError(t, err)
+	assert.Equal(t, []Partition{
+		{Number: 1, Offset: 2048 * V1SectorSize, Size: 2048 * V1SectorSize, Type: "0x83"},
+		{Number: 2, Offset: 4096 * V1SectorSize, Size: 4096 * V1SectorSize, Type: "0x05"},
+		{Number: 5, Offset: 4097 * V1SectorSize, Size: 1023 * V1SectorSize, Type: "0x83"},
+		{Number: 6, Offset: (4096 + 1024 + 8) * V1SectorSize, Size: 2040 * V1SectorSize, Type: "0x8e"},
+	}, partitions)
+
+	// a chain of EBRs which loops back on itself
+	ebr = make([]byte, 512)
+	putMBREntry(ebr, 0, 0x83, 8, 8)
+	putMBREntry(ebr, 1, 0x05, 1024, 2048)
+	_, err = f.WriteAt(ebr, (4096+1024)*V1SectorSize)
+	require.NoError(t, err)
+	_, err = ReadPartitions(f)
+	assert.Error(t, err)
+
+	require.NoError(t, f.Truncate(0))
+	require.NoError(t, f.Truncate(1024*1024))
+	_, err = ReadPartitions(f)
+	assert.ErrorIs(t, err, ErrNoPartitionTable)
+}
+
+func TestSection(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(8*1024*1024))
+	partition := Partition{Number: 1, Offset: 1024 * 1024, Size: 6 * 1024 * 1024}
+	section := NewSection(f, partition.Offset, partition.Size)
+
+	size, err := section.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, partition.Size, size)
+	_, err = section.WriteAt(make([]byte, 2), partition.Size-1)
+	assert.Error(t, err, "writes past the end of the section should fail")
+	buf := make([]byte, 2)
+	n, err := section.ReadAt(buf, partition.Size-1)
+	assert.Equal(t, 1, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// encrypt into the partition, and check that nothing outside of it
+	// was touched
+	plaintext := randomBytes(t, 2*1024*1024)
+	header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{Stripes: 100})
+	require.NoError(t, err)
+	_, err = section.WriteAt(header, 0)
+	require.NoError(t, err)
+	wc := volume.EncryptWriter(section, StreamOptions{})
+	_, err = wc.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	outside := make([]byte, partition.Offset)
+	_, err = f.ReadAt(outside, 0)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, partition.Offset), outside)
+	_, err = f.ReadAt(outside, partition.Offset+partition.Size)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, partition.Offset), outside)
+
+	v1header, _, _, _, err := ReadHeaders(section, ReadHeaderOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, v1header)
+	unlocked, err := v1header.Unlock("password", section, UnlockOptions{})
+	require.NoError(t, err)
+	decrypted := decryptVolume(t, unlocked, section)
+	assert.Equal(t, plaintext, decrypted[:len(plaintext)])
+}
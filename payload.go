@@ -0,0 +1,186 @@
+package luksy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Payload provides random access to the decrypted payload of an unlocked
+// volume, decrypting sectors as they are read, and encrypting them as they
+// are written.
+type Payload struct {
+	f        io.ReaderAt
+	segments []VolumeSegment
+	size     int64
+	readOnly bool
+	mu       sync.Mutex
+}
+
+// Payload returns a Payload which reads the volume's encrypted payload from
+// f, and writes to f if it is also an io.WriterAt and the volume isn't
+// ReadOnly.  The size of each part of the payload must be known, as it is for
+// a Volume returned by one of the Unlock functions.
+func (v *Volume) Payload(f io.ReaderAt) (*Payload, error) {
+	segments := v.Segments
+	if segments == nil {
+		segments = []VolumeSegment{{Cipher: v.Cipher, FirstSector: v.FirstSector, Offset: v.PayloadOffset, Size: v.PayloadSize}}
+	}
+	var size int64
+	for i, segment := range segments {
+		if segment.Size < 0 {
+			return nil, fmt.Errorf("size of payload segment %d is not known", i)
+		}
+		if segment.Cipher != nil && segment.Size%int64(segment.Cipher.SectorSize()) != 0 {
+			return nil, fmt.Errorf("size of payload segment %d (%d) is not a multiple of its sector size (%d)", i, segment.Size, segment.Cipher.SectorSize())
+		}
+		size += segment.Size
+	}
+	return &Payload{f: f, segments: segments, size: size, readOnly: v.ReadOnly}, nil
+}
+
+// Size returns the size of the decrypted payload.
+func (p *Payload) Size() int64 {
+	return p.size
+}
+
+// ReadAt reads decrypted data from the payload.
+func (p *Payload) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if off >= p.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(b)) > p.size-off {
+		b = b[:p.size-off]
+		eof = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.each(b, off, p.readSegment); err != nil {
+		return 0, err
+	}
+	return len(b), eof
+}
+
+// WriteAt encrypts data and writes it to the payload.  Writes which don't
+// cover entire sectors require the rest of those sectors to be read and
+// decrypted first.
+func (p *Payload) WriteAt(b []byte, off int64) (int, error) {
+	if p.readOnly {
+		return 0, errors.New("payload is read-only, because the volume is being reencrypted or has requirements that were ignored")
+	}
+	if _, ok := p.f.(io.WriterAt); !ok {
+		return 0, errors.New("payload is not writable")
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("write at negative offset %d", off)
+	}
+	if off > p.size || int64(len(b)) > p.size-off {
+		return 0, fmt.Errorf("writing %d bytes at offset %d would run past the end of a %d-byte payload", len(b), off, p.size)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.each(b, off, p.writeSegment); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Sync flushes writes to the file which contains the payload, if it knows
+// how to do that.
+func (p *Payload) Sync() error {
+	if syncer, ok := p.f.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// each calls fn for each part of b which falls in a single segment, along
+// with the offset in the segment where that part starts.
+func (p *Payload) each(b []byte, off int64, fn func(segment VolumeSegment, b []byte, off int64) error) error {
+	var start int64
+	for _, segment := range p.segments {
+		end := start + segment.Size
+		if len(b) > 0 && off < end {
+			n := len(b)
+			if int64(n) > end-off {
+				n = int(end - off)
+			}
+			if err := fn(segment, b[:n], off-start); err != nil {
+				return err
+			}
+			b = b[n:]
+			off += int64(n)
+		}
+		start = end
+	}
+	return nil
+}
+
+// sectors returns the range of a segment's sectors, in bytes, which holds
+// the length bytes at off.
+func sectors(segment VolumeSegment, off int64, length int) (int64, int64) {
+	sectorSize := int64(segment.Cipher.SectorSize())
+	first := off / sectorSize * sectorSize
+	last := (off + int64(length) + sectorSize - 1) / sectorSize * sectorSize
+	return first, last
+}
+
+// readSectors reads and decrypts the sectors of a segment which lie between
+// first and last.
+func (p *Payload) readSectors(segment VolumeSegment, first, last int64) ([]byte, error) {
+	buf := make([]byte, last-first)
+	if n, err := p.f.ReadAt(buf, segment.Offset+first); n != len(buf) {
+		return nil, fmt.Errorf("reading %d bytes at offset %d: %w", len(buf), segment.Offset+first, err)
+	}
+	sector := segment.FirstSector + uint64(first/int64(segment.Cipher.SectorSize()))
+	if err := segment.Cipher.DecryptSectors(buf, buf, sector); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (p *Payload) readSegment(segment VolumeSegment, b []byte, off int64) error {
+	if segment.Cipher == nil {
+		if n, err := p.f.ReadAt(b, segment.Offset+off); n != len(b) {
+			return fmt.Errorf("reading %d bytes at offset %d: %w", len(b), segment.Offset+off, err)
+		}
+		return nil
+	}
+	first, last := sectors(segment, off, len(b))
+	buf, err := p.readSectors(segment, first, last)
+	if err != nil {
+		return err
+	}
+	copy(b, buf[off-first:])
+	return nil
+}
+
+func (p *Payload) writeSegment(segment VolumeSegment, b []byte, off int64) error {
+	w := p.f.(io.WriterAt)
+	if segment.Cipher == nil {
+		_, err := w.WriteAt(b, segment.Offset+off)
+		return err
+	}
+	first, last := sectors(segment, off, len(b))
+	var buf []byte
+	if first == off && last == off+int64(len(b)) {
+		buf = make([]byte, last-first)
+	} else {
+		var err error
+		if buf, err = p.readSectors(segment, first, last); err != nil {
+			return err
+		}
+	}
+	copy(buf[off-first:], b)
+	sector := segment.FirstSector + uint64(first/int64(segment.Cipher.SectorSize()))
+	if err := segment.Cipher.EncryptSectors(buf, buf, sector); err != nil {
+		return err
+	}
+	_, err := w.WriteAt(buf, segment.Offset+first)
+	return err
+}
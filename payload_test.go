@@ -0,0 +1,107 @@
+package luksy
+
+import (
+	"io"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// payloadVolume builds a volume whose payload is made up of an encrypted
+// segment with 4096-byte sectors, an unencrypted segment, and an encrypted
+// segment with 512-byte sectors, writes plaintext to it, and returns it.
+func payloadVolume(t *testing.T, plaintext []byte) (*os.File, *Volume) {
+	require.Equal(t, 0, len(plaintext)%(3*4096))
+	third := int64(len(plaintext) / 3)
+	large, err := NewSectorCipher("aes-xts-plain64", randomBytes(t, 64), 4096)
+	require.NoError(t, err)
+	small, err := NewSectorCipher("serpent-cbc-essiv:sha256", randomBytes(t, 32), V1SectorSize)
+	require.NoError(t, err)
+	volume := &Volume{
+		PayloadOffset: 8192,
+		PayloadSize:   3 * third,
+		Segments: []VolumeSegment{
+			{Cipher: large, FirstSector: 0, Offset: 8192, Size: third},
+			{Offset: 8192 + third, Size: third},
+			{Cipher: small, FirstSector: 1000, Offset: 8192 + 2*third, Size: third},
+		},
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "encrypted"))
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	wc := volume.EncryptWriter(f, StreamOptions{})
+	_, err = wc.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	return f, volume
+}
+
+func TestPayload(t *testing.T) {
+	expected := randomBytes(t, 3*64*4096)
+	f, volume := payloadVolume(t, expected)
+	payload, err := volume.Payload(f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expected)), payload.Size())
+
+	// a mix of aligned and unaligned reads and writes, some of which
+	// cross from one segment into another
+	rng := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		off := rng.Int63n(int64(len(expected)))
+		length := rng.Intn(3 * 4096)
+		if i%4 == 0 {
+			off = off / 4096 * 4096
+			length = 4096 * (1 + rng.Intn(3))
+		}
+		if off+int64(length) > int64(len(expected)) {
+			length = len(expected) - int(off)
+		}
+		if i%2 == 0 {
+			data := randomBytes(t, length)
+			n, err := payload.WriteAt(data, off)
+			require.NoError(t, err, "writing %d bytes at %d", length, off)
+			require.Equal(t, length, n)
+			copy(expected[off:], data)
+		} else {
+			data := make([]byte, length)
+			n, err := payload.ReadAt(data, off)
+			require.NoError(t, err, "reading %d bytes at %d", length, off)
+			require.Equal(t, length, n)
+			require.Equal(t, expected[off:off+int64(length)], data, "reading %d bytes at %d", length, off)
+		}
+	}
+	require.NoError(t, payload.Sync())
+
+	// the result should match when we decrypt the whole thing
+	rc := volume.DecryptReader(f, StreamOptions{})
+	decrypted, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, expected, decrypted)
+
+	// reads which run off the end are short, and writes which would are
+	// refused
+	buf := make([]byte, 100)
+	n, err := payload.ReadAt(buf, payload.Size()-10)
+	assert.Equal(t, 10, n)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, expected[len(expected)-10:], buf[:10])
+	_, err = payload.WriteAt(buf, payload.Size()-10)
+	assert.Error(t, err)
+
+	// a payload whose size isn't known can't be used
+	_, err = (&Volume{Cipher: volume.Segments[0].Cipher, PayloadSize: -1}).Payload(f)
+	assert.Error(t, err)
+
+	// a payload in a file that we can't write to
+	payload, err = volume.Payload(io.NewSectionReader(f, 0, 1<<30))
+	require.NoError(t, err)
+	_, err = payload.WriteAt(buf, 0)
+	assert.Error(t, err)
+	_, err = payload.ReadAt(buf, 0)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,153 @@
+package luksy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The defaults which cryptsetup has historically used for plain mode.
+const (
+	plainDefaultCipher  = "aes-cbc-essiv:sha256"
+	plainDefaultKeySize = 32
+	plainDefaultHash    = "ripemd160"
+)
+
+// PlainOptions describes a volume in cryptsetup's "plain" mode, which has no
+// header, so everything that would otherwise be read from one has to be
+// supplied.
+type PlainOptions struct {
+	// Cipher is the cipher which encrypts the payload.  If "",
+	// "aes-cbc-essiv:sha256" is used.
+	Cipher string
+	// Offset is the offset in the file where the payload begins, in
+	// bytes.  It must be a multiple of V1SectorSize.
+	Offset int64
+	// Skip is the number of the payload's first sector, for purposes of
+	// IV generation.
+	Skip uint64
+	// Size is the size of the payload, in bytes.  It must be a multiple
+	// of V1SectorSize.  If 0, the payload runs to the end of the file.
+	Size int64
+}
+
+// PlainKey derives a key of the specified size from a passphrase, the way
+// cryptsetup does in plain mode.  The hash is specified as a hash algorithm
+// name, "plain" to use the passphrase itself, either of which can be
+// followed by ":" and a number of bytes to derive, with the remainder of the
+// key being zero-filled.  If the hash is "", "ripemd160" is used.  If the
+// key size is 0, 32 is used.
+func PlainKey(passphrase []byte, hashSpec string, keySize int) ([]byte, error) {
+	if hashSpec == "" {
+		hashSpec = plainDefaultHash
+	}
+	if keySize == 0 {
+		keySize = plainDefaultKeySize
+	}
+	if keySize < 0 {
+		return nil, fmt.Errorf("invalid key size %d", keySize)
+	}
+	hashName, hashLength := hashSpec, keySize
+	if name, length, ok := strings.Cut(hashSpec, ":"); ok {
+		l, err := strconv.Atoi(length)
+		if err != nil || l < 0 {
+			return nil, fmt.Errorf("invalid hash specification %q", hashSpec)
+		}
+		if l > keySize {
+			return nil, fmt.Errorf("hash length %d in %q is larger than the key size %d", l, hashSpec, keySize)
+		}
+		hashName, hashLength = name, l
+	}
+	key := make([]byte, keySize)
+	if hashName == "plain" {
+		if len(passphrase) < hashLength {
+			return nil, fmt.Errorf("passphrase is too short to be used as a %d-byte key", hashLength)
+		}
+		copy(key, passphrase[:hashLength])
+		return key, nil
+	}
+	hasher, err := hasherByName(hashName)
+	if err != nil {
+		return nil, err
+	}
+	// each round hashes the passphrase with one more "A" in front of it
+	// than the last one did, until there's enough output to fill the key
+	for round, derived := 0, 0; derived < hashLength; round++ {
+		h := hasher()
+		h.Write([]byte(strings.Repeat("A", round)))
+		h.Write(passphrase)
+		derived += copy(key[derived:hashLength], h.Sum(nil))
+	}
+	return key, nil
+}
+
+// plainVolume checks options, and returns a Volume for a plain mode payload
+// with the specified key, with its size taken from the options.
+func plainVolume(key []byte, options PlainOptions) (*Volume, error) {
+	cipher := options.Cipher
+	if cipher == "" {
+		cipher = plainDefaultCipher
+	}
+	switch {
+	case options.Offset < 0 || options.Offset%V1SectorSize != 0:
+		return nil, fmt.Errorf("offset %d is not a multiple of %d", options.Offset, V1SectorSize)
+	case options.Size < 0 || options.Size%V1SectorSize != 0:
+		return nil, fmt.Errorf("size %d is not a multiple of %d", options.Size, V1SectorSize)
+	}
+	payloadCipher, err := NewSectorCipher(cipher, key, V1SectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("cipher %q with a %d-byte key: %w", cipher, len(key), err)
+	}
+	return &Volume{
+		Cipher:        payloadCipher,
+		FirstSector:   options.Skip,
+		PayloadOffset: options.Offset,
+		PayloadSize:   options.Size,
+	}, nil
+}
+
+// FormatPlain prepares to encrypt data using a key, as cryptsetup does in
+// plain mode.  There is no header to write.
+//
+// Returns a Volume which describes the payload.  If options.Size is 0, the
+// size of the payload is given as -1.
+func FormatPlain(key []byte, options PlainOptions) (*Volume, error) {
+	v, err := plainVolume(key, options)
+	if err != nil {
+		return nil, err
+	}
+	if v.PayloadSize == 0 {
+		v.PayloadSize = -1
+	}
+	return v, nil
+}
+
+// UnlockPlain returns a Volume which can be used to decrypt the payload of a
+// plain mode volume stored in f, using a key.  Because there is no header,
+// there's no way to check that the key or options are correct, and
+// decrypting with the wrong ones produces garbage.
+func UnlockPlain(key []byte, f ReaderAtSeekCloser, options PlainOptions) (*Volume, error) {
+	v, err := plainVolume(key, options)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if v.PayloadSize == 0 {
+		if v.PayloadOffset > size {
+			return nil, fmt.Errorf("offset %d is past the end of the file, which is %d bytes long", v.PayloadOffset, size)
+		}
+		v.PayloadSize = size - v.PayloadOffset
+	}
+	if v.PayloadOffset+v.PayloadSize > size {
+		return nil, fmt.Errorf("payload at offset %d, size %d runs past the end of the file, which is %d bytes long", v.PayloadOffset, v.PayloadSize, size)
+	}
+	if v.PayloadSize == 0 {
+		return nil, errors.New("payload is empty")
+	}
+	return v, nil
+}
@@ -0,0 +1,105 @@
+package luksy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlainKey(t *testing.T) {
+	for _, tc := range []struct {
+		hash     string
+		keySize  int
+		expected string
+	}{
+		{"", 0, "2c08e8f5884750a7b99f6f2f342fc638db25ff31fb00ff3460badc65d7758851"},
+		{"sha1", 32, "5baa61e4c9b93f3f0682250b6cf8331b7ee68fd830c90fe08d77d911f4b5543e"},
+		{"sha256", 64, "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d89fff15cdec1f0b4f804c2217cce94ad7194ebc18744892bc7bb52be9fd7bb942"},
+		{"sha256:16", 32, "5e884898da28047151d0e56f8dc6292700000000000000000000000000000000"},
+		{"plain", 8, hex.EncodeToString([]byte("password"))},
+		{"plain:4", 8, hex.EncodeToString([]byte("pass\x00\x00\x00\x00"))},
+	} {
+		key, err := PlainKey([]byte("password"), tc.hash, tc.keySize)
+		require.NoError(t, err, "hash %q", tc.hash)
+		assert.Equal(t, tc.expected, hex.EncodeToString(key), "hash %q", tc.hash)
+	}
+
+	for _, tc := range []struct {
+		hash    string
+		keySize int
+	}{
+		{"plain", 16},
+		{"sha256:33", 32},
+		{"sha256:x", 32},
+		{"md5", 32},
+		{"sha256", -1},
+	} {
+		_, err := PlainKey([]byte("password"), tc.hash, tc.keySize)
+		assert.Error(t, err, "hash %q, key size %d", tc.hash, tc.keySize)
+	}
+}
+
+func TestPlainRoundTrip(t *testing.T) {
+	key, err := PlainKey([]byte("password"), "sha256", 64)
+	require.NoError(t, err)
+	options := PlainOptions{Cipher: "aes-xts-plain64", Offset: 8 * V1SectorSize, Skip: 3}
+	volume, err := FormatPlain(key, options)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), volume.PayloadSize)
+
+	plaintext := make([]byte, 64*V1SectorSize)
+	_, err = rand.Read(plaintext)
+	require.NoError(t, err)
+	f, err := os.Create(filepath.Join(t.TempDir(), "encrypted"))
+	require.NoError(t, err)
+	defer f.Close()
+	wc := volume.EncryptWriter(f, StreamOptions{})
+	_, err = wc.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+
+	// the payload should be encrypted as though it started at sector "skip"
+	ciphertext := make([]byte, len(plaintext))
+	_, err = f.ReadAt(ciphertext, options.Offset)
+	require.NoError(t, err)
+	sectorCipher, err := NewSectorCipher(options.Cipher, key, V1SectorSize)
+	require.NoError(t, err)
+	decrypted := make([]byte, len(ciphertext))
+	require.NoError(t, sectorCipher.DecryptSectors(decrypted, ciphertext, options.Skip))
+	assert.Equal(t, plaintext, decrypted)
+
+	unlocked, err := UnlockPlain(key, f, options)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(plaintext)), unlocked.PayloadSize)
+	rc := unlocked.DecryptReader(f, StreamOptions{})
+	decrypted, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, plaintext, decrypted)
+
+	options.Size = 16 * V1SectorSize
+	unlocked, err = UnlockPlain(key, f, options)
+	require.NoError(t, err)
+	rc = unlocked.DecryptReader(f, StreamOptions{})
+	decrypted, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, plaintext[:options.Size], decrypted)
+
+	for _, bad := range []PlainOptions{
+		{Cipher: options.Cipher, Offset: 100},
+		{Cipher: options.Cipher, Size: 100},
+		{Cipher: options.Cipher, Size: int64(len(plaintext)) * 2},
+		{Cipher: options.Cipher, Offset: int64(len(plaintext)) * 2},
+		{Cipher: "aes-cbc-essiv:sha256"}, // 64 bytes is the wrong key size for this
+	} {
+		_, err = UnlockPlain(key, f, bad)
+		assert.Error(t, err, "%+v", bad)
+	}
+}
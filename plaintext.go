@@ -0,0 +1,106 @@
+package luksy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// V2JSONTokenTypePlaintextSize is the type of the token which records the
+// exact length of a payload's plaintext in a LUKSv2 header, when it isn't a
+// multiple of the sector size.  cryptsetup ignores tokens of types that it
+// doesn't know about.
+const V2JSONTokenTypePlaintextSize = "luksy-plaintext-size"
+
+// newPlaintextSizeToken returns a token which records the plaintext's size.
+func newPlaintextSizeToken(size int64) V2JSONToken {
+	return V2JSONToken{
+		Type:                     V2JSONTokenTypePlaintextSize,
+		Keyslots:                 []string{},
+		V2JSONTokenPlaintextSize: &V2JSONTokenPlaintextSize{PlaintextSize: strconv.FormatInt(size, 10)},
+	}
+}
+
+// plaintextSize returns the size of the plaintext recorded in a token, or 0
+// if there isn't one, after checking that it fits in the payload, which is
+// payloadSize bytes long, or of unknown length if payloadSize is negative.
+func (j V2JSON) plaintextSize(payloadSize int64) (int64, error) {
+	var size int64
+	for _, t := range sortedIDs(j.Tokens) {
+		token := j.Tokens[t]
+		if token.Type != V2JSONTokenTypePlaintextSize {
+			continue
+		}
+		if token.V2JSONTokenPlaintextSize == nil {
+			return -1, fmt.Errorf("token %q is corrupt: no plaintext size", t)
+		}
+		recorded, err := strconv.ParseInt(token.PlaintextSize, 10, 64)
+		if err != nil || recorded <= 0 {
+			return -1, fmt.Errorf("token %q has invalid plaintext size %q", t, token.PlaintextSize)
+		}
+		if size != 0 && recorded != size {
+			return -1, fmt.Errorf("tokens disagree about the plaintext size (%d and %d)", size, recorded)
+		}
+		if payloadSize >= 0 && recorded > payloadSize {
+			return -1, fmt.Errorf("token %q records a plaintext size of %d, but the payload is only %d bytes long", t, recorded, payloadSize)
+		}
+		size = recorded
+	}
+	return size, nil
+}
+
+// setPlaintextSize makes the payload, which has to be a single encrypted
+// segment, just large enough to hold size bytes of plaintext, and records
+// size in a token, replacing any that already recorded a size.
+func (j *V2JSON) setPlaintextSize(size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid plaintext size %d", size)
+	}
+	dataSegments, err := j.dataSegments()
+	if err != nil {
+		return err
+	}
+	if len(dataSegments) != 1 {
+		return fmt.Errorf("payload has %d segments, but the plaintext size can only be recorded for a single segment", len(dataSegments))
+	}
+	id := dataSegments[0]
+	segment := j.Segments[id]
+	if segment.Type != "crypt" || segment.V2JSONSegmentCrypt == nil {
+		return fmt.Errorf("segment %q is not encrypted", id)
+	}
+	segment.Size = strconv.FormatInt(roundUpToMultiple64(size, int64(segment.SectorSize)), 10)
+	j.Segments[id] = segment
+	if j.Tokens == nil {
+		j.Tokens = make(map[string]V2JSONToken)
+	}
+	for _, t := range sortedIDs(j.Tokens) {
+		if j.Tokens[t].Type == V2JSONTokenTypePlaintextSize {
+			delete(j.Tokens, t)
+		}
+	}
+	for t := 0; ; t++ {
+		if _, ok := j.Tokens[strconv.Itoa(t)]; !ok {
+			j.Tokens[strconv.Itoa(t)] = newPlaintextSizeToken(size)
+			return nil
+		}
+	}
+}
+
+// SetV2PlaintextSize records the exact length of the plaintext in the LUKSv2
+// headers in f, for use when it wasn't known when the headers were created,
+// e.g., because the plaintext was read from a pipe.  The payload, which has to
+// be a single encrypted segment, is given a fixed size which is just large
+// enough to hold the plaintext.
+func SetV2PlaintextSize(f ReaderAtWriterAt, size int64) error {
+	v1, _, _, j, err := ReadHeaders(f, ReadHeaderOptions{Recover: true})
+	if err != nil {
+		return err
+	}
+	if v1 != nil {
+		return errors.New("LUKSv1 volumes have nowhere to record the plaintext size")
+	}
+	if err := j.setPlaintextSize(size); err != nil {
+		return err
+	}
+	return UpdateV2JSON(f, j)
+}
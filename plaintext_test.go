@@ -0,0 +1,135 @@
+package luksy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// imageFile writes an image to a temporary file, and opens it for reading and
+// writing.
+func imageFile(t *testing.T, image []byte) *os.File {
+	name := filepath.Join(t.TempDir(), "encrypted")
+	require.NoError(t, os.WriteFile(name, image, 0o600))
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestPlaintextSize(t *testing.T) {
+	plaintext := randomBytes(t, 100001)
+	decrypt := func(t *testing.T, f *os.File) *Volume {
+		_, h1, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		unlocked, err := h1.Unlock("password", f, *j, UnlockOptions{})
+		require.NoError(t, err)
+		rc := unlocked.DecryptReader(f, StreamOptions{})
+		decrypted, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, plaintext, decrypted)
+
+		// and when reading it as a stream
+		headers, err := ReadStreamHeaders(io.NewSectionReader(f, 0, 1<<62), ReadHeaderOptions{})
+		require.NoError(t, err)
+		streamed, err := headers.Unlock("password", UnlockOptions{})
+		require.NoError(t, err)
+		rc = streamed.DecryptStream(headers.Reader(), StreamOptions{})
+		decrypted, err = io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, plaintext, decrypted)
+
+		findings, err := Validate(f)
+		require.NoError(t, err)
+		assert.False(t, HasErrors(findings), "%v", findings)
+		return unlocked
+	}
+
+	for _, sectorSize := range []int{512, 4096} {
+		header, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100, SectorSize: sectorSize, PlaintextSize: int64(len(plaintext))})
+		require.NoError(t, err)
+		padded := roundUpToMultiple64(int64(len(plaintext)), int64(sectorSize))
+		assert.Equal(t, padded, volume.PayloadSize)
+		assert.Equal(t, int64(len(plaintext)), volume.PlaintextSize)
+		image := make([]byte, volume.PayloadOffset+padded)
+		copy(image, header)
+		wc := volume.EncryptWriter(byteWriterAt(image), StreamOptions{})
+		_, err = wc.Write(plaintext)
+		require.NoError(t, err)
+		require.NoError(t, wc.Close())
+		unlocked := decrypt(t, imageFile(t, image))
+		assert.Equal(t, padded, unlocked.PayloadSize)
+		assert.Equal(t, int64(len(plaintext)), unlocked.PlaintextSize)
+
+		// cryptsetup needs the token to have a list of key slots
+		_, _, _, j, err := ReadHeaders(bytes.NewReader(image), ReadHeaderOptions{})
+		require.NoError(t, err)
+		encoded, err := json.Marshal(j.Tokens["0"])
+		require.NoError(t, err)
+		assert.Contains(t, string(encoded), `"keyslots":[]`)
+
+		// writing the wrong amount is an error
+		for _, size := range []int{len(plaintext) - 1, len(plaintext) + 1} {
+			wc = volume.EncryptWriter(byteWriterAt(make([]byte, len(image))), StreamOptions{})
+			_, err = wc.Write(plaintext[:size%len(plaintext)])
+			if err == nil {
+				if size > len(plaintext) {
+					_, err = wc.Write(plaintext[:1])
+				}
+				if err == nil {
+					err = wc.Close()
+				}
+			}
+			assert.Error(t, err, "writing %d bytes", size)
+		}
+	}
+
+	t.Run("recorded-later", func(t *testing.T) {
+		header, volume, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100})
+		require.NoError(t, err)
+		var stream bytes.Buffer
+		wc := volume.EncryptStream(&stream, header, StreamOptions{})
+		_, err = wc.Write(plaintext)
+		require.NoError(t, err)
+		require.NoError(t, wc.Close())
+		f := imageFile(t, stream.Bytes())
+		require.NoError(t, SetV2PlaintextSize(f, int64(len(plaintext))))
+		unlocked := decrypt(t, f)
+		assert.Equal(t, int64(stream.Len())-unlocked.PayloadOffset, unlocked.PayloadSize)
+
+		// recording it again replaces the old token
+		require.NoError(t, SetV2PlaintextSize(f, int64(len(plaintext))))
+		_, _, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		assert.Len(t, j.Tokens, 1)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100, PlaintextSize: 1000, Segments: []FormatV2Segment{{Size: 4096}}})
+		assert.Error(t, err)
+		header, _, err := FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100, Segments: []FormatV2Segment{{Size: 4096}, {Linear: true}}})
+		require.NoError(t, err)
+		assert.Error(t, SetV2PlaintextSize(imageFile(t, header), 1000), "can't record a size for more than one segment")
+
+		// a token which claims more than the payload holds
+		header, _, err = FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100, PlaintextSize: 1000})
+		require.NoError(t, err)
+		f := imageFile(t, append(header, make([]byte, 4096)...))
+		_, _, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		j.Tokens["0"] = newPlaintextSizeToken(5000)
+		require.NoError(t, UpdateV2JSON(f, j))
+		_, h1, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{})
+		assert.ErrorContains(t, err, "plaintext size")
+	})
+}
@@ -0,0 +1,531 @@
+package luksy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotQcow2 is returned by ReadQcow2() when a file doesn't start with a
+// qcow2 header.
+var ErrNotQcow2 = errors.New("not a qcow2 image")
+
+// Locations of things in qcow2 headers, and values which are stored in them,
+// as described in QEMU's docs/interop/qcow2.txt.
+const (
+	qcow2Magic                 = "QFI\xfb"
+	qcow2VersionStart          = 4
+	qcow2BackingFileStart      = 8
+	qcow2ClusterBitsStart      = 20
+	qcow2SizeStart             = 24
+	qcow2CryptMethodStart      = 32
+	qcow2L1SizeStart           = 36
+	qcow2L1TableStart          = 40
+	qcow2RefcountTableStart    = 48
+	qcow2RefcountClustersStart = 56
+	qcow2IncompatibleStart     = 72
+	qcow2RefcountOrderStart    = 96
+	qcow2HeaderLengthStart     = 100
+	qcow2V2HeaderLength        = 72
+	qcow2V3HeaderLength        = 104
+	qcow2CryptNone             = 0
+	qcow2CryptAES              = 1
+	qcow2CryptLUKS             = 2
+	qcow2ExtEnd                = 0
+	qcow2ExtCrypto             = 0x0537be77
+	qcow2IncompatibleDirty     = 1 << 0
+	qcow2IncompatibleCorrupt   = 1 << 1
+	qcow2IncompatibleCompress  = 1 << 3
+	qcow2OffsetMask            = 0x00fffffffffffe00
+	qcow2Copied                = 1 << 63
+	qcow2Compressed            = 1 << 62
+	qcow2ZeroCluster           = 1 << 0
+	qcow2MinClusterBits        = 9
+	qcow2MaxClusterBits        = 21
+	qcow2MaxL1Size             = 32 * 1024 * 1024 // bytes, QEMU's QCOW_MAX_L1_SIZE
+	qcow2DefaultClusterSize    = 65536
+	qcow2RefcountOrder         = 4 // 16-bit refcounts
+)
+
+// Qcow2Image describes a qcow2 image whose contents are encrypted using an
+// embedded LUKS header.
+type Qcow2Image struct {
+	// Version is the qcow2 format version, 2 or 3.
+	Version int
+	// ClusterSize is the size of the clusters which the image's contents
+	// are divided into.
+	ClusterSize int64
+	// VirtualSize is the size of the disk that the image holds.
+	VirtualSize int64
+	// LUKSHeaderOffset and LUKSHeaderLength are the location of the
+	// embedded LUKS header in the image file.
+	LUKSHeaderOffset int64
+	LUKSHeaderLength int64
+	l1               []uint64
+}
+
+// ReadQcow2 reads the header of a qcow2 image, and its L1 table.  It returns
+// ErrNotQcow2 if the file isn't a qcow2 image, and an error if the image is
+// one which we can't decrypt, either because it isn't encrypted using LUKS,
+// or because it uses features which aren't supported: backing files,
+// external data files, and extended L2 entries.
+func ReadQcow2(f io.ReaderAt) (*Qcow2Image, error) {
+	header := make([]byte, qcow2V3HeaderLength)
+	n, err := f.ReadAt(header, 0)
+	if n < qcow2V2HeaderLength || string(header[:len(qcow2Magic)]) != qcow2Magic {
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return nil, ErrNotQcow2
+	}
+	q := &Qcow2Image{Version: int(binary.BigEndian.Uint32(header[qcow2VersionStart:]))}
+	headerLength := int64(qcow2V2HeaderLength)
+	switch q.Version {
+	case 2:
+	case 3:
+		if n < qcow2V3HeaderLength {
+			return nil, fmt.Errorf("qcow2 header is truncated: %w", err)
+		}
+		incompatible := binary.BigEndian.Uint64(header[qcow2IncompatibleStart:])
+		if incompatible&qcow2IncompatibleCorrupt != 0 {
+			log().Warnf("qcow2 image is marked as corrupt")
+		}
+		if unsupported := incompatible &^ (qcow2IncompatibleDirty | qcow2IncompatibleCorrupt | qcow2IncompatibleCompress); unsupported != 0 {
+			return nil, fmt.Errorf("qcow2 image uses unsupported incompatible features %#x", unsupported)
+		}
+		headerLength = int64(binary.BigEndian.Uint32(header[qcow2HeaderLengthStart:]))
+		if headerLength < qcow2V3HeaderLength {
+			return nil, fmt.Errorf("qcow2 header length %d is too short", headerLength)
+		}
+	default:
+		return nil, fmt.Errorf("qcow2 version %d is not supported", q.Version)
+	}
+	if binary.BigEndian.Uint64(header[qcow2BackingFileStart:]) != 0 {
+		return nil, errors.New("qcow2 images with backing files are not supported")
+	}
+	clusterBits := binary.BigEndian.Uint32(header[qcow2ClusterBitsStart:])
+	if clusterBits < qcow2MinClusterBits || clusterBits > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("qcow2 cluster bits value %d is out of range", clusterBits)
+	}
+	q.ClusterSize = int64(1) << clusterBits
+	q.VirtualSize = int64(binary.BigEndian.Uint64(header[qcow2SizeStart:]))
+	if q.VirtualSize < 0 {
+		return nil, fmt.Errorf("qcow2 virtual size %d is out of range", uint64(q.VirtualSize))
+	}
+	switch cryptMethod := binary.BigEndian.Uint32(header[qcow2CryptMethodStart:]); cryptMethod {
+	case qcow2CryptLUKS:
+	case qcow2CryptNone:
+		return nil, errors.New("qcow2 image is not encrypted")
+	case qcow2CryptAES:
+		return nil, errors.New("qcow2 image is encrypted using the legacy AES method, not LUKS")
+	default:
+		return nil, fmt.Errorf("qcow2 image uses unknown encryption method %d", cryptMethod)
+	}
+	if err := q.readExtensions(f, headerLength); err != nil {
+		return nil, err
+	}
+	if q.LUKSHeaderLength == 0 {
+		return nil, errors.New("qcow2 image is encrypted using LUKS, but has no LUKS header")
+	}
+
+	// check that the L1 table is the right size for the image, and read it
+	l2Entries := q.ClusterSize / 8
+	l1Size := binary.BigEndian.Uint32(header[qcow2L1SizeStart:])
+	if needed := (q.VirtualSize + q.ClusterSize*l2Entries - 1) / (q.ClusterSize * l2Entries); int64(l1Size) < needed {
+		return nil, fmt.Errorf("qcow2 L1 table has %d entries, but %d are needed", l1Size, needed)
+	}
+	if l1Size > qcow2MaxL1Size/8 {
+		return nil, fmt.Errorf("qcow2 L1 table has %d entries, more than the limit of %d", l1Size, qcow2MaxL1Size/8)
+	}
+	l1 := make([]byte, int64(l1Size)*8)
+	l1Offset := int64(binary.BigEndian.Uint64(header[qcow2L1TableStart:]))
+	if n, err := f.ReadAt(l1, l1Offset); n != len(l1) {
+		return nil, fmt.Errorf("reading qcow2 L1 table at offset %d: %w", l1Offset, err)
+	}
+	q.l1 = make([]uint64, l1Size)
+	for i := range q.l1 {
+		q.l1[i] = binary.BigEndian.Uint64(l1[i*8:])
+	}
+	return q, nil
+}
+
+// readExtensions reads the header extensions which follow the header,
+// looking for the one which points to the LUKS header.
+func (q *Qcow2Image) readExtensions(f io.ReaderAt, offset int64) error {
+	for offset+8 <= q.ClusterSize {
+		var ext [8]byte
+		if n, err := f.ReadAt(ext[:], offset); n != len(ext) {
+			return fmt.Errorf("reading qcow2 header extension at offset %d: %w", offset, err)
+		}
+		extType := binary.BigEndian.Uint32(ext[0:])
+		extLength := int64(binary.BigEndian.Uint32(ext[4:]))
+		if extType == qcow2ExtEnd {
+			return nil
+		}
+		if extType == qcow2ExtCrypto {
+			if extLength != 16 {
+				return fmt.Errorf("qcow2 encryption header extension has unexpected length %d", extLength)
+			}
+			var pointer [16]byte
+			if n, err := f.ReadAt(pointer[:], offset+8); n != len(pointer) {
+				return fmt.Errorf("reading qcow2 encryption header extension: %w", err)
+			}
+			q.LUKSHeaderOffset = int64(binary.BigEndian.Uint64(pointer[0:]))
+			q.LUKSHeaderLength = int64(binary.BigEndian.Uint64(pointer[8:]))
+			if q.LUKSHeaderOffset < 0 || q.LUKSHeaderLength < 0 {
+				return errors.New("qcow2 encryption header extension is corrupt")
+			}
+		}
+		offset += 8 + roundUpToMultiple64(extLength, 8)
+	}
+	return errors.New("qcow2 header extensions are not terminated")
+}
+
+func roundUpToMultiple64(i, factor int64) int64 {
+	if i%factor == 0 {
+		return i
+	}
+	return i + factor - i%factor
+}
+
+// LUKSHeader returns a Section of f which holds the image's LUKS header, which
+// can be passed to ReadHeaders() and then to Unlock().  The Volume which
+// Unlock() returns can then be passed to DecryptReader().
+func (q *Qcow2Image) LUKSHeader(f io.ReaderAt) *Section {
+	return NewSection(f, q.LUKSHeaderOffset, q.LUKSHeaderLength)
+}
+
+// DecryptReader returns an io.ReadCloser which reads the contents of the
+// disk that the image holds, decrypting them using the payload cipher of a
+// Volume which was unlocked using the image's LUKS header.  As QEMU does, we
+// generate IVs from each sector's location in the image file rather than on
+// the virtual disk.
+func (q *Qcow2Image) DecryptReader(f io.ReaderAt, volume *Volume) (io.ReadCloser, error) {
+	if volume.Cipher == nil {
+		return nil, errors.New("the LUKS header in the qcow2 image describes more than one payload segment")
+	}
+	if q.ClusterSize%int64(volume.Cipher.SectorSize()) != 0 {
+		return nil, fmt.Errorf("qcow2 cluster size %d is not a multiple of the encryption sector size %d", q.ClusterSize, volume.Cipher.SectorSize())
+	}
+	return &qcow2Reader{q: q, f: f, cipher: volume.Cipher, l2Index: -1}, nil
+}
+
+type qcow2Reader struct {
+	q       *Qcow2Image
+	f       io.ReaderAt
+	cipher  *SectorCipher
+	offset  int64
+	l2Index int64
+	l2      []byte
+	buf     []byte
+}
+
+// hostOffset returns the location in the image file of a guest cluster, or
+// 0 if the cluster reads as zeroes.
+func (r *qcow2Reader) hostOffset(guestCluster int64) (int64, error) {
+	l2Entries := r.q.ClusterSize / 8
+	l1Index := guestCluster / l2Entries
+	if l1Index != r.l2Index {
+		l2Offset := int64(r.q.l1[l1Index] & qcow2OffsetMask)
+		r.l2Index = l1Index
+		if l2Offset == 0 {
+			r.l2 = nil
+		} else {
+			if r.l2 == nil {
+				r.l2 = make([]byte, r.q.ClusterSize)
+			}
+			if n, err := r.f.ReadAt(r.l2, l2Offset); n != len(r.l2) {
+				r.l2Index = -1
+				return 0, fmt.Errorf("reading qcow2 L2 table at offset %d: %w", l2Offset, err)
+			}
+		}
+	}
+	if r.l2 == nil {
+		return 0, nil
+	}
+	entry := binary.BigEndian.Uint64(r.l2[(guestCluster%l2Entries)*8:])
+	if entry&qcow2Compressed != 0 {
+		return 0, fmt.Errorf("qcow2 cluster %d is compressed, which is not supported for encrypted images", guestCluster)
+	}
+	if entry&qcow2ZeroCluster != 0 && r.q.Version >= 3 {
+		return 0, nil
+	}
+	return int64(entry & qcow2OffsetMask), nil
+}
+
+func (r *qcow2Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.q.VirtualSize {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		guestCluster := r.offset / r.q.ClusterSize
+		host, err := r.hostOffset(guestCluster)
+		if err != nil {
+			return 0, err
+		}
+		buf := make([]byte, r.q.ClusterSize)
+		if host != 0 {
+			if n, err := r.f.ReadAt(buf, host); n != len(buf) {
+				return 0, fmt.Errorf("reading qcow2 cluster at offset %d: %w", host, err)
+			}
+			if err := r.cipher.DecryptSectors(buf, buf, uint64(host/int64(r.cipher.SectorSize()))); err != nil {
+				return 0, err
+			}
+		}
+		start := r.offset - guestCluster*r.q.ClusterSize
+		end := r.q.ClusterSize
+		if remaining := r.q.VirtualSize - guestCluster*r.q.ClusterSize; remaining < end {
+			end = remaining
+		}
+		r.buf = buf[start:end]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *qcow2Reader) Close() error {
+	r.buf = nil
+	return nil
+}
+
+// Qcow2Options controls how NewQcow2Writer() lays out a qcow2 image.
+type Qcow2Options struct {
+	// VirtualSize is the size of the disk that the image will hold, which
+	// must be a multiple of 512.
+	VirtualSize int64
+	// ClusterSize is the size of the image's clusters, a power of 2
+	// between 512 and 2 MiB.  If 0, 64 KiB is used.
+	ClusterSize int64
+}
+
+// NewQcow2Writer returns an io.WriteCloser which writes a qcow2 version 3
+// image to w, with the LUKS header embedded in it, encrypting the contents
+// of the disk as they are written to it using the Volume which was returned
+// along with the header.  Clusters which contain only zeroes are not
+// written.  The image is not complete until Close() has been called.
+// QEMU only supports LUKSv1 headers in qcow2 images.
+func NewQcow2Writer(w io.WriterAt, luksHeader []byte, volume *Volume, options Qcow2Options) (io.WriteCloser, error) {
+	if volume.Cipher == nil {
+		return nil, errors.New("volume does not have a single payload segment")
+	}
+	clusterSize := options.ClusterSize
+	if clusterSize == 0 {
+		clusterSize = qcow2DefaultClusterSize
+	}
+	if clusterSize < 1<<qcow2MinClusterBits || clusterSize > 1<<qcow2MaxClusterBits || clusterSize&(clusterSize-1) != 0 {
+		return nil, fmt.Errorf("qcow2 cluster size %d is not a power of 2 between %d and %d", clusterSize, 1<<qcow2MinClusterBits, 1<<qcow2MaxClusterBits)
+	}
+	if clusterSize%int64(volume.Cipher.SectorSize()) != 0 {
+		return nil, fmt.Errorf("qcow2 cluster size %d is not a multiple of the encryption sector size %d", clusterSize, volume.Cipher.SectorSize())
+	}
+	if options.VirtualSize < 0 || options.VirtualSize%V1SectorSize != 0 {
+		return nil, fmt.Errorf("qcow2 virtual size %d is not a multiple of %d", options.VirtualSize, V1SectorSize)
+	}
+	l2Entries := clusterSize / 8
+	l1Size := (options.VirtualSize + clusterSize*l2Entries - 1) / (clusterSize * l2Entries)
+	luksClusters := (int64(len(luksHeader)) + clusterSize - 1) / clusterSize
+	l1Clusters := (l1Size*8 + clusterSize - 1) / clusterSize
+	q := &qcow2Writer{
+		w:           w,
+		cipher:      volume.Cipher,
+		clusterSize: clusterSize,
+		virtualSize: options.VirtualSize,
+		luksLength:  int64(len(luksHeader)),
+		l1Offset:    (1 + luksClusters) * clusterSize,
+		l1:          make([]uint64, l1Size),
+		l2:          make([]byte, clusterSize),
+		zeroes:      make([]byte, clusterSize),
+		l2Index:     -1,
+		buf:         make([]byte, 0, clusterSize),
+	}
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+	q.nextCluster = 1 + luksClusters + l1Clusters
+	if _, err := w.WriteAt(luksHeader, clusterSize); err != nil {
+		return nil, fmt.Errorf("writing LUKS header: %w", err)
+	}
+	return q, nil
+}
+
+type qcow2Writer struct {
+	w           io.WriterAt
+	cipher      *SectorCipher
+	clusterSize int64
+	virtualSize int64
+	luksLength  int64
+	l1Offset    int64
+	l1          []uint64
+	l2          []byte
+	l2Index     int64
+	l2Dirty     bool
+	zeroes      []byte
+	nextCluster int64
+	guest       int64
+	buf         []byte
+	err         error
+}
+
+// allocate returns the offset of the next unused cluster.
+func (q *qcow2Writer) allocate() int64 {
+	offset := q.nextCluster * q.clusterSize
+	q.nextCluster++
+	return offset
+}
+
+// flushL2 writes the current L2 table, if it points to any clusters, and
+// records its location in the L1 table.
+func (q *qcow2Writer) flushL2() error {
+	if q.l2Dirty {
+		offset := q.allocate()
+		if _, err := q.w.WriteAt(q.l2, offset); err != nil {
+			return fmt.Errorf("writing qcow2 L2 table: %w", err)
+		}
+		q.l1[q.l2Index] = uint64(offset) | qcow2Copied
+		copy(q.l2, q.zeroes)
+		q.l2Dirty = false
+	}
+	return nil
+}
+
+// writeCluster encrypts and writes the current cluster, unless it's all
+// zeroes, and adds it to an L2 table.
+func (q *qcow2Writer) writeCluster() error {
+	guestCluster := q.guest / q.clusterSize
+	l2Entries := q.clusterSize / 8
+	if guestCluster/l2Entries != q.l2Index {
+		if err := q.flushL2(); err != nil {
+			return err
+		}
+		q.l2Index = guestCluster / l2Entries
+	}
+	cluster := q.buf[:q.clusterSize]
+	if !bytes.Equal(cluster, q.zeroes) {
+		offset := q.allocate()
+		if err := q.cipher.EncryptSectors(cluster, cluster, uint64(offset/int64(q.cipher.SectorSize()))); err != nil {
+			return err
+		}
+		if _, err := q.w.WriteAt(cluster, offset); err != nil {
+			return fmt.Errorf("writing qcow2 cluster: %w", err)
+		}
+		binary.BigEndian.PutUint64(q.l2[(guestCluster%l2Entries)*8:], uint64(offset)|qcow2Copied)
+		q.l2Dirty = true
+	}
+	q.guest += q.clusterSize
+	q.buf = q.buf[:0]
+	return nil
+}
+
+func (q *qcow2Writer) Write(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if q.guest+int64(len(q.buf)) >= q.virtualSize {
+			q.err = fmt.Errorf("more than %d bytes written to a qcow2 image", q.virtualSize)
+			return written, q.err
+		}
+		n := copy(q.buf[len(q.buf):cap(q.buf)], p)
+		if remaining := q.virtualSize - q.guest - int64(len(q.buf)); int64(n) > remaining {
+			n = int(remaining)
+		}
+		q.buf = q.buf[:len(q.buf)+n]
+		p = p[n:]
+		written += n
+		if int64(len(q.buf)) == q.clusterSize {
+			if q.err = q.writeCluster(); q.err != nil {
+				return written, q.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes any partial final cluster, the last L2 table, the L1 table,
+// the refcount table and its blocks, and finally the header.
+func (q *qcow2Writer) Close() error {
+	if q.err != nil {
+		return q.err
+	}
+	q.err = errors.New("qcow2 image already closed")
+	if n := len(q.buf); n > 0 {
+		q.buf = q.buf[:q.clusterSize]
+		copy(q.buf[n:], q.zeroes)
+		if err := q.writeCluster(); err != nil {
+			return err
+		}
+	}
+	if err := q.flushL2(); err != nil {
+		return err
+	}
+	l1 := make([]byte, len(q.l1)*8)
+	for i, entry := range q.l1 {
+		binary.BigEndian.PutUint64(l1[i*8:], entry)
+	}
+	if _, err := q.w.WriteAt(l1, q.l1Offset); err != nil {
+		return fmt.Errorf("writing qcow2 L1 table: %w", err)
+	}
+
+	// the refcount blocks and the refcount table need to be counted too
+	refcountsPerBlock := q.clusterSize * 8 / (1 << qcow2RefcountOrder)
+	var blocks, tableClusters int64
+	for {
+		total := q.nextCluster + blocks + tableClusters
+		newBlocks := (total + refcountsPerBlock - 1) / refcountsPerBlock
+		newTableClusters := (newBlocks*8 + q.clusterSize - 1) / q.clusterSize
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+	total := q.nextCluster + blocks + tableClusters
+	table := make([]byte, tableClusters*q.clusterSize)
+	block := make([]byte, q.clusterSize)
+	for i := int64(0); i < blocks; i++ {
+		copy(block, q.zeroes)
+		for j := int64(0); j < refcountsPerBlock && i*refcountsPerBlock+j < total; j++ {
+			binary.BigEndian.PutUint16(block[j*2:], 1)
+		}
+		offset := q.allocate()
+		if _, err := q.w.WriteAt(block, offset); err != nil {
+			return fmt.Errorf("writing qcow2 refcount block: %w", err)
+		}
+		binary.BigEndian.PutUint64(table[i*8:], uint64(offset))
+	}
+	tableOffset := q.nextCluster * q.clusterSize
+	if _, err := q.w.WriteAt(table, tableOffset); err != nil {
+		return fmt.Errorf("writing qcow2 refcount table: %w", err)
+	}
+
+	header := make([]byte, q.clusterSize)
+	copy(header, qcow2Magic)
+	clusterBits := 0
+	for int64(1)<<clusterBits < q.clusterSize {
+		clusterBits++
+	}
+	binary.BigEndian.PutUint32(header[qcow2VersionStart:], 3)
+	binary.BigEndian.PutUint32(header[qcow2ClusterBitsStart:], uint32(clusterBits))
+	binary.BigEndian.PutUint64(header[qcow2SizeStart:], uint64(q.virtualSize))
+	binary.BigEndian.PutUint32(header[qcow2CryptMethodStart:], qcow2CryptLUKS)
+	binary.BigEndian.PutUint32(header[qcow2L1SizeStart:], uint32(len(q.l1)))
+	binary.BigEndian.PutUint64(header[qcow2L1TableStart:], uint64(q.l1Offset))
+	binary.BigEndian.PutUint64(header[qcow2RefcountTableStart:], uint64(tableOffset))
+	binary.BigEndian.PutUint32(header[qcow2RefcountClustersStart:], uint32(tableClusters))
+	binary.BigEndian.PutUint32(header[qcow2RefcountOrderStart:], qcow2RefcountOrder)
+	binary.BigEndian.PutUint32(header[qcow2HeaderLengthStart:], qcow2V3HeaderLength)
+	ext := header[qcow2V3HeaderLength:]
+	binary.BigEndian.PutUint32(ext[0:], qcow2ExtCrypto)
+	binary.BigEndian.PutUint32(ext[4:], 16)
+	binary.BigEndian.PutUint64(ext[8:], uint64(q.clusterSize))
+	binary.BigEndian.PutUint64(ext[16:], uint64(q.luksLength))
+	// the end-of-extensions marker is already zeroes
+	if _, err := q.w.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("writing qcow2 header: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package luksy
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQcow2RoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		clusterSize int64
+		virtualSize int64
+	}{
+		{"defaults", 0, 3*65536 + 512*7},
+		{"small-clusters", 512, 512 * 200},
+		{"many-l2-tables", 4096, 4096 * 512 * 3},
+		{"empty", 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a disk with some clusters which are entirely zeroes
+			plaintext := randomBytes(t, int(tc.virtualSize))
+			zeroed := int64(65536)
+			if zeroed > tc.virtualSize/2 {
+				zeroed = tc.virtualSize / 2
+			}
+			copy(plaintext[zeroed:], make([]byte, zeroed))
+
+			header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{Stripes: 100})
+			require.NoError(t, err)
+			f, err := os.Create(filepath.Join(t.TempDir(), "image.qcow2"))
+			require.NoError(t, err)
+			defer f.Close()
+			wc, err := NewQcow2Writer(f, header, volume, Qcow2Options{VirtualSize: tc.virtualSize, ClusterSize: tc.clusterSize})
+			require.NoError(t, err)
+			_, err = wc.Write(plaintext)
+			require.NoError(t, err)
+			require.NoError(t, wc.Close())
+
+			image, err := ReadQcow2(f)
+			require.NoError(t, err)
+			assert.Equal(t, 3, image.Version)
+			assert.Equal(t, tc.virtualSize, image.VirtualSize)
+			if tc.clusterSize != 0 {
+				assert.Equal(t, tc.clusterSize, image.ClusterSize)
+			}
+			luksHeader := image.LUKSHeader(f)
+			v1header, _, _, _, err := ReadHeaders(luksHeader, ReadHeaderOptions{})
+			require.NoError(t, err)
+			require.NotNil(t, v1header)
+			_, err = v1header.Unlock("wrong", luksHeader, UnlockOptions{})
+			assert.ErrorIs(t, err, ErrIncorrectPassphrase)
+			unlocked, err := v1header.Unlock("password", luksHeader, UnlockOptions{})
+			require.NoError(t, err)
+			rc, err := image.DecryptReader(f, unlocked)
+			require.NoError(t, err)
+			decrypted, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			assert.Equal(t, plaintext, decrypted)
+
+			// clusters are encrypted using IVs based on where they
+			// are in the file, so the first data cluster, which
+			// follows the header, the LUKS header, and the L1 table,
+			// should not have been encrypted as though it were
+			// sector 0
+			clusterSize := image.ClusterSize
+			if tc.virtualSize > 0 {
+				l1 := make([]byte, 8)
+				_, err = f.ReadAt(l1, int64(binary.BigEndian.Uint64(readAt(t, f, qcow2L1TableStart, 8))))
+				require.NoError(t, err)
+				l2Offset := int64(binary.BigEndian.Uint64(l1) & qcow2OffsetMask)
+				l2 := readAt(t, f, l2Offset, 8)
+				host := int64(binary.BigEndian.Uint64(l2) & qcow2OffsetMask)
+				assert.Greater(t, host, 2*clusterSize)
+				cluster := readAt(t, f, host, int(clusterSize))
+				require.NoError(t, volume.Cipher.DecryptSectors(cluster, cluster, uint64(host/V1SectorSize)))
+				expected := plaintext
+				if int64(len(expected)) > clusterSize {
+					expected = expected[:clusterSize]
+				}
+				assert.Equal(t, expected, cluster[:len(expected)])
+			}
+		})
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "raw"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(make([]byte, 1024))
+	require.NoError(t, err)
+	_, err = ReadQcow2(f)
+	assert.ErrorIs(t, err, ErrNotQcow2)
+
+	// an L1 table that's larger than QEMU allows is refused before we
+	// try to allocate memory for it
+	header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{Stripes: 100})
+	require.NoError(t, err)
+	f, err = os.Create(filepath.Join(t.TempDir(), "image.qcow2"))
+	require.NoError(t, err)
+	defer f.Close()
+	wc, err := NewQcow2Writer(f, header, volume, Qcow2Options{VirtualSize: 4096})
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	var l1Size [4]byte
+	binary.BigEndian.PutUint32(l1Size[:], 0xffffffff)
+	_, err = f.WriteAt(l1Size[:], qcow2L1SizeStart)
+	require.NoError(t, err)
+	_, err = ReadQcow2(f)
+	assert.ErrorContains(t, err, "more than the limit")
+}
+
+func readAt(t *testing.T, f io.ReaderAt, offset int64, length int) []byte {
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	require.Equal(t, length, n, "%v", err)
+	return buf
+}
+
+func TestQcow2Writer(t *testing.T) {
+	header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{Stripes: 100})
+	require.NoError(t, err)
+	f, err := os.Create(filepath.Join(t.TempDir(), "image.qcow2"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, options := range []Qcow2Options{
+		{VirtualSize: 1000},
+		{VirtualSize: -512},
+		{VirtualSize: 4096, ClusterSize: 256},
+		{VirtualSize: 4096, ClusterSize: 3 * 4096},
+		{VirtualSize: 4096, ClusterSize: 4 * 1024 * 1024},
+	} {
+		_, err := NewQcow2Writer(f, header, volume, options)
+		assert.Error(t, err, "%+v", options)
+	}
+
+	// writing more than the virtual size is an error
+	wc, err := NewQcow2Writer(f, header, volume, Qcow2Options{VirtualSize: 4096})
+	require.NoError(t, err)
+	n, err := wc.Write(make([]byte, 8192))
+	assert.Equal(t, 4096, n)
+	assert.Error(t, err)
+
+	// the image is mostly empty, since only one cluster is written
+	wc, err = NewQcow2Writer(f, header, volume, Qcow2Options{VirtualSize: 1024 * 1024 * 1024})
+	require.NoError(t, err)
+	_, err = wc.Write([]byte("not all zeroes"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	st, err := f.Stat()
+	require.NoError(t, err)
+	assert.Less(t, st.Size(), int64(16*1024*1024))
+}
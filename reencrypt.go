@@ -0,0 +1,228 @@
+package luksy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// When cryptsetup reencrypts a LUKSv2 volume, it splits the payload into
+// segments: one for the part that has already been reencrypted, one for the
+// "hot zone" that it's working on, flagged "in-reencryption", and one for the
+// part it hasn't gotten to yet.  It also keeps "backup" copies of the
+// segments that describe the entire payload as it was before reencryption
+// started ("backup-previous") and as it will be once it's done
+// ("backup-final"), and of a segment which it moved out of the way to make
+// room for a header ("backup-moved-segment").  A "reencrypt" key slot, which
+// holds no key, records how the hot zone can be recovered if the process is
+// interrupted.
+
+// hasFlag returns true if the segment has the specified flag.
+func (s V2JSONSegment) hasFlag(flag string) bool {
+	for _, f := range s.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// dataSegments returns the IDs of the segments which describe the payload, in
+// the order in which they make it up, which is the order of their offsets.
+// Each segment has to start where the one before it ends, and only the last
+// one can run to the end of the file.
+func (j V2JSON) dataSegments() ([]string, error) {
+	type extent struct {
+		id           string
+		offset, size int64 // size is -1 if the segment is dynamic
+	}
+	var extents []extent
+	for _, s := range sortedIDs(j.Segments) {
+		segment := j.Segments[s]
+		if backupSegment(segment) {
+			continue
+		}
+		offset, err := strconv.ParseInt(segment.Offset, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("segment %q has invalid offset %q", s, segment.Offset)
+		}
+		size := int64(-1)
+		if segment.Size != "dynamic" {
+			if size, err = strconv.ParseInt(segment.Size, 10, 64); err != nil || size < 0 {
+				return nil, fmt.Errorf("segment %q has invalid size %q", s, segment.Size)
+			}
+		}
+		extents = append(extents, extent{id: s, offset: offset, size: size})
+	}
+	sort.SliceStable(extents, func(a, b int) bool {
+		return extents[a].offset < extents[b].offset
+	})
+	segments := make([]string, 0, len(extents))
+	for i, e := range extents {
+		if i > 0 {
+			previous := extents[i-1]
+			if previous.size < 0 {
+				return nil, fmt.Errorf("segment %q runs to the end of the file, but segment %q comes after it", previous.id, e.id)
+			}
+			switch end := previous.offset + previous.size; {
+			case e.offset < end:
+				return nil, fmt.Errorf("segments %q and %q overlap", previous.id, e.id)
+			case e.offset > end:
+				return nil, fmt.Errorf("there is a gap between segments %q and %q", previous.id, e.id)
+			}
+		}
+		segments = append(segments, e.id)
+	}
+	return segments, nil
+}
+
+// flaggedSegment returns the ID of the first segment with the specified flag,
+// or "" if there isn't one.
+func (j V2JSON) flaggedSegment(flag string) string {
+	for _, s := range sortedIDs(j.Segments) {
+		if j.Segments[s].hasFlag(flag) {
+			return s
+		}
+	}
+	return ""
+}
+
+// reencryptKeyslot returns the "reencrypt" key slot, if there is one.
+func (j V2JSON) reencryptKeyslot() (V2JSONKeyslot, bool) {
+	for _, k := range sortedIDs(j.Keyslots) {
+		if j.Keyslots[k].Type == "reencrypt" {
+			return j.Keyslots[k], true
+		}
+	}
+	return V2JSONKeyslot{}, false
+}
+
+// hotZoneSourceSegments returns the IDs of the backup segments that we need
+// to read the hot zone's original contents, which can only happen if the
+// reencrypt key slot recorded some way to recover them.
+func (j V2JSON) hotZoneSourceSegments() []string {
+	if j.flaggedSegment("in-reencryption") == "" {
+		return nil
+	}
+	keyslot, ok := j.reencryptKeyslot()
+	if !ok || keyslot.Area.Type == "none" {
+		return nil
+	}
+	var segments []string
+	for _, flag := range []string{"backup-previous", "backup-moved-segment"} {
+		if s := j.flaggedSegment(flag); s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// hotZoneSegments works out what the contents of an interrupted
+// reencryption's hot zone, which starts logicalOffset bytes into the payload,
+// should be, using whichever method the reencrypt key slot records.  It
+// returns one or more segments which describe them.
+func (j V2JSON) hotZoneSegments(f io.ReaderAt, hot VolumeSegment, logicalOffset int64, newSegment func(id string) (VolumeSegment, error)) ([]VolumeSegment, error) {
+	keyslot, ok := j.reencryptKeyslot()
+	if !ok {
+		log().Warnf("volume is being reencrypted, but has no reencrypt key slot; hot zone at offset %d may not decrypt correctly", hot.Offset)
+		return []VolumeSegment{hot}, nil
+	}
+	area := keyslot.Area
+	if area.Type == "none" {
+		log().Warnf("reencryption was not protected against interruption; hot zone at offset %d may not decrypt correctly", hot.Offset)
+		return []VolumeSegment{hot}, nil
+	}
+
+	// find where the hot zone's contents were before it was reencrypted
+	previousID := j.flaggedSegment("backup-previous")
+	if previousID == "" {
+		return nil, fmt.Errorf("no backup-previous segment to recover data from")
+	}
+	previous, err := newSegment(previousID)
+	if err != nil {
+		return nil, err
+	}
+	if movedID := j.flaggedSegment("backup-moved-segment"); movedID != "" {
+		moved, err := newSegment(movedID)
+		if err != nil {
+			return nil, err
+		}
+		if logicalOffset+hot.Size <= moved.Size {
+			previous = moved
+		}
+	}
+	if logicalOffset+hot.Size > previous.Size {
+		return nil, fmt.Errorf("hot zone at offset %d, size %d, extends past the end of the previous segment", logicalOffset, hot.Size)
+	}
+	original := previous.slice(logicalOffset, hot.Size)
+
+	switch area.Type {
+	case "datashift":
+		// the data was being moved, so its original location hasn't
+		// been overwritten
+		return []VolumeSegment{original}, nil
+	case "journal", "datashift-journal":
+		// the hot zone's original contents were copied to the key slot
+		// area before it was overwritten
+		if area.Size < hot.Size {
+			return nil, fmt.Errorf("journal size %d is too small for a %d-byte hot zone", area.Size, hot.Size)
+		}
+		original.Offset = area.Offset
+		return []VolumeSegment{original}, nil
+	case "checksum", "datashift-checksum":
+		// checksums of each block of the hot zone's original contents
+		// were stored in the key slot area, so any block that still
+		// matches its checksum hasn't been overwritten yet
+		if area.V2JSONAreaChecksum == nil {
+			return nil, fmt.Errorf("reencrypt key slot has no checksum parameters")
+		}
+		hasher, err := hasherByName(area.Hash)
+		if err != nil {
+			return nil, err
+		}
+		blockSize := int64(area.SectorSize)
+		if blockSize <= 0 || hot.Size%blockSize != 0 {
+			return nil, fmt.Errorf("hot zone size %d is not a multiple of checksum block size %d", hot.Size, blockSize)
+		}
+		hashSize := int64(hasher().Size())
+		checksums := make([]byte, hot.Size/blockSize*hashSize)
+		if int64(len(checksums)) > area.Size {
+			return nil, fmt.Errorf("checksum area size %d is too small for a %d-byte hot zone", area.Size, hot.Size)
+		}
+		if _, err := f.ReadAt(checksums, area.Offset); err != nil {
+			return nil, fmt.Errorf("reading checksums: %w", err)
+		}
+		var segments []VolumeSegment
+		block := make([]byte, blockSize)
+		for i := int64(0); i < hot.Size/blockSize; i++ {
+			if _, err := f.ReadAt(block, hot.Offset+i*blockSize); err != nil {
+				return nil, fmt.Errorf("reading hot zone: %w", err)
+			}
+			digest := hasher()
+			digest.Write(block)
+			source := hot.slice(i*blockSize, blockSize)
+			if bytes.Equal(digest.Sum(nil), checksums[i*hashSize:(i+1)*hashSize]) {
+				source = original.slice(i*blockSize, blockSize)
+				source.Offset = hot.Offset + i*blockSize
+			}
+			segments = appendVolumeSegment(segments, source)
+		}
+		return segments, nil
+	}
+	return nil, fmt.Errorf("unsupported reencryption resilience type %q", area.Type)
+}
+
+// appendVolumeSegment appends a segment to a list, merging it with the last
+// one if it picks up where that one left off.
+func appendVolumeSegment(segments []VolumeSegment, segment VolumeSegment) []VolumeSegment {
+	if len(segments) > 0 {
+		last := &segments[len(segments)-1]
+		if last.Cipher == segment.Cipher && last.Offset+last.Size == segment.Offset && (last.Cipher == nil || last.FirstSector+uint64(last.Size/int64(last.Cipher.SectorSize())) == segment.FirstSector) {
+			last.Size += segment.Size
+			return segments
+		}
+	}
+	return append(segments, segment)
+}
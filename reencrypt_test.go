@@ -0,0 +1,232 @@
+package luksy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnlockReencrypting(t *testing.T) {
+	const (
+		sectorSize = 4096
+		done       = 256 * 1024 // already reencrypted
+		hotSize    = 128 * 1024 // being reencrypted
+		payload    = 1024 * 1024
+	)
+	// two volumes with the same layout and password, but different keys
+	headerOld, cipherOld, err := FormatV2([]string{"password"}, "", sectorSize)
+	require.NoError(t, err)
+	headerNew, cipherNew, err := FormatV2([]string{"password"}, "", sectorSize)
+	require.NoError(t, err)
+	_, h1, h2, jOld, err := ReadHeaders(bytes.NewReader(headerOld), ReadHeaderOptions{})
+	require.NoError(t, err)
+	_, _, _, jNew, err := ReadHeaders(bytes.NewReader(headerNew), ReadHeaderOptions{})
+	require.NoError(t, err)
+	dataOffset, err := strconv.ParseInt(jOld.Segments["0"].Offset, 10, 64)
+	require.NoError(t, err)
+	keyslotOffset, keyslotSize := jOld.Keyslots["0"].Area.Offset, jOld.Keyslots["0"].Area.Size
+
+	plaintext := make([]byte, payload)
+	_, err = rand.Read(plaintext)
+	require.NoError(t, err)
+	encrypt := func(c *SectorCipher, start, end int64) []byte {
+		ciphertext := make([]byte, end-start)
+		require.NoError(t, c.EncryptSectors(ciphertext, plaintext[start:end], uint64(start/sectorSize)))
+		return ciphertext
+	}
+	crypt := func(cipher *SectorCipher, offset, size int64, flags ...string) V2JSONSegment {
+		sizeString := "dynamic"
+		if size >= 0 {
+			sizeString = strconv.FormatInt(size, 10)
+		}
+		return V2JSONSegment{
+			Type:   "crypt",
+			Offset: strconv.FormatInt(dataOffset+offset, 10),
+			Size:   sizeString,
+			Flags:  flags,
+			V2JSONSegmentCrypt: &V2JSONSegmentCrypt{
+				IVTweak:    int(offset / V1SectorSize),
+				Encryption: cipher.CipherSpec(),
+				SectorSize: sectorSize,
+			},
+		}
+	}
+
+	// build a file with the old volume's header, with the new volume's
+	// key slot and digest added to it
+	build := func(t *testing.T, resilience string, hot bool) (*os.File, *V2JSON, []byte) {
+		file := make([]byte, dataOffset+payload)
+		copy(file, headerOld)
+		copy(file[keyslotOffset+keyslotSize:], headerNew[keyslotOffset:keyslotOffset+keyslotSize])
+		j := *jOld
+		j.Config.Requirements = &V2JSONRequirements{Mandatory: []string{"online-reencrypt-v2"}}
+		j.Keyslots = map[string]V2JSONKeyslot{"0": jOld.Keyslots["0"]}
+		newKeyslot := jNew.Keyslots["0"]
+		newKeyslot.Area.Offset = keyslotOffset + keyslotSize
+		j.Keyslots["1"] = newKeyslot
+		reencryptArea := keyslotOffset + 2*keyslotSize
+		reencryptKeyslot := V2JSONKeyslot{
+			Type:    "reencrypt",
+			KeySize: 1,
+			Area: V2JSONArea{
+				Type:   resilience,
+				Offset: reencryptArea,
+				Size:   keyslotSize,
+			},
+			V2JSONKeyslotReencrypt: &V2JSONKeyslotReencrypt{Mode: "reencrypt", Direction: "forward"},
+		}
+		if resilience == "checksum" {
+			reencryptKeyslot.Area.V2JSONAreaChecksum = &V2JSONAreaChecksum{Hash: "sha256", SectorSize: sectorSize}
+		}
+		j.Keyslots["2"] = reencryptKeyslot
+		oldDigest := jOld.Digests["0"]
+		newDigest := jNew.Digests["0"]
+		newDigest.Keyslots = []string{"1"}
+		copy(file[dataOffset:], encrypt(cipherNew, 0, done))
+		if hot {
+			j.Segments = map[string]V2JSONSegment{
+				"0": crypt(cipherNew, 0, done),
+				"1": crypt(cipherNew, done, hotSize, "in-reencryption"),
+				"2": crypt(cipherOld, done+hotSize, -1),
+				"3": crypt(cipherOld, 0, -1, "backup-previous"),
+				"4": crypt(cipherNew, 0, -1, "backup-final"),
+			}
+			newDigest.Segments = []string{"0", "1", "4"}
+			oldDigest.Segments = []string{"2", "3"}
+		} else {
+			j.Segments = map[string]V2JSONSegment{
+				"0": crypt(cipherNew, 0, done),
+				"1": crypt(cipherOld, done, -1),
+				"2": crypt(cipherOld, 0, -1, "backup-previous"),
+				"3": crypt(cipherNew, 0, -1, "backup-final"),
+			}
+			newDigest.Segments = []string{"0", "3"}
+			oldDigest.Segments = []string{"1", "2"}
+		}
+		j.Digests = map[string]V2JSONDigest{"0": oldDigest, "1": newDigest}
+		copy(file[dataOffset+done:], encrypt(cipherOld, done, payload))
+		h1, h2 := *h1, *h2
+		require.NoError(t, WriteHeaders(byteWriterAt(file), &h1, &h2, &j))
+
+		name := filepath.Join(t.TempDir(), "encrypted")
+		require.NoError(t, os.WriteFile(name, file, 0o600))
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		t.Cleanup(func() { f.Close() })
+		return f, &j, file
+	}
+	decrypt := func(t *testing.T, f *os.File, j *V2JSON) []byte {
+		_, h1, _, _, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		volume, err := h1.Unlock("password", f, *j, UnlockOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(payload), volume.PayloadSize)
+		rc := volume.DecryptReader(f, StreamOptions{})
+		defer rc.Close()
+		decrypted, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		return decrypted
+	}
+
+	t.Run("no-hot-zone", func(t *testing.T) {
+		f, j, _ := build(t, "none", false)
+		assert.Equal(t, plaintext, decrypt(t, f, j))
+		_, h1, _, _, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		_, _, _, _, err = h1.Decrypt("password", f, *j)
+		assert.Error(t, err, "Decrypt() can't describe multiple segments")
+	})
+
+	t.Run("out-of-order", func(t *testing.T) {
+		// segment IDs don't have to follow the order of the segments'
+		// offsets
+		f, j, _ := build(t, "none", false)
+		j.Segments["0"], j.Segments["1"] = j.Segments["1"], j.Segments["0"]
+		oldDigest, newDigest := j.Digests["0"], j.Digests["1"]
+		oldDigest.Segments = []string{"0", "2"}
+		newDigest.Segments = []string{"1", "3"}
+		j.Digests["0"], j.Digests["1"] = oldDigest, newDigest
+		assert.Equal(t, plaintext, decrypt(t, f, j))
+
+		// but they do have to fit together
+		_, h1, _, _, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		for name, offset := range map[string]int64{"gap": done + sectorSize, "overlap": done - sectorSize} {
+			segment := j.Segments["0"]
+			segment.Offset = strconv.FormatInt(dataOffset+offset, 10)
+			j.Segments["0"] = segment
+			_, err = h1.Unlock("password", f, *j, UnlockOptions{})
+			assert.ErrorContains(t, err, name)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		f, j, file := build(t, "none", true)
+		copy(file[dataOffset+done:], encrypt(cipherNew, done, done+hotSize))
+		require.NoError(t, os.WriteFile(f.Name(), file, 0o600))
+		assert.Equal(t, plaintext, decrypt(t, f, j))
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		f, j, file := build(t, "checksum", true)
+		reencryptArea := j.Keyslots["2"].Area.Offset
+		oldHot := file[dataOffset+done : dataOffset+done+hotSize]
+		for i := 0; i < hotSize/sectorSize; i++ {
+			sum := sha256.Sum256(oldHot[i*sectorSize : (i+1)*sectorSize])
+			copy(file[reencryptArea+int64(i*len(sum)):], sum[:])
+		}
+		// interrupted halfway through the hot zone
+		copy(file[dataOffset+done:], encrypt(cipherNew, done, done+hotSize/2))
+		require.NoError(t, os.WriteFile(f.Name(), file, 0o600))
+		assert.Equal(t, plaintext, decrypt(t, f, j))
+	})
+
+	t.Run("journal", func(t *testing.T) {
+		f, j, file := build(t, "journal", true)
+		reencryptArea := j.Keyslots["2"].Area.Offset
+		copy(file[reencryptArea:], file[dataOffset+done:dataOffset+done+hotSize])
+		// interrupted partway through writing the hot zone
+		copy(file[dataOffset+done:], encrypt(cipherNew, done, done+hotSize/4))
+		_, err := rand.Read(file[dataOffset+done+hotSize/4 : dataOffset+done+hotSize/2])
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(f.Name(), file, 0o600))
+		assert.Equal(t, plaintext, decrypt(t, f, j))
+
+		// part of the payload is read from the journal, so writing
+		// to it would make it impossible to resume reencrypting
+		_, h1, _, _, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		volume, err := h1.Unlock("password", f, *j, UnlockOptions{})
+		require.NoError(t, err)
+		assert.True(t, volume.ReadOnly)
+		rw, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer rw.Close()
+		payload, err := volume.Payload(rw)
+		require.NoError(t, err)
+		_, err = payload.WriteAt(make([]byte, sectorSize), done)
+		assert.ErrorContains(t, err, "read-only")
+		after, err := os.ReadFile(f.Name())
+		require.NoError(t, err)
+		assert.Equal(t, file, after)
+	})
+
+	t.Run("wrong-password", func(t *testing.T) {
+		f, j, _ := build(t, "none", false)
+		_, h1, _, _, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		_, err = h1.Unlock("wrong", f, *j, UnlockOptions{})
+		assert.ErrorIs(t, err, ErrIncorrectPassphrase)
+		// a key slot which only unlocks one of the keys isn't enough
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{Keyslot: "1"})
+		assert.ErrorIs(t, err, ErrIncorrectPassphrase)
+	})
+}
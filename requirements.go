@@ -0,0 +1,77 @@
+package luksy
+
+import "strings"
+
+// supportedV2Requirements are the mandatory requirements which a LUKSv2
+// volume's metadata can list that we know how to honor when reading the
+// volume.  All of them are only set while a volume is being reencrypted.
+var supportedV2Requirements = map[string]bool{
+	"online-reencrypt":    true,
+	"online-reencrypt-v2": true,
+	"online-reencrypt-v3": true,
+}
+
+// supportedV2SegmentFlags are the segment flags that we know how to honor
+// when reading a volume.
+var supportedV2SegmentFlags = map[string]bool{
+	"in-reencryption":      true,
+	"backup-final":         true,
+	"backup-previous":      true,
+	"backup-moved-segment": true,
+}
+
+// backupSegment returns true if the segment doesn't describe any part of the
+// payload, but was saved while the volume was being reencrypted.
+func backupSegment(segment V2JSONSegment) bool {
+	for _, flag := range segment.Flags {
+		if strings.HasPrefix(flag, "backup-") {
+			return true
+		}
+	}
+	return false
+}
+
+// MandatoryRequirements returns the list of mandatory requirements from the
+// metadata, if it has any.
+func (j V2JSON) MandatoryRequirements() []string {
+	if j.Config.Requirements == nil {
+		return nil
+	}
+	return j.Config.Requirements.Mandatory
+}
+
+// CheckRequirements returns an *ErrUnmetRequirement if the metadata lists a
+// mandatory requirement, or flags a segment in a way, that we don't know how
+// to honor.  Reading the payload of such a volume could produce garbage, so
+// Unlock() and Decrypt() won't proceed unless this returns nil.
+func (j V2JSON) CheckRequirements() error {
+	for _, requirement := range j.MandatoryRequirements() {
+		if !supportedV2Requirements[requirement] {
+			return &ErrUnmetRequirement{Requirement: requirement}
+		}
+	}
+	for _, s := range sortedIDs(j.Segments) {
+		for _, flag := range j.Segments[s].Flags {
+			if !supportedV2SegmentFlags[flag] {
+				return &ErrUnmetRequirement{Requirement: flag, Segment: s}
+			}
+		}
+	}
+	return nil
+}
+
+// checkModifiable returns an *ErrUnmetRequirement if the metadata lists any
+// mandatory requirements or segment flags at all.  We can read volumes which
+// are part-way through being reencrypted, but we don't know how to modify
+// their metadata without interfering with the reencryption.
+func (j V2JSON) checkModifiable() error {
+	if requirements := j.MandatoryRequirements(); len(requirements) > 0 {
+		return &ErrUnmetRequirement{Requirement: requirements[0]}
+	}
+	for _, s := range sortedIDs(j.Segments) {
+		if flags := j.Segments[s].Flags; len(flags) > 0 {
+			return &ErrUnmetRequirement{Requirement: flags[0], Segment: s}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package luksy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequirements(t *testing.T) {
+	header, _, err := FormatV2([]string{"password"}, "", 0)
+	require.NoError(t, err)
+	encryptedFile := filepath.Join(t.TempDir(), "encrypted")
+	require.NoError(t, os.WriteFile(encryptedFile, header, 0o600))
+	f, err := os.OpenFile(encryptedFile, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	t.Run("none", func(t *testing.T) {
+		_, h1, _, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, j.MandatoryRequirements())
+		assert.NoError(t, j.CheckRequirements())
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("mandatory", func(t *testing.T) {
+		_, h1, h2, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		var requirements V2JSONRequirements
+		require.NoError(t, json.Unmarshal([]byte(`{"mandatory":["opal"]}`), &requirements))
+		j.Config.Requirements = &requirements
+		require.NoError(t, WriteHeaders(f, h1, h2, j))
+		_, h1, _, j, err = ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"opal"}, j.MandatoryRequirements())
+
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{})
+		var unmet *ErrUnmetRequirement
+		require.ErrorAs(t, err, &unmet)
+		assert.Equal(t, "opal", unmet.Requirement)
+		assert.Empty(t, unmet.Segment)
+		_, _, _, _, err = h1.Decrypt("password", f, *j)
+		assert.ErrorAs(t, err, &unmet)
+		assert.ErrorAs(t, UpdateV2JSON(f, j), &unmet)
+
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{IgnoreRequirements: true})
+		assert.NoError(t, err)
+
+		j.Config.Requirements = nil
+		require.NoError(t, WriteHeaders(f, h1, h2, j))
+	})
+
+	t.Run("segment-flags", func(t *testing.T) {
+		_, h1, h2, j, err := ReadHeaders(f, ReadHeaderOptions{})
+		require.NoError(t, err)
+		segment := j.Segments["0"]
+		segment.Flags = []string{"x-unknown-flag"}
+		j.Segments["0"] = segment
+		require.NoError(t, WriteHeaders(f, h1, h2, j))
+
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{})
+		var unmet *ErrUnmetRequirement
+		require.ErrorAs(t, err, &unmet)
+		assert.Equal(t, "x-unknown-flag", unmet.Requirement)
+		assert.Equal(t, "0", unmet.Segment)
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{IgnoreRequirements: true})
+		assert.NoError(t, err)
+
+		// a backup segment doesn't describe the payload, even if we're
+		// told to ignore the flag
+		segment.Flags = []string{"backup-previous"}
+		j.Segments["0"] = segment
+		_, err = h1.Unlock("password", f, *j, UnlockOptions{IgnoreRequirements: true})
+		assert.Error(t, err)
+	})
+}
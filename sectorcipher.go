@@ -0,0 +1,302 @@
+package luksy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aead/serpent"
+	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/twofish"
+	"golang.org/x/crypto/xts"
+)
+
+// SectorCipher encrypts and decrypts data one sector at a time, using the
+// same ciphers, modes, and IV generators that dm-crypt uses for LUKS and
+// plain volumes, but without any of the header or key slot handling.
+type SectorCipher struct {
+	cipherName string
+	cipherMode string
+	sectorSize int
+	blockSize  int
+	ivScale    uint64
+	encrypt    func(dst, src []byte, iv uint64, scratch *[maxBlockSize]byte)
+	decrypt    func(dst, src []byte, iv uint64, scratch *[maxBlockSize]byte)
+	scratch    sync.Pool
+}
+
+// maxBlockSize is the largest block size of any of the block ciphers we use.
+const maxBlockSize = 16
+
+// NewSectorCipher builds a SectorCipher from a LUKS-style cipher
+// specification (e.g., "aes-xts-plain64"), a key, and a sector size (which
+// defaults to 512 if 0 is specified).  As with dm-crypt, IVs are always
+// computed in terms of 512-byte sectors, even when larger sectors are used.
+func NewSectorCipher(cipherSpec string, key []byte, sectorSize int) (*SectorCipher, error) {
+	spec := strings.SplitN(cipherSpec, "-", 2)
+	if len(spec) < 2 || spec[0] == "" || spec[1] == "" {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, cipherSpec)
+	}
+	return newSectorCipher(spec[0], spec[1], key, sectorSize, true)
+}
+
+func newBlockCipherByName(cipherName string) (func([]byte) (cipher.Block, error), error) {
+	switch cipherName {
+	case "aes":
+		return aes.NewCipher, nil
+	case "twofish":
+		return func(key []byte) (cipher.Block, error) { return twofish.NewCipher(key) }, nil
+	case "cast5":
+		return func(key []byte) (cipher.Block, error) { return cast5.NewCipher(key) }, nil
+	case "serpent":
+		return serpent.NewCipher, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, cipherName)
+}
+
+// newSectorCipher builds a SectorCipher.  If bulk is set, IVs are computed in
+// terms of 512-byte sectors regardless of the sector size, which is what we
+// want for payload data, as iv_large_sectors is not being used.
+func newSectorCipher(cipherName, cipherMode string, key []byte, sectorSize int, bulk bool) (*SectorCipher, error) {
+	newBlockCipher, err := newBlockCipherByName(cipherName)
+	if err != nil {
+		return nil, err
+	}
+	if sectorSize == 0 {
+		sectorSize = V1SectorSize
+	}
+	switch sectorSize {
+	default:
+		return nil, fmt.Errorf("invalid sector size %d", sectorSize)
+	case 512, 1024, 2048, 4096:
+	}
+	c := &SectorCipher{
+		cipherName: cipherName,
+		cipherMode: cipherMode,
+		sectorSize: sectorSize,
+		ivScale:    1,
+	}
+	if bulk {
+		c.ivScale = uint64(sectorSize / V1SectorSize)
+	}
+
+	switch {
+	case cipherMode == "ecb":
+		block, err := newBlockCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		c.blockSize = block.BlockSize()
+		c.encrypt = func(dst, src []byte, _ uint64, _ *[maxBlockSize]byte) {
+			for processed := 0; processed < len(src); processed += block.BlockSize() {
+				block.Encrypt(dst[processed:], src[processed:])
+			}
+		}
+		c.decrypt = func(dst, src []byte, _ uint64, _ *[maxBlockSize]byte) {
+			for processed := 0; processed < len(src); processed += block.BlockSize() {
+				block.Decrypt(dst[processed:], src[processed:])
+			}
+		}
+	case cipherMode == "cbc-plain", cipherMode == "cbc-plain64":
+		block, err := newBlockCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		plain64 := cipherMode == "cbc-plain64"
+		c.setCBC(block, func(iv []byte, sector uint64) {
+			for i := range iv {
+				iv[i] = 0
+			}
+			if plain64 {
+				binary.LittleEndian.PutUint64(iv, sector)
+			} else {
+				binary.LittleEndian.PutUint32(iv, uint32(sector))
+			}
+		})
+	case strings.HasPrefix(cipherMode, "cbc-essiv:"):
+		hasherName := strings.TrimPrefix(cipherMode, "cbc-essiv:")
+		hasher, err := hasherByName(hasherName)
+		if err != nil {
+			return nil, fmt.Errorf("ESSIV hash %q: %w", hasherName, err)
+		}
+		h := hasher()
+		h.Write(key)
+		ivBlock, err := newBlockCipher(h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		block, err := newBlockCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if ivBlock.BlockSize() != block.BlockSize() {
+			return nil, fmt.Errorf("ESSIV block size %d does not match cipher block size %d", ivBlock.BlockSize(), block.BlockSize())
+		}
+		c.setCBC(block, func(iv []byte, sector uint64) {
+			for i := range iv {
+				iv[i] = 0
+			}
+			binary.LittleEndian.PutUint64(iv, sector)
+			ivBlock.Encrypt(iv, iv)
+		})
+	case cipherMode == "xts-plain", cipherMode == "xts-plain64":
+		xtsCipher, err := xts.NewCipher(newBlockCipher, key)
+		if err != nil {
+			return nil, err
+		}
+		c.blockSize = aes.BlockSize
+		plain64 := cipherMode == "xts-plain64"
+		c.encrypt = func(dst, src []byte, iv uint64, _ *[maxBlockSize]byte) {
+			if !plain64 {
+				iv = iv % 0x100000000
+			}
+			xtsCipher.Encrypt(dst, src, iv)
+		}
+		c.decrypt = func(dst, src []byte, iv uint64, _ *[maxBlockSize]byte) {
+			if !plain64 {
+				iv = iv % 0x100000000
+			}
+			xtsCipher.Decrypt(dst, src, iv)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, cipherMode)
+	}
+	c.scratch.New = func() any { return new([maxBlockSize]byte) }
+	return c, nil
+}
+
+// setCBC sets up the SectorCipher to use CBC mode with the specified block
+// cipher, with IVs generated by makeIV.  We do our own chaining rather than
+// using cipher.NewCBCEncrypter() and cipher.NewCBCDecrypter() so that we
+// don't have to allocate a new BlockMode for every sector.
+func (c *SectorCipher) setCBC(block cipher.Block, makeIV func(iv []byte, sector uint64)) {
+	blockSize := block.BlockSize()
+	c.blockSize = blockSize
+	c.encrypt = func(dst, src []byte, sector uint64, scratch *[maxBlockSize]byte) {
+		iv := scratch[:blockSize]
+		makeIV(iv, sector)
+		prev := iv
+		for processed := 0; processed < len(src); processed += blockSize {
+			out := dst[processed : processed+blockSize]
+			in := src[processed : processed+blockSize]
+			for i := range out {
+				out[i] = in[i] ^ prev[i]
+			}
+			block.Encrypt(out, out)
+			prev = out
+		}
+	}
+	c.decrypt = func(dst, src []byte, sector uint64, scratch *[maxBlockSize]byte) {
+		iv := scratch[:blockSize]
+		makeIV(iv, sector)
+		// work backward, so that when decrypting in place, the previous
+		// block of ciphertext is still around when we need it
+		for processed := len(src) - blockSize; processed >= 0; processed -= blockSize {
+			out := dst[processed : processed+blockSize]
+			block.Decrypt(out, src[processed:processed+blockSize])
+			prev := iv
+			if processed > 0 {
+				prev = src[processed-blockSize : processed]
+			}
+			for i := range out {
+				out[i] ^= prev[i]
+			}
+		}
+	}
+}
+
+// SectorSize returns the size of the sectors that the SectorCipher operates
+// on.
+func (c *SectorCipher) SectorSize() int {
+	return c.sectorSize
+}
+
+// CipherSpec returns the cipher specification that the SectorCipher was built
+// from, e.g., "aes-xts-plain64".
+func (c *SectorCipher) CipherSpec() string {
+	return c.cipherName + "-" + c.cipherMode
+}
+
+func (c *SectorCipher) process(fn func(dst, src []byte, iv uint64, scratch *[maxBlockSize]byte), dst, src []byte, firstSector uint64) error {
+	if len(dst) < len(src) {
+		return fmt.Errorf("output buffer too small (%d < %d)", len(dst), len(src))
+	}
+	if len(src)%c.blockSize != 0 {
+		return fmt.Errorf("data length %d is not a multiple of the cipher block size %d", len(src), c.blockSize)
+	}
+	scratch := c.scratch.Get().(*[maxBlockSize]byte)
+	defer c.scratch.Put(scratch)
+	for processed := 0; processed < len(src); processed += c.sectorSize {
+		sectorLeft := c.sectorSize
+		if processed+sectorLeft > len(src) {
+			sectorLeft = len(src) - processed
+		}
+		sector := firstSector + uint64(processed/c.sectorSize)
+		fn(dst[processed:processed+sectorLeft], src[processed:processed+sectorLeft], sector*c.ivScale, scratch)
+	}
+	return nil
+}
+
+// EncryptSectors encrypts src, which should be a multiple of the sector size
+// in length, into dst, treating the first sector as sector number
+// firstSector.  dst and src may be the same buffer.
+func (c *SectorCipher) EncryptSectors(dst, src []byte, firstSector uint64) error {
+	return c.process(c.encrypt, dst, src, firstSector)
+}
+
+// DecryptSectors decrypts src, which should be a multiple of the sector size
+// in length, into dst, treating the first sector as sector number
+// firstSector.  dst and src may be the same buffer.
+func (c *SectorCipher) DecryptSectors(dst, src []byte, firstSector uint64) error {
+	return c.process(c.decrypt, dst, src, firstSector)
+}
+
+// EncryptWriter returns an io.WriteCloser which encrypts data written to it
+// and writes the encrypted data to writer, treating the first sector as
+// sector number firstSector.  Buffers are encrypted concurrently, as
+// specified by options, but are written in order.  After writing a final
+// sector, the returned writer should be closed.  If only a partial sector
+// has been written when Close() is called, a final sector with its length
+// padded with zero bytes will be encrypted and written.
+func (c *SectorCipher) EncryptWriter(writer io.Writer, firstSector uint64, options StreamOptions) io.WriteCloser {
+	w := newWrapper(func(buf []byte, firstBlock uint64) error {
+		return c.EncryptSectors(buf, buf, firstSector+firstBlock)
+	}, c.sectorSize, options)
+	w.writer = writer
+	return w
+}
+
+// DecryptReader returns an io.ReadCloser which reads encrypted data from
+// reader and decrypts it, treating the first sector as sector number
+// firstSector.  Buffers are decrypted concurrently, as specified by options,
+// but are returned in order.  A partial sector at the end of the input is
+// discarded.  The returned reader reads ahead, so reader should not be used
+// by anything else until the returned reader has been closed.
+func (c *SectorCipher) DecryptReader(reader io.Reader, firstSector uint64, options StreamOptions) io.ReadCloser {
+	w := newWrapper(func(buf []byte, firstBlock uint64) error {
+		return c.DecryptSectors(buf, buf, firstSector+firstBlock)
+	}, c.sectorSize, options)
+	w.reader = reader
+	return w
+}
+
+// streamFunc returns a function which encrypts or decrypts successive chunks
+// of data, starting with sector number firstSector, of the type that
+// EncryptWriter and DecryptReader expect.
+func (c *SectorCipher) streamFunc(decrypt bool, firstSector uint64) func([]byte) ([]byte, error) {
+	process := c.EncryptSectors
+	if decrypt {
+		process = c.DecryptSectors
+	}
+	sector := firstSector
+	return func(input []byte) ([]byte, error) {
+		output := make([]byte, len(input))
+		err := process(output, input, sector)
+		sector += uint64(len(input) / c.sectorSize)
+		return output, err
+	}
+}
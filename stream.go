@@ -0,0 +1,210 @@
+package luksy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StreamHeaders are the LUKS headers read from the beginning of a stream,
+// such as a pipe, which can't be read from out of order.  The parts of the
+// stream which were read while looking for the headers, and while unlocking
+// the volume, are kept so that they can be read again using Reader().
+type StreamHeaders struct {
+	// V1Header is set if the stream starts with a LUKSv1 header.
+	V1Header *V1Header
+	// V2Header and V2JSON are set if the stream starts with a LUKSv2
+	// header.  V2JSON comes from whichever intact copy of the header is
+	// more recent.
+	V2Header *V2Header
+	V2JSON   *V2JSON
+	buffer   *streamBuffer
+}
+
+// ReadStreamHeaders reads LUKS headers from the beginning of r, which need
+// not support anything other than reading from front to back.
+func ReadStreamHeaders(r io.Reader, options ReadHeaderOptions) (*StreamHeaders, error) {
+	buffer := &streamBuffer{r: r}
+	v1, v2a, _, j, err := ReadHeaders(buffer, options)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamHeaders{V1Header: v1, V2Header: v2a, V2JSON: j, buffer: buffer}, nil
+}
+
+// Unlock attempts to verify the specified password using the headers and key
+// slots at the beginning of the stream.  Because the length of the stream
+// isn't known, the payload size of the returned Volume will be -1 unless the
+// header records it.  Volumes which were part-way through being reencrypted
+// can't be unlocked from a stream.
+func (s *StreamHeaders) Unlock(password string, options UnlockOptions) (*Volume, error) {
+	switch {
+	case s.V1Header != nil:
+		return s.V1Header.unlock(password, s.buffer, -1, options)
+	case s.V2Header != nil:
+		if s.V2JSON.flaggedSegment("in-reencryption") != "" {
+			return nil, errors.New("volume is part-way through being reencrypted, which can't be read from a stream")
+		}
+		unknownSize := func() (int64, error) { return -1, nil }
+		return s.V2Header.unlock(password, s.buffer, unknownSize, *s.V2JSON, options)
+	}
+	return nil, errors.New("internal error: unknown format")
+}
+
+// Reader returns a reader for the entire stream, starting from its beginning,
+// which can be passed to a Volume's DecryptStream method.  Once it has been
+// called, the StreamHeaders can no longer be used to unlock the volume.
+func (s *StreamHeaders) Reader() io.Reader {
+	buffer := s.buffer
+	s.buffer = nil
+	return io.MultiReader(bytes.NewReader(buffer.buf), buffer.r)
+}
+
+// streamBuffer reads from a stream as much as it needs to in order to satisfy
+// ReadAt calls, and remembers what it read.
+type streamBuffer struct {
+	r   io.Reader
+	buf []byte
+	err error
+}
+
+func (s *streamBuffer) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if end := off + int64(len(b)); end > int64(len(s.buf)) && s.err == nil {
+		more := make([]byte, end-int64(len(s.buf)))
+		n, err := io.ReadFull(s.r, more)
+		s.buf = append(s.buf, more[:n]...)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		s.err = err
+	}
+	if off >= int64(len(s.buf)) {
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, s.buf[off:])
+	if n < len(b) {
+		return n, s.err
+	}
+	return n, nil
+}
+
+// DecryptStream returns an io.ReadCloser which decrypts the payload, which it
+// reads from r, which starts at the beginning of the file or device that
+// contains the volume, and which only needs to be read from front to back.
+// Anything in r which comes before the payload is skipped over.  Closing the
+// returned reader doesn't wait for a read from r which is already in progress,
+// since if r is a pipe, that read might not finish until more is written to
+// it.
+func (v *Volume) DecryptStream(r io.Reader, options StreamOptions) io.ReadCloser {
+	options.detachReads = true
+	return v.DecryptReader(&sequentialReaderAt{r: r}, options)
+}
+
+// EncryptStream returns an io.WriteCloser which encrypts the payload, which
+// is written to it, and writes it to w, which doesn't need to support
+// anything other than writing from front to back.  The header, which would
+// usually be returned along with the Volume by one of the Format functions,
+// is written first, followed by enough zero bytes to reach the payload.
+// Close() returns an error if the payload didn't fill all of the segments
+// that have a fixed size.
+func (v *Volume) EncryptStream(w io.Writer, header []byte, options StreamOptions) io.WriteCloser {
+	sw := &sequentialWriterAt{w: w}
+	sw.WriteAt(header, 0) // an error here is returned by Write or Close
+	return &streamWriter{WriteCloser: v.EncryptWriter(sw, options), w: sw, payloadOffset: v.PayloadOffset}
+}
+
+// streamWriter is the writer returned by EncryptStream.
+type streamWriter struct {
+	io.WriteCloser
+	w             *sequentialWriterAt
+	payloadOffset int64
+}
+
+// Close finishes encrypting the payload, and if the payload was empty, writes
+// the padding that would have come before it.
+func (s *streamWriter) Close() error {
+	if err := s.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if s.w.pos < s.payloadOffset {
+		if _, err := s.w.WriteAt(nil, s.payloadOffset); err != nil {
+			return err
+		}
+	}
+	return s.w.err
+}
+
+// sequentialReaderAt implements io.ReaderAt for a reader, so long as it's
+// read from front to back.  Parts of the reader which are skipped over are
+// discarded.
+type sequentialReaderAt struct {
+	r   io.Reader
+	pos int64
+}
+
+func (s *sequentialReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off < s.pos {
+		return 0, fmt.Errorf("can't go back to offset %d after reading up to offset %d of a stream", off, s.pos)
+	}
+	if off > s.pos {
+		n, err := io.CopyN(io.Discard, s.r, off-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(s.r, b)
+	s.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// sequentialWriterAt implements io.WriterAt for a writer, so long as it's
+// written to from front to back.  Gaps are filled with zero bytes.
+type sequentialWriterAt struct {
+	w   io.Writer
+	pos int64
+	err error
+}
+
+func (s *sequentialWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if off < s.pos {
+		return 0, fmt.Errorf("can't go back to offset %d after writing up to offset %d of a stream", off, s.pos)
+	}
+	if off > s.pos {
+		n, err := io.CopyN(s.w, zeroReader{}, off-s.pos)
+		s.pos += n
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+	}
+	n, err := s.w.Write(b)
+	s.pos += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// zeroReader reads an endless supply of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
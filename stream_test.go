@@ -0,0 +1,134 @@
+package luksy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	plaintext := randomBytes(t, 256*1024)
+	for _, tc := range []struct {
+		name   string
+		format func() ([]byte, *Volume, error)
+	}{
+		{name: "luks1", format: func() ([]byte, *Volume, error) {
+			return FormatV1WithOptions([]string{"password"}, FormatV1Options{Stripes: 100})
+		}},
+		{name: "luks2", format: func() ([]byte, *Volume, error) {
+			return FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100, SectorSize: 4096})
+		}},
+		{name: "luks2-segments", format: func() ([]byte, *Volume, error) {
+			segments := []FormatV2Segment{{Size: 8192}, {Size: 4096, Linear: true}, {}}
+			return FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100, Segments: segments})
+		}},
+		{name: "luks2-fixed", format: func() ([]byte, *Volume, error) {
+			segments := []FormatV2Segment{{Size: int64(len(plaintext))}}
+			return FormatV2WithOptions([]string{"password"}, FormatV2Options{Stripes: 100, Segments: segments})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header, volume, err := tc.format()
+			require.NoError(t, err)
+
+			// writing to a stream should produce the same image as
+			// writing to a file
+			var image bytes.Buffer
+			wc := volume.EncryptStream(&image, header, StreamOptions{BufferSize: 3 * 4096})
+			_, err = io.Copy(wc, iotest.HalfReader(bytes.NewReader(plaintext)))
+			require.NoError(t, err)
+			require.NoError(t, wc.Close())
+			file := byteWriterAt(make([]byte, image.Len()))
+			copy(file, header)
+			wc = volume.EncryptWriter(file, StreamOptions{})
+			_, err = wc.Write(plaintext)
+			require.NoError(t, err)
+			require.NoError(t, wc.Close())
+			require.Equal(t, []byte(file), image.Bytes())
+
+			// a bytes.Buffer can't seek or read out of order
+			headers, err := ReadStreamHeaders(iotest.HalfReader(&image), ReadHeaderOptions{})
+			require.NoError(t, err)
+			_, err = headers.Unlock("wrong", UnlockOptions{})
+			assert.ErrorIs(t, err, ErrIncorrectPassphrase)
+			unlocked, err := headers.Unlock("password", UnlockOptions{})
+			require.NoError(t, err)
+			if tc.name == "luks2-fixed" {
+				assert.Equal(t, int64(len(plaintext)), unlocked.PayloadSize)
+			} else {
+				assert.Equal(t, int64(-1), unlocked.PayloadSize)
+			}
+			rc := unlocked.DecryptStream(headers.Reader(), StreamOptions{})
+			decrypted, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			assert.Equal(t, plaintext, decrypted)
+		})
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		volume, err := FormatPlain(make([]byte, 32), PlainOptions{Offset: 8192})
+		require.NoError(t, err)
+		var image bytes.Buffer
+		wc := volume.EncryptStream(&image, nil, StreamOptions{})
+		require.NoError(t, wc.Close())
+		assert.Equal(t, make([]byte, 8192), image.Bytes(), "an empty payload should still be preceded by padding")
+
+		image.Reset()
+		wc = volume.EncryptStream(&image, nil, StreamOptions{})
+		_, err = wc.Write(plaintext)
+		require.NoError(t, err)
+		require.NoError(t, wc.Close())
+		assert.Equal(t, 8192+len(plaintext), image.Len())
+		rc := volume.DecryptStream(&image, StreamOptions{})
+		decrypted, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, plaintext, decrypted)
+	})
+
+	t.Run("close-while-blocked", func(t *testing.T) {
+		header, volume, err := FormatV1WithOptions([]string{"password"}, FormatV1Options{Stripes: 100})
+		require.NoError(t, err)
+		var image bytes.Buffer
+		wc := volume.EncryptStream(&image, header, StreamOptions{})
+		_, err = wc.Write(plaintext)
+		require.NoError(t, err)
+		require.NoError(t, wc.Close())
+
+		// the pipe isn't closed after the image is written to it, so
+		// reading ahead blocks until we close it at the end
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go pw.Write(image.Bytes())
+		headers, err := ReadStreamHeaders(pr, ReadHeaderOptions{})
+		require.NoError(t, err)
+		unlocked, err := headers.Unlock("password", UnlockOptions{})
+		require.NoError(t, err)
+		rc := unlocked.DecryptStream(headers.Reader(), StreamOptions{BufferSize: 4096})
+		decrypted := make([]byte, len(plaintext))
+		_, err = io.ReadFull(rc, decrypted)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+		closed := make(chan error, 1)
+		go func() { closed <- rc.Close() }()
+		select {
+		case err := <-closed:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Close() waited for a read from a pipe that nothing was being written to")
+		}
+	})
+
+	t.Run("not-luks", func(t *testing.T) {
+		_, err := ReadStreamHeaders(bytes.NewReader(plaintext), ReadHeaderOptions{})
+		assert.Error(t, err)
+		_, err = ReadStreamHeaders(bytes.NewReader(nil), ReadHeaderOptions{})
+		assert.Error(t, err)
+	})
+}
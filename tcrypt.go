@@ -0,0 +1,291 @@
+package luksy
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// Locations of things in TrueCrypt and VeraCrypt headers, which are encrypted
+// in their entirety, apart from the salt.
+const (
+	tcryptHeaderSize       = 512
+	tcryptMagicTrueCrypt   = "TRUE"
+	tcryptMagicVeraCrypt   = "VERA"
+	tcryptSaltSize         = 64
+	tcryptHiddenOffset     = 65536  // hidden volume header, from the start
+	tcryptBackupOffset     = 131072 // backup header, from the end
+	tcryptHiddenBackup     = 65536  // backup hidden volume header, from the end
+	tcryptMagicStart       = 64
+	tcryptVersionStart     = 68
+	tcryptKeysCRCStart     = 72
+	tcryptVolumeSizeStart  = 100
+	tcryptMKOffsetStart    = 108
+	tcryptFlagsStart       = 124
+	tcryptSectorSizeStart  = 128
+	tcryptHeaderCRCStart   = 252
+	tcryptKeysStart        = 256
+	tcryptCascadeKeyLength = 64 // primary and secondary XTS keys, per cipher
+)
+
+// TcryptOptions controls how UnlockTcrypt() looks for and unlocks a
+// TrueCrypt or VeraCrypt volume.
+type TcryptOptions struct {
+	// Hidden causes the hidden volume's header to be used instead of the
+	// outer volume's header.
+	Hidden bool
+	// Backup causes the backup header at the end of the file to be used
+	// instead of the one at the start of the file.
+	Backup bool
+	// PIM is the VeraCrypt personal iterations multiplier.  If it is
+	// set, only VeraCrypt key derivation is attempted.
+	PIM int
+	// Hash, if set, limits key derivation to using the named hash
+	// ("sha512", "sha256", "ripemd160", or "sha1").  Whirlpool and
+	// Streebog are not supported.
+	Hash string
+}
+
+// tcryptKDF is one of the ways in which TrueCrypt and VeraCrypt derive
+// header keys from passwords.
+type tcryptKDF struct {
+	magic      string
+	hash       string
+	iterations int
+}
+
+// tcryptKDFs returns the key derivation parameters to try, given the
+// options, cheapest first.
+func tcryptKDFs(options TcryptOptions) []tcryptKDF {
+	var kdfs []tcryptKDF
+	if options.PIM > 0 {
+		iterations := 15000 + options.PIM*1000
+		for _, hash := range []string{"sha512", "sha256", "ripemd160"} {
+			kdfs = append(kdfs, tcryptKDF{magic: tcryptMagicVeraCrypt, hash: hash, iterations: iterations})
+		}
+	} else {
+		kdfs = []tcryptKDF{
+			{magic: tcryptMagicTrueCrypt, hash: "ripemd160", iterations: 2000},
+			{magic: tcryptMagicTrueCrypt, hash: "sha512", iterations: 1000},
+			{magic: tcryptMagicTrueCrypt, hash: "sha1", iterations: 2000},
+			{magic: tcryptMagicVeraCrypt, hash: "sha512", iterations: 500000},
+			{magic: tcryptMagicVeraCrypt, hash: "sha256", iterations: 500000},
+			{magic: tcryptMagicVeraCrypt, hash: "ripemd160", iterations: 655331},
+		}
+	}
+	if options.Hash == "" {
+		return kdfs
+	}
+	var filtered []tcryptKDF
+	for _, kdf := range kdfs {
+		if kdf.hash == options.Hash {
+			filtered = append(filtered, kdf)
+		}
+	}
+	return filtered
+}
+
+// tcryptCascades are the combinations of ciphers, each used in XTS mode,
+// that TrueCrypt and VeraCrypt can use, named as they name them.
+var tcryptCascades = [][]string{
+	{"aes"},
+	{"serpent"},
+	{"twofish"},
+	{"aes", "twofish"},
+	{"aes", "twofish", "serpent"},
+	{"serpent", "aes"},
+	{"serpent", "twofish", "aes"},
+	{"twofish", "serpent"},
+}
+
+// xtsCascade is a list of XTS ciphers, in the order in which they're named.
+// Data is encrypted using the last one first, and decrypted using the first
+// one first.
+type xtsCascade []*xts.Cipher
+
+// newXTSCascade builds an xtsCascade from a key which contains all of the
+// ciphers' primary keys followed by all of their secondary keys, each in the
+// order in which the ciphers are used for encryption.
+func newXTSCascade(names []string, key []byte) (xtsCascade, error) {
+	n := len(names)
+	if len(key) < n*tcryptCascadeKeyLength {
+		return nil, fmt.Errorf("key is too short (%d bytes) for %d ciphers", len(key), n)
+	}
+	half := tcryptCascadeKeyLength / 2
+	cascade := make(xtsCascade, n)
+	for i, name := range names {
+		newBlockCipher, err := newBlockCipherByName(name)
+		if err != nil {
+			return nil, err
+		}
+		slot := n - 1 - i
+		xtsKey := make([]byte, 0, tcryptCascadeKeyLength)
+		xtsKey = append(xtsKey, key[slot*half:(slot+1)*half]...)
+		xtsKey = append(xtsKey, key[(n+slot)*half:(n+slot+1)*half]...)
+		if cascade[i], err = xts.NewCipher(newBlockCipher, xtsKey); err != nil {
+			return nil, fmt.Errorf("initializing %s: %w", name, err)
+		}
+	}
+	return cascade, nil
+}
+
+func (c xtsCascade) encrypt(dst, src []byte, unit uint64) {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].Encrypt(dst, src, unit)
+		src = dst
+	}
+}
+
+func (c xtsCascade) decrypt(dst, src []byte, unit uint64) {
+	for i := range c {
+		c[i].Decrypt(dst, src, unit)
+		src = dst
+	}
+}
+
+// sectorCipher returns a SectorCipher which uses the cascade, with data units
+// that are 512-byte sectors.
+func (c xtsCascade) sectorCipher(names []string) *SectorCipher {
+	s := &SectorCipher{
+		cipherName: strings.Join(names, "-"),
+		cipherMode: "xts-plain64",
+		sectorSize: V1SectorSize,
+		blockSize:  aes.BlockSize,
+		ivScale:    1,
+		encrypt: func(dst, src []byte, iv uint64, _ *[maxBlockSize]byte) {
+			c.encrypt(dst, src, iv)
+		},
+		decrypt: func(dst, src []byte, iv uint64, _ *[maxBlockSize]byte) {
+			c.decrypt(dst, src, iv)
+		},
+	}
+	s.scratch.New = func() any { return new([maxBlockSize]byte) }
+	return s
+}
+
+// tcryptHeaderOffset returns the location of the header that options call
+// for, given the size of the file.
+func tcryptHeaderOffset(size int64, options TcryptOptions) (int64, error) {
+	var offset int64
+	switch {
+	case options.Backup && options.Hidden:
+		offset = size - tcryptHiddenBackup
+	case options.Backup:
+		offset = size - tcryptBackupOffset
+	case options.Hidden:
+		offset = tcryptHiddenOffset
+	}
+	if offset < 0 || offset+tcryptHeaderSize > size {
+		return -1, fmt.Errorf("file is too small (%d bytes) to hold a header at offset %d", size, offset)
+	}
+	return offset, nil
+}
+
+// checkTcryptHeader checks that a decrypted header has the expected magic
+// and checksums.
+func checkTcryptHeader(header []byte, magic string) bool {
+	if string(header[tcryptMagicStart:tcryptMagicStart+len(magic)]) != magic {
+		return false
+	}
+	if binary.BigEndian.Uint32(header[tcryptKeysCRCStart:]) != crc32.ChecksumIEEE(header[tcryptKeysStart:tcryptHeaderSize]) {
+		return false
+	}
+	return binary.BigEndian.Uint32(header[tcryptHeaderCRCStart:]) == crc32.ChecksumIEEE(header[tcryptMagicStart:tcryptHeaderCRCStart])
+}
+
+// UnlockTcrypt decrypts the header of a TrueCrypt or VeraCrypt volume in f
+// using a password, trying each supported key derivation function and
+// combination of ciphers in turn, and returns a Volume which can be used to
+// decrypt its payload.  Volumes are never modified, so the outer volume of
+// a volume which contains a hidden volume can't be damaged by reading it.
+// Keyfiles and system encryption are not supported.
+func UnlockTcrypt(password string, f ReaderAtSeekCloser, options TcryptOptions) (*Volume, error) {
+	kdfs := tcryptKDFs(options)
+	if len(kdfs) == 0 {
+		return nil, fmt.Errorf("unsupported hash %q", options.Hash)
+	}
+	return unlockTcrypt(password, f, options, kdfs)
+}
+
+// unlockTcrypt does the work of UnlockTcrypt, trying only the listed key
+// derivation functions.
+func unlockTcrypt(password string, f ReaderAtSeekCloser, options TcryptOptions, kdfs []tcryptKDF) (*Volume, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	headerOffset, err := tcryptHeaderOffset(size, options)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, tcryptHeaderSize)
+	if n, err := f.ReadAt(encrypted, headerOffset); n != len(encrypted) {
+		return nil, fmt.Errorf("reading header at offset %d: %w", headerOffset, err)
+	}
+	salt := encrypted[:tcryptSaltSize]
+	header := make([]byte, tcryptHeaderSize)
+	for _, kdf := range kdfs {
+		hasher, err := hasherByName(kdf.hash)
+		if err != nil {
+			return nil, err
+		}
+		key := pbkdf2.Key([]byte(password), salt, kdf.iterations, 3*tcryptCascadeKeyLength, hasher)
+		for _, names := range tcryptCascades {
+			cascade, err := newXTSCascade(names, key)
+			if err != nil {
+				return nil, err
+			}
+			copy(header, encrypted)
+			cascade.decrypt(header[tcryptMagicStart:], header[tcryptMagicStart:], 0)
+			if !checkTcryptHeader(header, kdf.magic) {
+				continue
+			}
+			log().Debugf("header at offset %d unlocked using PBKDF2-%s with %d iterations, cipher %s", headerOffset, kdf.hash, kdf.iterations, strings.Join(names, "-"))
+			return tcryptVolume(header, names, size)
+		}
+	}
+	return nil, ErrIncorrectPassphrase
+}
+
+// tcryptVolume builds a Volume from a decrypted header, after checking that
+// the header describes a payload that we can read.
+func tcryptVolume(header []byte, names []string, size int64) (*Volume, error) {
+	version := binary.BigEndian.Uint16(header[tcryptVersionStart:])
+	if version < 4 {
+		return nil, fmt.Errorf("header version %d is not supported", version)
+	}
+	if version >= 5 {
+		if sectorSize := binary.BigEndian.Uint32(header[tcryptSectorSizeStart:]); sectorSize != V1SectorSize {
+			return nil, fmt.Errorf("sector size %d is not supported", sectorSize)
+		}
+	}
+	if flags := binary.BigEndian.Uint32(header[tcryptFlagsStart:]); flags&1 != 0 {
+		return nil, errors.New("system encryption is not supported")
+	}
+	payloadOffset := binary.BigEndian.Uint64(header[tcryptMKOffsetStart:])
+	payloadSize := binary.BigEndian.Uint64(header[tcryptVolumeSizeStart:])
+	if payloadOffset%V1SectorSize != 0 || payloadSize%V1SectorSize != 0 {
+		return nil, fmt.Errorf("payload at offset %d, size %d is not sector-aligned", payloadOffset, payloadSize)
+	}
+	if payloadOffset > uint64(size) || payloadSize > uint64(size)-payloadOffset {
+		return nil, fmt.Errorf("payload at offset %d, size %d runs past the end of the file, which is %d bytes long", payloadOffset, payloadSize, size)
+	}
+	keySize := len(names) * tcryptCascadeKeyLength
+	cascade, err := newXTSCascade(names, header[tcryptKeysStart:tcryptKeysStart+keySize])
+	if err != nil {
+		return nil, err
+	}
+	return &Volume{
+		Cipher:        cascade.sectorCipher(names),
+		FirstSector:   payloadOffset / V1SectorSize,
+		PayloadOffset: int64(payloadOffset),
+		PayloadSize:   int64(payloadSize),
+	}, nil
+}
@@ -0,0 +1,204 @@
+package luksy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// writeTcryptHeader writes an encrypted TrueCrypt or VeraCrypt header to f.
+func writeTcryptHeader(t *testing.T, f io.WriterAt, offset int64, password string, kdf tcryptKDF, names []string, masterKey []byte, payloadOffset, payloadSize, hiddenSize uint64) {
+	header := make([]byte, tcryptHeaderSize)
+	_, err := rand.Read(header[:tcryptSaltSize])
+	require.NoError(t, err)
+	copy(header[tcryptMagicStart:], kdf.magic)
+	binary.BigEndian.PutUint16(header[tcryptVersionStart:], 5)
+	binary.BigEndian.PutUint64(header[92:], hiddenSize)
+	binary.BigEndian.PutUint64(header[tcryptVolumeSizeStart:], payloadSize)
+	binary.BigEndian.PutUint64(header[tcryptMKOffsetStart:], payloadOffset)
+	binary.BigEndian.PutUint64(header[116:], payloadSize)
+	binary.BigEndian.PutUint32(header[tcryptSectorSizeStart:], V1SectorSize)
+	copy(header[tcryptKeysStart:], masterKey)
+	binary.BigEndian.PutUint32(header[tcryptKeysCRCStart:], crc32.ChecksumIEEE(header[tcryptKeysStart:]))
+	binary.BigEndian.PutUint32(header[tcryptHeaderCRCStart:], crc32.ChecksumIEEE(header[tcryptMagicStart:tcryptHeaderCRCStart]))
+
+	hasher, err := hasherByName(kdf.hash)
+	require.NoError(t, err)
+	key := pbkdf2.Key([]byte(password), header[:tcryptSaltSize], kdf.iterations, 3*tcryptCascadeKeyLength, hasher)
+	cascade, err := newXTSCascade(names, key)
+	require.NoError(t, err)
+	cascade.encrypt(header[tcryptMagicStart:], header[tcryptMagicStart:], 0)
+	_, err = f.WriteAt(header, offset)
+	require.NoError(t, err)
+}
+
+// writeTcryptPayload encrypts plaintext and writes it to f at the offset.
+func writeTcryptPayload(t *testing.T, f io.WriterAt, names []string, masterKey []byte, offset int64, plaintext []byte) {
+	cascade, err := newXTSCascade(names, masterKey)
+	require.NoError(t, err)
+	ciphertext := make([]byte, len(plaintext))
+	require.NoError(t, cascade.sectorCipher(names).EncryptSectors(ciphertext, plaintext, uint64(offset/V1SectorSize)))
+	_, err = f.WriteAt(ciphertext, offset)
+	require.NoError(t, err)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+func decryptVolume(t *testing.T, volume *Volume, f io.ReaderAt) []byte {
+	rc := volume.DecryptReader(f, StreamOptions{})
+	decrypted, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	return decrypted
+}
+
+func TestXTSCascade(t *testing.T) {
+	// a "cascade" of one cipher is just that cipher in XTS mode
+	key := randomBytes(t, tcryptCascadeKeyLength)
+	cascade, err := newXTSCascade([]string{"aes"}, key)
+	require.NoError(t, err)
+	single, err := NewSectorCipher("aes-xts-plain64", key, V1SectorSize)
+	require.NoError(t, err)
+	plaintext := randomBytes(t, 4*V1SectorSize)
+	expected := make([]byte, len(plaintext))
+	require.NoError(t, single.EncryptSectors(expected, plaintext, 7))
+	actual := make([]byte, len(plaintext))
+	require.NoError(t, cascade.sectorCipher([]string{"aes"}).EncryptSectors(actual, plaintext, 7))
+	assert.Equal(t, expected, actual)
+
+	// the last-named cipher is applied first when encrypting, using the
+	// first primary and secondary keys
+	key = randomBytes(t, 2*tcryptCascadeKeyLength)
+	cascade, err = newXTSCascade([]string{"aes", "twofish"}, key)
+	require.NoError(t, err)
+	twofish, err := NewSectorCipher("twofish-xts-plain64", append(append([]byte{}, key[0:32]...), key[64:96]...), V1SectorSize)
+	require.NoError(t, err)
+	aes, err := NewSectorCipher("aes-xts-plain64", append(append([]byte{}, key[32:64]...), key[96:128]...), V1SectorSize)
+	require.NoError(t, err)
+	require.NoError(t, twofish.EncryptSectors(expected, plaintext, 7))
+	require.NoError(t, aes.EncryptSectors(expected, expected, 7))
+	require.NoError(t, cascade.sectorCipher([]string{"aes", "twofish"}).EncryptSectors(actual, plaintext, 7))
+	assert.Equal(t, expected, actual)
+}
+
+func TestUnlockTcrypt(t *testing.T) {
+	const (
+		size         = 1024 * 1024
+		outerOffset  = tcryptBackupOffset
+		outerSize    = size - 2*tcryptBackupOffset
+		hiddenOffset = 5 * tcryptBackupOffset
+		hiddenSize   = tcryptBackupOffset
+	)
+	// real volumes call for hundreds of thousands of iterations, which
+	// makes trying every KDF with a wrong password slow, so use far fewer
+	trueCrypt := tcryptKDF{magic: tcryptMagicTrueCrypt, hash: "sha512", iterations: 10}
+	veraCrypt := tcryptKDF{magic: tcryptMagicVeraCrypt, hash: "sha256", iterations: 20}
+	kdfs := []tcryptKDF{
+		{magic: tcryptMagicTrueCrypt, hash: "ripemd160", iterations: 20},
+		trueCrypt,
+		{magic: tcryptMagicVeraCrypt, hash: "sha512", iterations: 20},
+		veraCrypt,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		kdf    tcryptKDF
+		outer  []string
+		hidden []string
+	}{
+		{name: "truecrypt-aes", kdf: trueCrypt, outer: []string{"aes"}, hidden: []string{"serpent"}},
+		{name: "veracrypt-cascade", kdf: veraCrypt, outer: []string{"serpent", "twofish", "aes"}, hidden: []string{"aes", "twofish", "serpent"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "volume")
+			f, err := os.Create(filename)
+			require.NoError(t, err)
+			defer f.Close()
+			require.NoError(t, f.Truncate(size))
+
+			outerKey := randomBytes(t, len(tc.outer)*tcryptCascadeKeyLength)
+			hiddenKey := randomBytes(t, len(tc.hidden)*tcryptCascadeKeyLength)
+			outerPlaintext := randomBytes(t, outerSize)
+			hiddenPlaintext := randomBytes(t, hiddenSize)
+			writeTcryptHeader(t, f, 0, "outer", tc.kdf, tc.outer, outerKey, outerOffset, outerSize, hiddenSize)
+			writeTcryptHeader(t, f, size-tcryptBackupOffset, "outer", tc.kdf, tc.outer, outerKey, outerOffset, outerSize, hiddenSize)
+			writeTcryptHeader(t, f, tcryptHiddenOffset, "hidden", tc.kdf, tc.hidden, hiddenKey, hiddenOffset, hiddenSize, 0)
+			writeTcryptHeader(t, f, size-tcryptHiddenBackup, "hidden", tc.kdf, tc.hidden, hiddenKey, hiddenOffset, hiddenSize, 0)
+			writeTcryptPayload(t, f, tc.outer, outerKey, outerOffset, outerPlaintext)
+			writeTcryptPayload(t, f, tc.hidden, hiddenKey, hiddenOffset, hiddenPlaintext)
+
+			volume, err := unlockTcrypt("outer", f, TcryptOptions{}, kdfs)
+			require.NoError(t, err)
+			assert.Equal(t, int64(outerOffset), volume.PayloadOffset)
+			assert.Equal(t, int64(outerSize), volume.PayloadSize)
+			decrypted := decryptVolume(t, volume, f)
+			require.Len(t, decrypted, outerSize)
+			// the part of the outer volume that the hidden volume
+			// occupies won't match what we originally wrote there
+			assert.Equal(t, outerPlaintext[:hiddenOffset-outerOffset], decrypted[:hiddenOffset-outerOffset])
+
+			options := TcryptOptions{Hidden: true}
+			volume, err = unlockTcrypt("hidden", f, options, kdfs)
+			require.NoError(t, err)
+			assert.Equal(t, int64(hiddenOffset), volume.PayloadOffset)
+			assert.Equal(t, hiddenPlaintext, decryptVolume(t, volume, f))
+
+			_, err = unlockTcrypt("outer", f, options, kdfs)
+			assert.ErrorIs(t, err, ErrIncorrectPassphrase, "outer password should not unlock the hidden volume")
+
+			// damage the primary headers, and use the backups
+			_, err = f.WriteAt(make([]byte, tcryptHeaderSize), 0)
+			require.NoError(t, err)
+			_, err = f.WriteAt(make([]byte, tcryptHeaderSize), tcryptHiddenOffset)
+			require.NoError(t, err)
+			_, err = unlockTcrypt("outer", f, TcryptOptions{}, kdfs)
+			assert.ErrorIs(t, err, ErrIncorrectPassphrase)
+			options = TcryptOptions{Backup: true}
+			volume, err = unlockTcrypt("outer", f, options, kdfs)
+			require.NoError(t, err)
+			assert.Equal(t, outerPlaintext[:hiddenOffset-outerOffset], decryptVolume(t, volume, f)[:hiddenOffset-outerOffset])
+			options.Hidden = true
+			volume, err = unlockTcrypt("hidden", f, options, kdfs)
+			require.NoError(t, err)
+			assert.Equal(t, hiddenPlaintext, decryptVolume(t, volume, f))
+		})
+	}
+
+	t.Run("unsupported-hash", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "volume"))
+		require.NoError(t, err)
+		defer f.Close()
+		require.NoError(t, f.Truncate(size))
+		_, err = UnlockTcrypt("password", f, TcryptOptions{Hash: "whirlpool"})
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrIncorrectPassphrase)
+	})
+}
+
+func TestTcryptKDFs(t *testing.T) {
+	kdfs := tcryptKDFs(TcryptOptions{})
+	assert.Equal(t, []tcryptKDF{
+		{magic: tcryptMagicTrueCrypt, hash: "ripemd160", iterations: 2000},
+		{magic: tcryptMagicTrueCrypt, hash: "sha512", iterations: 1000},
+		{magic: tcryptMagicTrueCrypt, hash: "sha1", iterations: 2000},
+		{magic: tcryptMagicVeraCrypt, hash: "sha512", iterations: 500000},
+		{magic: tcryptMagicVeraCrypt, hash: "sha256", iterations: 500000},
+		{magic: tcryptMagicVeraCrypt, hash: "ripemd160", iterations: 655331},
+	}, kdfs)
+
+	kdfs = tcryptKDFs(TcryptOptions{PIM: 485, Hash: "sha256"})
+	assert.Equal(t, []tcryptKDF{{magic: tcryptMagicVeraCrypt, hash: "sha256", iterations: 500000}}, kdfs)
+}
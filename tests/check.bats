@@ -0,0 +1,63 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+function check_cryptsetup() {
+    fallocate -l 64M ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short | cryptsetup luksFormat -q "$@" ${BATS_TEST_TMPDIR}/encrypted -
+    ${luksy} check --strict ${BATS_TEST_TMPDIR}/encrypted
+    rm -f ${BATS_TEST_TMPDIR}/encrypted
+}
+
+@test check-cryptsetup-luks1 {
+    check_cryptsetup --type luks1
+}
+
+@test check-cryptsetup-luks2 {
+    check_cryptsetup --type luks2
+}
+
+@test check-cryptsetup-luks2-pbkdf2 {
+    check_cryptsetup --type luks2 --pbkdf pbkdf2
+}
+
+function check_luksy() {
+    dd if=/dev/urandom bs=1M count=1 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n short > ${BATS_TEST_TMPDIR}/short
+    ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/short "$@" ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} check --strict ${BATS_TEST_TMPDIR}/encrypted
+    printf '\377' | dd of=${BATS_TEST_TMPDIR}/encrypted bs=1 seek=4097 conv=notrunc status=none
+    run ${luksy} check ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/plaintext
+}
+
+@test check-luksy-luks2 {
+    check_luksy
+}
+
+@test check-luksy-luks2-fixed-size {
+    check_luksy --fixed-size
+}
+
+@test repair-luks2 {
+    dd if=/dev/urandom bs=1M count=1 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n short > ${BATS_TEST_TMPDIR}/short
+    ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/short ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    dd if=/dev/zero of=${BATS_TEST_TMPDIR}/encrypted bs=4096 count=1 conv=notrunc status=none
+    run cryptsetup isLuks ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+    # every command notices, and says so
+    run ${luksy} inspect ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -eq 0 ]
+    [[ "$output" =~ "using secondary header" ]]
+    run ${luksy} check ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+    [[ "$output" =~ "primary header is missing" ]]
+    run ${luksy} repair ${BATS_TEST_TMPDIR}/encrypted < /dev/null
+    [ "$status" -ne 0 ]
+    ${luksy} repair --yes ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} check --strict ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short | cryptsetup -q --test-passphrase --key-file - luksOpen ${BATS_TEST_TMPDIR}/encrypted
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/plaintext
+}
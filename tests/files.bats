@@ -0,0 +1,61 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+function make_tree() {
+    mkdir -p ${BATS_TEST_TMPDIR}/tree/etc ${BATS_TEST_TMPDIR}/tree/data/sub
+    echo "UUID=0 / ext4 defaults 0 1" > ${BATS_TEST_TMPDIR}/tree/etc/fstab
+    dd if=/dev/urandom bs=1M count=3 of=${BATS_TEST_TMPDIR}/tree/data/random status=none
+    echo nested > ${BATS_TEST_TMPDIR}/tree/data/sub/nested.txt
+    echo -n filespassword > ${BATS_TEST_TMPDIR}/password
+}
+
+function check_files() {
+    local image=${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/filesystem $image
+    run ${luksy} ls --password-file ${BATS_TEST_TMPDIR}/password $image
+    [ "$status" -eq 0 ]
+    [[ "$output" =~ "etc" ]]
+    [[ "$output" =~ "data" ]]
+    run ${luksy} ls --password-file ${BATS_TEST_TMPDIR}/password -R -l $image:/data
+    [ "$status" -eq 0 ]
+    [[ "$output" =~ "sub/nested.txt" ]]
+    run ${luksy} cat --password-file ${BATS_TEST_TMPDIR}/password $image:/etc/fstab
+    [ "$status" -eq 0 ]
+    [ "$output" = "UUID=0 / ext4 defaults 0 1" ]
+    run ${luksy} cat --password-file ${BATS_TEST_TMPDIR}/password $image:/etc/missing
+    [ "$status" -ne 0 ]
+    ${luksy} extract --password-file ${BATS_TEST_TMPDIR}/password $image:/data/random ${BATS_TEST_TMPDIR}/random
+    cmp ${BATS_TEST_TMPDIR}/random ${BATS_TEST_TMPDIR}/tree/data/random
+    ${luksy} extract --password-file ${BATS_TEST_TMPDIR}/password $image:/data ${BATS_TEST_TMPDIR}/extracted
+    diff -r ${BATS_TEST_TMPDIR}/extracted ${BATS_TEST_TMPDIR}/tree/data
+    # don't overwrite files that are already there
+    run ${luksy} extract --password-file ${BATS_TEST_TMPDIR}/password $image:/data/random ${BATS_TEST_TMPDIR}/random
+    [ "$status" -ne 0 ]
+}
+
+@test files-ext4 {
+    if ! command -v mkfs.ext4 > /dev/null ; then
+        skip "mkfs.ext4 is needed to build a filesystem"
+    fi
+    make_tree
+    ln -s ../etc/fstab ${BATS_TEST_TMPDIR}/tree/data/link
+    truncate -s 32M ${BATS_TEST_TMPDIR}/filesystem
+    mkfs.ext4 -q -d ${BATS_TEST_TMPDIR}/tree ${BATS_TEST_TMPDIR}/filesystem
+    check_files
+    run ${luksy} cat --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted:/data/link
+    [ "$status" -eq 0 ]
+    [ "$output" = "UUID=0 / ext4 defaults 0 1" ]
+    [ "$(readlink ${BATS_TEST_TMPDIR}/extracted/link)" = "../etc/fstab" ]
+}
+
+@test files-vfat {
+    if ! command -v mkfs.vfat > /dev/null || ! command -v mcopy > /dev/null ; then
+        skip "mkfs.vfat and mcopy are needed to build a filesystem"
+    fi
+    make_tree
+    truncate -s 32M ${BATS_TEST_TMPDIR}/filesystem
+    mkfs.vfat ${BATS_TEST_TMPDIR}/filesystem
+    mcopy -s -i ${BATS_TEST_TMPDIR}/filesystem ${BATS_TEST_TMPDIR}/tree/etc ${BATS_TEST_TMPDIR}/tree/data ::/
+    check_files
+}
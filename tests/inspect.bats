@@ -0,0 +1,60 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+function inspect_cryptsetup() {
+    fallocate -l 64M ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short | cryptsetup luksFormat -q "$@" ${BATS_TEST_TMPDIR}/encrypted -
+    for i in 1 2 3 4 5 6 7 ; do
+        echo -n short | cryptsetup luksAddKey -q --pbkdf pbkdf2 --pbkdf-force-iterations 1000 --new-keyfile <(echo -n key$i) ${BATS_TEST_TMPDIR}/encrypted -
+    done
+    uuid=$(cryptsetup luksUUID ${BATS_TEST_TMPDIR}/encrypted)
+    for format in text json luksdump ; do
+        ${luksy} inspect --format ${format} ${BATS_TEST_TMPDIR}/encrypted > ${BATS_TEST_TMPDIR}/first
+        ${luksy} inspect --format ${format} ${BATS_TEST_TMPDIR}/encrypted > ${BATS_TEST_TMPDIR}/second
+        cmp ${BATS_TEST_TMPDIR}/first ${BATS_TEST_TMPDIR}/second
+        grep -q "${uuid}" ${BATS_TEST_TMPDIR}/first
+    done
+    ${luksy} inspect --format json ${BATS_TEST_TMPDIR}/encrypted | python3 -m json.tool > /dev/null
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/first ${BATS_TEST_TMPDIR}/second
+}
+
+@test inspect-cryptsetup-luks1 {
+    inspect_cryptsetup --type luks1
+}
+
+@test inspect-cryptsetup-luks2 {
+    inspect_cryptsetup --type luks2
+}
+
+@test inspect-dump-json-metadata {
+    fallocate -l 64M ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short | cryptsetup luksFormat -q --type luks2 ${BATS_TEST_TMPDIR}/encrypted -
+    ${luksy} inspect --dump-json-metadata ${BATS_TEST_TMPDIR}/encrypted | python3 -c 'import json,sys; print(json.dumps(json.load(sys.stdin), sort_keys=True))' > ${BATS_TEST_TMPDIR}/luksy.json
+    cryptsetup luksDump --dump-json-metadata ${BATS_TEST_TMPDIR}/encrypted | python3 -c 'import json,sys; print(json.dumps(json.load(sys.stdin), sort_keys=True))' > ${BATS_TEST_TMPDIR}/cryptsetup.json
+    cmp ${BATS_TEST_TMPDIR}/luksy.json ${BATS_TEST_TMPDIR}/cryptsetup.json
+    rm -f ${BATS_TEST_TMPDIR}/encrypted
+}
+
+@test inspect-dump-json-metadata-damaged-secondary {
+    dd if=/dev/urandom bs=1M count=1 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n short > ${BATS_TEST_TMPDIR}/password
+    ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} inspect --dump-json-metadata ${BATS_TEST_TMPDIR}/encrypted > ${BATS_TEST_TMPDIR}/before.json
+    # give the secondary header a higher sequence ID, and change its JSON
+    # metadata without updating its checksum, so that it shouldn't be used
+    python3 - ${BATS_TEST_TMPDIR}/encrypted <<-'END'
+	import struct, sys
+	with open(sys.argv[1], 'r+b') as f:
+	    data = bytearray(f.read())
+	    size = struct.unpack('>Q', data[8:16])[0]
+	    data[size+16:size+24] = struct.pack('>Q', struct.unpack('>Q', data[16:24])[0] + 100)
+	    i = data.index(b'"sha256"', size + 4096)
+	    data[i:i+8] = b'"sha257"'
+	    f.seek(0)
+	    f.write(data)
+	END
+    ${luksy} inspect --dump-json-metadata ${BATS_TEST_TMPDIR}/encrypted > ${BATS_TEST_TMPDIR}/after.json
+    cmp ${BATS_TEST_TMPDIR}/before.json ${BATS_TEST_TMPDIR}/after.json
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/plaintext
+}
@@ -0,0 +1,25 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+@test token-import-export-cryptsetup {
+    fallocate -l 64M ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short | cryptsetup luksFormat -q --type luks2 ${BATS_TEST_TMPDIR}/encrypted -
+    echo -n '{"type":"acme-tpm","keyslots":["0"],"zeta":1,"alpha":{"nested":[1,2,3]},"pcrs":"0,7"}' > ${BATS_TEST_TMPDIR}/token.json
+    ${luksy} token import --json-file ${BATS_TEST_TMPDIR}/token.json ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} check --strict ${BATS_TEST_TMPDIR}/encrypted
+    cryptsetup token export --token-id 0 ${BATS_TEST_TMPDIR}/encrypted | python3 -c 'import json,sys; print(json.dumps(json.load(sys.stdin), sort_keys=True))' > ${BATS_TEST_TMPDIR}/cryptsetup.json
+    python3 -c 'import json,sys; print(json.dumps(json.load(sys.stdin), sort_keys=True))' < ${BATS_TEST_TMPDIR}/token.json > ${BATS_TEST_TMPDIR}/expected.json
+    cmp ${BATS_TEST_TMPDIR}/cryptsetup.json ${BATS_TEST_TMPDIR}/expected.json
+    cryptsetup token import --token-id 1 --json-file ${BATS_TEST_TMPDIR}/token.json ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} token export --token-id 1 ${BATS_TEST_TMPDIR}/encrypted | python3 -c 'import json,sys; print(json.dumps(json.load(sys.stdin), sort_keys=True))' > ${BATS_TEST_TMPDIR}/luksy.json
+    cmp ${BATS_TEST_TMPDIR}/luksy.json ${BATS_TEST_TMPDIR}/expected.json
+    ${luksy} token remove --token-id 1 ${BATS_TEST_TMPDIR}/encrypted
+    run cryptsetup token export --token-id 1 ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+    ${luksy} metadata export --json-file ${BATS_TEST_TMPDIR}/metadata.json ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} metadata import --json-file ${BATS_TEST_TMPDIR}/metadata.json ${BATS_TEST_TMPDIR}/encrypted
+    cryptsetup repair -q ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short | cryptsetup -q --test-passphrase --key-file - luksOpen ${BATS_TEST_TMPDIR}/encrypted
+    rm -f ${BATS_TEST_TMPDIR}/encrypted
+}
@@ -0,0 +1,54 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+function partitioned_disk() {
+    fallocate -l 128M ${BATS_TEST_TMPDIR}/disk
+    printf 'label: %s\n,48M\n,48M\n' "$1" | sfdisk -q ${BATS_TEST_TMPDIR}/disk
+}
+
+function partitions_luksy() {
+    partitioned_disk "$1"
+    shift
+    dd if=/dev/urandom bs=1M count=16 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n partitionpassword | ${luksy} encrypt --password-fd 0 --partition 2 "$@" ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/disk
+    start=$(sfdisk -d ${BATS_TEST_TMPDIR}/disk | grep "disk2 " | sed -r 's/.*start= *([0-9]+),.*/\1/')
+    size=$(sfdisk -d ${BATS_TEST_TMPDIR}/disk | grep "disk2 " | sed -r 's/.*size= *([0-9]+),.*/\1/')
+    dd if=${BATS_TEST_TMPDIR}/disk of=${BATS_TEST_TMPDIR}/partition bs=512 skip=${start} count=${size} status=none
+    uuid=$(cryptsetup luksUUID ${BATS_TEST_TMPDIR}/partition)
+    ${luksy} inspect ${BATS_TEST_TMPDIR}/disk | grep -q "^2 .*${uuid}"
+    ${luksy} inspect --partition-offset $((start * 512)) ${BATS_TEST_TMPDIR}/disk | grep -q "${uuid}"
+    echo -n partitionpassword | cryptsetup luksOpen --test-passphrase ${BATS_TEST_TMPDIR}/partition
+    echo -n partitionpassword | ${luksy} decrypt --password-fd 0 --partition 2 ${BATS_TEST_TMPDIR}/disk ${BATS_TEST_TMPDIR}/decrypted
+    cmp -n $(stat -c %s ${BATS_TEST_TMPDIR}/plaintext) ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+    # the partition table should still be intact
+    sfdisk -d ${BATS_TEST_TMPDIR}/disk | grep -q "disk1 "
+    rm -f ${BATS_TEST_TMPDIR}/disk ${BATS_TEST_TMPDIR}/partition ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/decrypted
+}
+
+@test partitions-gpt-luks1 {
+    partitions_luksy gpt --luks1
+}
+
+@test partitions-gpt-luks2 {
+    partitions_luksy gpt
+}
+
+@test partitions-mbr-luks2 {
+    partitions_luksy dos
+}
+
+@test partitions-cryptsetup {
+    partitioned_disk gpt
+    start=$(sfdisk -d ${BATS_TEST_TMPDIR}/disk | grep "disk1 " | sed -r 's/.*start= *([0-9]+),.*/\1/')
+    size=$(sfdisk -d ${BATS_TEST_TMPDIR}/disk | grep "disk1 " | sed -r 's/.*size= *([0-9]+),.*/\1/')
+    dd if=/dev/zero of=${BATS_TEST_TMPDIR}/partition bs=512 count=${size} status=none
+    echo -n partitionpassword | cryptsetup luksFormat -q --label partlabel ${BATS_TEST_TMPDIR}/partition -
+    uuid=$(cryptsetup luksUUID ${BATS_TEST_TMPDIR}/partition)
+    dd if=${BATS_TEST_TMPDIR}/partition of=${BATS_TEST_TMPDIR}/disk bs=512 seek=${start} conv=notrunc status=none
+    ${luksy} inspect ${BATS_TEST_TMPDIR}/disk | grep "^1 " | grep "${uuid}" | grep -q partlabel
+    echo -n partitionpassword | ${luksy} decrypt --password-fd 0 --partition 1 --test-passphrase ${BATS_TEST_TMPDIR}/disk
+    run ${luksy} decrypt --password-file /dev/null --partition 3 ${BATS_TEST_TMPDIR}/disk
+    [ "$status" -ne 0 ]
+    rm -f ${BATS_TEST_TMPDIR}/disk ${BATS_TEST_TMPDIR}/partition
+}
@@ -236,3 +236,52 @@ function passwords_cryptsetup() {
 @test passwords-cryptsetup-aes-cbc-essiv:sha256-luks2 {
     passwords_cryptsetup --cipher aes-cbc-essiv:sha256 --type luks2
 }
+
+function key_slot_cryptsetup() {
+    fallocate -l 64M ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short | cryptsetup luksFormat -q "$@" ${BATS_TEST_TMPDIR}/encrypted -
+    echo -n morethaneight > ${BATS_TEST_TMPDIR}/new-key
+    echo -n short | cryptsetup luksAddKey --key-slot 3 ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/new-key
+    run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/new-key --test-passphrase ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -eq 0 ]
+    [ "$output" = "Key slot 3 unlocked." ]
+    ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/new-key --key-slot 3 --test-passphrase ${BATS_TEST_TMPDIR}/encrypted
+    run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/new-key --key-slot 0 --test-passphrase ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+    run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/new-key --test-passphrase ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/plaintext
+    [ "$status" -ne 0 ]
+    rm -f ${BATS_TEST_TMPDIR}/encrypted
+}
+
+@test key-slot-cryptsetup-luks1 {
+    key_slot_cryptsetup --type luks1
+}
+
+@test key-slot-cryptsetup-luks2 {
+    key_slot_cryptsetup --type luks2
+}
+
+@test exit-codes {
+    dd if=/dev/urandom bs=1M count=1 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n short > ${BATS_TEST_TMPDIR}/short
+    echo -n wrong > ${BATS_TEST_TMPDIR}/wrong
+    ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/short ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/wrong --test-passphrase ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -eq 2 ]
+    run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/short --test-passphrase ${BATS_TEST_TMPDIR}/missing
+    [ "$status" -eq 4 ]
+    run ${luksy} --log-level debug decrypt --password-file ${BATS_TEST_TMPDIR}/short --test-passphrase ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -eq 0 ]
+    if [ "$(id -u)" -ne 0 ]; then
+        chmod 000 ${BATS_TEST_TMPDIR}/encrypted
+        run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/short --test-passphrase ${BATS_TEST_TMPDIR}/encrypted
+        [ "$status" -eq 1 ]
+        chmod 600 ${BATS_TEST_TMPDIR}/encrypted
+    fi
+    ${luksy} encrypt --luks1 --password-file ${BATS_TEST_TMPDIR}/short ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted1
+    # mark the only key slot as disabled
+    printf '\x00\x00\xde\xad' | dd of=${BATS_TEST_TMPDIR}/encrypted1 bs=1 seek=208 conv=notrunc status=none
+    run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/short --test-passphrase ${BATS_TEST_TMPDIR}/encrypted1
+    [ "$status" -eq 1 ]
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/encrypted1 ${BATS_TEST_TMPDIR}/plaintext
+}
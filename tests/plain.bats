@@ -0,0 +1,76 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+opened=
+
+teardown() {
+    if test -n "$opened" ; then
+        cryptsetup close plain
+        opened=
+    fi
+}
+
+function plain_luksy() {
+    dd if=/dev/urandom bs=1M count=16 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n plainpassword | ${luksy} encrypt --type plain --password-fd 0 "$@" ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    echo -n plainpassword | cryptsetup -q open --type plain "$@" ${BATS_TEST_TMPDIR}/encrypted plain
+    opened=1
+    cmp /dev/mapper/plain ${BATS_TEST_TMPDIR}/plaintext
+    cryptsetup close plain
+    opened=
+    echo -n plainpassword | ${luksy} decrypt --type plain --password-fd 0 "$@" ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+    rm -f ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+}
+
+function plain_cryptsetup() {
+    dd if=/dev/urandom bs=1M count=16 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    dd if=/dev/zero bs=1M count=24 of=${BATS_TEST_TMPDIR}/encrypted status=none
+    echo -n plainpassword | cryptsetup -q open --type plain "$@" --size 32768 ${BATS_TEST_TMPDIR}/encrypted plain
+    opened=1
+    dd if=${BATS_TEST_TMPDIR}/plaintext of=/dev/mapper/plain bs=1M status=none
+    cryptsetup close plain
+    opened=
+    echo -n plainpassword | ${luksy} decrypt --type plain --password-fd 0 "$@" --size 32768 ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+    rm -f ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+}
+
+@test plain-luksy-defaults {
+    plain_luksy --cipher aes-cbc-essiv:sha256 --key-size 256 --hash ripemd160
+}
+
+@test plain-luksy-xts-sha512 {
+    plain_luksy --cipher aes-xts-plain64 --key-size 512 --hash sha512
+}
+
+@test plain-luksy-offset-skip {
+    plain_luksy --cipher aes-xts-plain64 --key-size 512 --hash sha256 --offset 2048 --skip 100
+}
+
+@test plain-cryptsetup-defaults {
+    plain_cryptsetup --cipher aes-cbc-essiv:sha256 --key-size 256 --hash ripemd160
+}
+
+@test plain-cryptsetup-xts-offset-skip {
+    plain_cryptsetup --cipher aes-xts-plain64 --key-size 512 --hash sha256 --offset 4096 --skip 8
+}
+
+@test plain-key-file {
+    dd if=/dev/urandom bs=1M count=16 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    dd if=/dev/urandom bs=64 count=1 of=${BATS_TEST_TMPDIR}/keyfile status=none
+    ${luksy} encrypt --type plain --cipher aes-xts-plain64 --key-size 512 --key-file ${BATS_TEST_TMPDIR}/keyfile ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    cryptsetup -q open --type plain --cipher aes-xts-plain64 --key-size 512 --key-file ${BATS_TEST_TMPDIR}/keyfile ${BATS_TEST_TMPDIR}/encrypted plain
+    opened=1
+    cmp /dev/mapper/plain ${BATS_TEST_TMPDIR}/plaintext
+    cryptsetup close plain
+    opened=
+    rm -f ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/keyfile
+}
+
+@test plain-test-passphrase-refused {
+    dd if=/dev/urandom bs=1M count=1 of=${BATS_TEST_TMPDIR}/encrypted status=none
+    run ${luksy} decrypt --type plain --password-file /dev/null --test-passphrase ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+}
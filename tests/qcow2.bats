@@ -0,0 +1,48 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+setup() {
+    if ! command -v qemu-img > /dev/null ; then
+        skip "qemu-img is needed to read and write qcow2 images"
+    fi
+    dd if=/dev/urandom bs=1M count=16 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    # leave a hole in the middle, which shouldn't need to be allocated
+    dd if=/dev/zero bs=1M count=4 seek=6 conv=notrunc of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n qcow2password > ${BATS_TEST_TMPDIR}/password
+}
+
+@test qcow2-qemu-to-luksy {
+    qemu-img convert -f raw -O qcow2 \
+        --object secret,id=sec0,file=${BATS_TEST_TMPDIR}/password \
+        -o encrypt.format=luks,encrypt.key-secret=sec0 \
+        ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/image.qcow2
+    run ${luksy} inspect ${BATS_TEST_TMPDIR}/image.qcow2
+    [ "$status" -eq 0 ]
+    [[ "$output" =~ "qcow2 version" ]]
+    ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/image.qcow2 ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+    echo -n wrong > ${BATS_TEST_TMPDIR}/wrong
+    run ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/wrong ${BATS_TEST_TMPDIR}/image.qcow2 ${BATS_TEST_TMPDIR}/decrypted
+    [ "$status" -ne 0 ]
+    run ${luksy} decrypt --workers 2 --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/image.qcow2 ${BATS_TEST_TMPDIR}/decrypted
+    [ "$status" -ne 0 ]
+    [[ "$output" =~ "can not be used with qcow2 images" ]]
+}
+
+@test qcow2-luksy-to-qemu {
+    ${luksy} encrypt --qcow2 --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/image.qcow2
+    qemu-img check ${BATS_TEST_TMPDIR}/image.qcow2
+    qemu-img convert -O raw \
+        --object secret,id=sec0,file=${BATS_TEST_TMPDIR}/password \
+        --image-opts driver=qcow2,file.filename=${BATS_TEST_TMPDIR}/image.qcow2,encrypt.key-secret=sec0 \
+        ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+    ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/image.qcow2 ${BATS_TEST_TMPDIR}/decrypted2
+    cmp ${BATS_TEST_TMPDIR}/decrypted2 ${BATS_TEST_TMPDIR}/plaintext
+}
+
+@test qcow2-luks2-refused {
+    run ${luksy} encrypt --qcow2 --type luks2 --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/image.qcow2
+    [ "$status" -ne 0 ]
+}
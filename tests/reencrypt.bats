@@ -0,0 +1,74 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+@test reencrypt-init-only {
+    fallocate -l 64M ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short > ${BATS_TEST_TMPDIR}/password
+    cryptsetup luksFormat -q --type luks2 --key-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/before
+    cryptsetup reencrypt -q --init-only --key-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted
+    ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/after
+    cmp ${BATS_TEST_TMPDIR}/before ${BATS_TEST_TMPDIR}/after
+    ${luksy} metadata export --json-file ${BATS_TEST_TMPDIR}/metadata.json ${BATS_TEST_TMPDIR}/encrypted
+    run ${luksy} metadata import --json-file ${BATS_TEST_TMPDIR}/metadata.json ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+    [[ "$output" =~ "unsupported requirement" ]]
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/before ${BATS_TEST_TMPDIR}/after
+}
+
+# reencrypt_partially resumes a reencryption which was set up using
+# --init-only, and kills cryptsetup partway through, so that the image is left
+# with a reencrypt key slot and some segments that have been reencrypted and
+# some that haven't.  It tries again with shorter delays if cryptsetup
+# finishes before it can be killed.  Its arguments are the file, the password
+# file, and then any options for cryptsetup.
+function reencrypt_partially() {
+    local file=$1 passwordfile=$2
+    shift 2
+    cp ${file} ${file}.init
+    for delay in 2 1 0.5 0.2 0.1 0.05 ; do
+        cp ${file}.init ${file}
+        timeout -s KILL ${delay} cryptsetup reencrypt -q --resume-only --hotzone-size 1M --key-file ${passwordfile} "$@" ${file} || true
+        if cryptsetup luksDump ${file} | grep -q '^ *[0-9]*: reencrypt' ; then
+            rm -f ${file}.init
+            return 0
+        fi
+    done
+    rm -f ${file}.init
+    echo reencryption always finished before cryptsetup could be killed
+    return 1
+}
+
+# Without a way to recover the hot zone, which is what resilience "none"
+# means, neither luksy nor cryptsetup can read it after an interruption, so
+# only the resilience types that protect it are checked.
+@test reencrypt-interrupted {
+    for resilience in checksum journal ; do
+        echo testing resilience: ${resilience}
+        fallocate -l 256M ${BATS_TEST_TMPDIR}/encrypted
+        echo -n short > ${BATS_TEST_TMPDIR}/password
+        cryptsetup luksFormat -q --type luks2 --sector-size 4096 --key-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted
+        ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/before
+        cryptsetup reencrypt -q --init-only --resilience ${resilience} --key-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted
+        reencrypt_partially ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/password
+        ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/after
+        cmp ${BATS_TEST_TMPDIR}/before ${BATS_TEST_TMPDIR}/after
+        rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/before ${BATS_TEST_TMPDIR}/after
+    done
+}
+
+@test reencrypt-interrupted-datashift {
+    # encrypting in place moves the data to make room for the header,
+    # which needs free space at the end of the device
+    dd if=/dev/urandom bs=1M count=224 of=${BATS_TEST_TMPDIR}/before status=none
+    cp ${BATS_TEST_TMPDIR}/before ${BATS_TEST_TMPDIR}/encrypted
+    truncate -s 256M ${BATS_TEST_TMPDIR}/encrypted
+    echo -n short > ${BATS_TEST_TMPDIR}/password
+    cryptsetup reencrypt -q --encrypt --init-only --type luks2 --reduce-device-size 32M --key-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted
+    reencrypt_partially ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/password
+    cryptsetup luksDump ${BATS_TEST_TMPDIR}/encrypted | grep -q datashift
+    ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/after
+    cmp ${BATS_TEST_TMPDIR}/before ${BATS_TEST_TMPDIR}/after
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/before ${BATS_TEST_TMPDIR}/after
+}
@@ -0,0 +1,81 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+server=
+
+setup() {
+    if ! command -v qemu-img > /dev/null || ! command -v qemu-io > /dev/null ; then
+        skip "qemu-img and qemu-io are needed to act as NBD clients"
+    fi
+}
+
+teardown() {
+    if test -n "$server" ; then
+        kill $server
+        wait $server || true
+        server=
+    fi
+}
+
+function start_server() {
+    ${luksy} serve --nbd unix:${BATS_TEST_TMPDIR}/nbd.sock --password-file ${BATS_TEST_TMPDIR}/password "$@" &
+    server=$!
+    for i in $(seq 50) ; do
+        test -S ${BATS_TEST_TMPDIR}/nbd.sock && return 0
+        sleep 0.1
+    done
+    false
+}
+
+function serve_cryptsetup() {
+    dd if=/dev/urandom bs=1M count=16 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n servepassword > ${BATS_TEST_TMPDIR}/password
+    fallocate -l 32M ${BATS_TEST_TMPDIR}/encrypted
+    cryptsetup luksFormat -q "$@" ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/password
+    cryptsetup luksOpen --key-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted serve
+    dd if=${BATS_TEST_TMPDIR}/plaintext of=/dev/mapper/serve bs=1M status=none
+    cryptsetup close serve
+    start_server ${BATS_TEST_TMPDIR}/encrypted
+    uri="nbd+unix:///?socket=${BATS_TEST_TMPDIR}/nbd.sock"
+    qemu-img convert -f raw -O raw "$uri" ${BATS_TEST_TMPDIR}/served
+    cmp -n 16777216 ${BATS_TEST_TMPDIR}/served ${BATS_TEST_TMPDIR}/plaintext
+    # an unaligned write, which should show up when cryptsetup decrypts it
+    qemu-io -f raw -c "write -P 0x5a 1000 70000" "$uri"
+    kill $server
+    wait $server || true
+    server=
+    python3 -c "
+import sys
+data = bytearray(open(sys.argv[1], 'rb').read())
+data[1000:71000] = b'\x5a' * 70000
+open(sys.argv[1], 'wb').write(data)" ${BATS_TEST_TMPDIR}/plaintext
+    cryptsetup luksOpen --key-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted serve
+    cmp -n 16777216 /dev/mapper/serve ${BATS_TEST_TMPDIR}/plaintext
+    cryptsetup close serve
+    rm -f ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/served
+}
+
+@test serve-cryptsetup-luks1 {
+    serve_cryptsetup --type luks1
+}
+
+@test serve-cryptsetup-luks2 {
+    serve_cryptsetup --type luks2
+}
+
+@test serve-cryptsetup-luks2-sector-size-4096 {
+    serve_cryptsetup --type luks2 --sector-size 4096
+}
+
+@test serve-read-only {
+    dd if=/dev/urandom bs=1M count=4 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n servepassword > ${BATS_TEST_TMPDIR}/password
+    ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    cp ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/original
+    start_server --read-only ${BATS_TEST_TMPDIR}/encrypted
+    run qemu-io -f raw -c "write -P 0x5a 0 4096" "nbd+unix:///?socket=${BATS_TEST_TMPDIR}/nbd.sock"
+    cmp ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/original
+    qemu-img convert -f raw -O raw "nbd+unix:///?socket=${BATS_TEST_TMPDIR}/nbd.sock" ${BATS_TEST_TMPDIR}/served
+    cmp -n 4194304 ${BATS_TEST_TMPDIR}/served ${BATS_TEST_TMPDIR}/plaintext
+}
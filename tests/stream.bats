@@ -0,0 +1,46 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+setup() {
+    dd if=/dev/urandom bs=1M count=8 of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n streampassword > ${BATS_TEST_TMPDIR}/password
+}
+
+@test stream-tar-roundtrip {
+    mkdir -p ${BATS_TEST_TMPDIR}/dir/sub ${BATS_TEST_TMPDIR}/out
+    cp ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/dir/sub/file
+    echo hello > ${BATS_TEST_TMPDIR}/dir/hello
+    for type in luks1 luks2 ; do
+        tar c -C ${BATS_TEST_TMPDIR} dir | ${luksy} encrypt --type ${type} --password-file ${BATS_TEST_TMPDIR}/password - ${BATS_TEST_TMPDIR}/${type}.img
+        rm -fr ${BATS_TEST_TMPDIR}/out/dir
+        cat ${BATS_TEST_TMPDIR}/${type}.img | ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password - - | tar x -C ${BATS_TEST_TMPDIR}/out
+        diff -r ${BATS_TEST_TMPDIR}/dir ${BATS_TEST_TMPDIR}/out/dir
+    done
+}
+
+@test stream-stdout {
+    for type in luks1 luks2 plain ; do
+        ${luksy} encrypt --type ${type} --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext - > ${BATS_TEST_TMPDIR}/${type}.img
+        ${luksy} decrypt --type ${type} --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/${type}.img ${BATS_TEST_TMPDIR}/${type}.decrypted
+        cmp ${BATS_TEST_TMPDIR}/${type}.decrypted ${BATS_TEST_TMPDIR}/plaintext
+        cat ${BATS_TEST_TMPDIR}/plaintext | ${luksy} encrypt --type ${type} --password-file ${BATS_TEST_TMPDIR}/password - - |
+            ${luksy} decrypt --type ${type} --password-file ${BATS_TEST_TMPDIR}/password - - | cmp - ${BATS_TEST_TMPDIR}/plaintext
+    done
+}
+
+@test stream-errors {
+    echo -n wrong > ${BATS_TEST_TMPDIR}/wrong
+    ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/image
+    run sh -c "cat ${BATS_TEST_TMPDIR}/image | ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/wrong - -"
+    [ "$status" -ne 0 ]
+    run sh -c "cat ${BATS_TEST_TMPDIR}/plaintext | ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password - -"
+    [ "$status" -ne 0 ]
+    # the password can't come from stdin if the input does
+    run sh -c "cat ${BATS_TEST_TMPDIR}/image | ${luksy} decrypt - -"
+    [ "$status" -ne 0 ]
+    run sh -c "cat ${BATS_TEST_TMPDIR}/plaintext | ${luksy} encrypt - ${BATS_TEST_TMPDIR}/image2"
+    [ "$status" -ne 0 ]
+    run sh -c "cat ${BATS_TEST_TMPDIR}/plaintext | ${luksy} encrypt --fixed-size --password-file ${BATS_TEST_TMPDIR}/password - ${BATS_TEST_TMPDIR}/image2"
+    [ "$status" -ne 0 ]
+}
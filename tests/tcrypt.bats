@@ -0,0 +1,117 @@
+#!/usr/bin/env bats
+
+luksy=${LUKSY:-${BATS_TEST_DIRNAME}/../luksy}
+
+# Volumes are created using VeraCrypt and filled in using cryptsetup, so that
+# luksy is checked against both of them.  VeraCrypt can no longer create
+# volumes in TrueCrypt's format, so only VeraCrypt's format is covered.
+#
+# VeraCrypt refuses PIMs below 485 unless the password is at least 20
+# characters long, and a low PIM keeps key derivation quick.
+password=veracrypt-outer-password
+hiddenpassword=veracrypt-hidden-password
+
+opened=
+
+setup() {
+    if ! command -v veracrypt > /dev/null ; then
+        skip "veracrypt is needed to create TrueCrypt-format volumes"
+    fi
+    echo -n ${password} > ${BATS_TEST_TMPDIR}/password
+    echo -n ${hiddenpassword} > ${BATS_TEST_TMPDIR}/hiddenpassword
+}
+
+teardown() {
+    if test -n "$opened" ; then
+        cryptsetup close tcrypt
+        opened=
+    fi
+}
+
+# veracrypt_create creates a volume using VeraCrypt.  Its arguments are the
+# file, the volume type, the password, and then any options for veracrypt.
+function veracrypt_create() {
+    local file=$1 type=$2 pass=$3
+    shift 3
+    veracrypt --text --non-interactive --create ${file} --volume-type=${type} --filesystem=none --password=${pass} --keyfiles= --random-source=/dev/urandom "$@"
+}
+
+# tcrypt_fill writes random data to a volume using cryptsetup, and saves a
+# copy of it.  Its arguments are the file, the password, the file to save the
+# plaintext to, and then any options for cryptsetup.
+function tcrypt_fill() {
+    local file=$1 pass=$2 plaintext=$3
+    shift 3
+    echo -n ${pass} | cryptsetup -q open --type tcrypt --veracrypt "$@" ${file} tcrypt
+    opened=1
+    head -c $(blockdev --getsize64 /dev/mapper/tcrypt) /dev/urandom > ${plaintext}
+    dd if=${plaintext} of=/dev/mapper/tcrypt bs=1M oflag=direct status=none
+    cryptsetup close tcrypt
+    opened=
+}
+
+function tcrypt_veracrypt() {
+    local encryption=$1 hash=$2
+    veracrypt_create ${BATS_TEST_TMPDIR}/encrypted normal ${password} --size=8M --encryption=${encryption} --hash=${hash} --pim=1
+    tcrypt_fill ${BATS_TEST_TMPDIR}/encrypted ${password} ${BATS_TEST_TMPDIR}/plaintext --veracrypt-pim 1
+    ${luksy} decrypt --type tcrypt --veracrypt-pim 1 --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/decrypted
+}
+
+@test tcrypt-veracrypt-aes-sha512 {
+    tcrypt_veracrypt AES sha512
+}
+
+@test tcrypt-veracrypt-serpent-sha256 {
+    tcrypt_veracrypt Serpent sha256
+}
+
+@test tcrypt-veracrypt-twofish-sha512 {
+    tcrypt_veracrypt Twofish sha512
+}
+
+@test tcrypt-veracrypt-aes-twofish {
+    tcrypt_veracrypt "AES(Twofish)" sha512
+}
+
+@test tcrypt-veracrypt-aes-twofish-serpent {
+    tcrypt_veracrypt "AES(Twofish(Serpent))" sha512
+}
+
+@test tcrypt-veracrypt-serpent-aes {
+    tcrypt_veracrypt "Serpent(AES)" sha256
+}
+
+@test tcrypt-veracrypt-serpent-twofish-aes {
+    tcrypt_veracrypt "Serpent(Twofish(AES))" sha256
+}
+
+@test tcrypt-veracrypt-twofish-serpent {
+    tcrypt_veracrypt "Twofish(Serpent)" sha256
+}
+
+@test tcrypt-veracrypt-default-iterations {
+    veracrypt_create ${BATS_TEST_TMPDIR}/encrypted normal ${password} --size=4M --encryption=AES --hash=sha256 --pim=0
+    tcrypt_fill ${BATS_TEST_TMPDIR}/encrypted ${password} ${BATS_TEST_TMPDIR}/plaintext
+    ${luksy} decrypt --type tcrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/decrypted
+}
+
+@test tcrypt-veracrypt-hidden-and-backup {
+    veracrypt_create ${BATS_TEST_TMPDIR}/encrypted normal ${password} --size=16M --encryption=AES --hash=sha512 --pim=1
+    veracrypt_create ${BATS_TEST_TMPDIR}/encrypted hidden ${hiddenpassword} --size=4M --encryption="Serpent(Twofish(AES))" --hash=sha256 --pim=1
+    tcrypt_fill ${BATS_TEST_TMPDIR}/encrypted ${hiddenpassword} ${BATS_TEST_TMPDIR}/hidden --veracrypt-pim 1 --tcrypt-hidden
+    ${luksy} decrypt --type tcrypt --veracrypt-pim 1 --tcrypt-hidden --password-file ${BATS_TEST_TMPDIR}/hiddenpassword ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/hidden
+    # destroy both of the primary headers, and read the backups instead
+    dd if=/dev/zero of=${BATS_TEST_TMPDIR}/encrypted bs=512 count=1 conv=notrunc status=none
+    dd if=/dev/zero of=${BATS_TEST_TMPDIR}/encrypted bs=512 count=1 seek=128 conv=notrunc status=none
+    run ${luksy} decrypt --type tcrypt --veracrypt-pim 1 --tcrypt-hidden --password-file ${BATS_TEST_TMPDIR}/hiddenpassword ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    [ "$status" -ne 0 ]
+    ${luksy} decrypt --type tcrypt --veracrypt-pim 1 --tcrypt-hidden --tcrypt-backup --password-file ${BATS_TEST_TMPDIR}/hiddenpassword ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/hidden
+    ${luksy} decrypt --type tcrypt --veracrypt-pim 1 --tcrypt-backup --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+    rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/hidden ${BATS_TEST_TMPDIR}/decrypted
+}
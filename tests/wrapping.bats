@@ -39,6 +39,42 @@ function wrapping() {
     wrapping
 }
 
+@test wrapping-fixed-size-luks2 {
+    wrapping --fixed-size
+}
+
+@test wrapping-offset-luks1 {
+    wrapping --luks1 --offset 32768
+}
+
+@test wrapping-offset-luks2 {
+    wrapping --offset 32768
+}
+
+@test wrapping-align-payload-luks1 {
+    wrapping --luks1 --align-payload 2048
+}
+
+@test wrapping-align-payload-luks2 {
+    wrapping --align-payload 2048
+}
+
+@test wrapping-metadata-sizes-luks2 {
+    wrapping --luks2-metadata-size 64k --luks2-keyslots-size 2M
+}
+
+@test wrapping-keyslot-cipher-luks2 {
+    wrapping --keyslot-cipher aes-cbc-essiv:sha256 --keyslot-key-size 256
+}
+
+@test wrapping-hash-luks1 {
+    wrapping --luks1 --hash sha512
+}
+
+@test wrapping-hash-luks2 {
+    wrapping --hash sha512
+}
+
 @test wrapping-aes-xts-plain32-luks1 {
     wrapping --cipher aes-xts-plain --luks1
 }
@@ -179,3 +215,28 @@ function wrapping_cryptsetup() {
 @test wrapping-cryptsetup-aes-cbc-essiv:sha256-luks2 {
     wrapping_cryptsetup --cipher aes-cbc-essiv:sha256 --type luks2
 }
+
+@test wrapping-odd-size {
+    # one byte more than a whole number of sectors
+    dd if=/dev/urandom bs=1000001 count=1 iflag=fullblock of=${BATS_TEST_TMPDIR}/plaintext status=none
+    echo -n short > ${BATS_TEST_TMPDIR}/password
+    run ${luksy} encrypt --luks1 --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+    [ "$status" -ne 0 ]
+    for input in file stdin ; do
+        rm -f ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+        if test $input = file ; then
+            ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/plaintext ${BATS_TEST_TMPDIR}/encrypted
+        else
+            cat ${BATS_TEST_TMPDIR}/plaintext | ${luksy} encrypt --password-file ${BATS_TEST_TMPDIR}/password - ${BATS_TEST_TMPDIR}/encrypted
+        fi
+        ${luksy} decrypt --password-file ${BATS_TEST_TMPDIR}/password ${BATS_TEST_TMPDIR}/encrypted ${BATS_TEST_TMPDIR}/decrypted
+        cmp ${BATS_TEST_TMPDIR}/decrypted ${BATS_TEST_TMPDIR}/plaintext
+        # cryptsetup should see the plaintext, padded to a whole number of sectors
+        uuid=$(cryptsetup luksUUID ${BATS_TEST_TMPDIR}/encrypted)
+        cryptsetup -q --key-file ${BATS_TEST_TMPDIR}/password luksOpen ${BATS_TEST_TMPDIR}/encrypted decrypted
+        cmp -n 1000001 /dev/mapper/decrypted ${BATS_TEST_TMPDIR}/plaintext
+        [ "$(blockdev --getsize64 /dev/mapper/decrypted)" -eq 1003520 ]
+        cryptsetup close decrypted
+        uuid=
+    done
+}
@@ -15,16 +15,35 @@ func durationOf(f func()) time.Duration {
 }
 
 func IterationsPBKDF2(salt []byte, keyLen int, h func() hash.Hash) int {
+	return iterationsPBKDF2(salt, keyLen, h, time.Second)
+}
+
+// minDigestIterations is the smallest number of iterations that
+// digestIterationsPBKDF2 will suggest.
+const minDigestIterations = 1000
+
+// digestIterationsPBKDF2 returns the number of iterations to use when
+// computing the digest of a master key, which cryptsetup targets at 1/8 of a
+// second, with a minimum of 1000.
+func digestIterationsPBKDF2(salt []byte, keyLen int, h func() hash.Hash) int {
+	iterations := iterationsPBKDF2(salt, keyLen, h, time.Second/8)
+	if iterations < minDigestIterations {
+		iterations = minDigestIterations
+	}
+	return iterations
+}
+
+func iterationsPBKDF2(salt []byte, keyLen int, h func() hash.Hash, target time.Duration) int {
 	iterations := 2
 	var d time.Duration
-	for d < time.Second {
+	for d < target {
 		d = durationOf(func() {
 			_ = pbkdf2.Key([]byte{}, salt, iterations, keyLen, h)
 		})
-		if d < time.Second/10 {
+		if d < target/10 {
 			iterations *= 2
 		} else {
-			return iterations * int(time.Second) / int(d)
+			return int(int64(iterations) * int64(target) / int64(d))
 		}
 	}
 	return iterations
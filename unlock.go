@@ -0,0 +1,213 @@
+package luksy
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"hash"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// UnlockOptions controls how Unlock() tries key slots.  Key slots are always
+// tried in order of priority, and then in order of their IDs, but more than
+// one of them can be tried at a time.
+type UnlockOptions struct {
+	// Parallelism is the maximum number of key slots to try at the same
+	// time.  If 0, one per CPU is used, except that key slots which use
+	// Argon2, which already runs on several threads of its own, are tried
+	// one at a time.
+	Parallelism int
+	// MemoryLimit is the maximum number of bytes that key derivation
+	// functions being run at the same time may use between them.  A key
+	// slot which on its own needs more than this is still tried, but by
+	// itself.  If 0, 1 GiB is used.
+	MemoryLimit int64
+	// Keyslot, if set, is the ID of the only key slot to try.
+	Keyslot string
+	// IgnoreRequirements allows a LUKSv2 volume to be unlocked even if
+	// its metadata has requirements or segment flags that we don't know
+	// how to honor.  The payload may not decrypt correctly, so this
+	// should only be used for forensic purposes.
+	IgnoreRequirements bool
+}
+
+const defaultUnlockMemoryLimit = 1024 * 1024 * 1024
+
+// keyslotAttempt is a key slot which we want to try to unlock.
+type keyslotAttempt struct {
+	// id is the ID of the key slot.
+	id string
+	// memory is the number of bytes that the key derivation function will
+	// use.
+	memory int64
+	// try returns the main key if the password unlocks the key slot, or
+	// nil if it doesn't.  It should give up and return nil, nil as soon as
+	// it can after cancel is closed.  Argon2 can't be interrupted, so an
+	// attempt which uses it runs to completion regardless.
+	try func(cancel <-chan struct{}) ([]byte, error)
+}
+
+// tryKeyslots tries each of the attempts, running up to the configured
+// number of them at a time, and returns the index of, and the key produced
+// by, the first of them which either succeeds or fails with an error, as if
+// they had been tried in order.  Attempts which haven't started by then are
+// skipped, and those which are running are cancelled and waited for.  If none
+// of them succeed, it returns -1.
+func tryKeyslots(attempts []keyslotAttempt, options UnlockOptions) (int, []byte, error) {
+	parallelism := options.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	memoryLimit := options.MemoryLimit
+	if memoryLimit <= 0 {
+		memoryLimit = defaultUnlockMemoryLimit
+	}
+	type result struct {
+		key []byte
+		err error
+	}
+	results := make([]chan result, len(attempts))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	cancel := make(chan struct{})
+	var running sync.WaitGroup
+	var lock sync.Mutex
+	cond := sync.NewCond(&lock)
+	inFlight := 0
+	exclusiveInFlight := false
+	memoryInUse := int64(0)
+	cancelled := false
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		for i := range attempts {
+			attempt := attempts[i]
+			exclusive := options.Parallelism <= 0 && attempt.memory > 0
+			lock.Lock()
+			for !cancelled && inFlight > 0 && (exclusive || exclusiveInFlight || inFlight >= parallelism || memoryInUse+attempt.memory > memoryLimit) {
+				cond.Wait()
+			}
+			if cancelled {
+				lock.Unlock()
+				return
+			}
+			inFlight++
+			exclusiveInFlight = exclusive
+			memoryInUse += attempt.memory
+			lock.Unlock()
+			running.Add(1)
+			go func(i int) {
+				defer running.Done()
+				key, err := attempt.try(cancel)
+				lock.Lock()
+				inFlight--
+				if exclusive {
+					exclusiveInFlight = false
+				}
+				memoryInUse -= attempt.memory
+				cond.Broadcast()
+				lock.Unlock()
+				results[i] <- result{key: key, err: err}
+			}(i)
+		}
+	}()
+	for i := range attempts {
+		r := <-results[i]
+		if r.key != nil || r.err != nil {
+			lock.Lock()
+			cancelled = true
+			close(cancel)
+			cond.Broadcast()
+			lock.Unlock()
+			running.Wait()
+			return i, r.key, r.err
+		}
+	}
+	running.Wait()
+	return -1, nil, nil
+}
+
+// pbkdf2CancelInterval is the number of PBKDF2 iterations which
+// pbkdf2KeyCancelable runs between checks for cancellation.
+const pbkdf2CancelInterval = 4096
+
+// pbkdf2KeyCancelable derives a key the same way pbkdf2.Key() does, but stops
+// and returns nil if cancel is closed before it finishes.
+func pbkdf2KeyCancelable(password, salt []byte, iter, keyLen int, h func() hash.Hash, cancel <-chan struct{}) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iter; n++ {
+			if n%pbkdf2CancelInterval == 0 {
+				select {
+				case <-cancel:
+					return nil
+				default:
+				}
+			}
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// lessID compares two IDs from a LUKSv2 JSON block, which are usually
+// numbers, but which are stored as strings.
+func lessID(a, b string) bool {
+	aNum, aErr := strconv.Atoi(a)
+	bNum, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return aNum < bNum
+	case aErr == nil:
+		return true
+	case bErr == nil:
+		return false
+	}
+	return a < b
+}
+
+// sortedIDs returns the keys of a map from a LUKSv2 JSON block in a
+// predictable order.
+func sortedIDs[T any](m map[string]T) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+	return ids
+}
+
+// keyslotsByPriority returns the IDs of the key slots in a LUKSv2 JSON block,
+// highest priority first, and in order of their IDs within each priority.
+func (j V2JSON) keyslotsByPriority() []string {
+	priority := func(id string) V2JSONKeyslotPriority {
+		if p := j.Keyslots[id].Priority; p != nil {
+			return *p
+		}
+		return V2JSONKeyslotPriorityNormal
+	}
+	ids := sortedIDs(j.Keyslots)
+	sort.SliceStable(ids, func(a, b int) bool { return priority(ids[a]) > priority(ids[b]) })
+	return ids
+}
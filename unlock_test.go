@@ -0,0 +1,189 @@
+package luksy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestKeyslotsByPriority(t *testing.T) {
+	high, normal, ignore := V2JSONKeyslotPriorityHigh, V2JSONKeyslotPriorityNormal, V2JSONKeyslotPriorityIgnore
+	j := V2JSON{
+		Keyslots: map[string]V2JSONKeyslot{
+			"0":  {Priority: &normal},
+			"1":  {Priority: &high},
+			"2":  {},
+			"3":  {Priority: &ignore},
+			"10": {Priority: &high},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{"1", "10", "0", "2", "3"}, j.keyslotsByPriority())
+	}
+}
+
+type tryKeyslotsCounter struct {
+	running, maxRunning, started int32
+}
+
+func (c *tryKeyslotsCounter) attempt(key []byte, err error, memory int64) keyslotAttempt {
+	return keyslotAttempt{
+		memory: memory,
+		try: func(<-chan struct{}) ([]byte, error) {
+			atomic.AddInt32(&c.started, 1)
+			n := atomic.AddInt32(&c.running, 1)
+			for {
+				m := atomic.LoadInt32(&c.maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&c.maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&c.running, -1)
+			return key, err
+		},
+	}
+}
+
+func TestTryKeyslots(t *testing.T) {
+	t.Run("first-match-wins", func(t *testing.T) {
+		var c tryKeyslotsCounter
+		attempts := []keyslotAttempt{c.attempt(nil, nil, 0), c.attempt(nil, nil, 0), c.attempt([]byte("two"), nil, 0), c.attempt([]byte("three"), nil, 0)}
+		for i := 0; i < 8; i++ {
+			attempts = append(attempts, c.attempt(nil, nil, 0))
+		}
+		i, key, err := tryKeyslots(attempts, UnlockOptions{Parallelism: 3})
+		require.NoError(t, err)
+		assert.Equal(t, 2, i)
+		assert.Equal(t, []byte("two"), key)
+		assert.LessOrEqual(t, atomic.LoadInt32(&c.maxRunning), int32(3))
+		assert.Less(t, atomic.LoadInt32(&c.started), int32(len(attempts)), "expected later attempts to be skipped")
+	})
+
+	t.Run("no-match", func(t *testing.T) {
+		var c tryKeyslotsCounter
+		i, key, err := tryKeyslots([]keyslotAttempt{c.attempt(nil, nil, 0), c.attempt(nil, nil, 0)}, UnlockOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, -1, i)
+		assert.Nil(t, key)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var c tryKeyslotsCounter
+		i, _, err := tryKeyslots([]keyslotAttempt{c.attempt(nil, nil, 0), c.attempt(nil, errors.New("oops"), 0), c.attempt([]byte("two"), nil, 0)}, UnlockOptions{Parallelism: 1})
+		assert.Error(t, err)
+		assert.Equal(t, 1, i)
+	})
+
+	t.Run("memory-limit", func(t *testing.T) {
+		var c tryKeyslotsCounter
+		attempts := []keyslotAttempt{c.attempt(nil, nil, 600), c.attempt(nil, nil, 600), c.attempt(nil, nil, 600), c.attempt([]byte("three"), nil, 2000)}
+		i, _, err := tryKeyslots(attempts, UnlockOptions{Parallelism: 4, MemoryLimit: 1000})
+		require.NoError(t, err)
+		assert.Equal(t, 3, i)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&c.maxRunning), "memory limit should have kept attempts from overlapping")
+	})
+
+	t.Run("argon2-alone-by-default", func(t *testing.T) {
+		var c tryKeyslotsCounter
+		attempts := []keyslotAttempt{c.attempt(nil, nil, 0), c.attempt(nil, nil, 100), c.attempt(nil, nil, 0), c.attempt(nil, nil, 100)}
+		i, _, err := tryKeyslots(attempts, UnlockOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, -1, i)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&c.maxRunning), "attempts which need memory shouldn't overlap with others by default")
+	})
+
+	t.Run("match-cancels-running", func(t *testing.T) {
+		var running, cancelled int32
+		blocked := keyslotAttempt{
+			try: func(cancel <-chan struct{}) ([]byte, error) {
+				atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				select {
+				case <-cancel:
+					atomic.AddInt32(&cancelled, 1)
+				case <-time.After(time.Minute):
+				}
+				return nil, nil
+			},
+		}
+		matched := keyslotAttempt{
+			try: func(<-chan struct{}) ([]byte, error) {
+				time.Sleep(10 * time.Millisecond)
+				return []byte("zero"), nil
+			},
+		}
+		start := time.Now()
+		i, key, err := tryKeyslots([]keyslotAttempt{matched, blocked, blocked}, UnlockOptions{Parallelism: 3})
+		require.NoError(t, err)
+		assert.Equal(t, 0, i)
+		assert.Equal(t, []byte("zero"), key)
+		assert.Less(t, time.Since(start), time.Minute/2, "expected the running attempts to be cancelled")
+		assert.Zero(t, atomic.LoadInt32(&running), "attempts were still running after a match")
+		assert.Equal(t, int32(2), atomic.LoadInt32(&cancelled))
+	})
+}
+
+func TestPbkdf2KeyCancelable(t *testing.T) {
+	for _, iterations := range []int{1, 2, pbkdf2CancelInterval - 1, pbkdf2CancelInterval, 3*pbkdf2CancelInterval + 1} {
+		for _, keyLen := range []int{16, 32, 64} {
+			expected := pbkdf2.Key([]byte("password"), []byte("salt"), iterations, keyLen, sha256.New)
+			assert.Equal(t, expected, pbkdf2KeyCancelable([]byte("password"), []byte("salt"), iterations, keyLen, sha256.New, nil), "iterations=%d,keyLen=%d", iterations, keyLen)
+		}
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	assert.Nil(t, pbkdf2KeyCancelable([]byte("password"), []byte("salt"), 1000000, 32, sha256.New, cancel))
+}
+
+func TestUnlockKeyslot(t *testing.T) {
+	for _, version := range []string{"v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			var header []byte
+			var err error
+			switch version {
+			case "v1":
+				header, _, err = FormatV1([]string{"first", "second"}, "")
+			case "v2":
+				header, _, err = FormatV2([]string{"first", "second"}, "", 0)
+			}
+			require.NoError(t, err)
+			encryptedFile := filepath.Join(t.TempDir(), "encrypted")
+			require.NoError(t, os.WriteFile(encryptedFile, header, 0o600))
+			f, err := os.Open(encryptedFile)
+			require.NoError(t, err)
+			defer f.Close()
+			v1header, v2header, _, v2json, err := ReadHeaders(f, ReadHeaderOptions{})
+			require.NoError(t, err)
+			unlock := func(password string, options UnlockOptions) (*Volume, error) {
+				if v1header != nil {
+					return v1header.Unlock(password, f, options)
+				}
+				return v2header.Unlock(password, f, *v2json, options)
+			}
+
+			volume, err := unlock("second", UnlockOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, "1", volume.Keyslot)
+
+			volume, err = unlock("second", UnlockOptions{Keyslot: "1"})
+			require.NoError(t, err)
+			assert.Equal(t, "1", volume.Keyslot)
+
+			_, err = unlock("second", UnlockOptions{Keyslot: "0"})
+			assert.ErrorIs(t, err, ErrIncorrectPassphrase)
+
+			_, err = unlock("second", UnlockOptions{Keyslot: "5"})
+			assert.Error(t, err)
+			assert.NotErrorIs(t, err, ErrIncorrectPassphrase)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package luksy
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 	"syscall"
@@ -45,6 +46,20 @@ const (
 	V2SectorSize    = 4096
 )
 
+// v2HeaderSizes are the header sizes, including the JSON area, which the
+// LUKSv2 specification allows.  The secondary header is always found at an
+// offset equal to the header size.
+var v2HeaderSizes = []uint64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+func validV2HeaderSize(size uint64) bool {
+	for _, s := range v2HeaderSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
 func (h V2Header) Magic() string {
 	return string(h[v2MagicStart : v2MagicStart+v2MagicLength])
 }
@@ -201,3 +216,31 @@ func (h V2Header) Checksum() []uint8 {
 func (h *V2Header) SetChecksum(sum []uint8) {
 	h.setInt8(v2ChecksumStart, sum, v2ChecksumLength)
 }
+
+// computeChecksum computes the header's checksum, which covers the header,
+// with the checksum field zeroed out, followed by the JSON area that follows
+// it.
+func (h V2Header) computeChecksum(jsonArea []byte) ([]byte, error) {
+	hasher, err := hasherByName(h.ChecksumAlgorithm())
+	if err != nil {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q: %w", h.ChecksumAlgorithm(), err)
+	}
+	h.SetChecksum(nil)
+	d := hasher()
+	d.Write(h[:])
+	d.Write(jsonArea)
+	return d.Sum(nil), nil
+}
+
+// verifyChecksum checks the header's checksum against the header and the
+// JSON area that follows it.
+func (h V2Header) verifyChecksum(jsonArea []byte) error {
+	sum, err := h.computeChecksum(jsonArea)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Checksum()) {
+		return ErrHeaderChecksum
+	}
+	return nil
+}
@@ -1,11 +1,17 @@
 package luksy
 
+import (
+	"bytes"
+	"encoding/json"
+)
+
 type V2JSON struct {
 	Config   V2JSONConfig             `json:"config"`
 	Keyslots map[string]V2JSONKeyslot `json:"keyslots"`
 	Digests  map[string]V2JSONDigest  `json:"digests"`
 	Segments map[string]V2JSONSegment `json:"segments"`
 	Tokens   map[string]V2JSONToken   `json:"tokens"`
+	raw      []byte                   // as it was read
 }
 
 type V2JSONKeyslotPriority int
@@ -35,6 +41,7 @@ type V2JSONKeyslot struct {
 	Priority                *V2JSONKeyslotPriority `json:"priority,omitempty"`
 	*V2JSONKeyslotLUKS2                            // type = "luks2"
 	*V2JSONKeyslotReencrypt                        // type = "reencrypt"
+	raw                     []byte                 // as it was read
 }
 
 type V2JSONKeyslotLUKS2 struct {
@@ -55,6 +62,7 @@ type V2JSONArea struct {
 	*V2JSONAreaChecksum                 // type = "checksum"
 	*V2JSONAreaDatashift                // type = "datashift"
 	*V2JSONAreaDatashiftChecksum        // type = "datashift-checksum"
+	raw                          []byte // as it was read
 }
 
 type V2JSONAreaRaw struct {
@@ -79,6 +87,7 @@ type V2JSONAreaDatashiftChecksum struct {
 type V2JSONAF struct {
 	Type           string `json:"type"` // "luks1"
 	*V2JSONAFLUKS1        // type == "luks1"
+	raw            []byte // as it was read
 }
 
 type V2JSONAFLUKS1 struct {
@@ -91,6 +100,7 @@ type V2JSONKdf struct {
 	Salt              []byte `json:"salt"`
 	*V2JSONKdfPbkdf2         // type = "pbkdf2"
 	*V2JSONKdfArgon2i        // type = "argon2i" or type = "argon2id"
+	raw               []byte // as it was read
 }
 
 type V2JSONKdfPbkdf2 struct {
@@ -110,6 +120,7 @@ type V2JSONSegment struct {
 	Size                string              `json:"size"` // numeric value or "dynamic"
 	Flags               []string            `json:"flags,omitempty"`
 	*V2JSONSegmentCrypt `json:",omitempty"` // type = "crypt"
+	raw                 []byte              // as it was read
 }
 
 type V2JSONSegmentCrypt struct {
@@ -123,6 +134,7 @@ type V2JSONSegmentIntegrity struct {
 	Type              string `json:"type"`
 	JournalEncryption string `json:"journal_encryption"`
 	JournalIntegrity  string `json:"journal_integrity"`
+	raw               []byte // as it was read
 }
 
 type V2JSONDigest struct {
@@ -132,6 +144,7 @@ type V2JSONDigest struct {
 	Salt                []byte   `json:"salt"`
 	Digest              []byte   `json:"digest"`
 	*V2JSONDigestPbkdf2          // type == "pbkdf2"
+	raw                 []byte   // as it was read
 }
 
 type V2JSONDigestPbkdf2 struct {
@@ -140,18 +153,273 @@ type V2JSONDigestPbkdf2 struct {
 }
 
 type V2JSONConfig struct {
-	JsonSize     int      `json:"json_size,string"`
-	KeyslotsSize int      `json:"keyslots_size,string,omitempty"`
-	Flags        []string `json:"flags,omitempty"` // one or more of "allow-discards", "same-cpu-crypt", "submit-from-crypt-cpus", "no-journal", "no-read-workqueue", "no-write-workqueue"
-	Requirements []string `json:"requirements,omitempty"`
+	JsonSize     int                 `json:"json_size,string"`
+	KeyslotsSize int                 `json:"keyslots_size,string,omitempty"`
+	Flags        []string            `json:"flags,omitempty"` // one or more of "allow-discards", "same-cpu-crypt", "submit-from-crypt-cpus", "no-journal", "no-read-workqueue", "no-write-workqueue"
+	Requirements *V2JSONRequirements `json:"requirements,omitempty"`
+	raw          []byte              // as it was read
+}
+
+type V2JSONRequirements struct {
+	Mandatory []string `json:"mandatory,omitempty"` // "online-reencrypt", "online-reencrypt-v2", "opal", and others
+	raw       []byte   // as it was read
 }
 
 type V2JSONToken struct {
-	Type                     string   `json:"type"` // "luks2-keyring"
-	Keyslots                 []string `json:"keyslots,omitempty"`
-	*V2JSONTokenLUKS2Keyring          // type == "luks2-keyring"
+	Type                      string   `json:"type"` // "luks2-keyring", or anything else
+	Keyslots                  []string `json:"keyslots,omitempty"`
+	*V2JSONTokenLUKS2Keyring           // type == "luks2-keyring"
+	*V2JSONTokenPlaintextSize          // type == V2JSONTokenTypePlaintextSize
+	raw                       []byte   // as it was read
 }
 
 type V2JSONTokenLUKS2Keyring struct {
 	KeyDescription string `json:"key_description"`
 }
+
+type V2JSONTokenPlaintextSize struct {
+	PlaintextSize string `json:"plaintext_size"` // decimal integer, in bytes
+}
+
+// The types which make up the JSON metadata remember the encoding that they
+// were decoded from, so that the metadata can be read, modified, and written
+// back without losing any fields, or any types of key slots, areas, segments,
+// digests, or tokens, that we don't know about.  If none of the fields that
+// we know about have been changed, a value is encoded exactly as it was read,
+// and if any of them have, the fields that we don't know about are kept
+// alongside them.  Each of the types below has the same fields as its
+// exported counterpart, but none of its methods.
+type (
+	v2JSON                 V2JSON
+	v2JSONKeyslot          V2JSONKeyslot
+	v2JSONArea             V2JSONArea
+	v2JSONAF               V2JSONAF
+	v2JSONKdf              V2JSONKdf
+	v2JSONSegment          V2JSONSegment
+	v2JSONSegmentIntegrity V2JSONSegmentIntegrity
+	v2JSONDigest           V2JSONDigest
+	v2JSONConfig           V2JSONConfig
+	v2JSONRequirements     V2JSONRequirements
+	v2JSONToken            V2JSONToken
+)
+
+// unmarshalJSONPreserving decodes data into v, and returns a copy of data to
+// be saved for use by marshalJSONPreserving.
+func unmarshalJSONPreserving[T any](data []byte, v *T) ([]byte, error) {
+	var decoded T
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	*v = decoded
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil, nil
+	}
+	return bytes.Clone(data), nil
+}
+
+// encodeJSON encodes v the way json.Marshal() does, except that it doesn't
+// escape HTML characters, and if v can encode itself, what it produces is
+// used as it is, instead of being compacted.
+func encodeJSON(v any) ([]byte, error) {
+	if m, ok := v.(json.Marshaler); ok {
+		return m.MarshalJSON()
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// encodeJSONObject encodes an object with the specified fields, in sorted
+// order, using their values exactly as they are.
+func encodeJSONObject(fields map[string]json.RawMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range sortedIDs(fields) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := encodeJSON(field)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(fields[field])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// marshalJSONPreserving encodes v, which was decoded from raw if raw is not
+// nil.  Any fields in raw which decoding and then encoding it didn't
+// reproduce are fields that we don't know about, and are kept exactly as
+// they were.
+func marshalJSONPreserving[T any](v T, raw []byte) ([]byte, error) {
+	known, err := encodeJSON(v)
+	if err != nil || raw == nil {
+		return known, err
+	}
+	var original T
+	if err := json.Unmarshal(raw, &original); err != nil {
+		return nil, err
+	}
+	originalKnown, err := encodeJSON(original)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(known, originalKnown) {
+		return raw, nil
+	}
+	var fields, knownFields, originalKnownFields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(known, &knownFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(originalKnown, &originalKnownFields); err != nil {
+		return nil, err
+	}
+	for field := range originalKnownFields {
+		delete(fields, field)
+	}
+	for field, value := range knownFields {
+		fields[field] = value
+	}
+	return encodeJSONObject(fields)
+}
+
+func (j *V2JSON) UnmarshalJSON(data []byte) (err error) {
+	j.raw, err = unmarshalJSONPreserving(data, (*v2JSON)(j))
+	return err
+}
+
+func (j V2JSON) MarshalJSON() ([]byte, error) {
+	encoded, err := marshalJSONPreserving(v2JSON(j), j.raw)
+	if err != nil || j.Tokens == nil || bytes.Equal(encoded, j.raw) {
+		return encoded, err
+	}
+	// encoding/json compacts whatever a token's MarshalJSON() returns, so
+	// put the tokens in the way they encode themselves, which for tokens
+	// that we don't know about is exactly the way they were read
+	tokens := make(map[string]json.RawMessage, len(j.Tokens))
+	for id, token := range j.Tokens {
+		if tokens[id], err = token.MarshalJSON(); err != nil {
+			return nil, err
+		}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	if fields["tokens"], err = encodeJSONObject(tokens); err != nil {
+		return nil, err
+	}
+	return encodeJSONObject(fields)
+}
+
+func (k *V2JSONKeyslot) UnmarshalJSON(data []byte) (err error) {
+	k.raw, err = unmarshalJSONPreserving(data, (*v2JSONKeyslot)(k))
+	return err
+}
+
+func (k V2JSONKeyslot) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONKeyslot(k), k.raw)
+}
+
+func (a *V2JSONArea) UnmarshalJSON(data []byte) (err error) {
+	a.raw, err = unmarshalJSONPreserving(data, (*v2JSONArea)(a))
+	return err
+}
+
+func (a V2JSONArea) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONArea(a), a.raw)
+}
+
+func (a *V2JSONAF) UnmarshalJSON(data []byte) (err error) {
+	a.raw, err = unmarshalJSONPreserving(data, (*v2JSONAF)(a))
+	return err
+}
+
+func (a V2JSONAF) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONAF(a), a.raw)
+}
+
+func (k *V2JSONKdf) UnmarshalJSON(data []byte) (err error) {
+	k.raw, err = unmarshalJSONPreserving(data, (*v2JSONKdf)(k))
+	return err
+}
+
+func (k V2JSONKdf) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONKdf(k), k.raw)
+}
+
+func (s *V2JSONSegment) UnmarshalJSON(data []byte) (err error) {
+	s.raw, err = unmarshalJSONPreserving(data, (*v2JSONSegment)(s))
+	return err
+}
+
+func (s V2JSONSegment) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONSegment(s), s.raw)
+}
+
+func (i *V2JSONSegmentIntegrity) UnmarshalJSON(data []byte) (err error) {
+	i.raw, err = unmarshalJSONPreserving(data, (*v2JSONSegmentIntegrity)(i))
+	return err
+}
+
+func (i V2JSONSegmentIntegrity) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONSegmentIntegrity(i), i.raw)
+}
+
+func (d *V2JSONDigest) UnmarshalJSON(data []byte) (err error) {
+	d.raw, err = unmarshalJSONPreserving(data, (*v2JSONDigest)(d))
+	return err
+}
+
+func (d V2JSONDigest) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONDigest(d), d.raw)
+}
+
+func (c *V2JSONConfig) UnmarshalJSON(data []byte) (err error) {
+	c.raw, err = unmarshalJSONPreserving(data, (*v2JSONConfig)(c))
+	return err
+}
+
+func (c V2JSONConfig) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONConfig(c), c.raw)
+}
+
+func (r *V2JSONRequirements) UnmarshalJSON(data []byte) (err error) {
+	r.raw, err = unmarshalJSONPreserving(data, (*v2JSONRequirements)(r))
+	return err
+}
+
+func (r V2JSONRequirements) MarshalJSON() ([]byte, error) {
+	return marshalJSONPreserving(v2JSONRequirements(r), r.raw)
+}
+
+func (t *V2JSONToken) UnmarshalJSON(data []byte) (err error) {
+	t.raw, err = unmarshalJSONPreserving(data, (*v2JSONToken)(t))
+	return err
+}
+
+// v2JSONTokenEmptyKeyslots is a v2JSONToken whose list of key slots is
+// encoded even if it's empty.
+type v2JSONTokenEmptyKeyslots struct {
+	v2JSONToken
+	Keyslots []string `json:"keyslots"`
+}
+
+func (t V2JSONToken) MarshalJSON() ([]byte, error) {
+	if t.Keyslots != nil && len(t.Keyslots) == 0 {
+		// cryptsetup insists that every token has a list of key
+		// slots, even if it's empty, which omitempty would leave out
+		return marshalJSONPreserving(v2JSONTokenEmptyKeyslots{v2JSONToken: v2JSONToken(t), Keyslots: t.Keyslots}, t.raw)
+	}
+	return marshalJSONPreserving(v2JSONToken(t), t.raw)
+}
@@ -0,0 +1,554 @@
+package luksy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Severity indicates how serious a problem that Validate() found is.
+type Severity int
+
+const (
+	// SeverityWarning marks something which is unusual, but which
+	// shouldn't keep the volume from being used.
+	SeverityWarning = Severity(iota)
+	// SeverityError marks something which is wrong, and which will keep
+	// the volume from being used, or which will cause it to be used
+	// incorrectly.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ValidationFinding describes a problem that Validate() found.
+type ValidationFinding struct {
+	Severity Severity
+	Message  string
+}
+
+func (f ValidationFinding) String() string {
+	return f.Severity.String() + ": " + f.Message
+}
+
+// Limits beyond which we consider key derivation parameters to be absurd,
+// either because they're so weak as to be useless, or because they would
+// take an unreasonable amount of time or memory to use.
+const (
+	validateMinPBKDF2Iterations = 1000
+	validateMaxPBKDF2Iterations = 1 << 30
+	validateMinArgon2Memory     = 32
+	validateMaxArgon2Memory     = 4 * 1024 * 1024
+	validateMaxArgon2Time       = 1 << 16
+	validateMaxArgon2CPUs       = 1 << 8
+)
+
+type validator struct {
+	findings []ValidationFinding
+}
+
+func (v *validator) errorf(format string, args ...any) {
+	v.findings = append(v.findings, ValidationFinding{Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(format string, args ...any) {
+	v.findings = append(v.findings, ValidationFinding{Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// HasErrors returns true if any of the findings is an error.
+func HasErrors(findings []ValidationFinding) bool {
+	for _, f := range findings {
+		if f.Severity >= SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reads the LUKS headers from f and checks them for problems, more
+// thoroughly than ReadHeaders() does.  It returns a list of the problems it
+// found, which will be empty if everything looks fine.  An error is returned
+// only if f can't be read, or doesn't contain a LUKS header at all.
+func Validate(f io.ReaderAt) ([]ValidationFinding, error) {
+	var v validator
+	var v2a V2Header
+	n, err := f.ReadAt(v2a[:], 0)
+	if err != nil && (err != io.EOF || n < len(V1Header{})) {
+		return nil, fmt.Errorf("reading LUKS header: %w", err)
+	}
+	if v2a.Magic() != V1Magic {
+		// the primary header may have been overwritten, in which case
+		// there may still be a secondary header
+		h1, h2, _, j, err := recoverV2Headers(f)
+		switch {
+		case errors.Is(err, errNoSecondaryHeader):
+			return nil, fmt.Errorf("error reading LUKS header - magic identifier not found")
+		case err != nil:
+			v.errorf("primary header is missing, and %v", err)
+		default:
+			v.errorf("primary header is missing, but an intact secondary header was found at offset %d", h2.HeaderOffset())
+			v.validateV2JSON(*h1, *j)
+		}
+		return v.findings, nil
+	}
+	switch v2a.Version() {
+	case 1:
+		var v1 V1Header
+		copy(v1[:], v2a[:])
+		v.validateV1(v1)
+	case 2:
+		if n != len(v2a) {
+			v.errorf("primary header truncated: only %d bytes present", n)
+			break
+		}
+		v.validateV2(f, v2a)
+	default:
+		v.errorf("unrecognized LUKS version %d", v2a.Version())
+	}
+	return v.findings, nil
+}
+
+func (v *validator) validateV1(h V1Header) {
+	if h.UUID() == "" {
+		v.warnf("header has no UUID")
+	}
+	if _, err := hasherByName(h.HashSpec()); err != nil {
+		v.errorf("hash %q: %v", h.HashSpec(), err)
+	}
+	keyBytes := int(h.KeyBytes())
+	switch keyBytes {
+	case 0:
+		v.errorf("main key length is 0")
+	default:
+		if _, err := newSectorCipher(h.CipherName(), h.CipherMode(), make([]byte, keyBytes), V1SectorSize, true); err != nil {
+			v.errorf("cipher %s-%s with a %d-byte key: %v", h.CipherName(), h.CipherMode(), keyBytes, err)
+		}
+	}
+	v.checkIterations("main key digest", int64(h.MKDigestIter()))
+
+	type extent struct {
+		slot       int
+		start, end int64
+	}
+	var extents []extent
+	activeSlots := 0
+	for k := 0; k < v1NumKeys; k++ {
+		ks, err := h.KeySlot(k)
+		if err != nil {
+			v.errorf("key slot %d: %v", k, err)
+			continue
+		}
+		active, err := ks.Active()
+		if err != nil {
+			v.errorf("key slot %d: %v", k, err)
+			continue
+		}
+		if ks.Stripes() == 0 {
+			if active {
+				v.errorf("key slot %d: stripes is 0", k)
+			}
+			continue
+		}
+		if ks.Stripes() != V1Stripes {
+			v.warnf("key slot %d: unusual number of stripes %d", k, ks.Stripes())
+		}
+		start := int64(ks.KeyMaterialOffset()) * V1SectorSize
+		end := start + int64(roundUpToMultiple(keyBytes*int(ks.Stripes()), V1SectorSize))
+		if start < v1HeaderStructSize {
+			v.errorf("key slot %d: key material at offset %d overlaps the header", k, start)
+		}
+		if h.PayloadOffset() != 0 && end > int64(h.PayloadOffset())*V1SectorSize {
+			v.errorf("key slot %d: key material at offset %d-%d overlaps the payload at offset %d", k, start, end, int64(h.PayloadOffset())*V1SectorSize)
+		}
+		extents = append(extents, extent{slot: k, start: start, end: end})
+		if !active {
+			continue
+		}
+		activeSlots++
+		v.checkIterations(fmt.Sprintf("key slot %d", k), int64(ks.Iterations()))
+	}
+	for i := range extents {
+		for j := i + 1; j < len(extents); j++ {
+			if extents[i].start < extents[j].end && extents[j].start < extents[i].end {
+				v.errorf("key slots %d and %d have overlapping key material", extents[i].slot, extents[j].slot)
+			}
+		}
+	}
+	if activeSlots == 0 {
+		v.errorf("no active key slots")
+	}
+}
+
+// checkIterations flags PBKDF2 iteration counts that are zero or absurd.
+func (v *validator) checkIterations(what string, iterations int64) {
+	switch {
+	case iterations <= 0:
+		v.errorf("%s: PBKDF2 iteration count is %d", what, iterations)
+	case iterations < validateMinPBKDF2Iterations:
+		v.warnf("%s: PBKDF2 iteration count %d is very low", what, iterations)
+	case iterations > validateMaxPBKDF2Iterations:
+		v.warnf("%s: PBKDF2 iteration count %d is very high", what, iterations)
+	}
+}
+
+// readV2Header reads and checks one of the two LUKSv2 binary headers, along
+// with its JSON area, returning the JSON area if the header is usable.
+func (v *validator) readV2Header(f io.ReaderAt, which string, h V2Header, offset uint64, magic string) []byte {
+	ok := true
+	if h.Magic() != magic {
+		v.errorf("%s header: bad magic %q", which, h.Magic())
+		return nil
+	}
+	if h.Version() != 2 {
+		v.errorf("%s header: version is %d", which, h.Version())
+		ok = false
+	}
+	if h.HeaderOffset() != offset {
+		v.errorf("%s header: header offset is %d, but it was found at %d", which, h.HeaderOffset(), offset)
+		ok = false
+	}
+	if !validV2HeaderSize(h.HeaderSize()) {
+		v.errorf("%s header: invalid header size %d", which, h.HeaderSize())
+		return nil
+	}
+	jsonArea := make([]byte, h.HeaderSize()-V2SectorSize)
+	n, err := f.ReadAt(jsonArea, int64(offset)+V2SectorSize)
+	if n != len(jsonArea) {
+		v.errorf("%s header: reading JSON area: short read (%d < %d): %v", which, n, len(jsonArea), err)
+		return nil
+	}
+	if err := h.verifyChecksum(jsonArea); err != nil {
+		v.errorf("%s header: %v", which, err)
+		ok = false
+	}
+	if !ok {
+		return nil
+	}
+	return jsonArea
+}
+
+func (v *validator) validateV2(f io.ReaderAt, h1 V2Header) {
+	json1 := v.readV2Header(f, "primary", h1, 0, V2Magic1)
+	var json2 []byte
+	var h2 V2Header
+	if validV2HeaderSize(h1.HeaderSize()) {
+		n, err := f.ReadAt(h2[:], int64(h1.HeaderSize()))
+		if n != len(h2) {
+			v.errorf("secondary header: short read (%d < %d): %v", n, len(h2), err)
+		} else {
+			json2 = v.readV2Header(f, "secondary", h2, h1.HeaderSize(), V2Magic2)
+		}
+	}
+	if json1 != nil && json2 != nil {
+		if h1.UUID() != h2.UUID() {
+			v.errorf("primary and secondary headers have different UUIDs (%q and %q)", h1.UUID(), h2.UUID())
+		}
+		if h1.SequenceID() != h2.SequenceID() {
+			v.warnf("primary and secondary headers have different sequence IDs (%d and %d)", h1.SequenceID(), h2.SequenceID())
+		} else if !bytes.Equal(json1, json2) {
+			v.errorf("primary and secondary headers have the same sequence ID, but different JSON data")
+		}
+	}
+	h, jsonArea := h1, json1
+	if jsonArea == nil || (json2 != nil && h2.SequenceID() > h1.SequenceID()) {
+		h, jsonArea = h2, json2
+	}
+	if jsonArea == nil {
+		v.errorf("no usable header")
+		return
+	}
+	if h.UUID() == "" {
+		v.warnf("header has no UUID")
+	}
+	var j V2JSON
+	if err := json.Unmarshal(bytes.TrimRightFunc(jsonArea, func(r rune) bool { return r == 0 }), &j); err != nil {
+		v.errorf("decoding JSON data: %v", err)
+		return
+	}
+	v.validateV2JSON(h, j)
+}
+
+// parseID checks that a keyslot, segment, digest, or token ID is a
+// non-negative integer, as the specification requires.
+func (v *validator) parseID(what, id string) {
+	if n, err := strconv.Atoi(id); err != nil || n < 0 || strconv.Itoa(n) != id {
+		v.errorf("%s ID %q is not a non-negative integer", what, id)
+	}
+}
+
+func (v *validator) validateV2JSON(h V2Header, j V2JSON) {
+	headerSize := int64(h.HeaderSize())
+	if int64(j.Config.JsonSize) != headerSize-V2SectorSize {
+		v.errorf("config: JSON size %d doesn't match header size %d", j.Config.JsonSize, headerSize)
+	}
+	keyslotsStart := 2 * headerSize
+	keyslotsEnd := keyslotsStart + int64(j.Config.KeyslotsSize)
+	if j.Config.KeyslotsSize <= 0 {
+		v.errorf("config: keyslots size is %d", j.Config.KeyslotsSize)
+	} else if j.Config.KeyslotsSize%V2SectorSize != 0 {
+		v.errorf("config: keyslots size %d is not a multiple of %d", j.Config.KeyslotsSize, V2SectorSize)
+	}
+
+	type extent struct {
+		id         string
+		start, end int64
+	}
+	var areas []extent
+	for _, k := range sortedIDs(j.Keyslots) {
+		keyslot := j.Keyslots[k]
+		what := fmt.Sprintf("key slot %s", k)
+		v.parseID("key slot", k)
+		if keyslot.KeySize <= 0 {
+			v.errorf("%s: key size is %d", what, keyslot.KeySize)
+		}
+		area := keyslot.Area
+		if area.Offset < keyslotsStart || area.Offset+area.Size > keyslotsEnd || area.Size < 0 {
+			v.errorf("%s: area at offset %d, size %d is outside of the keyslots area at offset %d, size %d", what, area.Offset, area.Size, keyslotsStart, j.Config.KeyslotsSize)
+		}
+		if area.Offset%V2SectorSize != 0 {
+			v.warnf("%s: area offset %d is not aligned to %d bytes", what, area.Offset, V2SectorSize)
+		}
+		areas = append(areas, extent{id: k, start: area.Offset, end: area.Offset + area.Size})
+		switch keyslot.Type {
+		case "luks2":
+			if keyslot.V2JSONKeyslotLUKS2 == nil {
+				v.errorf("%s: no luks2 parameters", what)
+				continue
+			}
+			v.validateV2Keyslot(what, keyslot)
+		case "reencrypt":
+			if keyslot.V2JSONKeyslotReencrypt == nil {
+				v.errorf("%s: no reencrypt parameters", what)
+			}
+		default:
+			v.warnf("%s: unrecognized type %q", what, keyslot.Type)
+		}
+	}
+	for i := range areas {
+		for k := i + 1; k < len(areas); k++ {
+			if areas[i].start < areas[k].end && areas[k].start < areas[i].end {
+				v.errorf("key slots %s and %s have overlapping areas", areas[i].id, areas[k].id)
+			}
+		}
+	}
+
+	if len(j.Segments) == 0 {
+		v.errorf("no segments")
+	}
+	var segments []extent
+	for _, s := range sortedIDs(j.Segments) {
+		segment := j.Segments[s]
+		what := fmt.Sprintf("segment %s", s)
+		v.parseID("segment", s)
+		offset, err := strconv.ParseInt(segment.Offset, 10, 64)
+		if err != nil || offset < 0 {
+			v.errorf("%s: invalid offset %q", what, segment.Offset)
+			continue
+		}
+		if offset < keyslotsEnd {
+			v.errorf("%s: offset %d is inside of the metadata, which ends at %d", what, offset, keyslotsEnd)
+		}
+		end := int64(-1)
+		if segment.Size != "dynamic" {
+			size, err := strconv.ParseInt(segment.Size, 10, 64)
+			if err != nil || size < 0 {
+				v.errorf("%s: invalid size %q", what, segment.Size)
+				continue
+			}
+			end = offset + size
+		}
+		if !backupSegment(segment) {
+			// backup segments describe data that other segments
+			// also describe
+			segments = append(segments, extent{id: s, start: offset, end: end})
+		}
+		switch segment.Type {
+		case "crypt":
+			if segment.V2JSONSegmentCrypt == nil {
+				v.errorf("%s: no crypt parameters", what)
+				continue
+			}
+			switch segment.SectorSize {
+			case 512, 1024, 2048, 4096:
+				if offset%int64(segment.SectorSize) != 0 {
+					v.errorf("%s: offset %d is not a multiple of the sector size %d", what, offset, segment.SectorSize)
+				}
+				if end >= 0 && (end-offset)%int64(segment.SectorSize) != 0 {
+					v.errorf("%s: size %d is not a multiple of the sector size %d", what, end-offset, segment.SectorSize)
+				}
+			default:
+				v.errorf("%s: invalid sector size %d", what, segment.SectorSize)
+			}
+			if segment.IVTweak < 0 {
+				v.errorf("%s: negative IV tweak %d", what, segment.IVTweak)
+			} else if segment.SectorSize > 0 && (int64(segment.IVTweak)*V1SectorSize)%int64(segment.SectorSize) != 0 {
+				v.errorf("%s: IV tweak %d (in 512-byte units) is not a multiple of the sector size %d", what, segment.IVTweak, segment.SectorSize)
+			}
+		case "linear":
+		default:
+			v.warnf("%s: unrecognized type %q", what, segment.Type)
+		}
+	}
+	for i := range segments {
+		for k := i + 1; k < len(segments); k++ {
+			a, b := segments[i], segments[k]
+			if (a.end < 0 || b.start < a.end) && (b.end < 0 || a.start < b.end) {
+				v.errorf("segments %s and %s overlap", a.id, b.id)
+			}
+		}
+	}
+
+	keyslotDigested := make(map[string]bool)
+	segmentDigested := make(map[string]bool)
+	for _, d := range sortedIDs(j.Digests) {
+		digest := j.Digests[d]
+		what := fmt.Sprintf("digest %s", d)
+		v.parseID("digest", d)
+		for _, k := range digest.Keyslots {
+			if _, ok := j.Keyslots[k]; !ok {
+				v.errorf("%s: references key slot %s, which doesn't exist", what, k)
+			}
+			keyslotDigested[k] = true
+		}
+		for _, s := range digest.Segments {
+			if _, ok := j.Segments[s]; !ok {
+				v.errorf("%s: references segment %s, which doesn't exist", what, s)
+			}
+			segmentDigested[s] = true
+		}
+		if len(digest.Digest) == 0 {
+			v.errorf("%s: digest is empty", what)
+		}
+		if len(digest.Salt) == 0 {
+			v.warnf("%s: salt is empty", what)
+		}
+		switch digest.Type {
+		case "pbkdf2":
+			if digest.V2JSONDigestPbkdf2 == nil {
+				v.errorf("%s: no pbkdf2 parameters", what)
+				continue
+			}
+			if _, err := hasherByName(digest.Hash); err != nil {
+				v.errorf("%s: hash %q: %v", what, digest.Hash, err)
+			}
+			v.checkIterations(what, int64(digest.Iterations))
+		default:
+			v.warnf("%s: unrecognized type %q", what, digest.Type)
+		}
+	}
+	for _, k := range sortedIDs(j.Keyslots) {
+		if !keyslotDigested[k] && j.Keyslots[k].Type == "luks2" {
+			v.warnf("key slot %s is not referenced by any digest", k)
+		}
+	}
+	for _, s := range sortedIDs(j.Segments) {
+		if !segmentDigested[s] && j.Segments[s].Type == "crypt" {
+			v.warnf("segment %s is not referenced by any digest", s)
+		}
+	}
+
+	for _, t := range sortedIDs(j.Tokens) {
+		v.parseID("token", t)
+		for _, k := range j.Tokens[t].Keyslots {
+			if _, ok := j.Keyslots[k]; !ok {
+				v.errorf("token %s: references key slot %s, which doesn't exist", t, k)
+			}
+		}
+	}
+
+	if requirements := j.MandatoryRequirements(); len(requirements) > 0 {
+		v.warnf("config: volume has requirements %v", requirements)
+	}
+}
+
+func (v *validator) validateV2Keyslot(what string, keyslot V2JSONKeyslot) {
+	area := keyslot.Area
+	switch area.Type {
+	case "raw":
+		if area.V2JSONAreaRaw == nil {
+			v.errorf("%s: no raw area parameters", what)
+			break
+		}
+		if area.KeySize <= 0 {
+			v.errorf("%s: area key size is %d", what, area.KeySize)
+		} else if _, err := NewSectorCipher(area.Encryption, make([]byte, area.KeySize), V1SectorSize); err != nil {
+			v.errorf("%s: area encryption %q with a %d-byte key: %v", what, area.Encryption, area.KeySize, err)
+		}
+	default:
+		v.errorf("%s: area type %q is not raw", what, area.Type)
+	}
+
+	switch keyslot.AF.Type {
+	case "luks1":
+		if keyslot.AF.V2JSONAFLUKS1 == nil {
+			v.errorf("%s: no AF parameters", what)
+			break
+		}
+		if keyslot.AF.Stripes <= 0 {
+			v.errorf("%s: AF stripes is %d", what, keyslot.AF.Stripes)
+		} else if int64(keyslot.KeySize)*int64(keyslot.AF.Stripes) > area.Size {
+			v.errorf("%s: area size %d is too small for %d stripes of a %d-byte key", what, area.Size, keyslot.AF.Stripes, keyslot.KeySize)
+		} else if keyslot.AF.Stripes != V2Stripes {
+			v.warnf("%s: unusual number of stripes %d", what, keyslot.AF.Stripes)
+		}
+		if _, err := hasherByName(keyslot.AF.Hash); err != nil {
+			v.errorf("%s: AF hash %q: %v", what, keyslot.AF.Hash, err)
+		}
+	default:
+		v.errorf("%s: unrecognized AF type %q", what, keyslot.AF.Type)
+	}
+
+	kdf := keyslot.Kdf
+	if len(kdf.Salt) == 0 {
+		v.warnf("%s: KDF salt is empty", what)
+	}
+	switch kdf.Type {
+	case "pbkdf2":
+		if kdf.V2JSONKdfPbkdf2 == nil {
+			v.errorf("%s: no pbkdf2 parameters", what)
+			break
+		}
+		if _, err := hasherByName(kdf.Hash); err != nil {
+			v.errorf("%s: KDF hash %q: %v", what, kdf.Hash, err)
+		}
+		v.checkIterations(what, int64(kdf.Iterations))
+	case "argon2i", "argon2id":
+		if kdf.V2JSONKdfArgon2i == nil {
+			v.errorf("%s: no %s parameters", what, kdf.Type)
+			break
+		}
+		switch {
+		case kdf.Time <= 0:
+			v.errorf("%s: %s time cost is %d", what, kdf.Type, kdf.Time)
+		case kdf.Time > validateMaxArgon2Time:
+			v.warnf("%s: %s time cost %d is very high", what, kdf.Type, kdf.Time)
+		}
+		switch {
+		case kdf.Memory <= 0:
+			v.errorf("%s: %s memory cost is %d", what, kdf.Type, kdf.Memory)
+		case kdf.Memory < validateMinArgon2Memory:
+			v.warnf("%s: %s memory cost %d KiB is very low", what, kdf.Type, kdf.Memory)
+		case kdf.Memory > validateMaxArgon2Memory:
+			v.warnf("%s: %s memory cost %d KiB is very high", what, kdf.Type, kdf.Memory)
+		}
+		switch {
+		case kdf.CPUs <= 0:
+			v.errorf("%s: %s parallel cost is %d", what, kdf.Type, kdf.CPUs)
+		case kdf.CPUs > validateMaxArgon2CPUs:
+			v.warnf("%s: %s parallel cost %d is very high", what, kdf.Type, kdf.CPUs)
+		}
+	default:
+		v.errorf("%s: unrecognized KDF type %q", what, kdf.Type)
+	}
+}
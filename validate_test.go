@@ -0,0 +1,104 @@
+package luksy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func findingsMatching(findings []ValidationFinding, severity Severity, substring string) []ValidationFinding {
+	var matches []ValidationFinding
+	for _, f := range findings {
+		if f.Severity == severity && strings.Contains(f.Message, substring) {
+			matches = append(matches, f)
+		}
+	}
+	return matches
+}
+
+func TestValidateV1(t *testing.T) {
+	header, _, err := FormatV1([]string{"first", "second"}, "")
+	require.NoError(t, err)
+	findings, err := Validate(bytes.NewReader(header))
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+
+	corrupted := bytes.Clone(header)
+	var h V1Header
+	copy(h[:], corrupted)
+	ks0, err := h.KeySlot(0)
+	require.NoError(t, err)
+	ks1, err := h.KeySlot(1)
+	require.NoError(t, err)
+	ks1.SetKeyMaterialOffset(ks0.KeyMaterialOffset() + 1)
+	ks1.SetIterations(0)
+	require.NoError(t, h.SetKeySlot(1, ks1))
+	copy(corrupted, h[:])
+	findings, err = Validate(bytes.NewReader(corrupted))
+	require.NoError(t, err)
+	assert.True(t, HasErrors(findings))
+	assert.NotEmpty(t, findingsMatching(findings, SeverityError, "key slots 0 and 1 have overlapping key material"), "%v", findings)
+	assert.NotEmpty(t, findingsMatching(findings, SeverityError, "key slot 1: PBKDF2 iteration count is 0"), "%v", findings)
+
+	_, err = Validate(bytes.NewReader(make([]byte, 4096)))
+	assert.Error(t, err)
+}
+
+func TestValidateV2(t *testing.T) {
+	header, _, err := FormatV2([]string{"first", "second"}, "", 0)
+	require.NoError(t, err)
+	findings, err := Validate(bytes.NewReader(header))
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+
+	corrupted := bytes.Clone(header)
+	corrupted[V2SectorSize+1] ^= 0xff
+	findings, err = Validate(bytes.NewReader(corrupted))
+	require.NoError(t, err)
+	assert.NotEmpty(t, findingsMatching(findings, SeverityError, "primary header: "+ErrHeaderChecksum.Error()), "%v", findings)
+	assert.Empty(t, findingsMatching(findings, SeverityError, "secondary header"), "%v", findings)
+
+	// an overwritten primary header is reported, and the secondary header
+	// is checked instead
+	copy(corrupted, make([]byte, V2SectorSize))
+	findings, err = Validate(bytes.NewReader(corrupted))
+	require.NoError(t, err)
+	assert.NotEmpty(t, findingsMatching(findings, SeverityError, "primary header is missing, but an intact secondary header was found"), "%v", findings)
+	_, err = Validate(bytes.NewReader(make([]byte, len(header))))
+	assert.Error(t, err)
+
+	_, v2header, _, v2json, err := ReadHeaders(bytes.NewReader(header), ReadHeaderOptions{})
+	require.NoError(t, err)
+	var v validator
+	v.validateV2JSON(*v2header, *v2json)
+	assert.Empty(t, v.findings)
+
+	var j V2JSON
+	encoded, err := json.Marshal(v2json)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(encoded, &j))
+	ks0, ks1 := j.Keyslots["0"], j.Keyslots["1"]
+	ks1.Area.Offset = ks0.Area.Offset
+	ks1.Kdf.Salt = nil
+	j.Keyslots["1"] = ks1
+	digest := j.Digests["0"]
+	digest.Keyslots = append(digest.Keyslots, "7")
+	digest.Segments = append(digest.Segments, "3")
+	j.Digests["0"] = digest
+	segment := j.Segments["0"]
+	segment.Offset = "4096"
+	segment.SectorSize = 1000
+	j.Segments["0"] = segment
+	v = validator{}
+	v.validateV2JSON(*v2header, j)
+	assert.NotEmpty(t, findingsMatching(v.findings, SeverityError, "key slots 0 and 1 have overlapping areas"), "%v", v.findings)
+	assert.NotEmpty(t, findingsMatching(v.findings, SeverityWarning, "key slot 1: KDF salt is empty"), "%v", v.findings)
+	assert.NotEmpty(t, findingsMatching(v.findings, SeverityError, "references key slot 7"), "%v", v.findings)
+	assert.NotEmpty(t, findingsMatching(v.findings, SeverityError, "references segment 3"), "%v", v.findings)
+	assert.NotEmpty(t, findingsMatching(v.findings, SeverityError, "segment 0: offset 4096 is inside of the metadata"), "%v", v.findings)
+	assert.NotEmpty(t, findingsMatching(v.findings, SeverityError, "segment 0: invalid sector size 1000"), "%v", v.findings)
+}